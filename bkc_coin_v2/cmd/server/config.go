@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"bkc_coin_v2/internal/config"
+)
+
+const configUsage = `usage: server config check [file]
+
+  check [file]  validate the config file (default $CONFIG_FILE) with the
+                environment on top and print the economy settings
+
+Exits 1 if the config is invalid.`
+
+// runConfig implements "server config ..." and returns the exit code.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "check" || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, configUsage)
+		return 2
+	}
+	path := strings.TrimSpace(os.Getenv("CONFIG_FILE"))
+	if len(args) == 2 {
+		path = args[1]
+	}
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config check: %v\n", err)
+		return 1
+	}
+	out, _ := json.MarshalIndent(cfg.Economy, "", "  ")
+	if path == "" {
+		path = "environment only"
+	}
+	fmt.Printf("config ok (%s)\n%s\n", path, out)
+	return 0
+}
@@ -5,7 +5,9 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,13 +16,26 @@ import (
 	"syscall"
 	"time"
 
+	"bkc_coin_v2/internal/admin"
 	"bkc_coin_v2/internal/api"
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/cache"
+	"bkc_coin_v2/internal/chain"
 	"bkc_coin_v2/internal/config"
 	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/events"
 	"bkc_coin_v2/internal/fasttap"
+	"bkc_coin_v2/internal/lifecycle"
+	"bkc_coin_v2/internal/logx"
 	"bkc_coin_v2/internal/memtap"
+	"bkc_coin_v2/internal/metrics"
 	"bkc_coin_v2/internal/security"
+	"bkc_coin_v2/internal/session"
+	"bkc_coin_v2/internal/standing"
+	"bkc_coin_v2/internal/supply"
+	"bkc_coin_v2/internal/tapcore"
 	"bkc_coin_v2/internal/tgbot"
+	"bkc_coin_v2/internal/tokenomics"
 
 	"github.com/go-chi/chi/v5"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -28,22 +43,37 @@ import (
 )
 
 func main() {
-	cfg := config.Load()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfig(os.Args[2:]))
+	}
+
+	cfg, err := config.Load()
+	logx.Setup(logx.ConfigFromEnv()) // after Load: the file may set LOG_*
+	if err != nil {
+		fatal("config", err)
+	}
+	reloader, err := config.NewReloader(strings.TrimSpace(os.Getenv("CONFIG_FILE")))
+	if err != nil {
+		fatal("config", err)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	database, err := db.Connect(ctx, cfg.DatabaseURL)
 	if err != nil {
-		log.Fatalf("db connect: %v", err)
+		fatal("db connect", err)
 	}
 	defer database.Close()
 
 	if err := database.Migrate(ctx); err != nil {
-		log.Fatalf("db migrate: %v", err)
+		fatal("db migrate", err)
 	}
 	if err := database.EnsureDepositWalletsIfEmpty(ctx, cfg.DepositWallets); err != nil {
-		log.Fatalf("ensure deposit wallets: %v", err)
+		fatal("ensure deposit wallets", err)
 	}
 
 	// Init system state if missing.
@@ -52,7 +82,7 @@ func main() {
 		if err == pgx.ErrNoRows {
 			initSystem(ctx, cfg, database)
 		} else {
-			log.Fatalf("get system: %v", err)
+			fatal("get system", err)
 		}
 	}
 
@@ -61,32 +91,61 @@ func main() {
 	if cfg.RunBot {
 		bot, err = tgbot.New(cfg, database)
 		if err != nil {
-			log.Fatalf("bot init: %v", err)
+			fatal("bot init", err)
 		}
 	}
 
 	// Optional: fast tap pipeline (Redis + stream worker -> Postgres).
 	var ft *fasttap.Engine
+	var redisMgr *cache.RedisManager
 	if strings.TrimSpace(cfg.RedisURL) != "" {
 		rdb, err := fasttap.Connect(ctx, cfg.RedisURL)
 		if err != nil {
-			log.Fatalf("redis connect: %v", err)
+			fatal("redis connect", err)
 		}
 		defer func() {
 			if rdb != nil {
 				_ = rdb.Close()
 			}
 		}()
+		redisMgr = cache.NewRedisManagerFromClient(rdb, "bkc:")
 		ft = fasttap.New(cfg, database, rdb)
-		if ft != nil && ft.Enabled() && cfg.RunFasttap {
-			if err := ft.EnsureSystemCached(ctx); err != nil {
-				log.Fatalf("fasttap system warmup: %v", err)
+	}
+
+	// Components are started in dependency order and stopped in reverse:
+	// HTTP first (in-flight requests drain), then the jobs, and the tap
+	// backend last so its final flush sees every tap.
+	life := lifecycle.New(lifecycle.ConfigFromEnv())
+	var tapDeps []string // the tap backend's component, if it has one
+	if ft != nil && ft.Enabled() {
+		// Every replica pushes reloaded limits; the tap script reads them
+		// from the shared hash, so nodes that were not reloaded follow too.
+		reloader.OnChange(func(ctx context.Context, e config.Economy) {
+			if err := ft.SetTapParams(ctx, e); err != nil {
+				slog.ErrorContext(ctx, "push tap params failed", "err", err)
 			}
-			ft.StartWorker(ctx)
-			log.Printf("fasttap enabled (stream=%s group=%s)", ft.StreamKey, ft.StreamGroup)
-		} else if ft != nil && ft.Enabled() {
-			log.Printf("fasttap enabled (worker disabled by RUN_FASTTAP_WORKER=0)")
+		})
+	}
+	if ft != nil && ft.Enabled() && cfg.RunFasttap {
+		if err := ft.EnsureSystemCached(ctx); err != nil {
+			fatal("fasttap system warmup", err)
 		}
+		if err := ft.SetTapParams(ctx, *config.Econ()); err != nil {
+			fatal("fasttap tap params", err)
+		}
+		life.Add(lifecycle.Component{
+			Name: "fasttap",
+			Start: func(ctx context.Context) error {
+				ft.StartWorker(ctx)
+				ft.StartReconciler(ctx)
+				slog.Info("fasttap enabled", "stream", ft.StreamKey, "group", ft.StreamGroup)
+				return nil
+			},
+			Stop: ft.Stop,
+		})
+		tapDeps = []string{"fasttap"}
+	} else if ft != nil && ft.Enabled() {
+		slog.Info("fasttap enabled, worker disabled by RUN_FASTTAP_WORKER=0")
 	}
 
 	// Optional: mem tap pipeline (in-memory tap cache + periodic Postgres flush).
@@ -95,10 +154,51 @@ func main() {
 	if ft == nil || !ft.Enabled() {
 		mt = memtap.New(cfg, database)
 		if mt != nil && mt.Enabled() {
-			mt.Start(ctx)
-			log.Printf("memtap enabled (flush in-memory to postgres)")
+			if err := mt.ReplayWAL(ctx); err != nil {
+				fatal("memtap wal replay", err)
+			}
+			life.Add(lifecycle.Component{
+				Name: "memtap",
+				Start: func(ctx context.Context) error {
+					mt.Start(ctx)
+					slog.Info("memtap enabled, flushing in-memory taps to postgres")
+					return nil
+				},
+				Stop: mt.Stop,
+			})
+			tapDeps = []string{"memtap"}
 		}
 	}
+
+	// Tap backend: fasttap > memtap > direct Postgres.
+	var taps tapcore.TapBackend
+	switch {
+	case ft != nil && ft.Enabled():
+		taps = ft
+	case mt != nil && mt.Enabled():
+		taps = mt
+	default:
+		taps = tapcore.NewPostgres(cfg, database)
+	}
+	slog.Info("tap backend selected", "backend", taps.Name())
+	life.Add(lifecycle.Background("halving", func(ctx context.Context) { runHalvingCheck(ctx, database, taps) }, tapDeps...))
+	ledgerChain := chain.New(database, chain.ConfigFromEnv())
+	life.Add(lifecycle.Background("chain", ledgerChain.Run))
+	auditor := supply.New(database, supply.ConfigFromEnv())
+	life.Add(lifecycle.Background("supply", auditor.Run))
+	tokens := tokenomics.NewTokenomicsManager(database)
+	standingCfg := standing.ConfigFromEnv()
+	standingCfg.Fees = cfg.TransferFees
+	var notifier standing.Notifier
+	if bot != nil {
+		notifier = bot
+	}
+	eventHub := events.New(redisMgr, database, events.ConfigFromEnv())
+	life.Add(lifecycle.Background("events", eventHub.Run))
+	life.Add(lifecycle.Background("standing", standing.New(database, tokens, notifier, eventHub, auditor, standingCfg).Run, "events"))
+	sessions := session.New(database, cfg.BotToken, session.ConfigFromEnv())
+	life.Add(lifecycle.Background("sessions", sessions.Run))
+	httpAfter := append([]string{"events", "sessions", "standing"}, tapDeps...)
 	useWebhook := cfg.RunBot && shouldUseTelegramWebhook(cfg.PublicBaseURL)
 	webhookSecret := strings.TrimSpace(os.Getenv("TELEGRAM_WEBHOOK_SECRET"))
 	if webhookSecret == "" {
@@ -108,30 +208,22 @@ func main() {
 
 	// Background maintenance (optional by role/env).
 	if cfg.RunOverdue {
-		go func() {
-			ticker := time.NewTicker(60 * time.Second)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case <-ticker.C:
-					n, err := database.MarkOverdueBankLoans(ctx, time.Now().UTC())
-					if err != nil {
-						log.Printf("bank_loans overdue: %v", err)
-						continue
-					}
-					if n > 0 {
-						log.Printf("bank_loans overdue processed: %d", n)
-					}
-				}
-			}
-		}()
+		life.Add(lifecycle.Background("overdue", func(ctx context.Context) { runOverdue(ctx, database) }))
+	}
+
+	// Admin panel: ADMIN_ID always has a super_admin account.
+	adminMgr := admin.NewAdminManager(database)
+	auditLog := audit.New(database)
+	if bot != nil {
+		bot.Audit = auditLog
+	}
+	if _, err := adminMgr.EnsureOwner(ctx, cfg.AdminID); err != nil {
+		slog.Error("ensure admin owner failed", "err", err)
 	}
 
 	// HTTP server
 	guard := security.NewFromEnv()
-	apiSrv := &api.API{Cfg: cfg, DB: database, Tg: bot, FastTap: ft, MemTap: mt, Guard: guard}
+	apiSrv := &api.API{Cfg: cfg, DB: database, Tg: bot, FastTap: ft, Taps: taps, Guard: guard, Chain: ledgerChain, Supply: auditor, Tokens: tokens, Sessions: sessions, Events: eventHub, Reloader: reloader, Admin: adminMgr, Audit: auditLog}
 	root := chi.NewRouter()
 	root.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -147,6 +239,10 @@ func main() {
 	if cfg.RunAPI {
 		root.Mount("/api/v1", apiSrv.Router())
 	}
+	if strings.TrimSpace(os.Getenv("METRICS_ENABLED")) != "0" {
+		registerMetrics(database, taps, redisMgr, auditor, eventHub)
+		root.Handle("/metrics", metrics.Default.Handler(strings.TrimSpace(os.Getenv("METRICS_TOKEN"))))
+	}
 
 	if useWebhook {
 		root.Post(webhookPath, func(w http.ResponseWriter, r *http.Request) {
@@ -158,17 +254,32 @@ func main() {
 			bot.HandleUpdate(ctx, upd)
 			w.WriteHeader(http.StatusOK)
 		})
-		webhookURL := strings.TrimRight(cfg.PublicBaseURL, "/") + webhookPath
-		if err := bot.SetWebhook(webhookURL); err != nil {
-			log.Printf("telegram setWebhook error: %v", err)
-		} else {
-			log.Printf("telegram webhook enabled")
-		}
-	} else if cfg.RunBot {
-		// If a webhook is configured on Telegram side, polling won't work.
-		_ = bot.SetWebhook("")
-		bot.StartPolling(ctx)
-		log.Printf("telegram polling enabled")
+	}
+	if bot != nil {
+		life.Add(lifecycle.Component{
+			Name: "bot",
+			Start: func(ctx context.Context) error {
+				if useWebhook {
+					webhookURL := strings.TrimRight(cfg.PublicBaseURL, "/") + webhookPath
+					if err := bot.SetWebhook(webhookURL); err != nil {
+						slog.Error("telegram setWebhook failed", "err", err)
+					} else {
+						slog.Info("telegram webhook enabled")
+					}
+				} else {
+					// If a webhook is configured on Telegram side, polling won't work.
+					_ = bot.SetWebhook("")
+					bot.StartPolling(ctx)
+					slog.Info("telegram polling enabled")
+				}
+				if err := bot.ResumeBroadcasts(ctx); err != nil {
+					slog.Error("resume broadcasts failed", "err", err)
+				}
+				return nil
+			},
+			Stop: bot.Stop,
+		})
+		httpAfter = append(httpAfter, "bot")
 	}
 
 	// Static webapp (optional local hosting)
@@ -188,47 +299,219 @@ func main() {
 		Handler:           root,
 		ReadHeaderTimeout: 5 * time.Second,
 	}
+	// Event streams never finish on their own; end them so Shutdown only
+	// waits for ordinary requests. Clients resume on another node.
+	srv.RegisterOnShutdown(eventHub.CloseStreams)
+	serveErr := make(chan error, 1)
+	life.Add(lifecycle.Component{
+		Name:  "http",
+		After: httpAfter,
+		Start: func(ctx context.Context) error {
+			ln, err := net.Listen("tcp", srv.Addr)
+			if err != nil {
+				return err
+			}
+			slog.Info("http listening", "port", port)
+			go func() {
+				if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					serveErr <- err
+				}
+			}()
+			return nil
+		},
+		Stop: srv.Shutdown,
+	})
+
+	if err := life.Start(ctx); err != nil {
+		fatal("start", err)
+	}
 
+	// SIGHUP re-reads the config file and applies the economy settings.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		log.Printf("http listening on :%s", port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("http: %v", err)
+		for range hup {
+			reloadConfig(logx.WithRequestID(ctx, ""), reloader, auditLog)
 		}
 	}()
 
-	// Graceful shutdown
-	sig := make(chan os.Signal, 1)
+	// Graceful shutdown; a second signal exits at once.
+	sig := make(chan os.Signal, 2)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	select {
+	case s := <-sig:
+		slog.Info("shutting down", "signal", s.String())
+	case err := <-serveErr:
+		slog.Error("http serve failed, shutting down", "err", err)
+	}
+	go func() {
+		<-sig
+		slog.Error("second signal, exiting without waiting")
+		os.Exit(1)
+	}()
+	if err := life.Stop(context.Background()); err != nil {
+		slog.Error("shutdown incomplete", "err", err)
+	}
 	cancel()
-
-	ctxShut, cancelShut := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancelShut()
-	_ = srv.Shutdown(ctxShut)
 }
 
 func initSystem(ctx context.Context, cfg config.Config, database *db.DB) {
 	adminAllocated := (cfg.TotalSupply * cfg.AdminAllocationPct) / 100
 	reserve := cfg.TotalSupply - adminAllocated
 
-	_, err := database.EnsureSystemState(ctx, cfg.TotalSupply, cfg.AdminID, adminAllocated, reserve, cfg.StartRateCoinsPerUSD, cfg.MinRateCoinsPerUSD, 3, 30_000)
+	sys, err := database.EnsureSystemState(ctx, cfg.TotalSupply, cfg.AdminID, adminAllocated, reserve, cfg.StartRateCoinsPerUSD, cfg.MinRateCoinsPerUSD, 3, 30_000)
 	if err != nil {
-		log.Fatalf("ensure system: %v", err)
+		fatal("ensure system", err)
 	}
 
-	// Create admin user and set premine balance directly (not taken from reserve)
-	_, err = database.Pool.Exec(ctx, `
+	// Create admin user and credit the premine directly (not taken from reserve).
+	// Only once: the genesis_admin ledger row marks it done, so restarts do not
+	// overwrite the admin balance and break the supply invariant.
+	err = database.WithTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM system_state WHERE id=1 FOR UPDATE`); err != nil {
+			return err
+		}
+		var done bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM ledger WHERE kind='genesis_admin')`).Scan(&done); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if _, err := tx.Exec(ctx, `
 INSERT INTO users (user_id, username, first_name, balance, energy, energy_max)
 VALUES ($1, 'admin', 'Admin', $2, $3, $3)
-ON CONFLICT (user_id) DO UPDATE SET balance = EXCLUDED.balance
-`, cfg.AdminID, adminAllocated, float64(cfg.EnergyMax))
+ON CONFLICT (user_id) DO UPDATE SET balance = users.balance + EXCLUDED.balance
+`, cfg.AdminID, sys.AdminAllocated, float64(cfg.EnergyMax)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('genesis_admin', NULL, $1, $2, '{}'::jsonb)`, cfg.AdminID, sys.AdminAllocated)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("ensure admin user: %v", err)
+		fatal("ensure admin user", err)
+	}
+
+	slog.Info("initialized system", "total", cfg.TotalSupply, "admin", adminAllocated, "reserve", reserve)
+}
+
+// runOverdue marks overdue bank loans and purges old idempotency keys every
+// minute.
+func runOverdue(ctx context.Context, database *db.DB) {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runCtx := logx.WithRequestID(ctx, "")
+			n, err := database.MarkOverdueBankLoans(runCtx, time.Now().UTC())
+			if err != nil {
+				slog.ErrorContext(runCtx, "bank_loans overdue failed", "err", err)
+				continue
+			}
+			if n > 0 {
+				slog.InfoContext(runCtx, "bank_loans overdue processed", "loans", n)
+			}
+			if n, err := database.PurgeIdempotencyKeys(runCtx); err != nil {
+				slog.ErrorContext(runCtx, "idempotency purge failed", "err", err)
+			} else if n > 0 {
+				slog.InfoContext(runCtx, "idempotency keys purged", "keys", n)
+			}
+		}
+	}
+}
+
+// runHalvingCheck applies due halvings (total_mined crossed the next threshold)
+// and pushes the current reward into the tap backend cache. Every node runs
+// it; the system_state row lock makes concurrent checks safe.
+func runHalvingCheck(ctx context.Context, database *db.DB, taps tapcore.TapBackend) {
+	everySec := int64(30)
+	if v := strings.TrimSpace(os.Getenv("HALVING_CHECK_EVERY_SEC")); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			everySec = n
+		}
+	}
+	if everySec <= 0 {
+		return
 	}
+	if everySec < 5 {
+		everySec = 5
+	}
+	setter, _ := taps.(tapcore.RewardSetter)
+	tm := tokenomics.NewTokenomicsManager(database)
+
+	ticker := time.NewTicker(time.Duration(everySec) * time.Second)
+	defer ticker.Stop()
+	for {
+		runCtx := logx.WithRequestID(ctx, "")
+		// Several epochs may be due after a long pause; each call applies one.
+		for i := 0; i < 8; i++ {
+			done, err := tm.CheckAndProcessHalving(runCtx)
+			if err != nil {
+				slog.ErrorContext(runCtx, "halving check failed", "err", err)
+				break
+			}
+			if !done {
+				break
+			}
+		}
+		if setter != nil {
+			if sys, err := database.GetSystem(runCtx); err == nil {
+				if err := setter.SetTapReward(runCtx, sys.TapRewardBP, sys.CurrentHalving); err != nil {
+					slog.ErrorContext(runCtx, "push tap reward failed", "err", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// registerMetrics adds the scrape-time collectors of everything this node
+// runs; hot-path counters register themselves in their packages.
+func registerMetrics(database *db.DB, taps tapcore.TapBackend, redisMgr *cache.RedisManager, auditor *supply.Auditor, hub *events.Hub) {
+	metrics.Default.Collect(metrics.Runtime)
+	metrics.Default.Collect(database.WriteMetrics)
+	metrics.Default.Collect(auditor.WriteMetrics)
+	metrics.Default.Collect(hub.WriteMetrics)
+	metrics.Default.Collect(func(ctx context.Context, w *metrics.Writer) {
+		w.Values("bkc_tap_backend", taps.Stats(ctx), "backend", taps.Name())
+	})
+	if redisMgr != nil {
+		metrics.Default.Collect(redisMgr.WriteMetrics)
+	}
+}
 
-	_, _ = database.Pool.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('genesis_admin', NULL, $1, $2, '{}'::jsonb)`, cfg.AdminID, adminAllocated)
+// reloadConfig applies the config file on SIGHUP. The reload is recorded
+// before it takes effect; if the audit log cannot be written it is skipped.
+func reloadConfig(ctx context.Context, reloader *config.Reloader, auditLog *audit.Log) {
+	ctx = audit.WithActor(ctx, audit.Actor{Kind: audit.ActorSystem, Via: "sighup"})
+	res, err := reloader.Reload(ctx, func(res config.ReloadResult) error {
+		if _, err := auditLog.Record(ctx, audit.Entry{
+			Action: "config_reload",
+			Target: "config",
+			After:  audit.JSON(map[string]any{"changed": res.Changed, "restart_required": res.Restart}),
+		}); err != nil {
+			return fmt.Errorf("audit record failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "config reload rejected", "err", err)
+		return
+	}
+	slog.InfoContext(ctx, "config reloaded", "changed", res.Changed, "restart_required", res.Restart)
+}
 
-	log.Printf("initialized system: total=%d, admin=%d, reserve=%d", cfg.TotalSupply, adminAllocated, reserve)
+// fatal logs a startup failure and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
 
 func shouldUseTelegramWebhook(publicBaseURL string) bool {
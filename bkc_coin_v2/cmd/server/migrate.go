@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"bkc_coin_v2/internal/config"
+	"bkc_coin_v2/internal/db"
+)
+
+const migrateUsage = `usage: server migrate <command>
+
+  status      list migrations and whether they are applied
+  up          apply all pending migrations
+  down [N]    roll back the last N migrations (default 1)
+  to N        migrate up or down to version N (0 = empty schema)
+
+Only DATABASE_URL is required.`
+
+// runMigrate implements "server migrate ..." and returns the exit code.
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	dsn := config.DatabaseURLFromEnv()
+	if dsn == "" {
+		fmt.Fprintln(os.Stderr, "migrate: DATABASE_URL is not set")
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	database, err := db.Connect(ctx, dsn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: db connect: %v\n", err)
+		return 1
+	}
+	defer database.Close()
+
+	var done []db.Migration
+	switch args[0] {
+	case "status":
+		st, err := database.MigrateStatus(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate status: %v\n", err)
+			return 1
+		}
+		for _, s := range st {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + s.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d  %-24s %s\n", s.Version, s.Name, applied)
+		}
+		return 0
+	case "up":
+		done, err = database.MigrateUp(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps <= 0 {
+				fmt.Fprintln(os.Stderr, "migrate down: N must be a positive number")
+				return 2
+			}
+		}
+		done, err = database.MigrateDown(ctx, steps)
+	case "to":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			return 2
+		}
+		version, perr := strconv.Atoi(args[1])
+		if perr != nil {
+			fmt.Fprintln(os.Stderr, "migrate to: N must be a number")
+			return 2
+		}
+		done, err = database.MigrateTo(ctx, version)
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	for _, m := range done {
+		fmt.Printf("ran %04d_%s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate %s: %v\n", args[0], err)
+		return 1
+	}
+	if len(done) == 0 {
+		fmt.Println("nothing to do")
+	}
+	return 0
+}
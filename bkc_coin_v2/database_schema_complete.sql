@@ -2,6 +2,7 @@
 -- BKC COIN V2 - ПОЛНАЯ СТРУКТУРА БАЗ ДАННЫХ
 -- Архитектура: 5 Neon (профили), 2 Supabase (P2P/кредиты), 2 Cockroach (логи), 6 Redis
 -- =============================================================================
+-- Справочный черновик. Реальная схема — internal/db/migrations (server migrate).
 
 -- БАЗА 1-5: NEON (ПРОФИЛИ ПОЛЬЗОВАТЕЛЕЙ - ШАРДИНГ ПО user_id % 5)
 -- =============================================================================
@@ -22,6 +23,7 @@ CREATE TABLE IF NOT EXISTS users (
     energy_boost_max_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1,
     level INT NOT NULL DEFAULT 1,
     taps_power INT NOT NULL DEFAULT 1,
+    tap_reward_carry BIGINT NOT NULL DEFAULT 0, -- неоплаченная доля монеты, б.п.
     referrals_count BIGINT NOT NULL DEFAULT 0,
     referred_by BIGINT,
     is_admin BOOLEAN DEFAULT FALSE,
@@ -118,7 +120,8 @@ CREATE TABLE IF NOT EXISTS system_state (
     unfrozen_schedule JSONB DEFAULT '{}', -- График разблокировки
     start_rate_coins_usd BIGINT NOT NULL DEFAULT 60_000,
     min_rate_coins_usd BIGINT NOT NULL DEFAULT 50_000,
-    current_tap_reward BIGINT NOT NULL DEFAULT 1,
+    current_tap_reward BIGINT NOT NULL DEFAULT 1, -- устарело, см. tap_reward_bp
+    tap_reward_bp BIGINT NOT NULL DEFAULT 10000, -- награда за единицу силы тапа, б.п. монеты
     total_mined BIGINT NOT NULL DEFAULT 0,
     total_burned BIGINT NOT NULL DEFAULT 0,
     halving_threshold BIGINT NOT NULL DEFAULT 100_000_000,
@@ -151,6 +154,12 @@ CREATE INDEX IF NOT EXISTS ledger_from_idx ON ledger(from_id);
 CREATE INDEX IF NOT EXISTS ledger_kind_idx ON ledger(kind, ts DESC);
 CREATE INDEX IF NOT EXISTS ledger_event_id_uniq ON ledger(event_id);
 
+-- Комментарии к переводам: отдельно от ledger, чтобы не попадать в публичные блоки
+CREATE TABLE IF NOT EXISTS transfer_memos (
+    ledger_id BIGINT PRIMARY KEY REFERENCES ledger(id),
+    memo TEXT NOT NULL
+);
+
 -- БАЗА 6-7: SUPABASE (P2P МАРКЕТ И КРЕДИТЫ)
 -- =============================================================================
 
@@ -430,7 +439,7 @@ DECLARE
     new_reward BIGINT;
 BEGIN
     -- Получаем текущие значения
-    SELECT total_mined, current_tap_reward INTO current_mined, current_reward
+    SELECT total_mined, tap_reward_bp INTO current_mined, current_reward
     FROM system_state WHERE id = 1;
     
     -- Проверяем нужен ли халвинг
@@ -439,16 +448,16 @@ BEGIN
         
         UPDATE system_state 
         SET 
-            current_tap_reward = new_reward,
+            tap_reward_bp = new_reward,
             current_halving = current_halving + 1,
             updated_at = now()
         WHERE id = 1;
         
-        -- Записываем в ledger
+        -- Записываем в ledger (информационная строка, сумма 0)
         INSERT INTO ledger(kind, amount, meta)
-        VALUES ('halving', new_reward, jsonb_build_object(
-            'old_reward', current_reward,
-            'new_reward', new_reward,
+        VALUES ('halving', 0, jsonb_build_object(
+            'old_reward_bp', current_reward,
+            'new_reward_bp', new_reward,
             'halving_number', current_halving + 1
         ));
     END IF;
@@ -552,7 +561,7 @@ SELECT
     admin_allocated,
     total_mined,
     total_burned,
-    current_tap_reward,
+    tap_reward_bp,
     current_halving,
     ROUND((total_burned::decimal / total_supply) * 100, 2) as burn_percentage,
     ROUND((reserve_supply::decimal / total_supply) * 100, 2) as reserve_percentage,
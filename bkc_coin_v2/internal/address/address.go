@@ -0,0 +1,134 @@
+// Package address formats and parses BKC wallet addresses and recipient
+// references.
+//
+// An address is "BKC" + user_id + a 4-letter checksum, e.g. BKC123456789QZXA.
+// The checksum alphabet has no digits, so the id and the checksum never run
+// into each other. Parsing is case-insensitive; a wrong checksum is
+// ErrChecksum, so a mistyped digit does not silently pick another user.
+// The old form without a checksum parses as KindLegacy; it cannot catch a
+// typo, so callers moving coins reject it with ErrNoChecksum.
+package address
+
+import (
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+const (
+	prefix      = "BKC"
+	checkLen    = 4
+	checkLetter = "ABCDEFGHJKLMNPQRSTUVWXYZ" // no I and O
+)
+
+var (
+	ErrInvalid    = errors.New("invalid recipient")
+	ErrChecksum   = errors.New("bad address checksum")
+	ErrNoChecksum = errors.New("address without checksum")
+)
+
+// Format renders the address of a user.
+func Format(userID int64) string {
+	id := strconv.FormatInt(userID, 10)
+	return prefix + id + checksum(id)
+}
+
+func checksum(id string) string {
+	n := crc32.ChecksumIEEE([]byte(prefix + id))
+	base := uint32(len(checkLetter))
+	out := make([]byte, checkLen)
+	for i := checkLen - 1; i >= 0; i-- {
+		out[i] = checkLetter[n%base]
+		n /= base
+	}
+	return string(out)
+}
+
+// Kind tells how a recipient was written.
+type Kind string
+
+const (
+	KindID       Kind = "id"       // 123456789
+	KindLegacy   Kind = "legacy"   // BKC123456789, no checksum
+	KindAddress  Kind = "address"  // BKC123456789QZXA
+	KindUsername Kind = "username" // @name
+)
+
+// Ref is a parsed recipient reference. UserID is set for every kind except
+// KindUsername, which still has to be looked up.
+type Ref struct {
+	Kind     Kind
+	UserID   int64
+	Username string
+}
+
+// Parse accepts a numeric user_id, a BKC address (with or without checksum)
+// or @username.
+func Parse(raw string) (Ref, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return Ref{}, ErrInvalid
+	}
+	if strings.HasPrefix(raw, "@") {
+		name := raw[1:]
+		if !validUsername(name) {
+			return Ref{}, ErrInvalid
+		}
+		return Ref{Kind: KindUsername, Username: name}, nil
+	}
+	up := strings.ToUpper(strings.ReplaceAll(raw, " ", ""))
+	if !strings.HasPrefix(up, prefix) {
+		id, ok := parseID(up)
+		if !ok {
+			return Ref{}, ErrInvalid
+		}
+		return Ref{Kind: KindID, UserID: id}, nil
+	}
+	body := up[len(prefix):]
+	digits := strings.TrimRightFunc(body, func(r rune) bool { return r < '0' || r > '9' })
+	id, ok := parseID(digits)
+	if !ok {
+		return Ref{}, ErrInvalid
+	}
+	check := body[len(digits):]
+	if check == "" {
+		return Ref{Kind: KindLegacy, UserID: id}, nil
+	}
+	if len(check) != checkLen || strings.Trim(check, checkLetter) != "" {
+		return Ref{}, ErrInvalid
+	}
+	if check != checksum(digits) {
+		return Ref{}, ErrChecksum
+	}
+	return Ref{Kind: KindAddress, UserID: id}, nil
+}
+
+func parseID(s string) (int64, bool) {
+	if s == "" || len(s) > 19 {
+		return 0, false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0, false
+		}
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// validUsername checks the Telegram username shape: 5-32 of [A-Za-z0-9_].
+func validUsername(s string) bool {
+	if len(s) < 5 || len(s) > 32 {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -2,21 +2,68 @@ package admin
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"time"
 
+	"bkc_coin_v2/internal/audit"
 	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/logx"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var logger = logx.Component("admin")
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrNotFound           = errors.New("not found")
+	ErrNotEnough          = errors.New("not enough balance")
+	ErrBadParams          = errors.New("bad params")
+)
+
+// Разрешения. god_mode включает все остальные.
+const (
+	PermGodMode   = "god_mode"
+	PermUsers     = "users"
+	PermMarket    = "market"
+	PermBank      = "bank"
+	PermGames     = "games"
+	PermAnalytics = "analytics"
+)
+
+// Роли администраторов.
+const (
+	RoleSuperAdmin = "super_admin"
+	RoleAdmin      = "admin"
+	RoleModerator  = "moderator"
 )
 
+// rolePermissions разрешения, которые роль дает сама по себе; столбец
+// permissions добавляет к ним отдельные права.
+var rolePermissions = map[string][]string{
+	RoleSuperAdmin: {PermGodMode},
+	RoleAdmin:      {PermUsers, PermMarket, PermBank, PermGames, PermAnalytics},
+	RoleModerator:  {PermUsers, PermMarket},
+}
+
+var knownPermissions = map[string]bool{
+	PermGodMode: true, PermUsers: true, PermMarket: true,
+	PermBank: true, PermGames: true, PermAnalytics: true,
+}
+
 // AdminManager управляет админ-панелью
 type AdminManager struct {
-	db *db.DB
+	db         *db.DB
+	audit      *audit.Log
+	sessionTTL time.Duration
 }
 
-// NewAdminManager создает новый менеджер админ-панели
+// NewAdminManager создает новый менеджер админ-панели. Время жизни сессии
+// панели задает ADMIN_SESSION_TTL_HOURS (по умолчанию 12, от 1 до 168).
 func NewAdminManager(database *db.DB) *AdminManager {
-	return &AdminManager{db: database}
+	return &AdminManager{db: database, audit: audit.New(database), sessionTTL: sessionTTLFromEnv()}
 }
 
 // AdminUser представляет администратора
@@ -26,6 +73,7 @@ type AdminUser struct {
 	Email       string     `json:"email"`
 	Role        string     `json:"role"`        // super_admin, admin, moderator
 	Permissions []string   `json:"permissions"` // god_mode, users, market, bank, games, analytics
+	TelegramID  *int64     `json:"telegram_id"`
 	IsActive    bool       `json:"is_active"`
 	LastLogin   *time.Time `json:"last_login"`
 	CreatedAt   time.Time  `json:"created_at"`
@@ -36,13 +84,14 @@ type AdminUser struct {
 type UserManagement struct {
 	UserID       int64      `json:"user_id"`
 	Username     string     `json:"username"`
+	FirstName    string     `json:"first_name"`
 	Balance      int64      `json:"balance"`
 	Level        int        `json:"level"`
 	IsSubscribed bool       `json:"is_subscribed"`
 	IsBanned     bool       `json:"is_banned"`
 	BanReason    string     `json:"ban_reason"`
 	BanExpiresAt *time.Time `json:"ban_expires_at"`
-	LastActive   time.Time  `json:"last_active"`
+	LastActive   *time.Time `json:"last_active"`
 	Referrals    int        `json:"referrals"`
 	TapsTotal    int64      `json:"taps_total"`
 	CreatedAt    time.Time  `json:"created_at"`
@@ -53,10 +102,10 @@ type MarketManagement struct {
 	ListingID    int64      `json:"listing_id"`
 	UserID       int64      `json:"user_id"`
 	Username     string     `json:"username"`
-	ItemType     string     `json:"item_type"` // nft, physical
-	ItemName     string     `json:"item_name"`
+	Category     string     `json:"category"`
+	Title        string     `json:"title"`
 	Price        int64      `json:"price"`
-	Status       string     `json:"status"` // active, pending, rejected, sold
+	Status       string     `json:"status"` // active, sold, cancelled, rejected
 	IsApproved   bool       `json:"is_approved"`
 	ApprovedBy   *int64     `json:"approved_by"`
 	ApprovedAt   *time.Time `json:"approved_at"`
@@ -74,7 +123,7 @@ type BankManagement struct {
 	Principal     int64     `json:"principal"`
 	InterestTotal int64     `json:"interest_total"`
 	TotalDue      int64     `json:"total_due"`
-	Status        string    `json:"status"` // active, repaid, defaulted, collector
+	Status        string    `json:"status"` // active, repaid, overdue
 	DueAt         time.Time `json:"due_at"`
 	CreatedAt     time.Time `json:"created_at"`
 }
@@ -96,17 +145,6 @@ type Analytics struct {
 	RevenueToday  int64 `json:"revenue_today"`
 }
 
-// GodModeAction действие God Mode
-type GodModeAction struct {
-	AdminID    int64     `json:"admin_id"`
-	ActionType string    `json:"action_type"` // add_balance, remove_balance, ban_user, unban_user, approve_market, reject_market
-	TargetID   int64     `json:"target_id"`
-	Amount     int64     `json:"amount"`
-	Reason     string    `json:"reason"`
-	Metadata   string    `json:"metadata"`
-	CreatedAt  time.Time `json:"created_at"`
-}
-
 // SubscriptionCheck проверка подписки
 type SubscriptionCheck struct {
 	UserID        int64      `json:"user_id"`
@@ -119,47 +157,320 @@ type SubscriptionCheck struct {
 	IsValid       bool       `json:"is_valid"`
 }
 
-// AuthenticateAdmin аутентифицирует администратора
-func (am *AdminManager) AuthenticateAdmin(ctx context.Context, username, password string) (*AdminUser, error) {
+const adminColumns = `id, username, email, role, permissions, telegram_id, is_active, last_login, created_at, updated_at`
+
+func scanAdmin(row pgx.Row) (*AdminUser, error) {
 	var admin AdminUser
-	err := am.db.Pool.QueryRow(ctx, `
-		SELECT id, username, email, role, permissions, is_active, last_login, created_at, updated_at
-		FROM admin_users 
-		WHERE username = $1 AND password_hash = crypt($2, password_hash) AND is_active = true
-	`, username, password).Scan(&admin.ID, &admin.Username, &admin.Email,
-		&admin.Role, &admin.Permissions, &admin.IsActive, &admin.LastLogin,
-		&admin.CreatedAt, &admin.UpdatedAt)
+	err := row.Scan(&admin.ID, &admin.Username, &admin.Email, &admin.Role, &admin.Permissions,
+		&admin.TelegramID, &admin.IsActive, &admin.LastLogin, &admin.CreatedAt, &admin.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &admin, nil
+}
 
+// AuthenticateAdmin аутентифицирует администратора. Пароль проверяется
+// через pgcrypto crypt(); у записей без пароля (вход только через Telegram)
+// вход по паролю невозможен.
+func (am *AdminManager) AuthenticateAdmin(ctx context.Context, username, password string) (*AdminUser, error) {
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	admin, err := scanAdmin(am.db.Pool.QueryRow(ctx, `
+		SELECT `+adminColumns+`
+		FROM admin_users
+		WHERE username = $1 AND is_active = true
+		  AND CASE WHEN password_hash = '' THEN false ELSE password_hash = crypt($2, password_hash) END
+	`, username, password))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
 		return nil, fmt.Errorf("authentication failed: %w", err)
 	}
 
 	// Обновляем время последнего входа
-	_, err = am.db.Pool.Exec(ctx, "UPDATE admin_users SET last_login = $1 WHERE id = $2", time.Now(), admin.ID)
+	am.touchLogin(ctx, admin.ID)
+	return admin, nil
+}
+
+// AdminByTelegramID находит активного администратора, привязанного к
+// аккаунту Telegram.
+func (am *AdminManager) AdminByTelegramID(ctx context.Context, telegramID int64) (*AdminUser, error) {
+	admin, err := scanAdmin(am.db.Pool.QueryRow(ctx, `
+		SELECT `+adminColumns+` FROM admin_users WHERE telegram_id = $1 AND is_active = true
+	`, telegramID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		log.Printf("Failed to update admin last login: %v", err)
+		return nil, fmt.Errorf("failed to get admin: %w", err)
 	}
+	return admin, nil
+}
 
-	return &admin, nil
+func (am *AdminManager) touchLogin(ctx context.Context, adminID int64) {
+	_, err := am.db.Pool.Exec(ctx, "UPDATE admin_users SET last_login = now() WHERE id = $1", adminID)
+	if err != nil {
+		logger.WarnContext(ctx, "admin last login update failed", "admin_id", adminID, "err", err)
+	}
+}
+
+// EnsureOwner заводит (или возвращает) запись super_admin для ADMIN_ID,
+// чтобы владелец бота всегда мог войти в панель через Telegram.
+func (am *AdminManager) EnsureOwner(ctx context.Context, telegramID int64) (*AdminUser, error) {
+	if telegramID == 0 {
+		return nil, ErrBadParams
+	}
+	_, err := am.db.Pool.Exec(ctx, `
+		INSERT INTO admin_users(username, role, password_hash, telegram_id)
+		SELECT $1::text, $2::text, '', $3::bigint
+		WHERE NOT EXISTS (SELECT 1 FROM admin_users WHERE telegram_id = $3::bigint)
+		ON CONFLICT (username) DO NOTHING
+	`, fmt.Sprintf("tg_%d", telegramID), RoleSuperAdmin, telegramID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create owner: %w", err)
+	}
+	_, err = am.db.Pool.Exec(ctx, `
+		UPDATE admin_users SET role = $1, is_active = true, updated_at = now()
+		WHERE telegram_id = $2 AND (role <> $1 OR NOT is_active)
+	`, RoleSuperAdmin, telegramID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update owner: %w", err)
+	}
+	return am.AdminByTelegramID(ctx, telegramID)
 }
 
-// HasPermission проверяет наличие разрешения
+// HasPermission проверяет наличие разрешения: у роли или в списке
+// permissions администратора.
 func (am *AdminManager) HasPermission(admin *AdminUser, permission string) bool {
-	for _, p := range admin.Permissions {
-		if p == permission || p == "god_mode" {
+	if admin == nil || !admin.IsActive {
+		return false
+	}
+	for _, p := range append(rolePermissions[admin.Role], admin.Permissions...) {
+		if p == permission || p == PermGodMode {
 			return true
 		}
 	}
 	return false
 }
 
-// GetUsersList получает список пользователей
+// EffectivePermissions все разрешения администратора с учетом роли.
+func EffectivePermissions(admin *AdminUser) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, p := range append(rolePermissions[admin.Role], admin.Permissions...) {
+		if p == PermGodMode {
+			return []string{PermGodMode, PermUsers, PermMarket, PermBank, PermGames, PermAnalytics}
+		}
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// NewAdmin данные нового администратора. Нужен пароль или Telegram ID.
+type NewAdmin struct {
+	Username    string   `json:"username"`
+	Email       string   `json:"email"`
+	Password    string   `json:"password"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+	TelegramID  int64    `json:"telegram_id"`
+}
+
+// AdminUpdate изменения администратора; nil поля не меняются.
+type AdminUpdate struct {
+	Role        *string   `json:"role"`
+	Permissions *[]string `json:"permissions"`
+	IsActive    *bool     `json:"is_active"`
+	Password    *string   `json:"password"`
+	TelegramID  *int64    `json:"telegram_id"` // 0 отвязывает
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func validPermissions(perms []string) bool {
+	for _, p := range perms {
+		if !knownPermissions[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// ListAdmins список администраторов
+func (am *AdminManager) ListAdmins(ctx context.Context) ([]AdminUser, error) {
+	rows, err := am.db.Pool.Query(ctx, `SELECT `+adminColumns+` FROM admin_users ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list admins: %w", err)
+	}
+	defer rows.Close()
+
+	admins := []AdminUser{}
+	for rows.Next() {
+		admin, err := scanAdmin(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list admins: %w", err)
+		}
+		admins = append(admins, *admin)
+	}
+	return admins, rows.Err()
+}
+
+// CreateAdmin создает администратора
+func (am *AdminManager) CreateAdmin(ctx context.Context, actorID int64, in NewAdmin) (*AdminUser, error) {
+	if in.Username == "" || !validRole(in.Role) || !validPermissions(in.Permissions) || (in.Password == "" && in.TelegramID == 0) {
+		return nil, ErrBadParams
+	}
+	if in.Permissions == nil {
+		in.Permissions = []string{}
+	}
+	var telegramID *int64
+	if in.TelegramID != 0 {
+		telegramID = &in.TelegramID
+	}
+
+	tx, err := am.db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	admin, err := scanAdmin(tx.QueryRow(ctx, `
+		INSERT INTO admin_users(username, email, role, permissions, password_hash, telegram_id)
+		VALUES($1, $2, $3, $4, CASE WHEN $5::text = '' THEN '' ELSE crypt($5, gen_salt('bf')) END, $6)
+		RETURNING `+adminColumns,
+		in.Username, in.Email, in.Role, in.Permissions, in.Password, telegramID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create admin: %w", err)
+	}
+	if err := recordAction(ctx, tx, actorID, "admin_create", audit.Target("admin", admin.ID), nil, adminState(admin, false), ""); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit admin: %w", err)
+	}
+
+	logger.InfoContext(ctx, "admin created", "actor_id", actorID, "admin_id", admin.ID, "username", admin.Username, "role", admin.Role)
+	return admin, nil
+}
+
+// UpdateAdmin меняет роль, права, пароль или привязку администратора.
+// Отключение или смена пароля завершают его сессии.
+func (am *AdminManager) UpdateAdmin(ctx context.Context, actorID, adminID int64, up AdminUpdate) (*AdminUser, error) {
+	if up.Role != nil && !validRole(*up.Role) {
+		return nil, ErrBadParams
+	}
+	if up.Permissions != nil && !validPermissions(*up.Permissions) {
+		return nil, ErrBadParams
+	}
+
+	tx, err := am.db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var perms []string
+	if up.Permissions != nil {
+		perms = *up.Permissions
+		if perms == nil {
+			perms = []string{}
+		}
+	}
+	var telegramID *int64
+	if up.TelegramID != nil && *up.TelegramID != 0 {
+		telegramID = up.TelegramID
+	}
+	before, err := scanAdmin(tx.QueryRow(ctx, `SELECT `+adminColumns+` FROM admin_users WHERE id = $1 FOR UPDATE`, adminID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin: %w", err)
+	}
+	admin, err := scanAdmin(tx.QueryRow(ctx, `
+		UPDATE admin_users SET
+		  role = COALESCE($2, role),
+		  permissions = COALESCE($3, permissions),
+		  is_active = COALESCE($4, is_active),
+		  password_hash = CASE WHEN $5::text IS NULL THEN password_hash
+		                       WHEN $5 = '' THEN ''
+		                       ELSE crypt($5, gen_salt('bf')) END,
+		  telegram_id = CASE WHEN $6 THEN $7 ELSE telegram_id END,
+		  updated_at = now()
+		WHERE id = $1
+		RETURNING `+adminColumns,
+		adminID, up.Role, perms, up.IsActive, up.Password, up.TelegramID != nil, telegramID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update admin: %w", err)
+	}
+	if (up.IsActive != nil && !*up.IsActive) || up.Password != nil {
+		if _, err := tx.Exec(ctx, `UPDATE admin_sessions SET revoked_at = now() WHERE admin_id = $1 AND revoked_at IS NULL`, adminID); err != nil {
+			return nil, fmt.Errorf("failed to revoke sessions: %w", err)
+		}
+	}
+	if err := recordAction(ctx, tx, actorID, "admin_update", audit.Target("admin", adminID), adminState(before, false), adminState(admin, up.Password != nil), ""); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit admin: %w", err)
+	}
+
+	logger.InfoContext(ctx, "admin updated", "actor_id", actorID, "admin_id", adminID)
+	return admin, nil
+}
+
+// adminState поля администратора для журнала аудита (без хэша пароля).
+func adminState(a *AdminUser, passwordChanged bool) map[string]any {
+	m := map[string]any{
+		"username":    a.Username,
+		"role":        a.Role,
+		"permissions": a.Permissions,
+		"telegram_id": a.TelegramID,
+		"is_active":   a.IsActive,
+	}
+	if passwordChanged {
+		m["password_changed"] = true
+	}
+	return m
+}
+
+// recordAction записывает действие в журнал аудита в транзакции самого
+// действия. Исполнитель берется из контекста запроса (IP, способ входа),
+// иначе это администратор adminID.
+func recordAction(ctx context.Context, tx pgx.Tx, adminID int64, action, target string, before, after any, reason string) error {
+	actor, ok := audit.ActorFrom(ctx)
+	if !ok {
+		actor = audit.Actor{Kind: audit.ActorAdmin, ID: adminID}
+	}
+	_, err := audit.Append(ctx, tx, audit.Entry{
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Before: audit.JSON(before),
+		After:  audit.JSON(after),
+		Reason: reason,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
+
+// GetUsersList получает список пользователей; filter ищет по username,
+// имени или точному user_id.
 func (am *AdminManager) GetUsersList(ctx context.Context, limit, offset int, filter string) ([]UserManagement, error) {
 	query := `
-		SELECT u.user_id, u.username, u.balance, u.level, u.is_subscribed, 
-		       u.is_banned, u.ban_reason, u.ban_expires_at, u.last_active,
-		       (SELECT COUNT(*) FROM referrals WHERE referrer_id = u.user_id) as referrals,
-		       u.taps_total, u.created_at
+		SELECT u.user_id, COALESCE(u.username, ''), COALESCE(u.first_name, ''), u.balance, u.level,
+		       u.is_subscribed, u.is_banned, COALESCE(u.ban_reason, ''), u.ban_expires_at, u.last_active,
+		       u.referrals_count, u.taps_total, u.created_at
 		FROM users u
 		WHERE 1=1
 	`
@@ -167,8 +478,8 @@ func (am *AdminManager) GetUsersList(ctx context.Context, limit, offset int, fil
 	argIndex := 1
 
 	if filter != "" {
-		query += fmt.Sprintf(" AND (u.username ILIKE $%d OR u.email ILIKE $%d)", argIndex, argIndex+1)
-		args = append(args, "%"+filter+"%", "%"+filter+"%")
+		query += fmt.Sprintf(" AND (u.username ILIKE $%d OR u.first_name ILIKE $%d OR u.user_id::text = $%d)", argIndex, argIndex, argIndex+1)
+		args = append(args, "%"+filter+"%", filter)
 		argIndex += 2
 	}
 
@@ -181,17 +492,17 @@ func (am *AdminManager) GetUsersList(ctx context.Context, limit, offset int, fil
 	}
 	defer rows.Close()
 
-	var users []UserManagement
+	users := []UserManagement{}
 	for rows.Next() {
 		var user UserManagement
 		err := rows.Scan(
-			&user.UserID, &user.Username, &user.Balance, &user.Level,
+			&user.UserID, &user.Username, &user.FirstName, &user.Balance, &user.Level,
 			&user.IsSubscribed, &user.IsBanned, &user.BanReason,
 			&user.BanExpiresAt, &user.LastActive, &user.Referrals,
 			&user.TapsTotal, &user.CreatedAt,
 		)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("failed to get users list: %w", err)
 		}
 		users = append(users, user)
 	}
@@ -199,7 +510,29 @@ func (am *AdminManager) GetUsersList(ctx context.Context, limit, offset int, fil
 	return users, rows.Err()
 }
 
-// BanUser блокирует пользователя
+// BannedUserIDs пользователи с действующей блокировкой.
+func (am *AdminManager) BannedUserIDs(ctx context.Context) ([]int64, error) {
+	rows, err := am.db.Pool.Query(ctx, `
+		SELECT user_id FROM users
+		WHERE is_banned AND (ban_expires_at IS NULL OR ban_expires_at > now())
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get banned users: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// BanUser блокирует пользователя; days <= 0 навсегда
 func (am *AdminManager) BanUser(ctx context.Context, adminID, userID int64, reason string, days int) error {
 	var expiresAt *time.Time
 	if days > 0 {
@@ -213,9 +546,14 @@ func (am *AdminManager) BanUser(ctx context.Context, adminID, userID int64, reas
 	}
 	defer tx.Rollback(ctx)
 
+	before, err := lockBanState(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
 	// Блокируем пользователя
 	_, err = tx.Exec(ctx, `
-		UPDATE users 
+		UPDATE users
 		SET is_banned = true, ban_reason = $1, ban_expires_at = $2
 		WHERE user_id = $3
 	`, reason, expiresAt, userID)
@@ -223,20 +561,17 @@ func (am *AdminManager) BanUser(ctx context.Context, adminID, userID int64, reas
 		return fmt.Errorf("failed to ban user: %w", err)
 	}
 
-	// Записываем действие God Mode
-	_, err = tx.Exec(ctx, `
-		INSERT INTO god_mode_actions(admin_id, action_type, target_id, reason, created_at)
-		VALUES($1, 'ban_user', $2, $3, $4)
-	`, adminID, userID, reason, time.Now())
-	if err != nil {
-		return fmt.Errorf("failed to record god mode action: %w", err)
+	// Записываем действие в журнал аудита
+	after := map[string]any{"is_banned": true, "ban_reason": reason, "ban_expires_at": expiresAt}
+	if err := recordAction(ctx, tx, adminID, "ban_user", audit.Target("user", userID), before, after, reason); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return fmt.Errorf("failed to commit ban: %w", err)
 	}
 
-	log.Printf("Admin %d banned user %d: %s (expires: %v)", adminID, userID, reason, expiresAt)
+	logger.InfoContext(ctx, "user banned", "admin_id", adminID, "target_user", userID, "reason", reason, "expires_at", expiresAt)
 
 	return nil
 }
@@ -249,9 +584,14 @@ func (am *AdminManager) UnbanUser(ctx context.Context, adminID, userID int64) er
 	}
 	defer tx.Rollback(ctx)
 
+	before, err := lockBanState(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
 	// Разблокируем пользователя
 	_, err = tx.Exec(ctx, `
-		UPDATE users 
+		UPDATE users
 		SET is_banned = false, ban_reason = NULL, ban_expires_at = NULL
 		WHERE user_id = $1
 	`, userID)
@@ -259,25 +599,41 @@ func (am *AdminManager) UnbanUser(ctx context.Context, adminID, userID int64) er
 		return fmt.Errorf("failed to unban user: %w", err)
 	}
 
-	// Записываем действие God Mode
-	_, err = tx.Exec(ctx, `
-		INSERT INTO god_mode_actions(admin_id, action_type, target_id, created_at)
-		VALUES($1, 'unban_user', $2, $3)
-	`, adminID, userID, time.Now())
-	if err != nil {
-		return fmt.Errorf("failed to record god mode action: %w", err)
+	// Записываем действие в журнал аудита
+	after := map[string]any{"is_banned": false, "ban_reason": "", "ban_expires_at": nil}
+	if err := recordAction(ctx, tx, adminID, "unban_user", audit.Target("user", userID), before, after, ""); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return fmt.Errorf("failed to commit unban: %w", err)
 	}
 
-	log.Printf("Admin %d unbanned user %d", adminID, userID)
+	logger.InfoContext(ctx, "user unbanned", "admin_id", adminID, "target_user", userID)
 
 	return nil
 }
 
-// AddBalance добавляет баланс пользователю (God Mode)
+// lockBanState блокирует строку пользователя и возвращает состояние бана
+// для журнала аудита.
+func lockBanState(ctx context.Context, tx pgx.Tx, userID int64) (map[string]any, error) {
+	var banned bool
+	var reason string
+	var expiresAt *time.Time
+	err := tx.QueryRow(ctx, `
+		SELECT is_banned, COALESCE(ban_reason, ''), ban_expires_at FROM users WHERE user_id = $1 FOR UPDATE
+	`, userID).Scan(&banned, &reason, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	return map[string]any{"is_banned": banned, "ban_reason": reason, "ban_expires_at": expiresAt}, nil
+}
+
+// AddBalance начисляет пользователю монеты из резерва (God Mode). Эмиссия
+// не растет: монеты уходят из reserve_supply, как у admin_reserve_send.
 func (am *AdminManager) AddBalance(ctx context.Context, adminID, userID int64, amount int64, reason string) error {
 	if amount <= 0 {
 		return fmt.Errorf("amount must be positive")
@@ -289,43 +645,60 @@ func (am *AdminManager) AddBalance(ctx context.Context, adminID, userID int64, a
 	}
 	defer tx.Rollback(ctx)
 
-	// Добавляем баланс
-	_, err = tx.Exec(ctx, "UPDATE users SET balance = balance + $1 WHERE user_id = $2", amount, userID)
+	// Резерв блокируется первым, как во всех операциях с ним
+	var reserve, reserved int64
+	if err := tx.QueryRow(ctx, `SELECT reserve_supply, reserved_supply FROM system_state WHERE id=1 FOR UPDATE`).Scan(&reserve, &reserved); err != nil {
+		return fmt.Errorf("failed to lock reserve: %w", err)
+	}
+	if reserve-reserved < amount {
+		return fmt.Errorf("reserve: %w", ErrNotEnough)
+	}
+
+	var balance int64
+	err = tx.QueryRow(ctx, "SELECT balance FROM users WHERE user_id = $1 FOR UPDATE", userID).Scan(&balance)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
 	if err != nil {
+		return fmt.Errorf("failed to get user balance: %w", err)
+	}
+
+	// Добавляем баланс
+	if _, err := tx.Exec(ctx, "UPDATE users SET balance = balance + $1 WHERE user_id = $2", amount, userID); err != nil {
 		return fmt.Errorf("failed to add balance: %w", err)
 	}
+	if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply - $1, updated_at = now() WHERE id=1`, amount); err != nil {
+		return fmt.Errorf("failed to update reserve: %w", err)
+	}
 
 	// Записываем в ledger
+	meta, _ := json.Marshal(map[string]any{"admin_id": adminID, "reason": reason})
 	_, err = tx.Exec(ctx, `
 		INSERT INTO ledger(kind, from_id, to_id, amount, meta)
 		VALUES('admin_add', NULL, $1, $2, $3::jsonb)
-	`, userID, amount, fmt.Sprintf(`{
-		"admin_id": %d,
-		"reason": "%s"
-	}`, adminID, reason))
+	`, userID, amount, string(meta))
 	if err != nil {
 		return fmt.Errorf("failed to record ledger: %w", err)
 	}
 
-	// Записываем действие God Mode
-	_, err = tx.Exec(ctx, `
-		INSERT INTO god_mode_actions(admin_id, action_type, target_id, amount, reason, created_at)
-		VALUES($1, 'add_balance', $2, $3, $4, $5)
-	`, adminID, userID, amount, reason, time.Now())
-	if err != nil {
-		return fmt.Errorf("failed to record god mode action: %w", err)
+	// Записываем действие в журнал аудита
+	if err := recordAction(ctx, tx, adminID, "add_balance", audit.Target("user", userID),
+		map[string]any{"balance": balance, "reserve": reserve},
+		map[string]any{"balance": balance + amount, "reserve": reserve - amount, "amount": amount},
+		reason); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return fmt.Errorf("failed to commit add balance: %w", err)
 	}
 
-	log.Printf("Admin %d added %d BKC to user %d: %s", adminID, amount, userID, reason)
+	logger.InfoContext(ctx, "balance added", "admin_id", adminID, "target_user", userID, "amount", amount, "reason", reason)
 
 	return nil
 }
 
-// RemoveBalance удаляет баланс у пользователя (God Mode)
+// RemoveBalance списывает монеты пользователя в резерв (God Mode)
 func (am *AdminManager) RemoveBalance(ctx context.Context, adminID, userID int64, amount int64, reason string) error {
 	if amount <= 0 {
 		return fmt.Errorf("amount must be positive")
@@ -337,15 +710,23 @@ func (am *AdminManager) RemoveBalance(ctx context.Context, adminID, userID int64
 	}
 	defer tx.Rollback(ctx)
 
+	var reserve int64
+	if err := tx.QueryRow(ctx, `SELECT reserve_supply FROM system_state WHERE id=1 FOR UPDATE`).Scan(&reserve); err != nil {
+		return fmt.Errorf("failed to lock reserve: %w", err)
+	}
+
 	// Проверяем баланс
 	var currentBalance int64
 	err = tx.QueryRow(ctx, "SELECT balance FROM users WHERE user_id = $1 FOR UPDATE", userID).Scan(&currentBalance)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get user balance: %w", err)
 	}
 
 	if currentBalance < amount {
-		return fmt.Errorf("insufficient balance: current %d, trying to remove %d", currentBalance, amount)
+		return fmt.Errorf("current %d, trying to remove %d: %w", currentBalance, amount, ErrNotEnough)
 	}
 
 	// Удаляем баланс
@@ -353,49 +734,54 @@ func (am *AdminManager) RemoveBalance(ctx context.Context, adminID, userID int64
 	if err != nil {
 		return fmt.Errorf("failed to remove balance: %w", err)
 	}
+	if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply + $1, updated_at = now() WHERE id=1`, amount); err != nil {
+		return fmt.Errorf("failed to update reserve: %w", err)
+	}
 
 	// Записываем в ledger
+	meta, _ := json.Marshal(map[string]any{"admin_id": adminID, "reason": reason})
 	_, err = tx.Exec(ctx, `
 		INSERT INTO ledger(kind, from_id, to_id, amount, meta)
 		VALUES('admin_remove', $1, NULL, $2, $3::jsonb)
-	`, userID, amount, fmt.Sprintf(`{
-		"admin_id": %d,
-		"reason": "%s"
-	}`, adminID, reason))
+	`, userID, amount, string(meta))
 	if err != nil {
 		return fmt.Errorf("failed to record ledger: %w", err)
 	}
 
-	// Записываем действие God Mode
-	_, err = tx.Exec(ctx, `
-		INSERT INTO god_mode_actions(admin_id, action_type, target_id, amount, reason, created_at)
-		VALUES($1, 'remove_balance', $2, $3, $4, $5)
-	`, adminID, userID, amount, reason, time.Now())
-	if err != nil {
-		return fmt.Errorf("failed to record god mode action: %w", err)
+	// Записываем действие в журнал аудита
+	if err := recordAction(ctx, tx, adminID, "remove_balance", audit.Target("user", userID),
+		map[string]any{"balance": currentBalance, "reserve": reserve},
+		map[string]any{"balance": currentBalance - amount, "reserve": reserve + amount, "amount": amount},
+		reason); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return fmt.Errorf("failed to commit remove balance: %w", err)
 	}
 
-	log.Printf("Admin %d removed %d BKC from user %d: %s", adminID, amount, userID, reason)
+	logger.InfoContext(ctx, "balance removed", "admin_id", adminID, "target_user", userID, "amount", amount, "reason", reason)
 
 	return nil
 }
 
-// GetMarketListings получает объявления маркетплейса
+// GetMarketListings получает объявления маркетплейса. Статус "pending" —
+// активные объявления, которые еще никто не проверял.
 func (am *AdminManager) GetMarketListings(ctx context.Context, status string, limit, offset int) ([]MarketManagement, error) {
 	query := `
-		SELECT ml.id, ml.user_id, u.username, ml.item_type, ml.item_name, 
-		       ml.price, ml.status, ml.is_approved, ml.approved_by, ml.approved_at,
+		SELECT ml.listing_id, ml.seller_id, COALESCE(u.username, ''), ml.category, ml.title,
+		       ml.price_coins, ml.status, ml.approved_by, ml.approved_at,
 		       ml.rejected_by, ml.rejected_at, ml.reject_reason, ml.created_at
 		FROM market_listings ml
-		JOIN users u ON ml.user_id = u.user_id
+		LEFT JOIN users u ON ml.seller_id = u.user_id
 	`
 	args := []interface{}{}
 
-	if status != "" {
+	switch status {
+	case "":
+	case "pending":
+		query += " WHERE ml.status = 'active' AND ml.approved_at IS NULL"
+	default:
 		query += " WHERE ml.status = $1"
 		args = append(args, status)
 	}
@@ -413,26 +799,46 @@ func (am *AdminManager) GetMarketListings(ctx context.Context, status string, li
 	}
 	defer rows.Close()
 
-	var listings []MarketManagement
+	listings := []MarketManagement{}
 	for rows.Next() {
 		var listing MarketManagement
 		err := rows.Scan(
 			&listing.ListingID, &listing.UserID, &listing.Username,
-			&listing.ItemType, &listing.ItemName, &listing.Price,
-			&listing.Status, &listing.IsApproved, &listing.ApprovedBy,
+			&listing.Category, &listing.Title, &listing.Price,
+			&listing.Status, &listing.ApprovedBy,
 			&listing.ApprovedAt, &listing.RejectedBy, &listing.RejectedAt,
 			&listing.RejectReason, &listing.CreatedAt,
 		)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("failed to get market listings: %w", err)
 		}
+		listing.IsApproved = listing.ApprovedAt != nil
 		listings = append(listings, listing)
 	}
 
 	return listings, rows.Err()
 }
 
-// ApproveMarketListing одобряет объявление
+// lockListingState блокирует объявление в одном из статусов statuses и
+// возвращает его состояние для журнала аудита.
+func lockListingState(ctx context.Context, tx pgx.Tx, listingID int64, statuses ...string) (map[string]any, error) {
+	var status string
+	var approved bool
+	err := tx.QueryRow(ctx, `
+		SELECT status, approved_at IS NOT NULL FROM market_listings
+		WHERE listing_id = $1 AND status = ANY($2) FOR UPDATE
+	`, listingID, statuses).Scan(&status, &approved)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get listing: %w", err)
+	}
+	return map[string]any{"status": status, "approved": approved}, nil
+}
+
+// ApproveMarketListing отмечает объявление проверенным; снятое ранее
+// (rejected) возвращается в продажу.
 func (am *AdminManager) ApproveMarketListing(ctx context.Context, adminID, listingID int64) error {
 	tx, err := am.db.Pool.Begin(ctx)
 	if err != nil {
@@ -440,36 +846,38 @@ func (am *AdminManager) ApproveMarketListing(ctx context.Context, adminID, listi
 	}
 	defer tx.Rollback(ctx)
 
+	before, err := lockListingState(ctx, tx, listingID, "active", "rejected")
+	if err != nil {
+		return err
+	}
+
 	// Одобряем объявление
-	now := time.Now()
 	_, err = tx.Exec(ctx, `
-		UPDATE market_listings 
-		SET status = 'active', is_approved = true, approved_by = $1, approved_at = $2
-		WHERE id = $3
-	`, adminID, now, listingID)
+		UPDATE market_listings
+		SET status = 'active', approved_by = $1, approved_at = now(),
+		    rejected_by = NULL, rejected_at = NULL, reject_reason = ''
+		WHERE listing_id = $2
+	`, adminID, listingID)
 	if err != nil {
 		return fmt.Errorf("failed to approve listing: %w", err)
 	}
 
-	// Записываем действие God Mode
-	_, err = tx.Exec(ctx, `
-		INSERT INTO god_mode_actions(admin_id, action_type, target_id, created_at)
-		VALUES($1, 'approve_market', $2, $3)
-	`, adminID, listingID, now)
-	if err != nil {
-		return fmt.Errorf("failed to record god mode action: %w", err)
+	// Записываем действие в журнал аудита
+	after := map[string]any{"status": "active", "approved": true}
+	if err := recordAction(ctx, tx, adminID, "approve_market", audit.Target("listing", listingID), before, after, ""); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return fmt.Errorf("failed to commit approval: %w", err)
 	}
 
-	log.Printf("Admin %d approved market listing %d", adminID, listingID)
+	logger.InfoContext(ctx, "market listing approved", "admin_id", adminID, "listing_id", listingID)
 
 	return nil
 }
 
-// RejectMarketListing отклоняет объявление
+// RejectMarketListing снимает активное объявление с продажи
 func (am *AdminManager) RejectMarketListing(ctx context.Context, adminID, listingID int64, reason string) error {
 	tx, err := am.db.Pool.Begin(ctx)
 	if err != nil {
@@ -477,31 +885,33 @@ func (am *AdminManager) RejectMarketListing(ctx context.Context, adminID, listin
 	}
 	defer tx.Rollback(ctx)
 
+	before, err := lockListingState(ctx, tx, listingID, "active")
+	if err != nil {
+		return err
+	}
+
 	// Отклоняем объявление
-	now := time.Now()
 	_, err = tx.Exec(ctx, `
-		UPDATE market_listings 
-		SET status = 'rejected', is_approved = false, rejected_by = $1, rejected_at = $2, reject_reason = $3
-		WHERE id = $4
-	`, adminID, now, reason, listingID)
+		UPDATE market_listings
+		SET status = 'rejected', approved_by = NULL, approved_at = NULL,
+		    rejected_by = $1, rejected_at = now(), reject_reason = $2
+		WHERE listing_id = $3
+	`, adminID, reason, listingID)
 	if err != nil {
 		return fmt.Errorf("failed to reject listing: %w", err)
 	}
 
-	// Записываем действие God Mode
-	_, err = tx.Exec(ctx, `
-		INSERT INTO god_mode_actions(admin_id, action_type, target_id, reason, created_at)
-		VALUES($1, 'reject_market', $2, $3, $4)
-	`, adminID, listingID, reason, now)
-	if err != nil {
-		return fmt.Errorf("failed to record god mode action: %w", err)
+	// Записываем действие в журнал аудита
+	after := map[string]any{"status": "rejected", "approved": false}
+	if err := recordAction(ctx, tx, adminID, "reject_market", audit.Target("listing", listingID), before, after, reason); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return fmt.Errorf("failed to commit rejection: %w", err)
 	}
 
-	log.Printf("Admin %d rejected market listing %d: %s", adminID, listingID, reason)
+	logger.InfoContext(ctx, "market listing rejected", "admin_id", adminID, "listing_id", listingID, "reason", reason)
 
 	return nil
 }
@@ -509,10 +919,10 @@ func (am *AdminManager) RejectMarketListing(ctx context.Context, adminID, listin
 // GetBankLoans получает кредиты банка
 func (am *AdminManager) GetBankLoans(ctx context.Context, status string, limit, offset int) ([]BankManagement, error) {
 	query := `
-		SELECT bl.id, bl.user_id, u.username, bl.principal, bl.interest_total,
+		SELECT bl.loan_id, bl.user_id, COALESCE(u.username, ''), bl.principal, bl.interest,
 		       bl.total_due, bl.status, bl.due_at, bl.created_at
 		FROM bank_loans bl
-		JOIN users u ON bl.user_id = u.user_id
+		LEFT JOIN users u ON bl.user_id = u.user_id
 	`
 	args := []interface{}{}
 
@@ -534,7 +944,7 @@ func (am *AdminManager) GetBankLoans(ctx context.Context, status string, limit,
 	}
 	defer rows.Close()
 
-	var loans []BankManagement
+	loans := []BankManagement{}
 	for rows.Next() {
 		var loan BankManagement
 		err := rows.Scan(
@@ -543,7 +953,7 @@ func (am *AdminManager) GetBankLoans(ctx context.Context, status string, limit,
 			&loan.Status, &loan.DueAt, &loan.CreatedAt,
 		)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("failed to get bank loans: %w", err)
 		}
 		loans = append(loans, loan)
 	}
@@ -551,43 +961,48 @@ func (am *AdminManager) GetBankLoans(ctx context.Context, status string, limit,
 	return loans, rows.Err()
 }
 
-// GetAnalytics получает аналитику
+// GetAnalytics получает аналитику. Сутки считаются по UTC.
 func (am *AdminManager) GetAnalytics(ctx context.Context) (*Analytics, error) {
 	var analytics Analytics
-
-	// Общая статистика
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM users").Scan(&analytics.TotalUsers)
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE last_active > NOW() - INTERVAL '24 hours'").Scan(&analytics.ActiveUsers)
-	am.db.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(balance), 0) FROM users").Scan(&analytics.TotalBalance)
-	am.db.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(taps_total), 0) FROM users").Scan(&analytics.TotalTaps)
-
-	// NFT статистика
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM user_nfts").Scan(&analytics.TotalNFTs)
-
-	// Кредиты
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM bank_loans WHERE status = 'active'").Scan(&analytics.ActiveLoans)
-	am.db.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(total_due), 0) FROM bank_loans WHERE status = 'active'").Scan(&analytics.TotalDebt)
-
-	// Маркетплейс
-	am.db.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(price), 0) FROM market_listings WHERE status = 'sold'").Scan(&analytics.MarketVolume)
-
-	// Игры
-	am.db.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(system_profit), 0) FROM crash_games").Scan(&analytics.GamesRevenue)
-
-	// Подписки
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE is_subscribed = true").Scan(&analytics.Subscribers)
-
-	// Статистика за сегодня
-	today := time.Now().Truncate(24 * time.Hour)
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE created_at >= $1", today).Scan(&analytics.NewUsersToday)
-	am.db.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(taps_today), 0) FROM user_daily WHERE date = $1", today).Scan(&analytics.TapsToday)
-
-	// Доход за сегодня (сумма всех транзакций с налогом)
-	am.db.Pool.QueryRow(ctx, `
-		SELECT COALESCE(SUM(amount * 0.1), 0) 
-		FROM ledger 
-		WHERE created_at >= $1 AND kind IN ('transfer', 'nft_purchase', 'market_sale')
-	`, today).Scan(&analytics.RevenueToday)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	queries := []struct {
+		dst   *int64
+		query string
+		args  []any
+	}{
+		// Общая статистика
+		{&analytics.TotalUsers, "SELECT COUNT(*) FROM users", nil},
+		{&analytics.ActiveUsers, "SELECT COUNT(DISTINCT user_id) FROM user_daily WHERE updated_at > now() - INTERVAL '24 hours'", nil},
+		{&analytics.TotalBalance, "SELECT COALESCE(SUM(balance), 0) FROM users", nil},
+		{&analytics.TotalTaps, "SELECT COALESCE(SUM(taps_total), 0) FROM users", nil},
+		// NFT
+		{&analytics.TotalNFTs, "SELECT COALESCE(SUM(qty), 0) FROM nft_owns", nil},
+		// Кредиты
+		{&analytics.ActiveLoans, "SELECT COUNT(*) FROM bank_loans WHERE status IN ('active', 'overdue')", nil},
+		{&analytics.TotalDebt, "SELECT COALESCE(SUM(total_due), 0) FROM bank_loans WHERE status IN ('active', 'overdue')", nil},
+		// Маркетплейс
+		{&analytics.MarketVolume, "SELECT COALESCE(SUM(price_coins), 0) FROM market_listings WHERE status = 'sold'", nil},
+		// Игры
+		{&analytics.GamesRevenue, "SELECT COALESCE(SUM(system_profit), 0) FROM crash_games", nil},
+		// Подписки
+		{&analytics.Subscribers, "SELECT COUNT(*) FROM users WHERE is_subscribed = true", nil},
+		// За сегодня
+		{&analytics.NewUsersToday, "SELECT COUNT(*) FROM users WHERE created_at >= $1", []any{today}},
+		{&analytics.TapsToday, "SELECT COALESCE(SUM(tapped), 0) FROM user_daily WHERE day = $1::date", []any{today}},
+		// Доход за сегодня: покупки и комиссии, ушедшие в резерв или сожженные
+		{&analytics.RevenueToday, `
+			SELECT COALESCE(SUM(amount), 0)
+			FROM ledger
+			WHERE ts >= $1 AND kind IN ('buy_energy_1h', 'buy_tap_pack', 'upgrade_level', 'nft_buy',
+			                            'transfer_fee', 'transfer_fee_burn', 'market_listing_fee_burn')
+		`, []any{today}},
+	}
+	for _, q := range queries {
+		if err := am.db.Pool.QueryRow(ctx, q.query, q.args...).Scan(q.dst); err != nil {
+			return nil, fmt.Errorf("failed to get analytics: %w", err)
+		}
+	}
 
 	return &analytics, nil
 }
@@ -598,13 +1013,18 @@ func (am *AdminManager) CheckSubscription(ctx context.Context, userID int64) (*S
 	var expiresAt *time.Time
 
 	err := am.db.Pool.QueryRow(ctx, `
-		SELECT u.user_id, u.username, u.is_subscribed, s.plan_type, s.expires_at
+		SELECT u.user_id, COALESCE(u.username, ''), u.is_subscribed, COALESCE(s.plan_type, ''), s.expires_at
 		FROM users u
 		LEFT JOIN user_subscriptions s ON u.user_id = s.user_id AND s.is_active = true
 		WHERE u.user_id = $1
+		ORDER BY s.expires_at DESC NULLS LAST
+		LIMIT 1
 	`, userID).Scan(&check.UserID, &check.Username, &check.IsSubscribed,
 		&check.PlanType, &expiresAt)
 
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to check subscription: %w", err)
 	}
@@ -615,7 +1035,7 @@ func (am *AdminManager) CheckSubscription(ctx context.Context, userID int64) (*S
 	// Проверяем валидность подписки
 	if check.IsSubscribed && check.ExpiresAt != nil {
 		check.IsValid = time.Now().Before(*check.ExpiresAt)
-		check.DaysRemaining = int(check.ExpiresAt.Sub(time.Now()).Hours() / 24)
+		check.DaysRemaining = int(time.Until(*check.ExpiresAt).Hours() / 24)
 		if check.DaysRemaining < 0 {
 			check.DaysRemaining = 0
 		}
@@ -630,7 +1050,7 @@ func (am *AdminManager) CheckSubscription(ctx context.Context, userID int64) (*S
 			UPDATE users SET is_subscribed = false WHERE user_id = $1
 		`, userID)
 		if err != nil {
-			log.Printf("Failed to deactivate expired subscription for user %d: %v", userID, err)
+			logger.WarnContext(ctx, "expired subscription deactivation failed", "target_user", userID, "err", err)
 		}
 		check.IsSubscribed = false
 	}
@@ -638,82 +1058,49 @@ func (am *AdminManager) CheckSubscription(ctx context.Context, userID int64) (*S
 	return &check, nil
 }
 
-// GetGodModeActions получает действия God Mode
-func (am *AdminManager) GetGodModeActions(ctx context.Context, adminID int64, limit, offset int) ([]GodModeAction, error) {
-	query := `
-		SELECT gma.admin_id, au.username, gma.action_type, gma.target_id, 
-		       gma.amount, gma.reason, gma.metadata, gma.created_at
-		FROM god_mode_actions gma
-		JOIN admin_users au ON gma.admin_id = au.id
-	`
-	args := []interface{}{}
-
-	if adminID > 0 {
-		query += " WHERE gma.admin_id = $1"
-		args = append(args, adminID)
-	}
-
-	query += " ORDER BY gma.created_at DESC"
-
-	if limit > 0 {
-		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
-		args = append(args, limit, offset)
-	}
-
-	rows, err := am.db.Pool.Query(ctx, query, args...)
+// GetGodModeActions получает действия администраторов панели из журнала
+// аудита, новые первыми. adminID = 0 — действия всех администраторов.
+func (am *AdminManager) GetGodModeActions(ctx context.Context, adminID int64, limit, offset int) ([]audit.Entry, error) {
+	actions, err := am.audit.List(ctx, audit.Filter{
+		ActorKind: audit.ActorAdmin,
+		ActorID:   adminID,
+		Limit:     limit,
+		Offset:    offset,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get god mode actions: %w", err)
 	}
-	defer rows.Close()
-
-	var actions []GodModeAction
-	for rows.Next() {
-		var action GodModeAction
-		var adminUsername string
-		err := rows.Scan(
-			&action.AdminID, &adminUsername, &action.ActionType,
-			&action.TargetID, &action.Amount, &action.Reason,
-			&action.Metadata, &action.CreatedAt,
-		)
-		if err != nil {
-			continue
-		}
-		actions = append(actions, action)
-	}
-
-	return actions, rows.Err()
+	return actions, nil
 }
 
 // GetAdminStats получает статистику администраторов
 func (am *AdminManager) GetAdminStats(ctx context.Context) (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
-
-	// Количество администраторов по ролям
-	var superAdmins, admins, moderators int64
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM admin_users WHERE role = 'super_admin' AND is_active = true").Scan(&superAdmins)
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM admin_users WHERE role = 'admin' AND is_active = true").Scan(&admins)
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM admin_users WHERE role = 'moderator' AND is_active = true").Scan(&moderators)
-
-	// Действия God Mode за сегодня
-	today := time.Now().Truncate(24 * time.Hour)
-	var godModeActionsToday int64
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM god_mode_actions WHERE created_at >= $1", today).Scan(&godModeActionsToday)
-
-	// Ожидающие объявления
-	var pendingListings int64
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM market_listings WHERE status = 'pending'").Scan(&pendingListings)
-
-	// Просроченные кредиты
-	var overdueLoans int64
-	am.db.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM bank_loans WHERE status = 'active' AND due_at < NOW()").Scan(&overdueLoans)
-
-	stats["super_admins"] = superAdmins
-	stats["admins"] = admins
-	stats["moderators"] = moderators
-	stats["total_admins"] = superAdmins + admins + moderators
-	stats["god_mode_actions_today"] = godModeActionsToday
-	stats["pending_listings"] = pendingListings
-	stats["overdue_loans"] = overdueLoans
-
-	return stats, nil
+	var superAdmins, admins, moderators, actionsToday, pendingListings, overdueLoans int64
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	err := am.db.Pool.QueryRow(ctx, `
+		SELECT
+		  (SELECT COUNT(*) FROM admin_users WHERE role = 'super_admin' AND is_active),
+		  (SELECT COUNT(*) FROM admin_users WHERE role = 'admin' AND is_active),
+		  (SELECT COUNT(*) FROM admin_users WHERE role = 'moderator' AND is_active),
+		  (SELECT COUNT(*) FROM market_listings WHERE status = 'active' AND approved_at IS NULL),
+		  (SELECT COUNT(*) FROM bank_loans WHERE status = 'overdue' OR (status = 'active' AND due_at < now()))
+	`).Scan(&superAdmins, &admins, &moderators, &pendingListings, &overdueLoans)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin stats: %w", err)
+	}
+	actionsToday, err = am.audit.CountSince(ctx, "", today)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin stats: %w", err)
+	}
+
+	return map[string]interface{}{
+		"super_admins":           superAdmins,
+		"admins":                 admins,
+		"moderators":             moderators,
+		"total_admins":           superAdmins + admins + moderators,
+		"god_mode_actions_today": actionsToday,
+		"pending_listings":       pendingListings,
+		"overdue_loans":          overdueLoans,
+	}, nil
 }
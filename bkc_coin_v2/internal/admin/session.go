@@ -0,0 +1,131 @@
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/audit"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Сессии панели для входа по паролю. Токен "adm1.<hex>" отдается один раз,
+// в admin_sessions хранится только его SHA-256.
+
+const sessionPrefix = "adm1."
+
+// ErrSessionInvalid токен неизвестен, истек, отозван или админ отключен.
+var ErrSessionInvalid = errors.New("admin session invalid")
+
+func sessionTTLFromEnv() time.Duration {
+	hours := int64(12)
+	if v := strings.TrimSpace(os.Getenv("ADMIN_SESSION_TTL_HOURS")); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			hours = n
+		}
+	}
+	if hours < 1 {
+		hours = 1
+	}
+	if hours > 168 {
+		hours = 168
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// IsSessionToken отличает токен панели от токена пользователя (bkc1.).
+func IsSessionToken(s string) bool { return strings.HasPrefix(s, sessionPrefix) }
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession выдает токен панели администратору adminID. Вход пишется в
+// журнал аудита в той же транзакции: без записи сессия не создается.
+func (am *AdminManager) CreateSession(ctx context.Context, adminID int64, ip string) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := sessionPrefix + hex.EncodeToString(b)
+	expiresAt := time.Now().Add(am.sessionTTL)
+
+	tx, err := am.db.Pool.Begin(ctx)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO admin_sessions(token_hash, admin_id, ip, expires_at)
+		VALUES($1, $2, $3, $4)
+	`, hashToken(token), adminID, ip, expiresAt)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create admin session: %w", err)
+	}
+	if err := recordAction(ctx, tx, adminID, "admin_login", audit.Target("admin", adminID), nil, map[string]any{"expires_at": expiresAt.UTC()}, ""); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to commit admin session: %w", err)
+	}
+
+	// Заодно чистим давно истекшие и отозванные сессии
+	if _, err := am.db.Pool.Exec(ctx, `
+		DELETE FROM admin_sessions
+		WHERE expires_at < now() - INTERVAL '7 days' OR revoked_at < now() - INTERVAL '7 days'
+	`); err != nil {
+		logger.WarnContext(ctx, "admin sessions purge failed", "err", err)
+	}
+
+	return token, expiresAt, nil
+}
+
+// SessionAdmin возвращает администратора по действующему токену панели.
+func (am *AdminManager) SessionAdmin(ctx context.Context, token string) (*AdminUser, error) {
+	if !IsSessionToken(token) {
+		return nil, ErrSessionInvalid
+	}
+	admin, err := scanAdmin(am.db.Pool.QueryRow(ctx, `
+		SELECT `+prefixed("a.", adminColumns)+`
+		FROM admin_sessions s
+		JOIN admin_users a ON a.id = s.admin_id
+		WHERE s.token_hash = $1 AND s.revoked_at IS NULL AND s.expires_at > now() AND a.is_active
+	`, hashToken(token)))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrSessionInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check admin session: %w", err)
+	}
+	return admin, nil
+}
+
+// RevokeSession завершает одну сессию панели (выход).
+func (am *AdminManager) RevokeSession(ctx context.Context, token string) error {
+	_, err := am.db.Pool.Exec(ctx, `
+		UPDATE admin_sessions SET revoked_at = now() WHERE token_hash = $1 AND revoked_at IS NULL
+	`, hashToken(token))
+	if err != nil {
+		return fmt.Errorf("failed to revoke admin session: %w", err)
+	}
+	return nil
+}
+
+// prefixed ставит префикс таблицы перед каждым столбцом списка.
+func prefixed(prefix, columns string) string {
+	cols := strings.Split(columns, ",")
+	for i, c := range cols {
+		cols[i] = prefix + strings.TrimSpace(c)
+	}
+	return strings.Join(cols, ", ")
+}
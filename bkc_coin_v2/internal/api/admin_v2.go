@@ -0,0 +1,553 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"bkc_coin_v2/internal/admin"
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/events"
+)
+
+// /admin/v2 is the admin panel API. Callers authenticate with a Bearer
+// token: either a panel session from /admin/v2/login (admin_users password)
+// or a WebApp session of a Telegram account linked to an admin_users row.
+// Each route needs one permission; see AdminManager.HasPermission.
+
+var (
+	errBanned         = apiError{Status: 403, Code: "banned", Text: "account banned"}
+	errAdminForbidden = apiError{Status: 403, Code: "forbidden", Text: "missing permission"}
+	errTargetNotFound = apiError{Status: 404, Code: "user_not_found", Text: "user not found"}
+)
+
+type adminKey struct{}
+
+func adminFrom(r *http.Request) *admin.AdminUser {
+	u, _ := r.Context().Value(adminKey{}).(*admin.AdminUser)
+	return u
+}
+
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// readOptionalJSON is readJSON for bodies that may be left out.
+func readOptionalJSON(r *http.Request, dst any) error {
+	if err := readJSON(r, dst); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (a *API) adminV2Router() http.Handler {
+	r := chi.NewRouter()
+	r.Post("/login", a.adminV2Login)
+	r.Group(func(r chi.Router) {
+		r.Use(a.adminV2Auth)
+		r.Post("/logout", a.adminV2Logout)
+		r.Get("/me", a.adminV2Me)
+
+		r.With(a.requirePerm(admin.PermUsers)).Get("/users", a.adminV2Users)
+		r.With(a.requirePerm(admin.PermUsers)).Get("/users/{id}/subscription", a.adminV2Subscription)
+		r.With(a.requirePerm(admin.PermUsers)).Post("/users/{id}/ban", a.adminV2Ban)
+		r.With(a.requirePerm(admin.PermUsers)).Post("/users/{id}/unban", a.adminV2Unban)
+		r.With(a.requirePerm(admin.PermGodMode)).Post("/users/{id}/balance/add", a.adminV2Balance(true))
+		r.With(a.requirePerm(admin.PermGodMode)).Post("/users/{id}/balance/remove", a.adminV2Balance(false))
+
+		r.With(a.requirePerm(admin.PermMarket)).Get("/market/listings", a.adminV2Listings)
+		r.With(a.requirePerm(admin.PermMarket)).Post("/market/listings/{id}/approve", a.adminV2ListingApprove)
+		r.With(a.requirePerm(admin.PermMarket)).Post("/market/listings/{id}/reject", a.adminV2ListingReject)
+
+		r.With(a.requirePerm(admin.PermBank)).Get("/bank/loans", a.adminV2Loans)
+
+		r.With(a.requirePerm(admin.PermAnalytics)).Get("/analytics", a.adminV2Analytics)
+		r.With(a.requirePerm(admin.PermAnalytics)).Get("/stats", a.adminV2Stats)
+
+		r.With(a.requirePerm(admin.PermGodMode)).Get("/actions", a.adminV2Actions)
+		r.With(a.requirePerm(admin.PermGodMode)).Get("/audit", a.adminV2Audit)
+		r.With(a.requirePerm(admin.PermGodMode)).Get("/audit/verify", a.adminV2AuditVerify)
+		r.With(a.requirePerm(admin.PermGodMode)).Get("/admins", a.adminV2Admins)
+		r.With(a.requirePerm(admin.PermGodMode)).Post("/admins", a.adminV2AdminCreate)
+		r.With(a.requirePerm(admin.PermGodMode)).Post("/admins/{id}", a.adminV2AdminUpdate)
+	})
+	return r
+}
+
+// adminV2Auth resolves the Bearer token to an active admin. A failure is a
+// 401, so the guard counts it towards the IP's auth-fail ban.
+func (a *API) adminV2Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			writeError(w, r, errUnauthorized)
+			return
+		}
+		ctx := r.Context()
+		var adm *admin.AdminUser
+		var err error
+		if admin.IsSessionToken(token) {
+			adm, err = a.Admin.SessionAdmin(ctx, token)
+		} else {
+			user, ok := a.authUserFrom(r, "")
+			if !ok {
+				writeError(w, r, errUnauthorized)
+				return
+			}
+			adm, err = a.Admin.AdminByTelegramID(ctx, user.ID)
+			if errors.Is(err, admin.ErrNotFound) {
+				writeError(w, r, errForbidden)
+				return
+			}
+		}
+		switch {
+		case errors.Is(err, admin.ErrSessionInvalid):
+			writeError(w, r, errUnauthorized)
+			return
+		case err != nil:
+			writeError(w, r, errDB)
+			return
+		}
+		ctx = context.WithValue(ctx, adminKey{}, adm)
+		ctx = audit.WithActor(ctx, audit.Actor{
+			Kind: audit.ActorAdmin, ID: adm.ID, Name: adm.Username, IP: a.Guard.ClientIP(r), Via: "admin_v2",
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (a *API) requirePerm(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !a.Admin.HasPermission(adminFrom(r), perm) {
+				writeError(w, r, errAdminForbidden.with("permission", perm))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type adminV2LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (a *API) adminV2Login(w http.ResponseWriter, r *http.Request) {
+	var req adminV2LoginRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	ctx := r.Context()
+	adm, err := a.Admin.AuthenticateAdmin(ctx, strings.TrimSpace(req.Username), req.Password)
+	if errors.Is(err, admin.ErrInvalidCredentials) {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	actorCtx := audit.WithActor(ctx, audit.Actor{
+		Kind: audit.ActorAdmin, ID: adm.ID, Name: adm.Username, IP: a.Guard.ClientIP(r), Via: "admin_v2",
+	})
+	token, exp, err := a.Admin.CreateSession(actorCtx, adm.ID, a.Guard.ClientIP(r))
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	logger.InfoContext(ctx, "admin login", "admin_id", adm.ID, "username", adm.Username)
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{
+		"token":       token,
+		"expires_at":  exp.UTC(),
+		"admin":       adm,
+		"permissions": admin.EffectivePermissions(adm),
+	}})
+}
+
+// adminV2Logout ends a panel session. WebApp sessions end on /auth/logout.
+func (a *API) adminV2Logout(w http.ResponseWriter, r *http.Request) {
+	token := bearerToken(r)
+	if !admin.IsSessionToken(token) {
+		writeError(w, r, errNoSessionToken)
+		return
+	}
+	if err := a.Admin.RevokeSession(r.Context(), token); err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"revoked": 1}})
+}
+
+func (a *API) adminV2Me(w http.ResponseWriter, r *http.Request) {
+	adm := adminFrom(r)
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{
+		"admin":       adm,
+		"permissions": admin.EffectivePermissions(adm),
+	}})
+}
+
+func pageParams(r *http.Request) (limit, offset int) {
+	limit = int(queryInt(r, "limit", 50))
+	if limit < 1 || limit > 200 {
+		limit = 50
+	}
+	offset = int(queryInt(r, "offset", 0))
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+func idParam(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// writeAdminErr maps AdminManager errors; notFound is the 404 to use.
+func writeAdminErr(w http.ResponseWriter, r *http.Request, err error, notFound apiError) {
+	switch {
+	case errors.Is(err, admin.ErrNotFound):
+		writeError(w, r, notFound)
+	case errors.Is(err, admin.ErrBadParams):
+		writeError(w, r, errBadParams)
+	default:
+		writeError(w, r, errDB)
+	}
+}
+
+func (a *API) adminV2Users(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageParams(r)
+	users, err := a.Admin.GetUsersList(r.Context(), limit, offset, strings.TrimSpace(r.URL.Query().Get("q")))
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"users": users}})
+}
+
+func (a *API) adminV2Subscription(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(r)
+	if !ok {
+		writeError(w, r, badParam("id"))
+		return
+	}
+	check, err := a.Admin.CheckSubscription(r.Context(), id)
+	if err != nil {
+		writeAdminErr(w, r, err, errTargetNotFound)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: check})
+}
+
+type adminV2BanRequest struct {
+	Reason string `json:"reason"`
+	Days   int    `json:"days"` // 0 = permanent
+}
+
+// adminV2Ban bans the user and ends their WebApp sessions. Other nodes pick
+// the ban up within the banned-set TTL.
+func (a *API) adminV2Ban(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(r)
+	if !ok {
+		writeError(w, r, badParam("id"))
+		return
+	}
+	var req adminV2BanRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		writeError(w, r, badParam("reason"))
+		return
+	}
+	if req.Days < 0 || req.Days > 3650 {
+		writeError(w, r, badParam("days"))
+		return
+	}
+	ctx := r.Context()
+	adm := adminFrom(r)
+	if err := a.Admin.BanUser(ctx, adm.ID, id, req.Reason, req.Days); err != nil {
+		writeAdminErr(w, r, err, errTargetNotFound)
+		return
+	}
+	a.invalidateBanned()
+	if a.Sessions != nil {
+		if _, err := a.Sessions.RevokeAll(ctx, id, "banned"); err != nil {
+			logger.WarnContext(ctx, "revoke sessions of banned user failed", "target", id, "err", err)
+		}
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
+}
+
+func (a *API) adminV2Unban(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(r)
+	if !ok {
+		writeError(w, r, badParam("id"))
+		return
+	}
+	if err := a.Admin.UnbanUser(r.Context(), adminFrom(r).ID, id); err != nil {
+		writeAdminErr(w, r, err, errTargetNotFound)
+		return
+	}
+	a.invalidateBanned()
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
+}
+
+type adminV2BalanceRequest struct {
+	Amount int64  `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// adminV2Balance credits the user from the reserve (add) or debits them
+// into it (remove).
+func (a *API) adminV2Balance(add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := idParam(r)
+		if !ok {
+			writeError(w, r, badParam("id"))
+			return
+		}
+		var req adminV2BalanceRequest
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, r, errBadJSON)
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if req.Amount <= 0 {
+			writeError(w, r, badParam("amount"))
+			return
+		}
+		if req.Reason == "" {
+			writeError(w, r, badParam("reason"))
+			return
+		}
+		ctx := r.Context()
+		adm := adminFrom(r)
+		var err error
+		if add {
+			err = a.Admin.AddBalance(ctx, adm.ID, id, req.Amount, req.Reason)
+		} else {
+			err = a.Admin.RemoveBalance(ctx, adm.ID, id, req.Amount, req.Reason)
+		}
+		switch {
+		case errors.Is(err, admin.ErrNotEnough) && add:
+			writeError(w, r, errNotEnoughReserve)
+			return
+		case errors.Is(err, admin.ErrNotEnough):
+			writeError(w, r, a.notEnough(ctx, id, req.Amount))
+			return
+		case err != nil:
+			writeAdminErr(w, r, err, errTargetNotFound)
+			return
+		}
+		if add {
+			if a.FastTap != nil && a.FastTap.Enabled() {
+				_ = a.FastTap.AdjustReserve(ctx, -req.Amount)
+			}
+			a.Events.Publish(id, events.Credit, map[string]any{"amount": req.Amount, "reason": "admin_add"})
+		} else {
+			if a.FastTap != nil && a.FastTap.Enabled() {
+				_ = a.FastTap.AdjustReserve(ctx, req.Amount)
+			}
+			a.Events.Publish(id, events.Debit, map[string]any{"amount": req.Amount, "reason": "admin_remove"})
+		}
+		writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
+	}
+}
+
+func (a *API) adminV2Listings(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageParams(r)
+	listings, err := a.Admin.GetMarketListings(r.Context(), strings.TrimSpace(r.URL.Query().Get("status")), limit, offset)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"listings": listings}})
+}
+
+func (a *API) adminV2ListingApprove(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(r)
+	if !ok {
+		writeError(w, r, badParam("id"))
+		return
+	}
+	if err := a.Admin.ApproveMarketListing(r.Context(), adminFrom(r).ID, id); err != nil {
+		writeAdminErr(w, r, err, errListingNotFound)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
+}
+
+type adminV2RejectRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (a *API) adminV2ListingReject(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(r)
+	if !ok {
+		writeError(w, r, badParam("id"))
+		return
+	}
+	var req adminV2RejectRequest
+	if err := readOptionalJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	if err := a.Admin.RejectMarketListing(r.Context(), adminFrom(r).ID, id, strings.TrimSpace(req.Reason)); err != nil {
+		writeAdminErr(w, r, err, errListingNotFound)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
+}
+
+func (a *API) adminV2Loans(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageParams(r)
+	loans, err := a.Admin.GetBankLoans(r.Context(), strings.TrimSpace(r.URL.Query().Get("status")), limit, offset)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"loans": loans}})
+}
+
+func (a *API) adminV2Analytics(w http.ResponseWriter, r *http.Request) {
+	res, err := a.Admin.GetAnalytics(r.Context())
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: res})
+}
+
+func (a *API) adminV2Stats(w http.ResponseWriter, r *http.Request) {
+	res, err := a.Admin.GetAdminStats(r.Context())
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: res})
+}
+
+func (a *API) adminV2Actions(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageParams(r)
+	actions, err := a.Admin.GetGodModeActions(r.Context(), queryInt(r, "admin_id", 0), limit, offset)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"actions": actions}})
+}
+
+func (a *API) adminV2Admins(w http.ResponseWriter, r *http.Request) {
+	admins, err := a.Admin.ListAdmins(r.Context())
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"admins": admins}})
+}
+
+func (a *API) adminV2AdminCreate(w http.ResponseWriter, r *http.Request) {
+	var req admin.NewAdmin
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Password != "" && len(req.Password) < 10 {
+		writeError(w, r, invalid("password", "password too short"))
+		return
+	}
+	adm, err := a.Admin.CreateAdmin(r.Context(), adminFrom(r).ID, req)
+	if err != nil {
+		writeAdminErr(w, r, err, errNotFound)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: adm})
+}
+
+func (a *API) adminV2AdminUpdate(w http.ResponseWriter, r *http.Request) {
+	id, ok := idParam(r)
+	if !ok {
+		writeError(w, r, badParam("id"))
+		return
+	}
+	var req admin.AdminUpdate
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	if req.Password != nil && *req.Password != "" && len(*req.Password) < 10 {
+		writeError(w, r, invalid("password", "password too short"))
+		return
+	}
+	me := adminFrom(r)
+	// Locking yourself out is never what was meant.
+	if id == me.ID && ((req.IsActive != nil && !*req.IsActive) || (req.Role != nil && *req.Role != me.Role)) {
+		writeError(w, r, badRequest("cannot demote or disable yourself"))
+		return
+	}
+	adm, err := a.Admin.UpdateAdmin(r.Context(), me.ID, id, req)
+	if err != nil {
+		writeAdminErr(w, r, err, errNotFound)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: adm})
+}
+
+// isBanned reports whether the user has a live ban. The set is reloaded at
+// most every 30s; a failed reload keeps the previous one.
+func (a *API) isBanned(ctx context.Context, userID int64) bool {
+	if a.Admin == nil {
+		return false
+	}
+	const ttl = 30 * time.Second
+	now := time.Now()
+
+	a.bannedMu.RLock()
+	if a.bannedIDs != nil && now.Sub(a.bannedAt) < ttl {
+		_, banned := a.bannedIDs[userID]
+		a.bannedMu.RUnlock()
+		return banned
+	}
+	a.bannedMu.RUnlock()
+
+	a.bannedMu.Lock()
+	defer a.bannedMu.Unlock()
+	if a.bannedIDs == nil || now.Sub(a.bannedAt) >= ttl {
+		ids, err := a.Admin.BannedUserIDs(ctx)
+		if err != nil {
+			logger.WarnContext(ctx, "load banned users failed", "err", err)
+			if a.bannedIDs == nil {
+				a.bannedIDs = map[int64]struct{}{}
+			}
+		} else {
+			a.bannedIDs = make(map[int64]struct{}, len(ids))
+			for _, id := range ids {
+				a.bannedIDs[id] = struct{}{}
+			}
+		}
+		a.bannedAt = now
+	}
+	_, banned := a.bannedIDs[userID]
+	return banned
+}
+
+func (a *API) invalidateBanned() {
+	a.bannedMu.Lock()
+	a.bannedAt = time.Time{}
+	a.bannedMu.Unlock()
+}
@@ -7,21 +7,30 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"bkc_coin_v2/internal/address"
+	"bkc_coin_v2/internal/admin"
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/chain"
 	"bkc_coin_v2/internal/config"
 	"bkc_coin_v2/internal/cryptopay"
 	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/events"
 	"bkc_coin_v2/internal/fasttap"
-	"bkc_coin_v2/internal/memtap"
+	"bkc_coin_v2/internal/logx"
 	"bkc_coin_v2/internal/security"
+	"bkc_coin_v2/internal/session"
+	"bkc_coin_v2/internal/store"
+	"bkc_coin_v2/internal/supply"
+	"bkc_coin_v2/internal/tapcore"
 	"bkc_coin_v2/internal/telegram"
 	"bkc_coin_v2/internal/tgbot"
+	"bkc_coin_v2/internal/tokenomics"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/jackc/pgx/v5"
@@ -29,21 +38,44 @@ import (
 
 type API struct {
 	Cfg     config.Config
-	DB      *db.DB
+	DB      store.Store // *db.DB in production; memstore satisfies it too
 	Tg      *tgbot.Bot
 	FastTap *fasttap.Engine
-	MemTap  *memtap.Engine
+	Taps    tapcore.TapBackend
 	Guard   *security.Guard
+	Chain   *chain.Chain
+	Supply  *supply.Auditor
+	Tokens  *tokenomics.TokenomicsManager
+
+	// Sessions issues and checks session tokens; nil means initData only.
+	Sessions *session.Manager
+	// Events pushes per-user events to /events/stream; nil disables it.
+	Events *events.Hub
+	// Reloader applies config file changes on /admin/config/reload.
+	Reloader *config.Reloader
+	// Admin backs the /admin/v2 panel API; nil leaves it unmounted.
+	Admin *admin.AdminManager
+	// Audit records privileged actions; nil skips recording.
+	Audit *audit.Log
 
 	walletsMu       sync.RWMutex
 	walletsCached   map[string]string
 	walletsCachedAt time.Time
+
+	bannedMu  sync.RWMutex
+	bannedIDs map[int64]struct{}
+	bannedAt  time.Time
 }
 
 type envelope struct {
 	OK    bool        `json:"ok"`
 	Error string      `json:"error,omitempty"`
 	Data  interface{} `json:"data,omitempty"`
+
+	// Set by writeError: stable error code, localized message, extras.
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Details interface{} `json:"details,omitempty"`
 }
 
 type stateRequest struct {
@@ -56,13 +88,6 @@ type tapRequest struct {
 	Power    int64  `json:"power"`
 }
 
-type transferRequest struct {
-	InitData  string `json:"init_data"`
-	To        string `json:"to"`
-	ToAddress string `json:"to_address"`
-	Amount    int64  `json:"amount"`
-}
-
 type buyRequest struct {
 	InitData string `json:"init_data"`
 	Item     string `json:"item"`
@@ -85,6 +110,7 @@ type depositProcessRequest struct {
 	InitData  string `json:"init_data"`
 	DepositID int64  `json:"deposit_id"`
 	Approve   bool   `json:"approve"`
+	Reason    string `json:"reason"`
 }
 
 type cryptoPayInvoiceRequest struct {
@@ -112,22 +138,26 @@ type adminNFTCreateRequest struct {
 	ImageURL    string `json:"image_url"`
 	PriceCoins  int64  `json:"price_coins"`
 	SupplyTotal int64  `json:"supply_total"`
+	Reason      string `json:"reason"`
 }
 
 type adminReserveSendRequest struct {
 	InitData string `json:"init_data"`
 	ToUserID int64  `json:"to_user_id"`
 	Amount   int64  `json:"amount"`
+	Reason   string `json:"reason"`
 }
 
 type adminDepositWalletsSetRequest struct {
 	InitData string            `json:"init_data"`
 	Wallets  map[string]string `json:"wallets"`
+	Reason   string            `json:"reason"`
 }
 
 type adminBroadcastRequest struct {
 	InitData string `json:"init_data"`
 	Text     string `json:"text"`
+	Reason   string `json:"reason"`
 }
 
 type bankLoanTakeRequest struct {
@@ -194,22 +224,45 @@ type bankAmountRequest struct {
 type adminMarketListingDeleteRequest struct {
 	InitData  string `json:"init_data"`
 	ListingID int64  `json:"listing_id"`
+	Reason    string `json:"reason"`
 }
 
 func (a *API) Router() http.Handler {
 	r := chi.NewRouter()
+	r.Use(a.requestLogMiddleware)
+	r.Use(a.metricsMiddleware)
 	r.Use(a.corsMiddleware)
+	r.Use(a.localeMiddleware)
 	r.Use(a.securityMiddleware)
-	r.Use(a.memtapConsistencyMiddleware)
+	r.Use(a.supplyHaltMiddleware)
+	r.Use(a.tapConsistencyMiddleware)
 	r.Use(a.apiProfileMiddleware)
 
 	r.Get("/health", a.health)
 	r.Get("/blockchain", a.blockchain)
+	r.Get("/blockchain/blocks", a.blockchainBlocks)
+	r.Get("/blockchain/blocks/{height}", a.blockchainBlock)
+	r.Get("/blockchain/tx/{id}", a.blockchainTx)
+	r.Get("/blockchain/proof/{id}", a.blockchainProof)
 	// WebApp
+	r.Post("/auth/session", a.authSession)
+	r.Post("/auth/refresh", a.authRefresh)
+	r.Post("/auth/logout", a.authLogout)
 	r.Post("/state", a.state)
+	r.Get("/events/stream", a.eventsStream)
 	r.Post("/tap", a.tap)
-	r.Post("/transfer", a.transfer)
-	r.Post("/buy", a.buy)
+	r.Post("/transfer", a.idempotent("/transfer", a.transfer))
+	r.Post("/transfer/preview", a.transferPreview)
+	r.Post("/resolve", a.resolve)
+	r.Post("/standing/create", a.standingCreate)
+	r.Post("/standing/list", a.standingList)
+	r.Post("/standing/pause", a.standingSetStatus(db.StandingPaused))
+	r.Post("/standing/resume", a.standingSetStatus(db.StandingActive))
+	r.Post("/standing/cancel", a.standingSetStatus(db.StandingCancelled))
+	r.Post("/buy", a.idempotent("/buy", a.buy))
+	r.Post("/upgrade/level", a.idempotent("/upgrade/level", a.upgradeLevel))
+	r.Post("/history", a.history)
+	r.Post("/history/export", a.historyExport)
 	// Manual deposits
 	r.Post("/deposit/create", a.depositCreate)
 	r.Post("/deposit/list", a.depositList)
@@ -222,27 +275,27 @@ func (a *API) Router() http.Handler {
 	// NFTs
 	r.Post("/nfts/list", a.nftsList)
 	r.Post("/nfts/my", a.nftsMy)
-	r.Post("/nfts/buy", a.nftBuy)
+	r.Post("/nfts/buy", a.idempotent("/nfts/buy", a.nftBuy))
 	r.Post("/admin/nfts/create", a.adminNFTCreate)
 	// Bank
 	r.Post("/bank/freeze", a.bankFreeze)
 	r.Post("/bank/unfreeze", a.bankUnfreeze)
-	r.Post("/bank/loan/take", a.bankLoanTake)
+	r.Post("/bank/loan/take", a.idempotent("/bank/loan/take", a.bankLoanTake))
 	r.Post("/bank/loan/my", a.bankLoanMy)
-	r.Post("/bank/loan/repay", a.bankLoanRepay)
+	r.Post("/bank/loan/repay", a.idempotent("/bank/loan/repay", a.bankLoanRepay))
 	// P2P loans
-	r.Post("/p2p/loan/request", a.p2pLoanRequest)
+	r.Post("/p2p/loan/request", a.idempotent("/p2p/loan/request", a.p2pLoanRequest))
 	r.Post("/p2p/loan/incoming", a.p2pLoanIncoming)
 	r.Post("/p2p/loan/my", a.p2pLoanMy)
-	r.Post("/p2p/loan/accept", a.p2pLoanAccept)
+	r.Post("/p2p/loan/accept", a.idempotent("/p2p/loan/accept", a.p2pLoanAccept))
 	r.Post("/p2p/loan/reject", a.p2pLoanReject)
-	r.Post("/p2p/loan/repay", a.p2pLoanRepay)
+	r.Post("/p2p/loan/repay", a.idempotent("/p2p/loan/repay", a.p2pLoanRepay))
 	r.Post("/p2p/loan/recall", a.p2pLoanRecall)
 	// Marketplace
 	r.Post("/market/listings/create", a.marketListingCreate)
 	r.Post("/market/listings/list", a.marketListingList)
 	r.Post("/market/listings/my", a.marketListingMy)
-	r.Post("/market/listings/buy", a.marketListingBuy)
+	r.Post("/market/listings/buy", a.idempotent("/market/listings/buy", a.marketListingBuy))
 	r.Post("/market/listings/cancel", a.marketListingCancel)
 	r.Get("/assets/listings/{id}", a.marketListingImage)
 	// Admin
@@ -250,6 +303,16 @@ func (a *API) Router() http.Handler {
 	r.Post("/admin/deposit_wallets/set", a.adminDepositWalletsSet)
 	r.Post("/admin/broadcast", a.adminBroadcast)
 	r.Post("/admin/market/listings/delete", a.adminMarketListingDelete)
+	r.Post("/admin/fasttap/reconcile", a.adminFasttapReconcile)
+	r.Post("/admin/fasttap/dlq/list", a.adminFasttapDLQList)
+	r.Post("/admin/fasttap/dlq/replay", a.adminFasttapDLQReplay)
+	r.Post("/admin/fasttap/dlq/discard", a.adminFasttapDLQDiscard)
+	r.Post("/admin/supply/audit", a.adminSupplyAudit)
+	r.Post("/admin/supply/ack", a.adminSupplyAck)
+	r.Post("/admin/config/reload", a.adminConfigReload)
+	if a.Admin != nil {
+		r.Mount("/admin/v2", a.adminV2Router())
+	}
 
 	return r
 }
@@ -271,6 +334,16 @@ func (w *statusWriter) Write(b []byte) (int, error) {
 	return w.ResponseWriter.Write(b)
 }
 
+// Unwrap lets http.ResponseController reach the connection (event streams).
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// Flush keeps streaming responses (CSV export) working behind the middleware.
+func (w *statusWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
 func (a *API) securityMiddleware(next http.Handler) http.Handler {
 	if a.Guard == nil || !a.Guard.Enabled() {
 		return next
@@ -278,7 +351,7 @@ func (a *API) securityMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := a.Guard.ClientIP(r)
 		if a.Guard.IsBanned(ip) {
-			writeJSON(w, http.StatusTooManyRequests, envelope{OK: false, Error: "too many requests"})
+			writeError(w, r, errTooManyReqs)
 			return
 		}
 
@@ -290,19 +363,19 @@ func (a *API) securityMiddleware(next http.Handler) http.Handler {
 		}
 
 		path := strings.ToLower(strings.TrimSpace(r.URL.Path))
-		isPublic := strings.HasSuffix(path, "/health") || strings.HasSuffix(path, "/blockchain") || path == "/healthz"
+		isPublic := strings.HasSuffix(path, "/health") || isBlockchainPath(path) || path == "/healthz"
 		if isPublic {
 			if !a.Guard.AllowPublic(ip) {
-				writeJSON(w, http.StatusTooManyRequests, envelope{OK: false, Error: "rate limited"})
+				writeError(w, r, errRateLimited)
 				return
 			}
 		} else {
 			if !a.Guard.AllowAPI(ip) {
-				writeJSON(w, http.StatusTooManyRequests, envelope{OK: false, Error: "rate limited"})
+				writeError(w, r, errRateLimited)
 				return
 			}
 			if strings.HasSuffix(path, "/tap") && !a.Guard.AllowTapIP(ip) {
-				writeJSON(w, http.StatusTooManyRequests, envelope{OK: false, Error: "tap rate limited"})
+				writeError(w, r, errTapRateLimited)
 				return
 			}
 		}
@@ -349,17 +422,19 @@ func (a *API) corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func (a *API) memtapConsistencyMiddleware(next http.Handler) http.Handler {
+// tapConsistencyMiddleware flushes buffered taps before any balance-changing
+// request so it sees up-to-date balances in Postgres.
+func (a *API) tapConsistencyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if a.MemTap != nil && a.MemTap.Enabled() && r.Method == http.MethodPost {
+		if a.Taps != nil && r.Method == http.MethodPost {
 			path := strings.ToLower(strings.TrimSpace(r.URL.Path))
 			if !strings.HasSuffix(path, "/tap") &&
 				!strings.HasSuffix(path, "/state") &&
 				!strings.Contains(path, "/cryptopay/webhook") {
 				ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
 				defer cancel()
-				if err := a.MemTap.Flush(ctx); err != nil {
-					writeJSON(w, http.StatusServiceUnavailable, envelope{OK: false, Error: "tap queue busy, retry"})
+				if err := a.Taps.Flush(ctx); err != nil {
+					writeError(w, r, retryLater(http.StatusServiceUnavailable, "tap queue busy, retry"))
 					return
 				}
 			}
@@ -384,7 +459,12 @@ func (a *API) apiProfileMiddleware(next http.Handler) http.Handler {
 			p = "/"
 		}
 		// Always-allowed health endpoints.
-		if p == "/health" || p == "/blockchain" {
+		if p == "/health" || isBlockchainPath(p) {
+			return true
+		}
+		// Every profile serves /state, so every profile hands out sessions.
+		// Events reach every node over Redis, so any node can stream them.
+		if strings.HasPrefix(p, "/auth/") || strings.HasPrefix(p, "/events/") {
 			return true
 		}
 		switch profile {
@@ -396,8 +476,10 @@ func (a *API) apiProfileMiddleware(next http.Handler) http.Handler {
 				strings.HasPrefix(p, "/market/")
 		case "bank":
 			return p == "/state" ||
-				p == "/transfer" ||
+				p == "/transfer" || p == "/transfer/preview" || p == "/resolve" ||
+				p == "/history" || p == "/history/export" ||
 				strings.HasPrefix(p, "/bank/") ||
+				strings.HasPrefix(p, "/standing/") ||
 				strings.HasPrefix(p, "/p2p/") ||
 				strings.HasPrefix(p, "/deposit/") ||
 				strings.HasPrefix(p, "/cryptopay/")
@@ -409,7 +491,7 @@ func (a *API) apiProfileMiddleware(next http.Handler) http.Handler {
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !isAllowed(r.URL.Path) {
-			writeJSON(w, http.StatusNotFound, envelope{OK: false, Error: "endpoint disabled on this node profile"})
+			writeError(w, r, errProfileBlocked)
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -438,24 +520,22 @@ func (a *API) health(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 	defer cancel()
 
-	dbOK := true
-	var one int
-	if err := a.DB.Pool.QueryRow(ctx, `SELECT 1`).Scan(&one); err != nil || one != 1 {
-		dbOK = false
-	}
+	dbOK := a.DB.Ping(ctx) == nil
 
+	backend := ""
+	if a.Taps != nil {
+		backend = a.Taps.Name()
+	}
 	data := map[string]any{
 		"service":         "bkc_coin_v2",
 		"ts":              time.Now().Unix(),
 		"db_ok":           dbOK,
-		"fasttap_enabled": a.FastTap != nil && a.FastTap.Enabled(),
-		"memtap_enabled":  a.MemTap != nil && a.MemTap.Enabled(),
-	}
-	if a.FastTap != nil && a.FastTap.Enabled() {
-		data["fasttap"] = a.FastTap.QueueStats(ctx)
+		"tap_backend":     backend,
+		"fasttap_enabled": backend == "fasttap",
+		"memtap_enabled":  backend == "memtap",
 	}
-	if a.MemTap != nil && a.MemTap.Enabled() {
-		data["memtap"] = a.MemTap.Stats()
+	if a.Taps != nil {
+		data[backend] = a.Taps.Stats(ctx)
 	}
 
 	status := http.StatusOK
@@ -471,33 +551,89 @@ func (a *API) blockchain(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	sys, err := a.DB.GetSystem(ctx)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 
-	var users int64
-	_ = a.DB.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM users`).Scan(&users)
-	var txs int64
-	_ = a.DB.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM ledger`).Scan(&txs)
-	var tapsMinted int64
-	_ = a.DB.Pool.QueryRow(ctx, `SELECT COALESCE(SUM(amount),0) FROM ledger WHERE kind='tap'`).Scan(&tapsMinted)
+	counters, _ := a.DB.GetCounters(ctx)
 
 	rate := coinsPerUSD(sys.ReserveSupply, sys.InitialReserve, sys.StartRateCoinsUSD, sys.MinRateCoinsUSD)
 
+	halving := map[string]any{
+		"epoch":         sys.CurrentHalving,
+		"tap_reward_bp": tapcore.NormalizeRewardBP(sys.TapRewardBP),
+		"total_mined":   sys.TotalMined,
+		"threshold":     sys.HalvingThreshold,
+	}
+	if sys.HalvingThreshold > 0 {
+		next := (sys.CurrentHalving + 1) * sys.HalvingThreshold
+		remaining := next - sys.TotalMined
+		if remaining < 0 {
+			remaining = 0
+		}
+		halving["next_at_mined"] = next
+		halving["remaining"] = remaining
+	}
+
+	var chainHead map[string]any
+	if a.Chain != nil {
+		if head, err := a.Chain.Head(ctx); err == nil && head != nil {
+			chainHead = map[string]any{"height": head.Height, "hash": head.Hash, "sealed_at": head.CreatedAt.Unix()}
+		}
+	}
+
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{
 		"total_supply":    sys.TotalSupply,
 		"reserve_supply":  sys.ReserveSupply,
 		"reserved_supply": sys.ReservedSupply,
-		"users":           users,
-		"txs":             txs,
-		"taps_minted":     tapsMinted,
+		"users":           counters.Users,
+		"txs":             counters.LedgerRows,
+		"taps_minted":     counters.TapsMinted,
 		"coins_per_usd":   rate,
+		"halving":         halving,
+		"chain":           chainHead,
 		"ts":              time.Now().Unix(),
 	}})
 }
 
-func (a *API) authUserFrom(initData string) (telegram.AuthUser, bool) {
-	return telegram.VerifyWebAppInitData(initData, a.Cfg.BotToken)
+// authUserFrom authenticates a WebApp request. A session access token is
+// taken from "Authorization: Bearer" or from init_data itself, so old clients
+// keep working while they migrate; raw initData is still accepted unless
+// AUTH_REQUIRE_SESSION is set.
+func (a *API) authUserFrom(r *http.Request, initData string) (telegram.AuthUser, bool) {
+	if token := sessionToken(r, initData); token != "" {
+		if a.Sessions == nil {
+			return telegram.AuthUser{}, false
+		}
+		c, err := a.Sessions.Verify(token, time.Now())
+		if err != nil {
+			return telegram.AuthUser{}, false
+		}
+		if a.isBanned(r.Context(), c.UserID) {
+			return telegram.AuthUser{}, false
+		}
+		setRequestLanguage(r, c.Lang)
+		logx.SetUser(r.Context(), c.UserID)
+		return telegram.AuthUser{ID: c.UserID, Username: c.Username, FirstName: c.FirstName, LanguageCode: c.Lang}, true
+	}
+	if a.Sessions != nil && a.Sessions.Config().RequireSession {
+		return telegram.AuthUser{}, false
+	}
+	user, ok := telegram.VerifyWebAppInitData(initData, a.Cfg.BotToken)
+	if !ok {
+		return telegram.AuthUser{}, false
+	}
+	if a.Sessions != nil {
+		if maxAge := a.Sessions.Config().LegacyMaxAge; maxAge > 0 && !freshAuthDate(user.AuthDate, maxAge, time.Now()) {
+			return telegram.AuthUser{}, false
+		}
+	}
+	if a.isBanned(r.Context(), user.ID) {
+		return telegram.AuthUser{}, false
+	}
+	setRequestLanguage(r, user.LanguageCode)
+	logx.SetUser(r.Context(), user.ID)
+	return user, true
 }
 
 func copyStringMap(src map[string]string) map[string]string {
@@ -546,104 +682,73 @@ func (a *API) getDepositWallets(ctx context.Context) map[string]string {
 }
 
 func (a *API) buildUserState(ctx context.Context, user telegram.AuthUser) (map[string]any, error) {
+	econ := config.Econ()
 	// Ensure user exists.
-	u, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax))
+	u, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(econ.EnergyMax))
 	if err != nil {
 		return nil, err
 	}
 
 	now := time.Now().UTC()
-	var (
-		eMax      float64
-		newEnergy float64
-		memSnap   memtap.UserSnapshot
-		hasMemTap bool
-	)
-	if a.MemTap != nil && a.MemTap.Enabled() {
-		memSnap, hasMemTap = a.MemTap.SnapshotIfPending(user.ID, now)
-	}
-
-	if hasMemTap {
-		u.Balance = memSnap.Balance
-		u.TapsTotal = memSnap.TapsTotal
-		eMax = float64(memSnap.EnergyMax)
-		newEnergy = float64(memSnap.Energy)
-	} else {
-		// Regen energy and persist only when there is no pending in-memory tap state.
-		var regen float64
-		eMax, regen = a.effectiveEnergyParams(u, now)
-		newEnergy = regenEnergy(u.Energy, eMax, regen, u.EnergyUpdatedAt, now)
-		if math.Abs(newEnergy-u.Energy) > 0.0001 || now.Sub(u.EnergyUpdatedAt) > 2*time.Second {
-			_, _ = a.DB.Pool.Exec(ctx, `UPDATE users SET energy=$1, energy_updated_at=$2 WHERE user_id=$3`, newEnergy, now, user.ID)
-			u.Energy = newEnergy
-			u.EnergyUpdatedAt = now
-		}
+	snap, err := a.Taps.Snapshot(ctx, u, now)
+	if err != nil {
+		return nil, err
 	}
 
 	sys, err := a.DB.GetSystem(ctx)
 	if err != nil {
 		return nil, err
 	}
-
+	if rs, ok := a.Taps.(tapcore.ReserveSnapshotter); ok {
+		if res, pending := rs.ReserveSnapshot(); pending {
+			sys.ReserveSupply = res.Reserve
+			sys.InitialReserve = res.InitialReserve
+			sys.StartRateCoinsUSD = res.StartRate
+			sys.MinRateCoinsUSD = res.MinRate
+		}
+	}
 	rate := coinsPerUSD(sys.ReserveSupply, sys.InitialReserve, sys.StartRateCoinsUSD, sys.MinRateCoinsUSD)
 
-	ud, err := a.DB.GetUserDaily(ctx, user.ID, now)
-	if err != nil {
-		return nil, err
-	}
-	dailyLimit := a.Cfg.TapDailyLimit
+	dailyLimit := econ.TapDailyLimit
 	if dailyLimit < 0 {
 		dailyLimit = 0
 	}
-	dailyMax := dailyLimit + ud.ExtraQuota
-	dailyRemaining := dailyMax - ud.Tapped
-	if dailyRemaining < 0 {
-		dailyRemaining = 0
-	}
-
-	if hasMemTap {
-		ud.Tapped = memSnap.DailyTapped
-		ud.ExtraQuota = memSnap.DailyExtra
-		dailyRemaining = memSnap.DailyRemaining
-	}
-	if a.MemTap != nil && a.MemTap.Enabled() {
-		if reserve, initialReserve, startRate, minRate, ok := a.MemTap.ReserveSnapshotIfPending(); ok {
-			rate = coinsPerUSD(reserve, initialReserve, startRate, minRate)
-			sys.ReserveSupply = reserve
-		}
-	}
 
 	data := map[string]any{
 		"user_id":         user.ID,
 		"username":        user.Username,
 		"first_name":      user.FirstName,
 		"is_admin":        user.ID == a.Cfg.AdminID,
-		"address":         fmtAddress(user.ID),
-		"balance":         u.Balance,
+		"address":         address.Format(user.ID),
+		"balance":         snap.Balance,
 		"frozen_balance":  u.FrozenBalance,
-		"taps_total":      u.TapsTotal,
-		"energy":          int64(math.Floor(u.Energy)),
-		"energy_max":      int64(math.Floor(eMax)),
+		"taps_total":      snap.TapsTotal,
+		"level":           snap.Level,
+		"tap_power":       snap.TapPower,
+		"tap_reward_bp":   tapcore.NormalizeRewardBP(sys.TapRewardBP),
+		"next_level":      nextLevelInfo(snap.Level),
+		"energy":          snap.Energy,
+		"energy_max":      snap.EnergyMax,
 		"coins_per_usd":   rate,
 		"referrals":       u.ReferralsCount,
 		"ref_bonus_total": u.ReferralBonusTotal,
 		"tap": map[string]any{
 			"daily_limit":       dailyLimit,
-			"daily_tapped":      ud.Tapped,
-			"daily_extra_quota": ud.ExtraQuota,
-			"daily_remaining":   dailyRemaining,
-			"pack_size":         a.Cfg.ExtraTapsPackSize,
+			"daily_tapped":      snap.DailyTapped,
+			"daily_extra_quota": snap.DailyExtra,
+			"daily_remaining":   snap.DailyRemaining,
+			"pack_size":         econ.ExtraTapsPackSize,
 		},
 		"bank": map[string]any{
-			"loan_max_amount":        a.Cfg.BankLoanMaxAmount,
-			"loan_7d_interest_bp":    a.Cfg.BankLoan7DInterestBP,
-			"loan_30d_interest_bp":   a.Cfg.BankLoan30DInterestBP,
+			"loan_max_amount":        econ.BankLoanMaxAmount,
+			"loan_7d_interest_bp":    econ.BankLoan7DInterestBP,
+			"loan_30d_interest_bp":   econ.BankLoan30DInterestBP,
 			"p2p_recall_min_days":    a.Cfg.P2PRecallMinDays,
-			"market_listing_fee_bkc": a.Cfg.MarketListingFeeCoins,
+			"market_listing_fee_bkc": econ.MarketListingFeeCoins,
 		},
 		"prices": map[string]any{
-			"ENERGY_1H": a.Cfg.EnergyBoost1HPriceCoins,
-			"TAP_PACK":  a.Cfg.ExtraTapsPackPriceCoins,
+			"ENERGY_1H": econ.EnergyBoost1HPriceCoins,
+			"TAP_PACK":  econ.ExtraTapsPackPriceCoins,
 		},
 		"ts": time.Now().Unix(),
 	}
@@ -667,36 +772,41 @@ func (a *API) buildUserState(ctx context.Context, user telegram.AuthUser) (map[s
 func (a *API) state(w http.ResponseWriter, r *http.Request) {
 	var req stateRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	data, err := a.buildUserState(r.Context(), user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
+	if user.PhotoURL != "" {
+		// Best effort: the avatar is only used by /resolve.
+		_ = a.DB.SetUserPhoto(r.Context(), user.ID, user.PhotoURL)
+	}
 	writeJSON(w, 200, envelope{OK: true, Data: data})
 }
 
 func (a *API) tap(w http.ResponseWriter, r *http.Request) {
+	econ := config.Econ()
 	var req tapRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if a.Guard != nil && a.Guard.Enabled() {
 		if !a.Guard.AllowTapUser(user.ID) {
-			writeJSON(w, http.StatusTooManyRequests, envelope{OK: false, Error: "tap rate limited"})
+			writeError(w, r, errTapRateLimited)
 			return
 		}
 	}
@@ -705,288 +815,70 @@ func (a *API) tap(w http.ResponseWriter, r *http.Request) {
 	if requested <= 0 {
 		requested = req.Power
 	}
-	if requested <= 0 {
-		requested = 1
-	}
-	if requested > a.Cfg.TapMaxPerRequest {
-		requested = a.Cfg.TapMaxPerRequest
-	}
-
-	ctx := r.Context()
-	now := time.Now().UTC()
-
-	// Fast path (Redis): returns a compact response used by the webapp to reconcile optimistic taps.
-	if a.FastTap != nil && a.FastTap.Enabled() {
-		if err := a.FastTap.EnsureSystemCached(ctx); err != nil {
-			writeJSON(w, 500, envelope{OK: false, Error: "fasttap system error"})
-			return
-		}
-		if err := a.FastTap.EnsureUserCached(ctx, user.ID, user.Username, user.FirstName, now); err != nil {
-			writeJSON(w, 500, envelope{OK: false, Error: "fasttap user error"})
-			return
-		}
-		res, err := a.FastTap.Tap(ctx, user.ID, requested, now)
-		if err != nil {
-			writeJSON(w, 500, envelope{OK: false, Error: "fasttap failed"})
-			return
-		}
-		writeJSON(w, 200, envelope{OK: true, Data: map[string]any{
-			"gained":     res.Gained,
-			"tap_reason": res.Reason,
-			"energy":     res.Energy,
-			"energy_max": res.EnergyMax,
-			"tap": map[string]any{
-				"daily_limit":       a.Cfg.TapDailyLimit,
-				"daily_tapped":      res.DailyTapped,
-				"daily_extra_quota": res.DailyExtra,
-				"daily_remaining":   res.DailyRemaining,
-				"pack_size":         a.Cfg.ExtraTapsPackSize,
-			},
-			"ts": time.Now().Unix(),
-		}})
-		return
-	}
-
-	// Fast path (in-memory + periodic Postgres flush): no external Redis required.
-	if a.MemTap != nil && a.MemTap.Enabled() {
-		res, err := a.MemTap.Tap(ctx, user.ID, user.Username, user.FirstName, requested, now)
-		if err != nil {
-			writeJSON(w, 500, envelope{OK: false, Error: "memtap failed"})
-			return
-		}
-		writeJSON(w, 200, envelope{OK: true, Data: map[string]any{
-			"gained":     res.Gained,
-			"tap_reason": res.Reason,
-			"energy":     res.Energy,
-			"energy_max": res.EnergyMax,
-			"tap": map[string]any{
-				"daily_limit":       a.Cfg.TapDailyLimit,
-				"daily_tapped":      res.DailyTapped,
-				"daily_extra_quota": res.DailyExtra,
-				"daily_remaining":   res.DailyRemaining,
-				"pack_size":         a.Cfg.ExtraTapsPackSize,
-			},
-			"ts": time.Now().Unix(),
-		}})
-		return
-	}
-
-	// DB path (fallback): tap is applied immediately in Postgres.
-	_, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax))
-	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
-		return
-	}
-
-	var gained int64
-	tapReason := "ok"
-
-	err = a.DB.WithTx(ctx, func(tx pgx.Tx) error {
-		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-
-		// Lock system reserve first (avoid deadlocks with other reserve ops).
-		var reserve int64
-		var reserved int64
-		if err := tx.QueryRow(ctx, `SELECT reserve_supply, reserved_supply FROM system_state WHERE id=1 FOR UPDATE`).Scan(&reserve, &reserved); err != nil {
-			return err
-		}
-		availableReserve := reserve - reserved
-		if availableReserve < 0 {
-			availableReserve = 0
-		}
-
-		// Lock user
-		var bal int64
-		var energy float64
-		var energyMax float64
-		var updatedAt time.Time
-		var boostUntil time.Time
-		var regenMult float64
-		var maxMult float64
-		if err := tx.QueryRow(ctx, `
-SELECT balance, energy, energy_max, energy_updated_at,
-       COALESCE(energy_boost_until, to_timestamp(0)), energy_boost_regen_multiplier, energy_boost_max_multiplier
-FROM users
-WHERE user_id=$1
-FOR UPDATE
-`, user.ID).Scan(&bal, &energy, &energyMax, &updatedAt, &boostUntil, &regenMult, &maxMult); err != nil {
-			return err
-		}
-
-		eMax := energyMax
-		eRegen := a.Cfg.EnergyRegenPerSec
-		if now.Before(boostUntil) {
-			eMax = eMax * maxMult
-			eRegen = eRegen * regenMult
-		}
-		energy = regenEnergy(energy, eMax, eRegen, updatedAt, now)
-
-		mintable := int64(math.Floor(energy))
-		if mintable < 0 {
-			mintable = 0
-		}
-
-		remainingDaily := int64(1 << 62)
-		if a.Cfg.TapDailyLimit > 0 {
-			if _, err := tx.Exec(ctx, `INSERT INTO user_daily(user_id, day) VALUES($1,$2) ON CONFLICT DO NOTHING`, user.ID, day); err != nil {
-				return err
-			}
-			var tapped int64
-			var extraQuota int64
-			if err := tx.QueryRow(ctx, `SELECT tapped, extra_quota FROM user_daily WHERE user_id=$1 AND day=$2 FOR UPDATE`, user.ID, day).Scan(&tapped, &extraQuota); err != nil {
-				return err
-			}
-			remainingDaily = (a.Cfg.TapDailyLimit + extraQuota) - tapped
-			if remainingDaily < 0 {
-				remainingDaily = 0
-			}
-		}
 
-		gained = min3(requested, mintable, remainingDaily)
-		if gained > availableReserve {
-			gained = availableReserve
-		}
-		if gained < 0 {
-			gained = 0
-		}
-
-		if gained == 0 {
-			if a.Cfg.TapDailyLimit > 0 && remainingDaily == 0 && mintable > 0 {
-				tapReason = "daily_limit"
-			} else if availableReserve == 0 && mintable > 0 && remainingDaily > 0 {
-				tapReason = "reserve_empty"
-			} else if mintable <= 0 {
-				tapReason = "no_energy"
-			} else {
-				tapReason = "zero"
-			}
-		}
-		energy = energy - float64(gained)
-		if energy < 0 {
-			energy = 0
-		}
-
-		if gained > 0 {
-			// Move coins out of reserve.
-			if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply - $1, updated_at=now() WHERE id=1`, gained); err != nil {
-				return err
-			}
-			if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance + $1, taps_total = taps_total + $1 WHERE user_id=$2`, gained, user.ID); err != nil {
-				return err
-			}
-			if a.Cfg.TapDailyLimit > 0 {
-				if _, err := tx.Exec(ctx, `UPDATE user_daily SET tapped=tapped+$1, updated_at=now() WHERE user_id=$2 AND day=$3`, gained, user.ID, day); err != nil {
-					return err
-				}
-			}
-			_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('tap', NULL, $1, $2, $3::jsonb)`, user.ID, gained, toJSON(map[string]any{"req": requested}))
-			if err != nil {
-				return err
-			}
-		}
-
-		_, err := tx.Exec(ctx, `UPDATE users SET energy=$1, energy_updated_at=$2 WHERE user_id=$3`, energy, now, user.ID)
-		return err
-	})
+	res, err := a.Taps.Tap(r.Context(), user.ID, user.Username, user.FirstName, requested, time.Now().UTC())
 	if err != nil {
-		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"gained": 0}})
+		var notOwner *tapcore.NotOwnerError
+		if errors.As(err, &notOwner) {
+			a.forwardTap(w, r, req, notOwner)
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "tap failed"})
-		return
-	}
-
-	data, err := a.buildUserState(ctx, user)
-	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, failed("tap failed"))
 		return
 	}
-	data["gained"] = gained
-	data["tap_reason"] = tapReason
-	writeJSON(w, 200, envelope{OK: true, Data: data})
-}
-
-func (a *API) transfer(w http.ResponseWriter, r *http.Request) {
-	var req transferRequest
-	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
-		return
-	}
-	user, ok := a.authUserFrom(req.InitData)
-	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
-		return
-	}
-
-	amount := req.Amount
-	if amount <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "amount must be > 0"})
-		return
-	}
-
-	toRaw := strings.TrimSpace(req.To)
-	if toRaw == "" {
-		toRaw = strings.TrimSpace(req.ToAddress)
-	}
-	toID, err := parseUserID(toRaw)
-	if err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "invalid recipient"})
-		return
-	}
-
-	ctx := r.Context()
-	_, err = a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax))
-	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
-		return
-	}
-
-	// receiver must exist
-	_, err = a.DB.GetUser(ctx, toID)
-	if err != nil {
-		writeJSON(w, 404, envelope{OK: false, Error: "recipient not found"})
-		return
-	}
-
-	if err := a.DB.Transfer(ctx, user.ID, toID, amount); err != nil {
-		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough balance"})
+	observeTap(a.Taps.Name(), res)
+	if _, ok := a.Taps.(*tapcore.PostgresBackend); ok {
+		// WebApp clients on the Postgres path expect the full user state.
+		data, err := a.buildUserState(r.Context(), user)
+		if err != nil {
+			writeError(w, r, errServer)
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "transfer failed"})
-		return
-	}
-
-	data, err := a.buildUserState(ctx, user)
-	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		data["gained"] = res.Gained
+		data["tap_reason"] = res.Reason
+		writeJSON(w, 200, envelope{OK: true, Data: data})
 		return
 	}
-	writeJSON(w, 200, envelope{OK: true, Data: data})
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{
+		"gained":        res.Gained,
+		"taps":          res.Taps,
+		"tap_power":     res.TapPower,
+		"tap_reward_bp": res.RewardBP,
+		"tap_reason":    res.Reason,
+		"energy":        res.Energy,
+		"energy_max":    res.EnergyMax,
+		"tap": map[string]any{
+			"daily_limit":       econ.TapDailyLimit,
+			"daily_tapped":      res.DailyTapped,
+			"daily_extra_quota": res.DailyExtra,
+			"daily_remaining":   res.DailyRemaining,
+			"pack_size":         econ.ExtraTapsPackSize,
+		},
+		"ts": time.Now().Unix(),
+	}})
 }
 
 func (a *API) depositCreate(w http.ResponseWriter, r *http.Request) {
 	var req depositCreateRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 
 	amountUSD := req.AmountUSD
 	if amountUSD <= 0 || amountUSD > 1_000_000 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad amount_usd"})
+		writeError(w, r, badParam("amount_usd"))
 		return
 	}
 
 	txHash := strings.TrimSpace(req.TxHash)
 	if len(txHash) < 6 || len(txHash) > 200 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad tx_hash"})
+		writeError(w, r, badParam("tx_hash"))
 		return
 	}
 
@@ -996,31 +888,31 @@ func (a *API) depositCreate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := r.Context()
-	_, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax))
+	_, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(config.Econ().EnergyMax))
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 
 	sys, err := a.DB.GetSystem(ctx)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	rate := coinsPerUSD(sys.ReserveSupply, sys.InitialReserve, sys.StartRateCoinsUSD, sys.MinRateCoinsUSD)
 	coins := amountUSD * rate
 	if coins <= 0 {
-		writeJSON(w, 500, envelope{OK: false, Error: "rate error"})
+		writeError(w, r, failed("rate error"))
 		return
 	}
 
 	depositID, err := a.DB.CreateDeposit(ctx, user.ID, txHash, amountUSD, currency, coins)
 	if err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough reserve"})
+			writeError(w, r, errNotEnoughReserve)
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "deposit create failed"})
+		writeError(w, r, failed("deposit create failed"))
 		return
 	}
 	if a.FastTap != nil && a.FastTap.Enabled() {
@@ -1029,7 +921,7 @@ func (a *API) depositCreate(w http.ResponseWriter, r *http.Request) {
 
 	state, err := a.buildUserState(ctx, user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	state["deposit"] = map[string]any{
@@ -1045,22 +937,22 @@ func (a *API) depositCreate(w http.ResponseWriter, r *http.Request) {
 func (a *API) depositList(w http.ResponseWriter, r *http.Request) {
 	var req depositListRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if user.ID != a.Cfg.AdminID {
-		writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+		writeError(w, r, errForbidden)
 		return
 	}
 
 	items, err := a.DB.ListDeposits(r.Context(), req.Status, req.Limit)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"items": items}})
@@ -1069,43 +961,60 @@ func (a *API) depositList(w http.ResponseWriter, r *http.Request) {
 func (a *API) depositProcess(w http.ResponseWriter, r *http.Request) {
 	var req depositProcessRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if user.ID != a.Cfg.AdminID {
-		writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+		writeError(w, r, errForbidden)
 		return
 	}
 	if req.DepositID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad deposit_id"})
+		writeError(w, r, badParam("deposit_id"))
 		return
 	}
 
 	ctx := r.Context()
+	entry := audit.Entry{
+		Action: "deposit_reject",
+		Target: audit.Target("deposit", req.DepositID),
+		Reason: strings.TrimSpace(req.Reason),
+	}
+	if req.Approve {
+		entry.Action = "deposit_approve"
+	}
+	// The hook runs only if the deposit was pending and is now processed;
+	// Redis reserve accounting and the user's event need it as it was.
 	var before db.Deposit
-	if a.FastTap != nil && a.FastTap.Enabled() {
-		// For Redis reserve accounting we need to know how many coins were reserved.
-		if dps, err := a.DB.GetDeposit(ctx, req.DepositID); err == nil {
+	var processed bool
+	audited := a.auditHook(r, user, entry)
+	err := a.DB.ProcessDeposit(ctx, req.DepositID, user.ID, req.Approve, func(ctx context.Context, tx pgx.Tx, b, after any) error {
+		if dps, ok := b.(db.Deposit); ok {
 			before = dps
 		}
-	}
-
-	err := a.DB.ProcessDeposit(ctx, req.DepositID, user.ID, req.Approve)
+		processed = true
+		if audited == nil {
+			return nil
+		}
+		return audited(ctx, tx, b, after)
+	})
 	if err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough reserve"})
+			writeError(w, r, errNotEnoughReserve)
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "process failed"})
+		writeError(w, r, failed("process failed"))
 		return
 	}
+	if req.Approve && processed {
+		a.Events.Publish(before.UserID, events.DepositCredited, map[string]any{"deposit_id": before.DepositID, "coins": before.Coins, "source": "manual"})
+	}
 	if a.FastTap != nil && a.FastTap.Enabled() {
-		if strings.ToLower(strings.TrimSpace(before.Status)) == "pending" && before.Coins > 0 {
+		if processed && before.Coins > 0 {
 			if req.Approve {
 				_ = a.FastTap.AdjustReserve(ctx, -before.Coins)
 				_ = a.FastTap.AdjustReserved(ctx, -before.Coins)
@@ -1119,48 +1028,48 @@ func (a *API) depositProcess(w http.ResponseWriter, r *http.Request) {
 
 func (a *API) cryptoPayInvoice(w http.ResponseWriter, r *http.Request) {
 	if strings.TrimSpace(a.Cfg.CryptoPayToken) == "" {
-		writeJSON(w, 400, envelope{OK: false, Error: "cryptopay disabled"})
+		writeError(w, r, featureDisabled(400, "cryptopay", "cryptopay disabled"))
 		return
 	}
 
 	var req cryptoPayInvoiceRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	usd := req.AmountUSD
 	if usd <= 0 || usd > 10_000 {
-		writeJSON(w, 400, envelope{OK: false, Error: "amount_usd must be 1..10000"})
+		writeError(w, r, invalid("amount_usd", "amount_usd must be 1..10000").with("min", 1, "max", 10000))
 		return
 	}
 
 	ctx := r.Context()
-	_, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax))
+	_, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(config.Econ().EnergyMax))
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 
 	sys, err := a.DB.GetSystem(ctx)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 
 	rate := coinsPerUSD(sys.ReserveSupply, sys.InitialReserve, sys.StartRateCoinsUSD, sys.MinRateCoinsUSD)
 	coins := usd * rate
 	if coins <= 0 {
-		writeJSON(w, 500, envelope{OK: false, Error: "rate error"})
+		writeError(w, r, failed("rate error"))
 		return
 	}
 	available := sys.ReserveSupply - sys.ReservedSupply
 	if available < coins {
-		writeJSON(w, 400, envelope{OK: false, Error: "not enough reserve"})
+		writeError(w, r, errNotEnoughReserve)
 		return
 	}
 
@@ -1179,16 +1088,16 @@ func (a *API) cryptoPayInvoice(w http.ResponseWriter, r *http.Request) {
 		AllowAnonymous: true,
 	})
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "cryptopay createInvoice failed"})
+		writeError(w, r, upstreamFailed("cryptopay createInvoice failed"))
 		return
 	}
 
 	if err := a.DB.CreateCryptoPayInvoice(ctx, inv.InvoiceID, user.ID, usd, coins, inv.Status); err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough reserve"})
+			writeError(w, r, errNotEnoughReserve)
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	if a.FastTap != nil && a.FastTap.Enabled() {
@@ -1215,49 +1124,52 @@ func (a *API) cryptoPayInvoice(w http.ResponseWriter, r *http.Request) {
 
 func (a *API) cryptoPayCheck(w http.ResponseWriter, r *http.Request) {
 	if strings.TrimSpace(a.Cfg.CryptoPayToken) == "" {
-		writeJSON(w, 400, envelope{OK: false, Error: "cryptopay disabled"})
+		writeError(w, r, featureDisabled(400, "cryptopay", "cryptopay disabled"))
 		return
 	}
 
 	var req cryptoPayCheckRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if req.InvoiceID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad invoice_id"})
+		writeError(w, r, badParam("invoice_id"))
 		return
 	}
 
 	ctx := r.Context()
 	invRow, err := a.DB.GetCryptoPayInvoice(ctx, req.InvoiceID)
 	if err != nil {
-		writeJSON(w, 404, envelope{OK: false, Error: "invoice not found"})
+		writeError(w, r, errInvoiceNotFound)
 		return
 	}
 	if invRow.UserID != user.ID && user.ID != a.Cfg.AdminID {
-		writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+		writeError(w, r, errForbidden)
 		return
 	}
 
 	client := cryptopay.New(a.Cfg.CryptoPayToken)
 	items, err := client.GetInvoices(ctx, fmt.Sprintf("%d", req.InvoiceID))
 	if err != nil || len(items) == 0 {
-		writeJSON(w, 500, envelope{OK: false, Error: "cryptopay getInvoices failed"})
+		writeError(w, r, upstreamFailed("cryptopay getInvoices failed"))
 		return
 	}
 
 	status := items[0].Status
 	credited, finalStatus, err := a.DB.ProcessCryptoPayStatus(ctx, req.InvoiceID, status, time.Now().UTC())
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "process failed"})
+		writeError(w, r, failed("process failed"))
 		return
 	}
+	if credited > 0 {
+		a.Events.Publish(invRow.UserID, events.DepositCredited, map[string]any{"invoice_id": req.InvoiceID, "coins": credited, "source": "cryptopay"})
+	}
 	if a.FastTap != nil && a.FastTap.Enabled() {
 		if credited > 0 {
 			_ = a.FastTap.AdjustReserve(ctx, -credited)
@@ -1275,7 +1187,7 @@ func (a *API) cryptoPayCheck(w http.ResponseWriter, r *http.Request) {
 
 	state, err := a.buildUserState(ctx, user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	state["cryptopay"] = map[string]any{
@@ -1290,35 +1202,40 @@ func (a *API) cryptoPayWebhook(w http.ResponseWriter, r *http.Request) {
 	// Optional secret in path
 	secret := chi.URLParam(r, "secret")
 	if strings.TrimSpace(a.Cfg.CryptoPayWebhookSecret) != "" && secret != a.Cfg.CryptoPayWebhookSecret {
-		writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+		writeError(w, r, errForbidden)
 		return
 	}
 
 	if strings.TrimSpace(a.Cfg.CryptoPayToken) == "" {
-		writeJSON(w, 404, envelope{OK: false, Error: "not configured"})
+		writeError(w, r, featureDisabled(404, "cryptopay", "not configured"))
 		return
 	}
 
 	raw, err := io.ReadAll(r.Body)
 	if err != nil || len(raw) == 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad body"})
+		writeError(w, r, errBadBody)
 		return
 	}
 
 	sig := r.Header.Get("crypto-pay-api-signature")
 	if !cryptopay.VerifyWebhookSignature(a.Cfg.CryptoPayToken, raw, sig) {
-		writeJSON(w, 401, envelope{OK: false, Error: "bad signature"})
+		writeError(w, r, errBadSignature)
 		return
 	}
 
 	var upd cryptopay.WebhookUpdate
 	if err := json.Unmarshal(raw, &upd); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
 
 	inv := upd.Payload
 	credited, finalStatus, _ := a.DB.ProcessCryptoPayStatus(r.Context(), inv.InvoiceID, inv.Status, time.Now().UTC())
+	if credited > 0 && a.Events != nil {
+		if row, err := a.DB.GetCryptoPayInvoice(r.Context(), inv.InvoiceID); err == nil {
+			a.Events.Publish(row.UserID, events.DepositCredited, map[string]any{"invoice_id": inv.InvoiceID, "coins": credited, "source": "cryptopay"})
+		}
+	}
 	if a.FastTap != nil && a.FastTap.Enabled() {
 		ctx := r.Context()
 		if credited > 0 {
@@ -1340,17 +1257,17 @@ func (a *API) cryptoPayWebhook(w http.ResponseWriter, r *http.Request) {
 func (a *API) nftsList(w http.ResponseWriter, r *http.Request) {
 	var req nftsListRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	_, ok := a.authUserFrom(req.InitData)
+	_, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	items, err := a.DB.ListNFTs(r.Context())
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"items": items}})
@@ -1359,17 +1276,17 @@ func (a *API) nftsList(w http.ResponseWriter, r *http.Request) {
 func (a *API) nftsMy(w http.ResponseWriter, r *http.Request) {
 	var req nftsListRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	items, err := a.DB.ListUserNFTs(r.Context(), user.ID)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"items": items}})
@@ -1378,35 +1295,36 @@ func (a *API) nftsMy(w http.ResponseWriter, r *http.Request) {
 func (a *API) nftBuy(w http.ResponseWriter, r *http.Request) {
 	var req nftBuyRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if req.NFTID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad nft_id"})
+		writeError(w, r, badParam("nft_id"))
 		return
 	}
 	ctx := r.Context()
-	_, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax))
+	_, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(config.Econ().EnergyMax))
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	if err := a.DB.BuyNFT(ctx, user.ID, req.NFTID); err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough balance or sold out"})
+			writeError(w, r, errNotEnoughOrSoldOut)
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "buy failed"})
+		writeError(w, r, failed("buy failed"))
 		return
 	}
+	markCommitted(r)
 	state, err := a.buildUserState(ctx, user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: state})
@@ -1415,22 +1333,27 @@ func (a *API) nftBuy(w http.ResponseWriter, r *http.Request) {
 func (a *API) adminNFTCreate(w http.ResponseWriter, r *http.Request) {
 	var req adminNFTCreateRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if user.ID != a.Cfg.AdminID {
-		writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+		writeError(w, r, errForbidden)
 		return
 	}
 
-	id, err := a.DB.CreateNFT(r.Context(), req.Title, req.ImageURL, req.PriceCoins, req.SupplyTotal)
+	// The NFT id is known only inside the transaction; it is in After.
+	id, err := a.DB.CreateNFT(r.Context(), req.Title, req.ImageURL, req.PriceCoins, req.SupplyTotal, a.auditHook(r, user, audit.Entry{
+		Action: "nft_create",
+		Target: "nft",
+		Reason: strings.TrimSpace(req.Reason),
+	}))
 	if err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad params"})
+		writeError(w, r, errBadParams)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"nft_id": id}})
@@ -1439,70 +1362,79 @@ func (a *API) adminNFTCreate(w http.ResponseWriter, r *http.Request) {
 func (a *API) adminReserveSend(w http.ResponseWriter, r *http.Request) {
 	var req adminReserveSendRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if user.ID != a.Cfg.AdminID {
-		writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+		writeError(w, r, errForbidden)
 		return
 	}
 	if req.ToUserID <= 0 || req.Amount <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad params"})
-		return
-	}
-	if _, err := a.DB.GetUser(r.Context(), req.ToUserID); err != nil {
-		writeJSON(w, 404, envelope{OK: false, Error: "recipient not found"})
+		writeError(w, r, errBadParams)
 		return
 	}
-	err := a.DB.CreditFromReserve(r.Context(), req.ToUserID, req.Amount, "admin_reserve_send", map[string]any{"by": user.ID})
+	err := a.DB.CreditFromReserve(r.Context(), req.ToUserID, req.Amount, "admin_reserve_send", map[string]any{"by": user.ID}, a.auditHook(r, user, audit.Entry{
+		Action: "reserve_send",
+		Target: audit.Target("user", req.ToUserID),
+		Reason: strings.TrimSpace(req.Reason),
+	}))
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, r, errRecipientNotFound)
+			return
+		}
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough reserve"})
+			writeError(w, r, errNotEnoughReserve)
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "send failed"})
+		writeError(w, r, upstreamFailed("send failed"))
 		return
 	}
 	if a.FastTap != nil && a.FastTap.Enabled() {
 		_ = a.FastTap.AdjustReserve(r.Context(), -req.Amount)
 	}
+	a.Events.Publish(req.ToUserID, events.Credit, map[string]any{"amount": req.Amount, "reason": "admin_reserve_send"})
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
 }
 
 func (a *API) adminDepositWalletsSet(w http.ResponseWriter, r *http.Request) {
 	var req adminDepositWalletsSetRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if user.ID != a.Cfg.AdminID {
-		writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+		writeError(w, r, errForbidden)
 		return
 	}
 	if len(req.Wallets) > 50 {
-		writeJSON(w, 400, envelope{OK: false, Error: "too many wallets"})
+		writeError(w, r, invalid("wallets", "too many wallets"))
 		return
 	}
 	wallets := copyStringMap(req.Wallets)
 	for k, v := range wallets {
 		if len(k) > 24 || len(v) > 256 {
-			writeJSON(w, 400, envelope{OK: false, Error: "bad wallet value"})
+			writeError(w, r, invalid("wallets", "bad wallet value"))
 			return
 		}
 	}
 
-	if err := a.DB.SetDepositWallets(r.Context(), wallets); err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+	if err := a.DB.SetDepositWallets(r.Context(), wallets, a.auditHook(r, user, audit.Entry{
+		Action: "deposit_wallets_set",
+		Target: "deposit_wallets",
+		Reason: strings.TrimSpace(req.Reason),
+	})); err != nil {
+		writeError(w, r, errDB)
 		return
 	}
 
@@ -1513,7 +1445,7 @@ func (a *API) adminDepositWalletsSet(w http.ResponseWriter, r *http.Request) {
 
 	state, err := a.buildUserState(r.Context(), user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: state})
@@ -1522,66 +1454,75 @@ func (a *API) adminDepositWalletsSet(w http.ResponseWriter, r *http.Request) {
 func (a *API) adminBroadcast(w http.ResponseWriter, r *http.Request) {
 	var req adminBroadcastRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if user.ID != a.Cfg.AdminID {
-		writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+		writeError(w, r, errForbidden)
 		return
 	}
 	text := strings.TrimSpace(req.Text)
 	if text == "" {
-		writeJSON(w, 400, envelope{OK: false, Error: "empty text"})
+		writeError(w, r, invalid("text", "empty text"))
 		return
 	}
 	if len(text) > 3500 {
-		writeJSON(w, 400, envelope{OK: false, Error: "text too long"})
+		writeError(w, r, tooLong("text", "text too long"))
 		return
 	}
 	if a.Tg == nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "bot not configured"})
+		writeError(w, r, featureDisabled(500, "bot", "bot not configured"))
 		return
 	}
 
-	a.Tg.StartBroadcast(context.Background(), user.ID, text)
+	// A broadcast cannot be taken back, so it is recorded before it starts.
+	if err := a.recordAudit(r, user, audit.Entry{
+		Action: "broadcast",
+		After:  audit.JSON(map[string]any{"text": text}),
+		Reason: strings.TrimSpace(req.Reason),
+	}); err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	a.Tg.StartBroadcast(r.Context(), user.ID, text)
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"started": true}})
 }
 
 func (a *API) adminMarketListingDelete(w http.ResponseWriter, r *http.Request) {
 	var req adminMarketListingDeleteRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if user.ID != a.Cfg.AdminID {
-		writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+		writeError(w, r, errForbidden)
 		return
 	}
 	if req.ListingID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad listing_id"})
+		writeError(w, r, badParam("listing_id"))
 		return
 	}
-	res, err := a.DB.Pool.Exec(r.Context(), `
-UPDATE market_listings
-SET status='cancelled'
-WHERE listing_id=$1 AND status='active'
-`, req.ListingID)
+	found, err := a.DB.CancelMarketListing(r.Context(), req.ListingID, 0, a.auditHook(r, user, audit.Entry{
+		Action: "market_listing_delete",
+		Target: audit.Target("listing", req.ListingID),
+		Reason: strings.TrimSpace(req.Reason),
+	}))
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
-	if res.RowsAffected() == 0 {
-		writeJSON(w, 404, envelope{OK: false, Error: "listing not found"})
+	if !found {
+		writeError(w, r, errListingNotFound)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
@@ -1590,30 +1531,30 @@ WHERE listing_id=$1 AND status='active'
 func (a *API) bankFreeze(w http.ResponseWriter, r *http.Request) {
 	var req bankAmountRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	amount := req.Amount
 	if amount <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad amount"})
+		writeError(w, r, badParam("amount"))
 		return
 	}
 	if err := a.DB.FreezeBalance(r.Context(), user.ID, amount); err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough balance"})
+			writeError(w, r, a.notEnough(r.Context(), user.ID, amount))
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "freeze failed"})
+		writeError(w, r, failed("freeze failed"))
 		return
 	}
 	state, err := a.buildUserState(r.Context(), user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: state})
@@ -1622,44 +1563,49 @@ func (a *API) bankFreeze(w http.ResponseWriter, r *http.Request) {
 func (a *API) bankUnfreeze(w http.ResponseWriter, r *http.Request) {
 	var req bankAmountRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	amount := req.Amount
 	if amount <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad amount"})
+		writeError(w, r, badParam("amount"))
 		return
 	}
 	if err := a.DB.UnfreezeBalance(r.Context(), user.ID, amount); err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough frozen balance"})
+			e := errNotEnoughFrozen.with("required", amount)
+			if u, err := a.DB.GetUser(r.Context(), user.ID); err == nil {
+				e = e.with("available", u.FrozenBalance)
+			}
+			writeError(w, r, e)
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "unfreeze failed"})
+		writeError(w, r, failed("unfreeze failed"))
 		return
 	}
 	state, err := a.buildUserState(r.Context(), user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: state})
 }
 
 func (a *API) bankLoanTake(w http.ResponseWriter, r *http.Request) {
+	econ := config.Econ()
 	var req bankLoanTakeRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 
@@ -1669,47 +1615,48 @@ func (a *API) bankLoanTake(w http.ResponseWriter, r *http.Request) {
 	switch plan {
 	case "7d", "7", "week":
 		termDays = 7
-		interestBP = a.Cfg.BankLoan7DInterestBP
+		interestBP = econ.BankLoan7DInterestBP
 	case "30d", "30", "month":
 		termDays = 30
-		interestBP = a.Cfg.BankLoan30DInterestBP
+		interestBP = econ.BankLoan30DInterestBP
 	default:
-		writeJSON(w, 400, envelope{OK: false, Error: "bad plan"})
+		writeError(w, r, badParam("plan"))
 		return
 	}
 
 	amount := req.Amount
-	if amount <= 0 || amount > a.Cfg.BankLoanMaxAmount {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad amount"})
+	if amount <= 0 || amount > econ.BankLoanMaxAmount {
+		writeError(w, r, badParam("amount"))
 		return
 	}
 
 	ctx := r.Context()
-	if _, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax)); err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+	if _, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(econ.EnergyMax)); err != nil {
+		writeError(w, r, errDB)
 		return
 	}
 
 	loan, err := a.DB.CreateBankLoan(ctx, user.ID, amount, interestBP, termDays)
 	if err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough reserve"})
+			writeError(w, r, errNotEnoughReserve)
 			return
 		}
 		if errors.Is(err, db.ErrAlreadyExists) {
-			writeJSON(w, 400, envelope{OK: false, Error: "active loan exists"})
+			writeError(w, r, errActiveLoanExists)
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "loan create failed"})
+		writeError(w, r, failed("loan create failed"))
 		return
 	}
+	markCommitted(r)
 	if a.FastTap != nil && a.FastTap.Enabled() {
 		_ = a.FastTap.AdjustReserve(ctx, -loan.Principal)
 	}
 
 	state, err := a.buildUserState(ctx, user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	state["bank_loan"] = loan
@@ -1719,18 +1666,18 @@ func (a *API) bankLoanTake(w http.ResponseWriter, r *http.Request) {
 func (a *API) bankLoanMy(w http.ResponseWriter, r *http.Request) {
 	var req bankLoanMyRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	ctx := r.Context()
 	items, err := a.DB.ListBankLoansByUser(ctx, user.ID, req.Limit)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"items": items}})
@@ -1739,30 +1686,31 @@ func (a *API) bankLoanMy(w http.ResponseWriter, r *http.Request) {
 func (a *API) bankLoanRepay(w http.ResponseWriter, r *http.Request) {
 	var req bankLoanRepayRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if req.LoanID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad loan_id"})
+		writeError(w, r, badParam("loan_id"))
 		return
 	}
 	ctx := r.Context()
 	if err := a.DB.RepayBankLoan(ctx, user.ID, req.LoanID); err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough balance"})
+			writeError(w, r, a.notEnough(r.Context(), user.ID, 0))
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "repay failed"})
+		writeError(w, r, failed("repay failed"))
 		return
 	}
+	markCommitted(r)
 	state, err := a.buildUserState(ctx, user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: state})
@@ -1771,72 +1719,74 @@ func (a *API) bankLoanRepay(w http.ResponseWriter, r *http.Request) {
 func (a *API) p2pLoanRequest(w http.ResponseWriter, r *http.Request) {
 	var req p2pLoanRequestRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	lenderID, err := parseUserID(strings.TrimSpace(req.Lender))
 	if err != nil || lenderID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad lender"})
+		writeError(w, r, badParam("lender"))
 		return
 	}
 	if lenderID == user.ID {
-		writeJSON(w, 400, envelope{OK: false, Error: "self lender"})
+		writeError(w, r, errSelfLender)
 		return
 	}
 	amount := req.Amount
 	if amount <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad amount"})
+		writeError(w, r, badParam("amount"))
 		return
 	}
 	termDays := req.TermDays
 	if termDays <= 0 || termDays > 365 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad term_days"})
+		writeError(w, r, badParam("term_days"))
 		return
 	}
 	interestBP := req.InterestBP
 	if interestBP < 0 || interestBP > 50_000 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad interest_bp"})
+		writeError(w, r, badParam("interest_bp"))
 		return
 	}
 
 	ctx := r.Context()
-	if _, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax)); err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+	if _, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(config.Econ().EnergyMax)); err != nil {
+		writeError(w, r, errDB)
 		return
 	}
 	if _, err := a.DB.GetUser(ctx, lenderID); err != nil {
-		writeJSON(w, 404, envelope{OK: false, Error: "lender not found"})
+		writeError(w, r, errUserNotFound)
 		return
 	}
 
 	loan, err := a.DB.CreateP2PLoanRequest(ctx, user.ID, lenderID, amount, interestBP, termDays)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "request failed"})
+		writeError(w, r, failed("request failed"))
 		return
 	}
+	markCommitted(r)
+	a.Events.Publish(lenderID, events.LoanRequest, map[string]any{"loan": loan, "from": userRef(user)})
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"loan": loan}})
 }
 
 func (a *API) p2pLoanIncoming(w http.ResponseWriter, r *http.Request) {
 	var req bankLoanMyRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	ctx := r.Context()
 	items, err := a.DB.ListIncomingP2PRequests(ctx, user.ID, req.Limit)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"items": items}})
@@ -1845,18 +1795,18 @@ func (a *API) p2pLoanIncoming(w http.ResponseWriter, r *http.Request) {
 func (a *API) p2pLoanMy(w http.ResponseWriter, r *http.Request) {
 	var req bankLoanMyRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	ctx := r.Context()
 	items, err := a.DB.ListP2PLoansByUser(ctx, user.ID, req.Limit)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"items": items}})
@@ -1865,85 +1815,90 @@ func (a *API) p2pLoanMy(w http.ResponseWriter, r *http.Request) {
 func (a *API) p2pLoanAccept(w http.ResponseWriter, r *http.Request) {
 	var req p2pLoanIDRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if req.LoanID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad loan_id"})
+		writeError(w, r, badParam("loan_id"))
 		return
 	}
 	if err := a.DB.AcceptP2PLoan(r.Context(), user.ID, req.LoanID); err != nil {
 		if errors.Is(err, db.ErrForbidden) {
-			writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+			writeError(w, r, errForbidden)
 			return
 		}
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough balance"})
+			writeError(w, r, a.notEnough(r.Context(), user.ID, 0))
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "accept failed"})
+		writeError(w, r, failed("accept failed"))
 		return
 	}
+	markCommitted(r)
+	a.emitLoan(r.Context(), req.LoanID, events.LoanAccepted, "active", false)
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
 }
 
 func (a *API) p2pLoanReject(w http.ResponseWriter, r *http.Request) {
 	var req p2pLoanIDRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if req.LoanID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad loan_id"})
+		writeError(w, r, badParam("loan_id"))
 		return
 	}
 	if err := a.DB.RejectP2PLoan(r.Context(), user.ID, req.LoanID); err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "reject failed"})
+		writeError(w, r, failed("reject failed"))
 		return
 	}
+	a.emitLoan(r.Context(), req.LoanID, events.LoanRejected, "rejected", false)
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
 }
 
 func (a *API) p2pLoanRepay(w http.ResponseWriter, r *http.Request) {
 	var req p2pLoanIDRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if req.LoanID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad loan_id"})
+		writeError(w, r, badParam("loan_id"))
 		return
 	}
 	if err := a.DB.RepayP2PLoan(r.Context(), user.ID, req.LoanID); err != nil {
 		if errors.Is(err, db.ErrForbidden) {
-			writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+			writeError(w, r, errForbidden)
 			return
 		}
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough balance"})
+			writeError(w, r, a.notEnough(r.Context(), user.ID, 0))
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "repay failed"})
+		writeError(w, r, failed("repay failed"))
 		return
 	}
+	markCommitted(r)
+	a.emitLoan(r.Context(), req.LoanID, events.LoanRepaid, "repaid", true)
 	state, err := a.buildUserState(r.Context(), user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: state})
@@ -1952,58 +1907,60 @@ func (a *API) p2pLoanRepay(w http.ResponseWriter, r *http.Request) {
 func (a *API) p2pLoanRecall(w http.ResponseWriter, r *http.Request) {
 	var req p2pLoanIDRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if req.LoanID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad loan_id"})
+		writeError(w, r, badParam("loan_id"))
 		return
 	}
 	if err := a.DB.RecallP2PLoan(r.Context(), user.ID, req.LoanID, a.Cfg.P2PRecallMinDays); err != nil {
 		if errors.Is(err, db.ErrForbidden) {
-			writeJSON(w, 403, envelope{OK: false, Error: "forbidden"})
+			writeError(w, r, errForbidden)
 			return
 		}
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough borrower balance"})
+			writeError(w, r, errBorrowerNotEnough)
 			return
 		}
-		writeJSON(w, 400, envelope{OK: false, Error: err.Error()})
+		writeError(w, r, badRequest(err.Error()))
 		return
 	}
+	a.emitLoan(r.Context(), req.LoanID, events.LoanRecalled, "repaid", false)
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
 }
 
 func (a *API) marketListingCreate(w http.ResponseWriter, r *http.Request) {
+	econ := config.Econ()
 	var req marketListingCreateRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	ctx := r.Context()
-	if _, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax)); err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+	if _, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(econ.EnergyMax)); err != nil {
+		writeError(w, r, errDB)
 		return
 	}
 
 	// Create listing and burn fee.
-	listing, err := a.DB.CreateMarketListing(ctx, user.ID, req.Title, req.Description, req.Category, req.PriceCoins, req.Contact, a.Cfg.MarketListingFeeCoins)
+	listing, err := a.DB.CreateMarketListing(ctx, user.ID, req.Title, req.Description, req.Category, req.PriceCoins, req.Contact, econ.MarketListingFeeCoins)
 	if err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough balance for fee"})
+			writeError(w, r, errNotEnoughForFee)
 			return
 		}
-		writeJSON(w, 400, envelope{OK: false, Error: "bad params"})
+		writeError(w, r, errBadParams)
 		return
 	}
 
@@ -2016,11 +1973,11 @@ func (a *API) marketListingCreate(w http.ResponseWriter, r *http.Request) {
 		}
 		buf, err := base64.StdEncoding.DecodeString(rawB64)
 		if err != nil {
-			writeJSON(w, 400, envelope{OK: false, Error: "bad image_base64"})
+			writeError(w, r, badParam("image_base64"))
 			return
 		}
 		if len(buf) > 800_000 {
-			writeJSON(w, 400, envelope{OK: false, Error: "image too large"})
+			writeError(w, r, tooLong("image_base64", "image too large"))
 			return
 		}
 		if mime == "" {
@@ -2034,7 +1991,7 @@ func (a *API) marketListingCreate(w http.ResponseWriter, r *http.Request) {
 
 	state, err := a.buildUserState(ctx, user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	state["listing"] = listing
@@ -2044,18 +2001,18 @@ func (a *API) marketListingCreate(w http.ResponseWriter, r *http.Request) {
 func (a *API) marketListingList(w http.ResponseWriter, r *http.Request) {
 	var req marketListingListRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	_ = user
 	items, err := a.DB.ListMarketListings(r.Context(), req.Status, req.Limit)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"items": items}})
@@ -2064,17 +2021,17 @@ func (a *API) marketListingList(w http.ResponseWriter, r *http.Request) {
 func (a *API) marketListingMy(w http.ResponseWriter, r *http.Request) {
 	var req marketListingListRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	items, err := a.DB.ListMyMarketListings(r.Context(), user.ID, req.Limit)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"items": items}})
@@ -2083,29 +2040,41 @@ func (a *API) marketListingMy(w http.ResponseWriter, r *http.Request) {
 func (a *API) marketListingBuy(w http.ResponseWriter, r *http.Request) {
 	var req marketListingBuyRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if req.ListingID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad listing_id"})
+		writeError(w, r, badParam("listing_id"))
 		return
 	}
 	if err := a.DB.BuyMarketListing(r.Context(), user.ID, req.ListingID); err != nil {
 		if errors.Is(err, db.ErrNotEnough) {
-			writeJSON(w, 400, envelope{OK: false, Error: "not enough balance"})
+			writeError(w, r, a.notEnough(r.Context(), user.ID, 0))
 			return
 		}
-		writeJSON(w, 500, envelope{OK: false, Error: "buy failed"})
+		writeError(w, r, failed("buy failed"))
 		return
 	}
+	markCommitted(r)
+	if a.Events != nil {
+		if l, err := a.DB.GetMarketListing(r.Context(), req.ListingID); err == nil && l.BuyerID != nil && *l.BuyerID == user.ID {
+			a.Events.Publish(l.SellerID, events.MarketSale, map[string]any{
+				"listing_id": l.ListingID,
+				"title":      l.Title,
+				"category":   l.Category,
+				"price":      l.PriceCoins,
+				"buyer":      userRef(user),
+			})
+		}
+	}
 	state, err := a.buildUserState(r.Context(), user)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+		writeError(w, r, errServer)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: state})
@@ -2114,29 +2083,25 @@ func (a *API) marketListingBuy(w http.ResponseWriter, r *http.Request) {
 func (a *API) marketListingCancel(w http.ResponseWriter, r *http.Request) {
 	var req marketListingCancelRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 	if req.ListingID <= 0 {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad listing_id"})
+		writeError(w, r, badParam("listing_id"))
 		return
 	}
-	res, err := a.DB.Pool.Exec(r.Context(), `
-UPDATE market_listings
-SET status='cancelled'
-WHERE listing_id=$1 AND seller_id=$2 AND status='active'
-`, req.ListingID, user.ID)
+	found, err := a.DB.CancelMarketListing(r.Context(), req.ListingID, user.ID, nil)
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
-	if res.RowsAffected() == 0 {
-		writeJSON(w, 404, envelope{OK: false, Error: "listing not found"})
+	if !found {
+		writeError(w, r, errListingNotFound)
 		return
 	}
 	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"ok": true}})
@@ -2160,27 +2125,28 @@ func (a *API) marketListingImage(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *API) buy(w http.ResponseWriter, r *http.Request) {
+	econ := config.Econ()
 	var req buyRequest
 	if err := readJSON(r, &req); err != nil {
-		writeJSON(w, 400, envelope{OK: false, Error: "bad json"})
+		writeError(w, r, errBadJSON)
 		return
 	}
-	user, ok := a.authUserFrom(req.InitData)
+	user, ok := a.authUserFrom(r, req.InitData)
 	if !ok {
-		writeJSON(w, 401, envelope{OK: false, Error: "unauthorized"})
+		writeError(w, r, errUnauthorized)
 		return
 	}
 
 	item := strings.ToLower(strings.TrimSpace(req.Item))
 	if item == "" {
-		writeJSON(w, 400, envelope{OK: false, Error: "missing item"})
+		writeError(w, r, invalid("item", "missing item"))
 		return
 	}
 
 	ctx := r.Context()
-	_, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(a.Cfg.EnergyMax))
+	_, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(econ.EnergyMax))
 	if err != nil {
-		writeJSON(w, 500, envelope{OK: false, Error: "db error"})
+		writeError(w, r, errDB)
 		return
 	}
 
@@ -2188,56 +2154,31 @@ func (a *API) buy(w http.ResponseWriter, r *http.Request) {
 
 	switch item {
 	case "energy_1h":
-		price := a.Cfg.EnergyBoost1HPriceCoins
+		price := econ.EnergyBoost1HPriceCoins
 		var (
 			boostUntil time.Time
 			baseMax    float64
 			effMax     float64
 		)
-		err = a.DB.WithTx(ctx, func(tx pgx.Tx) error {
-			// lock user
-			var bal int64
-			var energyMax float64
-			if err := tx.QueryRow(ctx, `SELECT balance, energy_max FROM users WHERE user_id=$1 FOR UPDATE`, user.ID).Scan(&bal, &energyMax); err != nil {
-				return err
-			}
-			if bal < price {
-				return db.ErrNotEnough
-			}
-			// debit to reserve
-			if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance - $1 WHERE user_id=$2`, price, user.ID); err != nil {
-				return err
-			}
-			if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply + $1, updated_at=now() WHERE id=1`, price); err != nil {
-				return err
-			}
-			until := now.Add(1 * time.Hour)
-			boostUntil = until
-			baseMax = energyMax
-			regenMult := a.Cfg.EnergyBoost1HRegenMultiplier
-			maxMult := a.Cfg.EnergyBoost1HMaxMultiplier
-			effMax = energyMax * maxMult
-			if _, err := tx.Exec(ctx, `UPDATE users SET energy_boost_until=$1, energy_boost_regen_multiplier=$2, energy_boost_max_multiplier=$3, energy=$4, energy_updated_at=$5 WHERE user_id=$6`, until, regenMult, maxMult, effMax, now, user.ID); err != nil {
-				return err
-			}
-			_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('buy_energy_1h', $1, NULL, $2, $3::jsonb)`, user.ID, price, toJSON(map[string]any{"until": until.Unix()}))
-			return err
-		})
+		boostUntil = now.Add(1 * time.Hour)
+		baseMax, err = a.DB.BuyEnergyBoost(ctx, user.ID, price, boostUntil, econ.EnergyBoost1HRegenMultiplier, econ.EnergyBoost1HMaxMultiplier, now)
+		effMax = baseMax * econ.EnergyBoost1HMaxMultiplier
 		if err != nil {
 			if errors.Is(err, db.ErrNotEnough) {
-				writeJSON(w, 400, envelope{OK: false, Error: "not enough balance"})
+				writeError(w, r, a.notEnough(ctx, user.ID, price))
 				return
 			}
-			writeJSON(w, 500, envelope{OK: false, Error: "buy failed"})
+			writeError(w, r, failed("buy failed"))
 			return
 		}
+		markCommitted(r)
 		if a.FastTap != nil && a.FastTap.Enabled() {
 			_ = a.FastTap.AdjustReserve(ctx, price)
-			_ = a.FastTap.UpdateEnergyBoost(ctx, user.ID, boostUntil, a.Cfg.EnergyBoost1HRegenMultiplier, a.Cfg.EnergyBoost1HMaxMultiplier, effMax, baseMax, now)
+			_ = a.FastTap.UpdateEnergyBoost(ctx, user.ID, boostUntil, econ.EnergyBoost1HRegenMultiplier, econ.EnergyBoost1HMaxMultiplier, effMax, baseMax, now)
 		}
 		data, err := a.buildUserState(ctx, user)
 		if err != nil {
-			writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+			writeError(w, r, errServer)
 			return
 		}
 		data["item"] = item
@@ -2245,54 +2186,30 @@ func (a *API) buy(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, 200, envelope{OK: true, Data: data})
 		return
 	case "tap_pack":
-		packSize := a.Cfg.ExtraTapsPackSize
-		price := a.Cfg.ExtraTapsPackPriceCoins
+		packSize := econ.ExtraTapsPackSize
+		price := econ.ExtraTapsPackPriceCoins
 		if packSize <= 0 || price <= 0 {
-			writeJSON(w, 400, envelope{OK: false, Error: "tap pack disabled"})
+			writeError(w, r, featureDisabled(400, "tap_pack", "tap pack disabled"))
 			return
 		}
 		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-		err = a.DB.WithTx(ctx, func(tx pgx.Tx) error {
-			// lock user
-			var bal int64
-			if err := tx.QueryRow(ctx, `SELECT balance FROM users WHERE user_id=$1 FOR UPDATE`, user.ID).Scan(&bal); err != nil {
-				return err
-			}
-			if bal < price {
-				return db.ErrNotEnough
-			}
-			if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance - $1 WHERE user_id=$2`, price, user.ID); err != nil {
-				return err
-			}
-			if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply + $1, updated_at=now() WHERE id=1`, price); err != nil {
-				return err
-			}
-			if _, err := tx.Exec(ctx, `INSERT INTO user_daily(user_id, day) VALUES($1,$2) ON CONFLICT DO NOTHING`, user.ID, day); err != nil {
-				return err
-			}
-			if _, err := tx.Exec(ctx, `UPDATE user_daily SET extra_quota = extra_quota + $1, updated_at=now() WHERE user_id=$2 AND day=$3`, packSize, user.ID, day); err != nil {
-				return err
-			}
-			_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('buy_tap_pack', $1, NULL, $2, $3::jsonb)`,
-				user.ID, price, toJSON(map[string]any{"day": day.Format("2006-01-02"), "pack_size": packSize}),
-			)
-			return err
-		})
+		err = a.DB.BuyTapPack(ctx, user.ID, price, packSize, day)
 		if err != nil {
 			if errors.Is(err, db.ErrNotEnough) {
-				writeJSON(w, 400, envelope{OK: false, Error: "not enough balance"})
+				writeError(w, r, a.notEnough(ctx, user.ID, price))
 				return
 			}
-			writeJSON(w, 500, envelope{OK: false, Error: "buy failed"})
+			writeError(w, r, failed("buy failed"))
 			return
 		}
+		markCommitted(r)
 		if a.FastTap != nil && a.FastTap.Enabled() {
 			_ = a.FastTap.AdjustReserve(ctx, price)
 			_ = a.FastTap.AddDailyExtraQuota(ctx, user.ID, day, packSize)
 		}
 		data, err := a.buildUserState(ctx, user)
 		if err != nil {
-			writeJSON(w, 500, envelope{OK: false, Error: "server error"})
+			writeError(w, r, errServer)
 			return
 		}
 		data["item"] = item
@@ -2301,7 +2218,7 @@ func (a *API) buy(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, 200, envelope{OK: true, Data: data})
 		return
 	default:
-		writeJSON(w, 400, envelope{OK: false, Error: "unknown item"})
+		writeError(w, r, invalid("item", "unknown item"))
 		return
 	}
 }
@@ -2320,83 +2237,20 @@ func coinsPerUSD(reserve, initialReserve, startRate, minRate int64) int64 {
 	return minRate + (span*reserve)/initialReserve
 }
 
-func regenEnergy(current float64, eMax float64, regenPerSec float64, updatedAt time.Time, now time.Time) float64 {
-	if eMax <= 0 {
-		return 0
-	}
-	if current < 0 {
-		current = 0
-	}
-	dt := now.Sub(updatedAt).Seconds()
-	if dt <= 0 {
-		if current > eMax {
-			return eMax
-		}
-		return current
-	}
-	current = current + dt*regenPerSec
-	if current > eMax {
-		current = eMax
-	}
-	return current
-}
-
-func (a *API) effectiveEnergyParams(u db.UserState, now time.Time) (float64, float64) {
-	eMax := u.EnergyMax
-	eRegen := a.Cfg.EnergyRegenPerSec
-	if now.Before(u.EnergyBoostUntil) {
-		eMax = eMax * u.EnergyBoostMaxMultiplier
-		eRegen = eRegen * u.EnergyBoostRegenMultiplier
-	}
-	if eMax < 0 {
-		eMax = 0
-	}
-	if eRegen < 0 {
-		eRegen = 0
-	}
-	return eMax, eRegen
-}
-
-func min3(a, b, c int64) int64 {
-	m := a
-	if b < m {
-		m = b
-	}
-	if c < m {
-		m = c
-	}
-	return m
-}
-
+// parseUserID accepts a user_id or a checksummed BKC address; @username
+// goes through resolveRecipient.
 func parseUserID(raw string) (int64, error) {
-	raw = strings.TrimSpace(raw)
-	if raw == "" {
-		return 0, errors.New("empty")
-	}
-	if strings.HasPrefix(raw, "BKC") {
-		raw = strings.TrimPrefix(raw, "BKC")
-	}
-	if !isDigits(raw) {
-		return 0, errors.New("bad")
-	}
-	id, err := strconv.ParseInt(raw, 10, 64)
-	if err != nil || id <= 0 {
-		return 0, errors.New("bad")
+	ref, err := address.Parse(raw)
+	if err != nil {
+		return 0, err
 	}
-	return id, nil
-}
-
-func isDigits(s string) bool {
-	for _, r := range s {
-		if r < '0' || r > '9' {
-			return false
-		}
+	switch ref.Kind {
+	case address.KindUsername:
+		return 0, address.ErrInvalid
+	case address.KindLegacy:
+		return 0, address.ErrNoChecksum
 	}
-	return true
-}
-
-func fmtAddress(userID int64) string {
-	return "BKC" + strconv.FormatInt(userID, 10)
+	return ref.UserID, nil
 }
 
 func toJSON(v any) string {
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/config"
+	"bkc_coin_v2/internal/session"
+	"bkc_coin_v2/internal/telegram"
+)
+
+type authSessionRequest struct {
+	InitData string `json:"init_data"`
+}
+
+type authRefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type authLogoutRequest struct {
+	InitData string `json:"init_data"`
+	All      bool   `json:"all"` // end every session of the user, not just this one
+}
+
+// sessionToken returns the session token of a request: the Bearer header,
+// or init_data when the client puts the token there.
+func sessionToken(r *http.Request, initData string) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	if initData = strings.TrimSpace(initData); session.IsToken(initData) {
+		return initData
+	}
+	return ""
+}
+
+// freshAuthDate bounds how old a signed initData may be. initData without
+// auth_date is never fresh.
+func freshAuthDate(authDate time.Time, maxAge time.Duration, now time.Time) bool {
+	if authDate.IsZero() {
+		return false
+	}
+	age := now.Sub(authDate)
+	return age <= maxAge && age > -time.Minute // small clock skew
+}
+
+// authSession verifies initData once and opens a session.
+func (a *API) authSession(w http.ResponseWriter, r *http.Request) {
+	if a.Sessions == nil {
+		writeError(w, r, errSessionsDisabled)
+		return
+	}
+	var req authSessionRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := telegram.VerifyWebAppInitData(req.InitData, a.Cfg.BotToken)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	now := time.Now()
+	if !freshAuthDate(user.AuthDate, a.Sessions.Config().InitDataMaxAge, now) {
+		writeError(w, r, errInitDataExpired)
+		return
+	}
+	if a.isBanned(r.Context(), user.ID) {
+		writeError(w, r, errBanned)
+		return
+	}
+	ctx := r.Context()
+	if _, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(config.Econ().EnergyMax)); err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	pair, err := a.Sessions.Issue(ctx, user, now)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: pair})
+}
+
+// authRefresh trades a refresh token for a new token pair.
+func (a *API) authRefresh(w http.ResponseWriter, r *http.Request) {
+	if a.Sessions == nil {
+		writeError(w, r, errSessionsDisabled)
+		return
+	}
+	var req authRefreshRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	pair, err := a.Sessions.Refresh(r.Context(), strings.TrimSpace(req.RefreshToken), time.Now())
+	switch {
+	case err == nil:
+		writeJSON(w, 200, envelope{OK: true, Data: pair})
+	case errors.Is(err, session.ErrInvalid), errors.Is(err, session.ErrExpired):
+		writeError(w, r, errBadRefreshToken)
+	case errors.Is(err, session.ErrRevoked):
+		writeError(w, r, errSessionRevoked)
+	default:
+		writeError(w, r, errDB)
+	}
+}
+
+// authLogout ends the caller's session, or all of them with "all".
+// Logging out everywhere also works with raw initData.
+func (a *API) authLogout(w http.ResponseWriter, r *http.Request) {
+	if a.Sessions == nil {
+		writeError(w, r, errSessionsDisabled)
+		return
+	}
+	var req authLogoutRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	if req.All {
+		n, err := a.Sessions.RevokeAll(ctx, user.ID, "logout all")
+		if err != nil {
+			writeError(w, r, errDB)
+			return
+		}
+		writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"revoked": n}})
+		return
+	}
+	token := sessionToken(r, req.InitData)
+	if token == "" {
+		writeError(w, r, errNoSessionToken)
+		return
+	}
+	c, err := a.Sessions.Verify(token, time.Now())
+	if err != nil {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if err := a.Sessions.Revoke(ctx, user.ID, c.SessionID, "logout"); err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"revoked": 1}})
+}
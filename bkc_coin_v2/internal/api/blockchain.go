@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"bkc_coin_v2/internal/chain"
+)
+
+// Block explorer endpoints are public and read-only, like /blockchain itself.
+
+func isBlockchainPath(p string) bool {
+	return strings.HasSuffix(p, "/blockchain") || strings.Contains(p, "/blockchain/")
+}
+
+func queryInt(r *http.Request, key string, def int64) int64 {
+	v := strings.TrimSpace(r.URL.Query().Get(key))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+func (a *API) chainOrUnavailable(w http.ResponseWriter, r *http.Request) bool {
+	if a.Chain == nil {
+		writeError(w, r, featureDisabled(http.StatusServiceUnavailable, "chain", "chain disabled"))
+		return false
+	}
+	return true
+}
+
+func writeChainErr(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, chain.ErrNotFound) {
+		writeError(w, r, errNotFound)
+		return
+	}
+	writeError(w, r, errDB)
+}
+
+func (a *API) blockchainBlocks(w http.ResponseWriter, r *http.Request) {
+	if !a.chainOrUnavailable(w, r) {
+		return
+	}
+	blocks, err := a.Chain.ListBlocks(r.Context(), queryInt(r, "before", 0), int(queryInt(r, "limit", 20)))
+	if err != nil {
+		writeChainErr(w, r, err)
+		return
+	}
+	var next int64
+	if len(blocks) > 0 {
+		next = blocks[len(blocks)-1].Height
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"blocks": blocks, "next_before": next}})
+}
+
+func (a *API) blockchainBlock(w http.ResponseWriter, r *http.Request) {
+	if !a.chainOrUnavailable(w, r) {
+		return
+	}
+	height, err := strconv.ParseInt(chi.URLParam(r, "height"), 10, 64)
+	if err != nil || height <= 0 {
+		writeError(w, r, badParam("height"))
+		return
+	}
+	ctx := r.Context()
+	b, err := a.Chain.GetBlock(ctx, height)
+	if err != nil {
+		writeChainErr(w, r, err)
+		return
+	}
+	offset := int(queryInt(r, "offset", 0))
+	txs, err := a.Chain.BlockEntries(ctx, height, offset, int(queryInt(r, "limit", 100)))
+	if err != nil {
+		writeChainErr(w, r, err)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"block": b, "txs": txs, "offset": offset}})
+}
+
+func (a *API) blockchainTx(w http.ResponseWriter, r *http.Request) {
+	if !a.chainOrUnavailable(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeError(w, r, badParam("id"))
+		return
+	}
+	t, err := a.Chain.GetTx(r.Context(), id)
+	if err != nil {
+		writeChainErr(w, r, err)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: t})
+}
+
+func (a *API) blockchainProof(w http.ResponseWriter, r *http.Request) {
+	if !a.chainOrUnavailable(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeError(w, r, badParam("id"))
+		return
+	}
+	p, err := a.Chain.Proof(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, chain.ErrNotFound) {
+			writeError(w, r, errNotSealed)
+			return
+		}
+		writeChainErr(w, r, err)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: p})
+}
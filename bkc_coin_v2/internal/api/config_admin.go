@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/config"
+)
+
+type adminConfigReloadRequest struct {
+	InitData string `json:"init_data"`
+	Reason   string `json:"reason"`
+}
+
+// adminConfigReload re-reads the config file on this node, like SIGHUP. The
+// tap limits reach the other fasttap replicas through Redis; the rest of the
+// economy has to be reloaded on each node.
+func (a *API) adminConfigReload(w http.ResponseWriter, r *http.Request) {
+	var req adminConfigReloadRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if user.ID != a.Cfg.AdminID {
+		writeError(w, r, errForbidden)
+		return
+	}
+	if a.Reloader == nil {
+		writeError(w, r, featureDisabled(400, "config_reload", "config reload disabled"))
+		return
+	}
+	var auditErr error
+	res, err := a.Reloader.Reload(r.Context(), func(res config.ReloadResult) error {
+		auditErr = a.recordAudit(r, user, audit.Entry{
+			Action: "config_reload",
+			Target: "config",
+			After:  audit.JSON(map[string]any{"changed": res.Changed, "restart_required": res.Restart}),
+			Reason: strings.TrimSpace(req.Reason),
+		})
+		return auditErr
+	})
+	if auditErr != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	if err != nil {
+		writeError(w, r, badRequest("config rejected").with("errors", strings.Split(err.Error(), "\n")))
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: res})
+}
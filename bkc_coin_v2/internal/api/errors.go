@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"bkc_coin_v2/internal/i18n"
+)
+
+// apiError is a catalogued API failure. Code is stable and what clients
+// should switch on; Text is the English string older clients match in
+// "error"; the localized "message" comes from i18n key "api_error_"+Code.
+type apiError struct {
+	Status  int
+	Code    string
+	Text    string
+	Details map[string]any
+}
+
+// with returns a copy of e carrying extra details.
+func (e apiError) with(kv ...any) apiError {
+	d := make(map[string]any, len(e.Details)+len(kv)/2)
+	for k, v := range e.Details {
+		d[k] = v
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if k, ok := kv[i].(string); ok {
+			d[k] = kv[i+1]
+		}
+	}
+	e.Details = d
+	return e
+}
+
+var (
+	errBadJSON        = apiError{Status: 400, Code: "bad_json", Text: "bad json"}
+	errBadBody        = apiError{Status: 400, Code: "bad_json", Text: "bad body"}
+	errUnauthorized   = apiError{Status: 401, Code: "unauthorized", Text: "unauthorized"}
+	errForbidden      = apiError{Status: 403, Code: "forbidden", Text: "forbidden"}
+	errDB             = apiError{Status: 500, Code: "db_error", Text: "db error"}
+	errServer         = apiError{Status: 500, Code: "server_error", Text: "server error"}
+	errNotFound       = apiError{Status: 404, Code: "not_found", Text: "not found"}
+	errRateLimited    = apiError{Status: http.StatusTooManyRequests, Code: "rate_limited", Text: "rate limited"}
+	errTooManyReqs    = apiError{Status: http.StatusTooManyRequests, Code: "rate_limited", Text: "too many requests"}
+	errTapRateLimited = apiError{Status: http.StatusTooManyRequests, Code: "rate_limited", Text: "tap rate limited"}
+	errNotSealed      = apiError{Status: 404, Code: "not_found", Text: "not sealed yet"}
+	errBadParams      = badRequest("bad params")
+	errHalted         = apiError{Status: http.StatusServiceUnavailable, Code: "halted", Text: "money movement halted by supply audit"}
+	errNotHalted      = apiError{Status: 409, Code: "not_halted", Text: "not halted"}
+	errBadSignature   = apiError{Status: 401, Code: "bad_signature", Text: "bad signature"}
+	errProfileBlocked = apiError{Status: http.StatusNotFound, Code: "feature_disabled", Text: "endpoint disabled on this node profile"}
+	errShuttingDown   = retryLater(http.StatusServiceUnavailable, "node is shutting down")
+
+	// Sessions.
+	errInitDataExpired  = apiError{Status: 401, Code: "init_data_expired", Text: "init_data expired"}
+	errBadRefreshToken  = apiError{Status: 401, Code: "bad_refresh_token", Text: "bad refresh token"}
+	errSessionRevoked   = apiError{Status: 401, Code: "session_revoked", Text: "session revoked"}
+	errNoSessionToken   = apiError{Status: 400, Code: "no_session_token", Text: "no session token"}
+	errSessionsDisabled = featureDisabled(404, "sessions", "sessions disabled")
+
+	// Recipients and transfers.
+	errInvalidRecipient  = apiError{Status: 400, Code: "invalid_recipient", Text: "invalid recipient"}
+	errBadChecksum       = apiError{Status: 400, Code: "bad_checksum", Text: "bad address checksum"}
+	errNoChecksum        = apiError{Status: 400, Code: "address_without_checksum", Text: "address without checksum, use the full address"}
+	errAmbiguousUsername = apiError{Status: 409, Code: "ambiguous_username", Text: "ambiguous username, use the address"}
+	errRecipientNotFound = apiError{Status: 404, Code: "recipient_not_found", Text: "recipient not found"}
+	errUserNotFound      = apiError{Status: 404, Code: "user_not_found", Text: "lender not found"}
+	errSelfTransfer      = apiError{Status: 400, Code: "self_transfer", Text: "cannot transfer to yourself"}
+	errSelfLender        = apiError{Status: 400, Code: "self_transfer", Text: "self lender"}
+
+	// Balances.
+	errNotEnough            = apiError{Status: 400, Code: "not_enough_balance", Text: "not enough balance"}
+	errNotEnoughForFee      = apiError{Status: 400, Code: "not_enough_balance", Text: "not enough balance for fee"}
+	errNotEnoughOrSoldOut   = apiError{Status: 400, Code: "not_enough_balance_or_sold_out", Text: "not enough balance or sold out"}
+	errNotEnoughFrozen      = apiError{Status: 400, Code: "not_enough_frozen", Text: "not enough frozen balance"}
+	errBorrowerNotEnough    = apiError{Status: 400, Code: "borrower_not_enough_balance", Text: "not enough borrower balance"}
+	errNotEnoughReserve     = apiError{Status: 400, Code: "not_enough_reserve", Text: "not enough reserve"}
+	errActiveLoanExists     = apiError{Status: 400, Code: "active_loan_exists", Text: "active loan exists"}
+	errMaxLevel             = apiError{Status: 400, Code: "max_level", Text: "max level reached"}
+	errListingNotFound      = apiError{Status: 404, Code: "listing_not_found", Text: "listing not found"}
+	errInvoiceNotFound      = apiError{Status: 404, Code: "invoice_not_found", Text: "invoice not found"}
+	errStandingLimit        = apiError{Status: 409, Code: "limit_reached", Text: "too many standing orders"}
+	errStandingOrderState   = apiError{Status: 409, Code: "standing_order_state", Text: "order not found or not in a state that allows this"}
+	errIdempotencyMismatch  = apiError{Status: http.StatusConflict, Code: "idempotency_mismatch", Text: "idempotency_key reused with a different request"}
+	errIdempotencyInProcess = apiError{Status: http.StatusConflict, Code: "idempotency_in_progress", Text: "request with this idempotency_key is in progress"}
+	errTooManyStreams       = apiError{Status: http.StatusTooManyRequests, Code: "limit_reached", Text: "too many event streams"}
+)
+
+// notEnough is errNotEnough with the amount the operation needed (0 if the
+// handler does not know it) and the balance read after the failed debit.
+func (a *API) notEnough(ctx context.Context, userID, required int64) apiError {
+	e := errNotEnough
+	if required > 0 {
+		e = e.with("required", required)
+	}
+	if u, err := a.DB.GetUser(ctx, userID); err == nil {
+		e = e.with("available", u.Balance)
+	}
+	return e
+}
+
+// badParam is a 400 for one invalid request field.
+func badParam(field string) apiError {
+	return invalid(field, "bad "+field)
+}
+
+// invalid is badParam with its own legacy text.
+func invalid(field, text string) apiError {
+	return apiError{Status: 400, Code: "bad_param", Text: text, Details: map[string]any{"field": field}}
+}
+
+// badRequest is a 400 the handler cannot pin on one field.
+func badRequest(text string) apiError {
+	return apiError{Status: 400, Code: "bad_request", Text: text}
+}
+
+// tooLong is a 400 for a field over its length limit.
+func tooLong(field, text string) apiError {
+	return apiError{Status: 400, Code: "too_long", Text: text, Details: map[string]any{"field": field}}
+}
+
+// featureDisabled is a feature switched off by config or node profile.
+func featureDisabled(status int, feature, text string) apiError {
+	return apiError{Status: status, Code: "feature_disabled", Text: text, Details: map[string]any{"feature": feature}}
+}
+
+// retryLater is a transient conflict the client should retry.
+func retryLater(status int, text string) apiError {
+	return apiError{Status: status, Code: "retry_later", Text: text}
+}
+
+// failed is an internal failure of one operation.
+func failed(text string) apiError {
+	return apiError{Status: 500, Code: "server_error", Text: text}
+}
+
+// upstreamFailed is a failure of an external service (Telegram, CryptoPay).
+func upstreamFailed(text string) apiError {
+	return apiError{Status: 500, Code: "upstream_error", Text: text}
+}
+
+// localeKey holds the request's *i18n.Language; authUserFrom overwrites it
+// with the user's Telegram language once the user is known.
+type localeKey struct{}
+
+func (a *API) localeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := r.URL.Query().Get("lang")
+		if code == "" {
+			code, _, _ = strings.Cut(r.Header.Get("Accept-Language"), ",")
+		}
+		lang := i18n.FromLanguageCode(code)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localeKey{}, &lang)))
+	})
+}
+
+func setRequestLanguage(r *http.Request, code string) {
+	if code == "" {
+		return
+	}
+	if lang, ok := r.Context().Value(localeKey{}).(*i18n.Language); ok {
+		*lang = i18n.FromLanguageCode(code)
+	}
+}
+
+func requestLanguage(r *http.Request) i18n.Language {
+	if lang, ok := r.Context().Value(localeKey{}).(*i18n.Language); ok {
+		return *lang
+	}
+	return i18n.DefaultLocaleManager.DefaultLanguage()
+}
+
+// writeError answers with a catalogued error in the request's language.
+func writeError(w http.ResponseWriter, r *http.Request, e apiError) {
+	key := "api_error_" + e.Code
+	var args []any
+	if f, ok := e.Details["field"]; ok {
+		args = append(args, f)
+	}
+	msg := i18n.T(requestLanguage(r), key, args...)
+	if msg == key {
+		msg = e.Text
+	}
+	env := envelope{OK: false, Error: e.Text, Code: e.Code, Message: msg}
+	if len(e.Details) > 0 {
+		env.Details = e.Details
+	}
+	writeJSON(w, e.Status, env)
+}
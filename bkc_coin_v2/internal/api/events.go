@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/address"
+	"bkc_coin_v2/internal/events"
+	"bkc_coin_v2/internal/telegram"
+)
+
+// eventsStream is a Server-Sent Events stream of the user's events.
+// EventSource cannot send headers, so init_data (or a session token) may come
+// in the query; the resume cursor comes in Last-Event-ID, which the browser
+// sets on reconnect, or in last_event_id.
+func (a *API) eventsStream(w http.ResponseWriter, r *http.Request) {
+	if a.Events == nil {
+		writeError(w, r, featureDisabled(http.StatusNotFound, "events", "events disabled"))
+		return
+	}
+	q := r.URL.Query()
+	cred := q.Get("init_data")
+	if cred == "" {
+		cred = q.Get("token")
+	}
+	user, ok := a.authUserFrom(r, cred)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		writeError(w, r, errServer)
+		return
+	}
+	lastID := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
+	if lastID == "" {
+		lastID = strings.TrimSpace(q.Get("last_event_id"))
+	}
+
+	stream, replay, resync, err := a.Events.Subscribe(user.ID, lastID)
+	if err != nil {
+		if errors.Is(err, events.ErrTooManyStreams) {
+			writeError(w, r, errTooManyStreams.with("max", a.Events.Config().StreamsPerUser))
+			return
+		}
+		if errors.Is(err, events.ErrClosed) {
+			writeError(w, r, errShuttingDown)
+			return
+		}
+		writeError(w, r, errServer)
+		return
+	}
+	defer stream.Close()
+
+	// The stream outlives any write deadline set for ordinary requests.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if resync {
+		writeSSE(w, events.Event{Type: events.Resync, UserID: user.ID, At: time.Now().UTC()})
+	}
+	for _, ev := range replay {
+		writeSSE(w, ev)
+	}
+	w.(http.Flusher).Flush()
+
+	heartbeat := time.NewTicker(a.Events.Config().Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-stream.C:
+			if !ok {
+				return // dropped as too slow; the client resumes from its last id
+			}
+			writeSSE(w, ev)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		w.(http.Flusher).Flush()
+	}
+}
+
+// writeSSE writes one event. Resync has no id so it does not move the
+// client's cursor.
+func writeSSE(w http.ResponseWriter, ev events.Event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	if ev.ID != "" {
+		fmt.Fprintf(w, "id: %s\n", ev.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+}
+
+// userRef is how the other party of an event is shown.
+func userRef(u telegram.AuthUser) map[string]any {
+	return map[string]any{
+		"user_id":    u.ID,
+		"address":    address.Format(u.ID),
+		"username":   u.Username,
+		"first_name": u.FirstName,
+	}
+}
+
+// emitLoan tells the other party of a P2P loan that it changed. The loan is
+// read after the commit, so a call that changed nothing emits nothing.
+func (a *API) emitLoan(ctx context.Context, loanID int64, typ, wantStatus string, toLender bool) {
+	if a.Events == nil {
+		return
+	}
+	loan, err := a.DB.GetP2PLoan(ctx, loanID)
+	if err != nil || loan.Status != wantStatus {
+		return
+	}
+	to := loan.BorrowerID
+	if toLender {
+		to = loan.LenderID
+	}
+	a.Events.Publish(to, typ, map[string]any{"loan": loan})
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/fasttap"
+)
+
+type adminFasttapDLQListRequest struct {
+	InitData string `json:"init_data"`
+	Start    string `json:"start"` // last id of the previous page
+	Limit    int64  `json:"limit"`
+}
+
+type adminFasttapReconcileRequest struct {
+	InitData string `json:"init_data"`
+	Apply    bool   `json:"apply"` // false = dry run
+	Reason   string `json:"reason"`
+}
+
+type adminFasttapDLQIDsRequest struct {
+	InitData string   `json:"init_data"`
+	IDs      []string `json:"ids"`
+	Reason   string   `json:"reason"`
+}
+
+func (a *API) adminFasttapDLQList(w http.ResponseWriter, r *http.Request) {
+	var req adminFasttapDLQListRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if user.ID != a.Cfg.AdminID {
+		writeError(w, r, errForbidden)
+		return
+	}
+	if a.FastTap == nil || !a.FastTap.Enabled() {
+		writeError(w, r, featureDisabled(400, "fasttap", "fasttap disabled"))
+		return
+	}
+	ctx := r.Context()
+	entries, err := a.FastTap.ListDLQ(ctx, req.Start, req.Limit)
+	if err != nil {
+		writeError(w, r, failed("redis error"))
+		return
+	}
+	total, _ := a.FastTap.Rdb.XLen(ctx, a.FastTap.DLQKey).Result()
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{
+		"stream":  a.FastTap.DLQKey,
+		"total":   total,
+		"entries": entries,
+	}})
+}
+
+func (a *API) adminFasttapDLQReplay(w http.ResponseWriter, r *http.Request) {
+	a.adminFasttapDLQAction(w, r, true)
+}
+
+func (a *API) adminFasttapDLQDiscard(w http.ResponseWriter, r *http.Request) {
+	a.adminFasttapDLQAction(w, r, false)
+}
+
+func (a *API) adminFasttapDLQAction(w http.ResponseWriter, r *http.Request, replay bool) {
+	var req adminFasttapDLQIDsRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if user.ID != a.Cfg.AdminID {
+		writeError(w, r, errForbidden)
+		return
+	}
+	if a.FastTap == nil || !a.FastTap.Enabled() {
+		writeError(w, r, featureDisabled(400, "fasttap", "fasttap disabled"))
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > 500 {
+		writeError(w, r, badParam("ids"))
+		return
+	}
+	run, action := a.FastTap.DiscardDLQ, "fasttap_dlq_discard"
+	if replay {
+		run, action = a.FastTap.ReplayDLQ, "fasttap_dlq_replay"
+	}
+	// The DLQ lives in Redis, so the entry is written first: no entry, no
+	// action. Per-event results are in the response and the ledger.
+	if err := a.recordAudit(r, user, audit.Entry{
+		Action: action,
+		Target: "fasttap_dlq",
+		Before: audit.JSON(map[string]any{"ids": req.IDs}),
+		Reason: strings.TrimSpace(req.Reason),
+	}); err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	results, err := run(r.Context(), req.IDs)
+	if err != nil {
+		writeError(w, r, failed("redis error"))
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"results": results}})
+}
+
+func (a *API) adminFasttapReconcile(w http.ResponseWriter, r *http.Request) {
+	var req adminFasttapReconcileRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if user.ID != a.Cfg.AdminID {
+		writeError(w, r, errForbidden)
+		return
+	}
+	if a.FastTap == nil || !a.FastTap.Enabled() {
+		writeError(w, r, featureDisabled(400, "fasttap", "fasttap disabled"))
+		return
+	}
+	// A dry run changes nothing and is not audited. An applied run records
+	// the diffs it is about to fix before touching Redis.
+	var auditErr error
+	rep, err := a.FastTap.Reconcile(r.Context(), req.Apply, func(ctx context.Context, diffs []fasttap.ReconcileDiff) error {
+		auditErr = a.recordAudit(r, user, audit.Entry{
+			Action: "fasttap_reconcile",
+			Target: "fasttap",
+			After:  audit.JSON(map[string]any{"diffs": diffs}),
+			Reason: strings.TrimSpace(req.Reason),
+		})
+		return auditErr
+	})
+	if auditErr != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, fasttap.ErrStreamBusy) {
+			writeError(w, r, retryLater(409, "tap stream not drained, retry"))
+			return
+		}
+		writeError(w, r, failed("reconcile failed"))
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: rep})
+}
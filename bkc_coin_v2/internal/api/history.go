@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/history"
+)
+
+const (
+	historyDefaultLimit = 50
+	historyMaxLimit     = 200
+	historyExportMaxAge = 366 * 24 * time.Hour
+)
+
+type historyRequest struct {
+	InitData string   `json:"init_data"`
+	Kinds    []string `json:"kinds"`
+	From     string   `json:"from"` // RFC3339, YYYY-MM-DD or unix seconds; inclusive
+	To       string   `json:"to"`   // exclusive
+	Cursor   string   `json:"cursor"`
+	Limit    int      `json:"limit"`
+}
+
+func normalizeKinds(in []string) []string {
+	out := make([]string, 0, len(in))
+	for _, k := range in {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if k != "" && len(out) < 32 {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func parseHistoryRange(req historyRequest) (time.Time, time.Time, error) {
+	from, err := history.ParseTime(req.From)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	to, err := history.ParseTime(req.To)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !from.IsZero() && !to.IsZero() && !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("empty range")
+	}
+	return from, to, nil
+}
+
+func (a *API) history(w http.ResponseWriter, r *http.Request) {
+	var req historyRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	from, to, err := parseHistoryRange(req)
+	if err != nil {
+		writeError(w, r, badParam("range"))
+		return
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = historyDefaultLimit
+	}
+	if limit > historyMaxLimit {
+		limit = historyMaxLimit
+	}
+	f := db.HistoryFilter{UserID: user.ID, Kinds: normalizeKinds(req.Kinds), From: from, To: to, Limit: limit + 1}
+	if strings.TrimSpace(req.Cursor) != "" {
+		f.BeforeTS, f.BeforeID, err = history.DecodeCursor(req.Cursor)
+		if err != nil {
+			writeError(w, r, badParam("cursor"))
+			return
+		}
+	}
+
+	entries, err := a.DB.ListUserHistory(r.Context(), f)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	next := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[len(entries)-1]
+		next = history.EncodeCursor(last.TS, last.ID)
+	}
+	items := make([]history.Item, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, history.FromEntry(e, user.ID))
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{
+		"items":       items,
+		"next_cursor": next,
+	}})
+}
+
+// historyExport streams the range as CSV. The range is required and capped
+// so one export cannot scan a user's whole ledger forever.
+func (a *API) historyExport(w http.ResponseWriter, r *http.Request) {
+	var req historyRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	from, to, err := parseHistoryRange(req)
+	if err != nil || from.IsZero() {
+		writeError(w, r, badParam("range"))
+		return
+	}
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	if to.Sub(from) > historyExportMaxAge {
+		writeError(w, r, tooLong("range", "range too long"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	name := fmt.Sprintf("bkc_history_%d_%s_%s.csv", user.ID, from.Format("20060102"), to.Format("20060102"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	cw := history.NewCSVWriter(w, user.ID)
+	if fl, ok := w.(http.Flusher); ok {
+		cw.OnFlush = fl.Flush
+	}
+	f := db.HistoryFilter{UserID: user.ID, Kinds: normalizeKinds(req.Kinds), From: from, To: to, Asc: true}
+	if err := a.DB.ForEachUserLedger(ctx, f, cw.Write); err != nil {
+		// Headers are already sent; the truncated file is the only signal left.
+		logger.ErrorContext(ctx, "history export failed", "err", err)
+		return
+	}
+	_ = cw.Flush()
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Money-moving endpoints accept an optional idempotency key (JSON field
+// "idempotency_key" or the Idempotency-Key header). The first response is
+// stored and replayed for retries with the same payload; reusing the key for
+// a different payload is a conflict. Keys are scoped per user.
+//
+// A handler calls markCommitted as soon as its money movement is in the
+// database. From then on the key is never released: if the response itself
+// fails, retries get a bare {"committed": true} instead of running again.
+
+const maxIdempotencyKeyLen = 128
+
+// idempotentHandlerTimeout bounds a keyed request. It has to stay well below
+// the db lease after which a pending key may be taken over.
+const idempotentHandlerTimeout = time.Minute
+
+// committedResponse is stored when the handler committed but then failed to
+// build its answer.
+const committedResponse = `{"ok":true,"data":{"committed":true}}`
+
+type idemCommittedKey struct{}
+
+// markCommitted records that the current keyed request has written its money
+// movement. Outside idempotent it does nothing.
+func markCommitted(r *http.Request) {
+	if c, ok := r.Context().Value(idemCommittedKey{}).(*atomic.Bool); ok {
+		c.Store(true)
+	}
+}
+
+type idempotencyEnvelope struct {
+	InitData       string `json:"init_data"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+func validIdempotencyKey(k string) bool {
+	if len(k) < 8 || len(k) > maxIdempotencyKeyLen {
+		return false
+	}
+	for _, c := range k {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == ':' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyHash fingerprints the payload without init_data (which changes
+// per WebApp session) and the key itself. Maps marshal with sorted keys.
+// Numbers stay json.Number: as float64, amounts above 2^53 would collide.
+func idempotencyHash(endpoint string, body []byte) (string, bool) {
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil || dec.More() {
+		return "", false
+	}
+	delete(m, "init_data")
+	delete(m, "idempotency_key")
+	canon, err := json.Marshal(m)
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(append([]byte(endpoint+"\n"), canon...))
+	return hex.EncodeToString(sum[:]), true
+}
+
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (a *API) idempotent(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, errBadBody)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var env idempotencyEnvelope
+		_ = json.Unmarshal(body, &env)
+		key := strings.TrimSpace(env.IdempotencyKey)
+		if key == "" {
+			key = strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+		}
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeError(w, r, badParam("idempotency_key"))
+			return
+		}
+		user, ok := a.authUserFrom(r, env.InitData)
+		if !ok {
+			next(w, r) // the handler answers 401
+			return
+		}
+		hash, ok := idempotencyHash(endpoint, body)
+		if !ok {
+			next(w, r) // the handler answers "bad json"
+			return
+		}
+
+		ctx := r.Context()
+		ttl := time.Duration(a.Cfg.IdempotencyTTLHours) * time.Hour
+		claimed, rec, err := a.DB.ClaimIdempotencyKey(ctx, user.ID, key, endpoint, hash, ttl)
+		if err != nil {
+			writeError(w, r, errDB)
+			return
+		}
+		if !claimed {
+			switch {
+			case rec.Endpoint != endpoint || rec.RequestHash != hash:
+				writeError(w, r, errIdempotencyMismatch)
+			case rec.State != "done":
+				w.Header().Set("Retry-After", "2")
+				writeError(w, r, errIdempotencyInProcess)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.Status)
+				_, _ = io.WriteString(w, rec.Response)
+			}
+			return
+		}
+
+		committed := new(atomic.Bool)
+		hctx, hcancel := context.WithTimeout(context.WithValue(ctx, idemCommittedKey{}, committed), idempotentHandlerTimeout)
+		defer hcancel()
+		cw := &captureWriter{ResponseWriter: w}
+		next(cw, r.WithContext(hctx))
+
+		// Store the outcome on a fresh context: the client may already be gone,
+		// which is exactly when the retry will come.
+		storeCtx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+		defer cancel()
+		status, response := cw.status, cw.buf.String()
+		if status == 0 || status >= 500 {
+			if !committed.Load() {
+				// Nothing was written; let the retry run again.
+				if err := a.DB.ReleaseIdempotencyKey(storeCtx, user.ID, key); err != nil {
+					logger.ErrorContext(storeCtx, "idempotency release failed", "key", key, "err", err)
+				}
+				return
+			}
+			logger.WarnContext(storeCtx, "idempotent request committed but failed to respond", "key", key, "status", status)
+			status, response = http.StatusOK, committedResponse
+		}
+		if err := a.DB.CompleteIdempotencyKey(storeCtx, user.ID, key, status, response); err != nil {
+			logger.ErrorContext(storeCtx, "idempotency store failed", "key", key, "status", status, "err", err)
+		}
+	}
+}
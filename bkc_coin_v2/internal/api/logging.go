@@ -0,0 +1,42 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/logx"
+)
+
+var logger = logx.Component("api")
+
+const requestIDHeader = "X-Request-ID"
+
+// requestLogMiddleware gives every request an ID (the proxy's X-Request-ID
+// when it is sane), returns it in X-Request-ID and logs the request when it
+// ends: at DEBUG normally, at ERROR for 5xx.
+func (a *API) requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+		if !logx.ValidRequestID(id) {
+			id = ""
+		}
+		ctx := logx.WithRequestID(r.Context(), id)
+		w.Header().Set(requestIDHeader, logx.RequestID(ctx))
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		level := slog.LevelDebug
+		if sw.status >= 500 {
+			level = slog.LevelError
+		}
+		logger.Log(ctx, level, "http request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"duration_ms", time.Since(start).Milliseconds())
+	})
+}
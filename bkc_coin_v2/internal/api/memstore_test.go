@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bkc_coin_v2/internal/address"
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/config"
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/store/memstore"
+	"bkc_coin_v2/internal/tapcore"
+)
+
+const (
+	testBotToken = "123456:test-token"
+	testAdminID  = 1
+)
+
+// storeTaps is the tap backend of in-process runs: snapshots come from the
+// store, tapping itself is not served.
+type storeTaps struct {
+	st tapcore.SnapshotStore
+}
+
+func (t storeTaps) Name() string { return "store" }
+
+func (t storeTaps) Tap(ctx context.Context, userID int64, username, firstName string, requested int64, now time.Time) (tapcore.TapResult, error) {
+	return tapcore.TapResult{}, context.Canceled
+}
+
+func (t storeTaps) Snapshot(ctx context.Context, u db.UserState, now time.Time) (tapcore.Snapshot, error) {
+	return tapcore.LoadSnapshot(ctx, config.Econ(), t.st, u, now)
+}
+
+func (t storeTaps) InvalidateUser(ctx context.Context, userID int64) {}
+
+func (t storeTaps) Stats(ctx context.Context) map[string]any { return map[string]any{} }
+
+func (t storeTaps) Flush(ctx context.Context) error { return nil }
+
+// newTestAPI builds an API over a fresh memstore with the audit log kept in
+// the same store. The reserve starts at reserve coins.
+func newTestAPI(t *testing.T, reserve int64) (*API, *memstore.Store, http.Handler) {
+	t.Helper()
+	st := memstore.New()
+	if _, err := st.EnsureSystemState(context.Background(), reserve, testAdminID, 0, reserve, 1000, 100, 10, 100); err != nil {
+		t.Fatalf("system state: %v", err)
+	}
+	a := &API{
+		Cfg: config.Config{
+			BotToken:            testBotToken,
+			AdminID:             testAdminID,
+			TransferMemoMaxLen:  140,
+			IdempotencyTTLHours: 24,
+		},
+		DB:    st,
+		Taps:  storeTaps{st},
+		Audit: audit.NewStore(st),
+	}
+	return a, st, a.Router()
+}
+
+// initData signs a WebApp initData string for userID with testBotToken.
+func initData(userID int64) string {
+	user, _ := json.Marshal(map[string]any{"id": userID, "first_name": "U" + strconv.FormatInt(userID, 10)})
+	vals := url.Values{}
+	vals.Set("user", string(user))
+	vals.Set("auth_date", strconv.FormatInt(time.Now().Unix(), 10))
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+vals.Get(k))
+	}
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(testBotToken))
+	mac := hmac.New(sha256.New, secret.Sum(nil))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	vals.Set("hash", hex.EncodeToString(mac.Sum(nil)))
+	return vals.Encode()
+}
+
+type testResponse struct {
+	status int
+	header http.Header
+	env    struct {
+		OK   bool           `json:"ok"`
+		Code string         `json:"code"`
+		Data map[string]any `json:"data"`
+	}
+}
+
+func post(t *testing.T, h http.Handler, path string, body map[string]any) testResponse {
+	t.Helper()
+	raw, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(raw))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	out := testResponse{status: rec.Code, header: rec.Header()}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out.env); err != nil {
+		t.Fatalf("%s: bad response %q: %v", path, rec.Body.String(), err)
+	}
+	return out
+}
+
+func balance(t *testing.T, st *memstore.Store, userID int64) int64 {
+	t.Helper()
+	u, err := st.GetUser(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("get user %d: %v", userID, err)
+	}
+	return u.Balance
+}
+
+func fund(t *testing.T, st *memstore.Store, userID, amount int64) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := st.EnsureUser(ctx, userID, "", "U", 100); err != nil {
+		t.Fatalf("ensure user: %v", err)
+	}
+	if err := st.CreditFromReserve(ctx, userID, amount, "admin_reserve_send", nil, nil); err != nil {
+		t.Fatalf("fund: %v", err)
+	}
+}
+
+func TestStateOverMemstore(t *testing.T) {
+	_, st, h := newTestAPI(t, 1_000_000)
+	fund(t, st, 42, 500)
+
+	res := post(t, h, "/state", map[string]any{"init_data": initData(42)})
+	if res.status != 200 || !res.env.OK {
+		t.Fatalf("state: %d %+v", res.status, res.env)
+	}
+	if got := res.env.Data["balance"]; got != float64(500) {
+		t.Fatalf("balance = %v, want 500", got)
+	}
+	if res := post(t, h, "/state", map[string]any{"init_data": "user=%7B%22id%22%3A42%7D&hash=00"}); res.status != 401 {
+		t.Fatalf("forged init_data: status %d, want 401", res.status)
+	}
+}
+
+func TestTransferOverMemstore(t *testing.T) {
+	_, st, h := newTestAPI(t, 1_000_000)
+	fund(t, st, 42, 500)
+	fund(t, st, 43, 0)
+
+	res := post(t, h, "/transfer", map[string]any{"init_data": initData(42), "to": address.Format(43), "amount": 200, "memo": "rent"})
+	if res.status != 200 || !res.env.OK {
+		t.Fatalf("transfer: %d %+v", res.status, res.env)
+	}
+	if b := balance(t, st, 42); b != 300 {
+		t.Fatalf("sender balance = %d, want 300", b)
+	}
+	if b := balance(t, st, 43); b != 200 {
+		t.Fatalf("recipient balance = %d, want 200", b)
+	}
+
+	res = post(t, h, "/transfer", map[string]any{"init_data": initData(42), "to": address.Format(43), "amount": 301})
+	if res.status != 400 || res.env.Code != "not_enough_balance" {
+		t.Fatalf("overdraft: %d %q, want 400 not_enough_balance", res.status, res.env.Code)
+	}
+	if b := balance(t, st, 42); b != 300 {
+		t.Fatalf("sender balance after failed transfer = %d, want 300", b)
+	}
+}
+
+func TestIdempotentTransferOverMemstore(t *testing.T) {
+	_, st, h := newTestAPI(t, 1_000_000)
+	fund(t, st, 42, 500)
+	fund(t, st, 43, 0)
+
+	body := map[string]any{"init_data": initData(42), "to": address.Format(43), "amount": 100, "idempotency_key": "pay-0001"}
+	first := post(t, h, "/transfer", body)
+	second := post(t, h, "/transfer", body)
+	if first.status != 200 || second.status != 200 {
+		t.Fatalf("statuses %d, %d, want 200, 200", first.status, second.status)
+	}
+	if second.header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("second request was not replayed")
+	}
+	if b := balance(t, st, 43); b != 100 {
+		t.Fatalf("recipient balance = %d, want 100 (paid once)", b)
+	}
+
+	body["amount"] = 101
+	if res := post(t, h, "/transfer", body); res.status != http.StatusConflict || res.env.Code != "idempotency_mismatch" {
+		t.Fatalf("reused key: %d %q, want 409 idempotency_mismatch", res.status, res.env.Code)
+	}
+}
+
+func TestIdempotencyHashKeepsLargeNumbers(t *testing.T) {
+	a, _ := idempotencyHash("/transfer", []byte(`{"amount": 9007199254740993}`))
+	b, _ := idempotencyHash("/transfer", []byte(`{"amount": 9007199254740992}`))
+	if a == b {
+		t.Fatalf("amounts above 2^53 hash the same")
+	}
+}
+
+func TestAdminReserveSendIsAuditedOverMemstore(t *testing.T) {
+	a, st, h := newTestAPI(t, 1_000_000)
+	fund(t, st, 43, 0)
+
+	res := post(t, h, "/admin/reserve/send", map[string]any{"init_data": initData(testAdminID), "to_user_id": 43, "amount": 250, "reason": "prize"})
+	if res.status != 200 || !res.env.OK {
+		t.Fatalf("reserve send: %d %+v", res.status, res.env)
+	}
+	if b := balance(t, st, 43); b != 250 {
+		t.Fatalf("balance = %d, want 250", b)
+	}
+
+	ctx := context.Background()
+	entries, err := a.Audit.List(ctx, audit.Filter{Action: "reserve_send"})
+	if err != nil {
+		t.Fatalf("list audit: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Target != "user:43" || entries[0].Reason != "prize" || entries[0].Actor.ID != testAdminID {
+		t.Fatalf("audit entries = %+v, want one reserve_send to user:43", entries)
+	}
+	rep, err := a.Audit.Verify(ctx)
+	if err != nil || !rep.OK || rep.HeadSeq != 1 {
+		t.Fatalf("verify = %+v, %v; want an intact chain of 1", rep, err)
+	}
+
+	if res := post(t, h, "/admin/reserve/send", map[string]any{"init_data": initData(43), "to_user_id": 43, "amount": 1}); res.status != 403 {
+		t.Fatalf("non-admin: status %d, want 403", res.status)
+	}
+}
+
+func TestAuditFailureRollsBackOverMemstore(t *testing.T) {
+	_, st, _ := newTestAPI(t, 1_000_000)
+	fund(t, st, 43, 0)
+
+	hook := audit.Hook(audit.Actor{Kind: audit.ActorSystem}, audit.Entry{}) // no action: append fails
+	if err := st.CreditFromReserve(context.Background(), 43, 10, "admin_reserve_send", nil, hook); err == nil {
+		t.Fatalf("credit with a failing audit hook succeeded")
+	}
+	if b := balance(t, st, 43); b != 0 {
+		t.Fatalf("balance = %d, want 0 after rollback", b)
+	}
+	if n, _ := st.CountAuditSince(context.Background(), "", time.Time{}); n != 0 {
+		t.Fatalf("audit entries = %d, want 0", n)
+	}
+}
+
+func TestStandingResumeSkipsMissedSlotsOverMemstore(t *testing.T) {
+	_, st, h := newTestAPI(t, 1_000_000)
+	fund(t, st, 42, 500)
+	fund(t, st, 43, 0)
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	o, err := st.CreateStandingOrder(ctx, db.StandingOrder{
+		FromID: 42, ToID: 43, Amount: 10, Schedule: "daily", StartAt: now.Add(-10*24*time.Hour + time.Hour),
+	}, 10)
+	if err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+	if res := post(t, h, "/standing/pause", map[string]any{"init_data": initData(42), "order_id": o.OrderID}); res.status != 200 {
+		t.Fatalf("pause: %d %+v", res.status, res.env)
+	}
+	if res := post(t, h, "/standing/resume", map[string]any{"init_data": initData(42), "order_id": o.OrderID}); res.status != 200 {
+		t.Fatalf("resume: %d %+v", res.status, res.env)
+	}
+	got, err := st.GetStandingOrder(ctx, o.OrderID)
+	if err != nil {
+		t.Fatalf("get order: %v", err)
+	}
+	if got.Status != db.StandingActive || got.Slot != 10 || got.NextRunAt.Before(now) {
+		t.Fatalf("resumed order: status %s slot %d next %s; want active, slot 10, not before %s", got.Status, got.Slot, got.NextRunAt, now)
+	}
+}
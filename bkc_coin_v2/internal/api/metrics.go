@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/metrics"
+	"bkc_coin_v2/internal/tapcore"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var (
+	httpDuration = metrics.Default.Histogram("bkc_http_request_duration_seconds",
+		"API request latency by route pattern.", metrics.DefBuckets, "method", "route", "code")
+	tapRequests = metrics.Default.Counter("bkc_tap_requests_total",
+		"Tap requests served, by backend and outcome.", "backend", "reason")
+	tapsMinted = metrics.Default.Counter("bkc_taps_total",
+		"Taps consumed from energy, by backend.", "backend")
+	tapCoins = metrics.Default.Counter("bkc_tap_coins_total",
+		"Coins minted by taps, by backend.", "backend")
+)
+
+// metricsMiddleware times every request by its chi route pattern, so
+// /blockchain/blocks/{height} is one series. Requests refused before routing
+// (rate limits, node profile) are "other". Event streams are left out: their
+// duration is the life of the connection.
+func (a *API) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/events/stream") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		route := "other"
+		if rc := chi.RouteContext(r.Context()); rc != nil {
+			if p := rc.RoutePattern(); p != "" && !strings.HasSuffix(p, "*") {
+				route = p
+			}
+		}
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpDuration.With(r.Method, route, strconv.Itoa(status)).Since(start)
+	})
+}
+
+func observeTap(backend string, res tapcore.TapResult) {
+	reason := res.Reason
+	if reason == "" {
+		reason = "ok"
+	}
+	tapRequests.With(backend, reason).Inc()
+	tapsMinted.With(backend).Add(float64(res.Taps))
+	tapCoins.With(backend).Add(float64(res.Gained))
+}
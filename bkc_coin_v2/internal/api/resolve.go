@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"bkc_coin_v2/internal/address"
+	"bkc_coin_v2/internal/db"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type resolveRequest struct {
+	InitData string `json:"init_data"`
+	Query    string `json:"query"`
+}
+
+// resolveRecipient turns a user_id, BKC address or @username into an
+// existing account. A legacy address without a checksum is accepted only
+// with allowLegacy (/resolve, which shows who it is); endpoints moving
+// coins get address.ErrNoChecksum, so a mistyped digit cannot pay someone else.
+func (a *API) resolveRecipient(ctx context.Context, raw string, allowLegacy bool) (db.UserProfile, address.Kind, error) {
+	ref, err := address.Parse(raw)
+	if err != nil {
+		return db.UserProfile{}, "", err
+	}
+	if ref.Kind == address.KindLegacy && !allowLegacy {
+		return db.UserProfile{}, ref.Kind, address.ErrNoChecksum
+	}
+	var p db.UserProfile
+	if ref.Kind == address.KindUsername {
+		p, err = a.DB.FindUserByUsername(ctx, ref.Username)
+	} else {
+		p, err = a.DB.GetUserProfile(ctx, ref.UserID)
+	}
+	return p, ref.Kind, err
+}
+
+// writeResolveError maps resolver errors to responses.
+func writeResolveError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, address.ErrChecksum):
+		writeError(w, r, errBadChecksum)
+	case errors.Is(err, address.ErrNoChecksum):
+		writeError(w, r, errNoChecksum)
+	case errors.Is(err, address.ErrInvalid):
+		writeError(w, r, errInvalidRecipient)
+	case errors.Is(err, db.ErrAmbiguous):
+		writeError(w, r, errAmbiguousUsername)
+	case errors.Is(err, pgx.ErrNoRows):
+		writeError(w, r, errRecipientNotFound)
+	default:
+		writeError(w, r, errDB)
+	}
+}
+
+func recipientView(p db.UserProfile) map[string]any {
+	return map[string]any{
+		"user_id":    p.UserID,
+		"address":    address.Format(p.UserID),
+		"username":   p.Username,
+		"first_name": p.FirstName,
+		"photo_url":  p.PhotoURL,
+	}
+}
+
+// resolve lets the WebApp show who a transfer goes to before it is confirmed.
+func (a *API) resolve(w http.ResponseWriter, r *http.Request) {
+	var req resolveRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	p, kind, err := a.resolveRecipient(r.Context(), req.Query, true)
+	if err != nil {
+		writeResolveError(w, r, err)
+		return
+	}
+	view := recipientView(p)
+	view["kind"] = kind
+	view["self"] = p.UserID == user.ID
+	if kind == address.KindLegacy {
+		// The client must confirm the account and send view["address"] instead.
+		view["warning"] = errNoChecksum.Code
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: view})
+}
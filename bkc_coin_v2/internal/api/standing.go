@@ -0,0 +1,168 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"bkc_coin_v2/internal/config"
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/history"
+	"bkc_coin_v2/internal/standing"
+)
+
+// standingMaxLead is how far ahead the first payment may be scheduled.
+const standingMaxLead = 366 * 24 * time.Hour
+
+type standingCreateRequest struct {
+	InitData string `json:"init_data"`
+	To       string `json:"to"`
+	Amount   int64  `json:"amount"`
+	Memo     string `json:"memo"`
+	Schedule string `json:"schedule"` // once | daily | weekly | monthly
+	StartAt  string `json:"start_at"` // RFC3339, YYYY-MM-DD or unix; empty = now
+}
+
+type standingListRequest struct {
+	InitData string `json:"init_data"`
+	Limit    int64  `json:"limit"`
+}
+
+type standingIDRequest struct {
+	InitData string `json:"init_data"`
+	OrderID  int64  `json:"order_id"`
+}
+
+func (a *API) standingCreate(w http.ResponseWriter, r *http.Request) {
+	var req standingCreateRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if req.Amount <= 0 {
+		writeError(w, r, invalid("amount", "amount must be > 0"))
+		return
+	}
+	schedule, err := standing.ParseSchedule(req.Schedule)
+	if err != nil {
+		writeError(w, r, invalid("schedule", "schedule must be once, daily, weekly or monthly"))
+		return
+	}
+	now := time.Now().UTC()
+	startAt, err := history.ParseTime(req.StartAt)
+	if err != nil {
+		writeError(w, r, badParam("start_at"))
+		return
+	}
+	if startAt.Before(now) {
+		startAt = now
+	}
+	if startAt.Sub(now) > standingMaxLead {
+		writeError(w, r, invalid("start_at", "start_at is too far ahead"))
+		return
+	}
+	memo := normalizeMemo(req.Memo)
+	if int64(utf8.RuneCountInString(memo)) > a.Cfg.TransferMemoMaxLen {
+		writeError(w, r, tooLong("memo", "memo too long").with("max", a.Cfg.TransferMemoMaxLen))
+		return
+	}
+
+	ctx := r.Context()
+	to, _, err := a.resolveRecipient(ctx, strings.TrimSpace(req.To), false)
+	if err != nil {
+		writeResolveError(w, r, err)
+		return
+	}
+	if to.UserID == user.ID {
+		writeError(w, r, errSelfTransfer)
+		return
+	}
+	if _, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(config.Econ().EnergyMax)); err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+
+	o, err := a.DB.CreateStandingOrder(ctx, db.StandingOrder{
+		FromID:   user.ID,
+		ToID:     to.UserID,
+		Amount:   req.Amount,
+		Memo:     memo,
+		Schedule: schedule,
+		StartAt:  startAt,
+	}, a.Cfg.StandingOrdersPerUser)
+	if err != nil {
+		if errors.Is(err, db.ErrLimit) {
+			writeError(w, r, errStandingLimit.with("max", a.Cfg.StandingOrdersPerUser))
+			return
+		}
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"order": o, "to": recipientView(to)}})
+}
+
+func (a *API) standingList(w http.ResponseWriter, r *http.Request) {
+	var req standingListRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	orders, err := a.DB.ListStandingOrders(r.Context(), user.ID, req.Limit)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	if orders == nil {
+		orders = []db.StandingOrder{}
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"orders": orders}})
+}
+
+// standingSetStatus serves pause, resume and cancel; only the sender may
+// change an order.
+func (a *API) standingSetStatus(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req standingIDRequest
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, r, errBadJSON)
+			return
+		}
+		user, ok := a.authUserFrom(r, req.InitData)
+		if !ok {
+			writeError(w, r, errUnauthorized)
+			return
+		}
+		if req.OrderID <= 0 {
+			writeError(w, r, badParam("order_id"))
+			return
+		}
+		ctx := r.Context()
+		changed, err := a.DB.SetStandingOrderStatus(ctx, req.OrderID, user.ID, status, standing.Resume(time.Now().UTC()))
+		if err != nil {
+			writeError(w, r, errDB)
+			return
+		}
+		if !changed {
+			writeError(w, r, errStandingOrderState)
+			return
+		}
+		o, err := a.DB.GetStandingOrder(ctx, req.OrderID)
+		if err != nil {
+			writeError(w, r, errDB)
+			return
+		}
+		writeJSON(w, 200, envelope{OK: true, Data: map[string]any{"order": o}})
+	}
+}
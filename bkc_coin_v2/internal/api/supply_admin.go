@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/supply"
+)
+
+type adminSupplyAuditRequest struct {
+	InitData string `json:"init_data"`
+	Ledger   bool   `json:"ledger"` // also replay the ledger (slow on big tables)
+}
+
+type adminSupplyAckRequest struct {
+	InitData string `json:"init_data"`
+	Note     string `json:"note"`
+}
+
+// haltedPath lists the money movement endpoints closed while the supply
+// auditor's halt flag is raised. Taps, reads and admin tools stay open.
+func haltedPath(p string) bool {
+	p = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(p)), "/api/v1")
+	switch p {
+	case "/transfer", "/buy", "/upgrade/level", "/nfts/buy", "/market/listings/buy", "/deposit/process":
+		return true
+	}
+	return strings.HasPrefix(p, "/bank/loan/") || strings.HasPrefix(p, "/p2p/loan/")
+}
+
+func (a *API) supplyHaltMiddleware(next http.Handler) http.Handler {
+	if a.Supply == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && haltedPath(r.URL.Path) {
+			if halted, _ := a.Supply.Halted(r.Context()); halted {
+				w.Header().Set("Retry-After", "300")
+				writeError(w, r, errHalted)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) adminSupplyAudit(w http.ResponseWriter, r *http.Request) {
+	var req adminSupplyAuditRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if user.ID != a.Cfg.AdminID {
+		writeError(w, r, errForbidden)
+		return
+	}
+	if a.Supply == nil {
+		writeError(w, r, featureDisabled(400, "supply_audit", "supply audit disabled"))
+		return
+	}
+	ctx := r.Context()
+	rep, err := a.Supply.Audit(ctx, req.Ledger)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	halt, err := a.Supply.HaltState(ctx)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: map[string]any{
+		"report": rep,
+		"ok":     rep.OK(),
+		"halt":   halt,
+	}})
+}
+
+func (a *API) adminSupplyAck(w http.ResponseWriter, r *http.Request) {
+	var req adminSupplyAckRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	if user.ID != a.Cfg.AdminID {
+		writeError(w, r, errForbidden)
+		return
+	}
+	if a.Supply == nil {
+		writeError(w, r, featureDisabled(400, "supply_audit", "supply audit disabled"))
+		return
+	}
+	note := strings.TrimSpace(req.Note)
+	if note == "" {
+		writeError(w, r, invalid("note", "note required"))
+		return
+	}
+	halt, err := a.Supply.Acknowledge(r.Context(), user.ID, note, a.auditHook(r, user, audit.Entry{
+		Action: "supply_ack",
+		Target: "supply_halt",
+		Reason: note,
+	}))
+	if err != nil {
+		if errors.Is(err, supply.ErrNotHalted) {
+			writeError(w, r, errNotHalted)
+			return
+		}
+		writeError(w, r, errDB)
+		return
+	}
+	writeJSON(w, 200, envelope{OK: true, Data: halt})
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/tapcore"
+)
+
+// tapForwardedHeader marks a tap proxied from another replica; such a
+// request is never forwarded again.
+const tapForwardedHeader = "X-Tap-Forwarded"
+
+var tapForwardClient = &http.Client{Timeout: 3 * time.Second}
+
+// forwardTap proxies a tap to the replica that owns the user (memtap
+// ownership leases). Without a known owner address the client retries.
+func (a *API) forwardTap(w http.ResponseWriter, r *http.Request, req tapRequest, owner *tapcore.NotOwnerError) {
+	if owner.Addr == "" || r.Header.Get(tapForwardedHeader) != "" {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, retryLater(http.StatusServiceUnavailable, "tap owner unavailable, retry"))
+		return
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		writeError(w, r, failed("tap failed"))
+		return
+	}
+	fr, err := http.NewRequestWithContext(r.Context(), http.MethodPost, owner.Addr+r.URL.Path, bytes.NewReader(body))
+	if err != nil {
+		writeError(w, r, failed("tap failed"))
+		return
+	}
+	fr.Header.Set("Content-Type", "application/json")
+	fr.Header.Set(tapForwardedHeader, "1")
+	fr.Header.Set(requestIDHeader, logx.RequestID(r.Context()))
+	// Session-token clients send no init_data in the body; errors stay localized.
+	for _, h := range []string{"Authorization", "Accept-Language"} {
+		if v := r.Header.Get(h); v != "" {
+			fr.Header.Set(h, v)
+		}
+	}
+	if a.Guard != nil {
+		// Keep per-IP limits on the owner tied to the real client.
+		if ip := a.Guard.ClientIP(r); ip != "" {
+			fr.Header.Set("X-Forwarded-For", ip)
+		}
+	}
+	resp, err := tapForwardClient.Do(fr)
+	if err != nil {
+		logger.WarnContext(r.Context(), "tap forward failed", "owner", owner.Owner, "addr", owner.Addr, "err", err)
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, retryLater(http.StatusServiceUnavailable, "tap owner unavailable, retry"))
+		return
+	}
+	defer resp.Body.Close()
+
+	if ct := strings.TrimSpace(resp.Header.Get("Content-Type")); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "" {
+		w.Header().Set("Retry-After", ra)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, io.LimitReader(resp.Body, 1<<20))
+}
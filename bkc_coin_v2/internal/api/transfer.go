@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"bkc_coin_v2/internal/config"
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/events"
+	"bkc_coin_v2/internal/telegram"
+	"bkc_coin_v2/internal/tokenomics"
+)
+
+type transferRequest struct {
+	InitData  string `json:"init_data"`
+	To        string `json:"to"`
+	ToAddress string `json:"to_address"`
+	Amount    int64  `json:"amount"`
+	Memo      string `json:"memo"`
+}
+
+// transferInput is a validated transfer request.
+type transferInput struct {
+	user   telegram.AuthUser
+	to     db.UserProfile
+	amount int64
+	memo   string
+}
+
+// normalizeMemo trims the memo and drops control characters so it renders
+// as one line in history and the bot.
+func normalizeMemo(raw string) string {
+	raw = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, raw)
+	return strings.Join(strings.Fields(raw), " ")
+}
+
+// parseTransfer validates the request shared by /transfer and
+// /transfer/preview and writes the error response itself.
+func (a *API) parseTransfer(w http.ResponseWriter, r *http.Request) (transferInput, bool) {
+	var req transferRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return transferInput{}, false
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return transferInput{}, false
+	}
+
+	amount := req.Amount
+	if amount <= 0 {
+		writeError(w, r, invalid("amount", "amount must be > 0"))
+		return transferInput{}, false
+	}
+
+	memo := normalizeMemo(req.Memo)
+	if int64(utf8.RuneCountInString(memo)) > a.Cfg.TransferMemoMaxLen {
+		writeError(w, r, tooLong("memo", "memo too long").with("max", a.Cfg.TransferMemoMaxLen))
+		return transferInput{}, false
+	}
+
+	toRaw := strings.TrimSpace(req.To)
+	if toRaw == "" {
+		toRaw = strings.TrimSpace(req.ToAddress)
+	}
+	ctx := r.Context()
+	to, _, err := a.resolveRecipient(ctx, toRaw, false)
+	if err != nil {
+		writeResolveError(w, r, err)
+		return transferInput{}, false
+	}
+	if to.UserID == user.ID {
+		writeError(w, r, errSelfTransfer)
+		return transferInput{}, false
+	}
+
+	if _, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(config.Econ().EnergyMax)); err != nil {
+		writeError(w, r, errDB)
+		return transferInput{}, false
+	}
+	return transferInput{user: user, to: to, amount: amount, memo: memo}, true
+}
+
+// quoteTransfer prices a transfer for the sender. With TRANSFER_FEES off (or
+// no tokenomics manager wired) transfers are free.
+func (a *API) quoteTransfer(ctx context.Context, userID, amount int64) (tokenomics.TransferQuote, error) {
+	if !a.Cfg.TransferFees || a.Tokens == nil {
+		return tokenomics.TransferQuote{Gross: amount, Net: amount}, nil
+	}
+	q, err := a.Tokens.QuoteTransfer(ctx, userID, amount)
+	if err != nil {
+		return tokenomics.TransferQuote{}, err
+	}
+	return *q, nil
+}
+
+func transferView(q tokenomics.TransferQuote, to db.UserProfile, memo string) map[string]any {
+	return map[string]any{
+		"to":          recipientView(to),
+		"gross":       q.Gross,
+		"fee":         q.Fee,
+		"fee_burned":  q.FeeBurned,
+		"fee_reserve": q.FeeReserve,
+		"fee_rate":    q.FeeRate,
+		"tier":        q.Tier,
+		"net":         q.Net,
+		"memo":        memo,
+	}
+}
+
+func (a *API) transferPreview(w http.ResponseWriter, r *http.Request) {
+	in, ok := a.parseTransfer(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	q, err := a.quoteTransfer(ctx, in.user.ID, in.amount)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	u, err := a.DB.GetUser(ctx, in.user.ID)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+	view := transferView(q, in.to, in.memo)
+	view["balance"] = u.Balance
+	view["enough"] = u.Balance >= q.Gross
+	writeJSON(w, 200, envelope{OK: true, Data: view})
+}
+
+func (a *API) transfer(w http.ResponseWriter, r *http.Request) {
+	in, ok := a.parseTransfer(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	q, err := a.quoteTransfer(ctx, in.user.ID, in.amount)
+	if err != nil {
+		writeError(w, r, errDB)
+		return
+	}
+
+	spec := db.TransferSpec{
+		FromID:     in.user.ID,
+		ToID:       in.to.UserID,
+		Amount:     q.Gross,
+		FeeBurn:    q.FeeBurned,
+		FeeReserve: q.FeeReserve,
+		Memo:       in.memo,
+	}
+	if err := a.DB.TransferWithFee(ctx, spec); err != nil {
+		if errors.Is(err, db.ErrNotEnough) {
+			writeError(w, r, a.notEnough(ctx, in.user.ID, q.Gross))
+			return
+		}
+		writeError(w, r, failed("transfer failed"))
+		return
+	}
+
+	markCommitted(r)
+	a.Events.Publish(in.to.UserID, events.TransferIn, map[string]any{
+		"from":   userRef(in.user),
+		"amount": q.Net,
+		"memo":   in.memo,
+	})
+
+	data, err := a.buildUserState(ctx, in.user)
+	if err != nil {
+		writeError(w, r, errServer)
+		return
+	}
+	data["transfer"] = transferView(q, in.to, in.memo)
+	writeJSON(w, 200, envelope{OK: true, Data: data})
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"bkc_coin_v2/internal/config"
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/mining"
+	"bkc_coin_v2/internal/tapcore"
+)
+
+// maxUserLevel keeps 500*1.6^(level-1) well inside int64.
+const maxUserLevel = 50
+
+type upgradeLevelRequest struct {
+	InitData string `json:"init_data"`
+}
+
+// nextLevelInfo describes the next upgrade for the state payload; nil at max level.
+func nextLevelInfo(level int64) map[string]any {
+	level = tapcore.NormalizeLevel(level)
+	if level >= maxUserLevel {
+		return nil
+	}
+	next := mining.GetLevelCost(int(level + 1))
+	return map[string]any{
+		"level":     next.Level,
+		"cost":      next.Cost,
+		"tap_power": next.Power,
+	}
+}
+
+func (a *API) upgradeLevel(w http.ResponseWriter, r *http.Request) {
+	var req upgradeLevelRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, r, errBadJSON)
+		return
+	}
+	user, ok := a.authUserFrom(r, req.InitData)
+	if !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	u, err := a.DB.EnsureUser(ctx, user.ID, user.Username, user.FirstName, float64(config.Econ().EnergyMax))
+	if err != nil {
+		writeError(w, r, errServer)
+		return
+	}
+	level := tapcore.NormalizeLevel(u.Level)
+	if level >= maxUserLevel {
+		writeError(w, r, errMaxLevel)
+		return
+	}
+	next := mining.GetLevelCost(int(level + 1))
+	power := int64(next.Power)
+
+	err = a.DB.UpgradeLevel(ctx, user.ID, u.Level, int64(next.Level), power, next.Cost)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotEnough):
+			writeError(w, r, a.notEnough(ctx, user.ID, next.Cost))
+		case errors.Is(err, db.ErrAlreadyExists):
+			writeError(w, r, retryLater(409, "level changed, retry"))
+		default:
+			writeError(w, r, failed("upgrade failed"))
+		}
+		return
+	}
+
+	markCommitted(r)
+	if a.FastTap != nil && a.FastTap.Enabled() {
+		// Keep Redis energy state; only the level fields change. If that
+		// fails, drop the cached hash so the next tap reseeds the new level
+		// from Postgres. A missed reserve refund is fixed by the reconciler.
+		if err := a.FastTap.AdjustReserve(ctx, next.Cost); err != nil {
+			logger.ErrorContext(ctx, "fasttap reserve adjust after upgrade failed", "target_user", user.ID, "delta", next.Cost, "err", err)
+		}
+		if err := a.FastTap.UpdateLevel(ctx, user.ID, int64(next.Level), power); err != nil {
+			logger.WarnContext(ctx, "fasttap level update failed, invalidating cache", "target_user", user.ID, "level", next.Level, "err", err)
+			a.FastTap.InvalidateUser(ctx, user.ID)
+		}
+	} else {
+		a.Taps.InvalidateUser(ctx, user.ID)
+	}
+
+	data, err := a.buildUserState(ctx, user)
+	if err != nil {
+		writeError(w, r, errServer)
+		return
+	}
+	data["cost"] = next.Cost
+	writeJSON(w, 200, envelope{OK: true, Data: data})
+}
@@ -0,0 +1,499 @@
+// Package audit records privileged actions in admin_audit, a hash-chained
+// append-only table. New keeps the log in Postgres; NewStore runs it over
+// any Store, such as memstore.
+//
+// Every entry carries who acted (actor, IP, request ID), what changed
+// (before/after as JSON) and why. Entry n stores the hash of entry n-1 and
+// its own hash over all of its fields, and seq runs without gaps, so Verify
+// finds any row that was edited or deleted after the fact. Dropping the
+// newest rows leaves a valid but shorter chain; compare the head with one
+// noted earlier (bot /audit_verify, /admin/v2/audit/verify) to catch that.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/logx"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Appends serialize on this advisory lock so each sees the previous head.
+const lockID int64 = 0x626b635f617564 // "bkc_aud"
+
+// Actor kinds.
+const (
+	ActorTelegram = "telegram" // ADMIN_ID through the WebApp API or the bot
+	ActorAdmin    = "admin"    // an admin_users account on /admin/v2
+	ActorSystem   = "system"
+)
+
+type Actor struct {
+	Kind string `json:"kind"`
+	ID   int64  `json:"id"`
+	Name string `json:"name,omitempty"`
+	IP   string `json:"ip,omitempty"`
+	Via  string `json:"via,omitempty"` // api, admin_v2, bot
+}
+
+type Entry struct {
+	Seq       int64           `json:"seq"`
+	At        time.Time       `json:"at"`
+	Actor     Actor           `json:"actor"`
+	RequestID string          `json:"request_id,omitempty"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+	PrevHash  string          `json:"prev_hash"`
+	Hash      string          `json:"hash"`
+}
+
+// JSON encodes v for Entry.Before/After; nil stays empty.
+func JSON(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"marshal_error": err.Error()})
+	}
+	return b
+}
+
+// Target formats a target reference like "user:42".
+func Target(kind string, id int64) string {
+	return kind + ":" + strconv.FormatInt(id, 10)
+}
+
+type actorKey struct{}
+
+// WithActor returns ctx carrying the actor that entries appended with it are
+// attributed to when they name none themselves.
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+// ActorFrom returns the actor of ctx, if any.
+func ActorFrom(ctx context.Context) (Actor, bool) {
+	a, ok := ctx.Value(actorKey{}).(Actor)
+	return a, ok
+}
+
+// hashed is what an entry's hash covers, in a fixed field order.
+type hashed struct {
+	V         int             `json:"v"`
+	Seq       int64           `json:"seq"`
+	At        string          `json:"at"`
+	ActorKind string          `json:"actor_kind"`
+	ActorID   int64           `json:"actor_id"`
+	ActorName string          `json:"actor_name"`
+	IP        string          `json:"ip"`
+	Via       string          `json:"via"`
+	RequestID string          `json:"request_id"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	Reason    string          `json:"reason"`
+	PrevHash  string          `json:"prev_hash"`
+}
+
+func rawOrNull(m json.RawMessage) json.RawMessage {
+	if len(m) == 0 {
+		return json.RawMessage("null")
+	}
+	return m
+}
+
+// ComputeHash returns the hash e should carry given its fields and PrevHash.
+func ComputeHash(e Entry) string {
+	b, _ := json.Marshal(hashed{
+		V:         1,
+		Seq:       e.Seq,
+		At:        e.At.UTC().Format(time.RFC3339Nano),
+		ActorKind: e.Actor.Kind,
+		ActorID:   e.Actor.ID,
+		ActorName: e.Actor.Name,
+		IP:        e.Actor.IP,
+		Via:       e.Actor.Via,
+		RequestID: e.RequestID,
+		Action:    e.Action,
+		Target:    e.Target,
+		Before:    rawOrNull(e.Before),
+		After:     rawOrNull(e.After),
+		Reason:    e.Reason,
+		PrevHash:  e.PrevHash,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// compact normalizes JSON so the stored text and the hashed bytes agree.
+func compact(m json.RawMessage) (json.RawMessage, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Tx appends to the chain inside the transaction of the action it records.
+type Tx interface {
+	// Head locks the chain until the transaction ends and returns the newest
+	// seq and hash (0 and "" while the chain is empty).
+	Head(ctx context.Context) (int64, string, error)
+	Insert(ctx context.Context, e Entry) error
+}
+
+// Store keeps the chain: admin_audit in Postgres (New) or an in-process
+// store such as memstore (NewStore).
+type Store interface {
+	// InAuditTx runs fn in one transaction of the store.
+	InAuditTx(ctx context.Context, fn func(Tx) error) error
+	// AuditEntries returns up to limit entries with seq > after, oldest first.
+	AuditEntries(ctx context.Context, after int64, limit int) ([]Entry, error)
+	// ListAudit returns entries matching f, newest first; f is normalized.
+	ListAudit(ctx context.Context, f Filter) ([]Entry, error)
+	// CountAuditSince counts entries of the actor kind (all if empty) since t.
+	CountAuditSince(ctx context.Context, actorKind string, t time.Time) (int64, error)
+}
+
+type Log struct {
+	store Store
+}
+
+func New(d *db.DB) *Log {
+	return &Log{store: pgStore{d}}
+}
+
+// NewStore returns a log over any Store.
+func NewStore(s Store) *Log {
+	return &Log{store: s}
+}
+
+type txKey struct{}
+
+// WithTx returns ctx carrying t. A store without pgx transactions (memstore)
+// passes its own this way to the db.TxHook it runs, which hands it a nil
+// pgx.Tx.
+func WithTx(ctx context.Context, t Tx) context.Context {
+	return context.WithValue(ctx, txKey{}, t)
+}
+
+// Append adds e to the chain inside tx, so the entry commits or rolls back
+// with the action it records. A nil tx falls back to the Tx of ctx (WithTx).
+// Seq, At, hashes and, when unset, the actor (from ctx) and request ID are
+// filled in.
+func Append(ctx context.Context, tx pgx.Tx, e Entry) (Entry, error) {
+	if tx != nil {
+		return AppendTx(ctx, pgTx{tx}, e)
+	}
+	t, ok := ctx.Value(txKey{}).(Tx)
+	if !ok {
+		return Entry{}, errors.New("audit: no transaction")
+	}
+	return AppendTx(ctx, t, e)
+}
+
+// AppendTx is Append for any Tx.
+func AppendTx(ctx context.Context, t Tx, e Entry) (Entry, error) {
+	if e.Action == "" {
+		return Entry{}, errors.New("audit: action required")
+	}
+	if e.Actor.Kind == "" {
+		a, ok := ActorFrom(ctx)
+		if !ok {
+			a = Actor{Kind: ActorSystem}
+		}
+		e.Actor = a
+	}
+	if e.RequestID == "" {
+		e.RequestID = logx.RequestID(ctx)
+	}
+	var err error
+	if e.Before, err = compact(e.Before); err != nil {
+		return Entry{}, fmt.Errorf("audit: before: %w", err)
+	}
+	if e.After, err = compact(e.After); err != nil {
+		return Entry{}, fmt.Errorf("audit: after: %w", err)
+	}
+
+	seq, prev, err := t.Head(ctx)
+	if err != nil {
+		return Entry{}, err
+	}
+	e.Seq = seq + 1
+	e.PrevHash = prev
+	e.At = time.Now().UTC().Truncate(time.Microsecond) // Postgres precision
+	e.Hash = ComputeHash(e)
+	if err := t.Insert(ctx, e); err != nil {
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+// pgTx appends to admin_audit inside a Postgres transaction.
+type pgTx struct {
+	tx pgx.Tx
+}
+
+func (t pgTx) Head(ctx context.Context) (int64, string, error) {
+	if _, err := t.tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
+		return 0, "", err
+	}
+	var seq int64
+	var prev string
+	err := t.tx.QueryRow(ctx, `SELECT seq, hash FROM admin_audit ORDER BY seq DESC LIMIT 1`).Scan(&seq, &prev)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, "", err
+	}
+	return seq, prev, nil
+}
+
+func (t pgTx) Insert(ctx context.Context, e Entry) error {
+	_, err := t.tx.Exec(ctx, `
+INSERT INTO admin_audit(seq, ts, actor_kind, actor_id, actor_name, ip, via, request_id, action, target, before, after, reason, prev_hash, hash)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+`, e.Seq, e.At, e.Actor.Kind, e.Actor.ID, e.Actor.Name, e.Actor.IP, e.Actor.Via, e.RequestID,
+		e.Action, e.Target, string(e.Before), string(e.After), e.Reason, e.PrevHash, e.Hash)
+	return err
+}
+
+// Hook returns a db.TxHook that appends e inside the helper's transaction,
+// attributed to actor. Before and After left empty are filled from the state
+// the helper passes, read under its locks. A failed append rolls the action
+// back: no entry, no action.
+func Hook(actor Actor, e Entry) db.TxHook {
+	return func(ctx context.Context, tx pgx.Tx, before, after any) error {
+		entry := e
+		if len(entry.Before) == 0 {
+			entry.Before = JSON(before)
+		}
+		if len(entry.After) == 0 {
+			entry.After = JSON(after)
+		}
+		_, err := Append(WithActor(ctx, actor), tx, entry)
+		return err
+	}
+}
+
+// Record appends e in its own transaction. It is for actions outside
+// Postgres (Redis, Telegram): record first and act only if that succeeded.
+func (l *Log) Record(ctx context.Context, e Entry) (Entry, error) {
+	var out Entry
+	err := l.store.InAuditTx(ctx, func(t Tx) error {
+		var err error
+		out, err = AppendTx(ctx, t, e)
+		return err
+	})
+	return out, err
+}
+
+type Filter struct {
+	Action    string
+	ActorKind string
+	ActorID   int64
+	Target    string
+	BeforeSeq int64 // entries older than this; 0 = from the newest
+	Limit     int   // default 50, max 200
+	Offset    int
+}
+
+// Match reports whether e passes the filter's conditions (not its paging).
+func (f Filter) Match(e Entry) bool {
+	switch {
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.ActorKind != "" && e.Actor.Kind != f.ActorKind:
+		return false
+	case f.ActorID != 0 && e.Actor.ID != f.ActorID:
+		return false
+	case f.Target != "" && e.Target != f.Target:
+		return false
+	case f.BeforeSeq > 0 && e.Seq >= f.BeforeSeq:
+		return false
+	}
+	return true
+}
+
+// List returns matching entries, newest first.
+func (l *Log) List(ctx context.Context, f Filter) ([]Entry, error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	if f.Limit > 200 {
+		f.Limit = 200
+	}
+	if f.Offset < 0 {
+		f.Offset = 0
+	}
+	return l.store.ListAudit(ctx, f)
+}
+
+// CountSince counts entries of the actor kind (all if empty) since t.
+func (l *Log) CountSince(ctx context.Context, actorKind string, t time.Time) (int64, error) {
+	return l.store.CountAuditSince(ctx, actorKind, t)
+}
+
+type Problem struct {
+	Seq   int64  `json:"seq"`
+	Issue string `json:"issue"`
+}
+
+type Report struct {
+	OK       bool      `json:"ok"`
+	Checked  int64     `json:"checked"`
+	HeadSeq  int64     `json:"head_seq"`
+	HeadHash string    `json:"head_hash"`
+	Problems []Problem `json:"problems,omitempty"` // first maxProblems
+}
+
+const maxProblems = 50
+
+// Verify walks the whole chain and reports every break it finds: a missing
+// seq, a prev_hash that does not match the previous row, or a row whose
+// hash does not match its contents.
+func (l *Log) Verify(ctx context.Context) (Report, error) {
+	rep := Report{}
+	problem := func(seq int64, format string, args ...any) {
+		if len(rep.Problems) < maxProblems {
+			rep.Problems = append(rep.Problems, Problem{Seq: seq, Issue: fmt.Sprintf(format, args...)})
+		}
+	}
+	var last int64
+	prev := ""
+	broken := false
+	for {
+		page, err := l.store.AuditEntries(ctx, last, 1000)
+		if err != nil {
+			return Report{}, err
+		}
+		for _, e := range page {
+			rep.Checked++
+			if e.Seq != last+1 {
+				broken = true
+				problem(e.Seq, "entries %d..%d missing", last+1, e.Seq-1)
+			}
+			if e.PrevHash != prev {
+				broken = true
+				problem(e.Seq, "prev_hash does not match entry %d", last)
+			}
+			if ComputeHash(e) != e.Hash {
+				broken = true
+				problem(e.Seq, "hash does not match contents")
+			}
+			last, prev = e.Seq, e.Hash
+		}
+		if len(page) == 0 {
+			break
+		}
+	}
+	rep.OK = !broken
+	rep.HeadSeq, rep.HeadHash = last, prev
+	return rep, nil
+}
+
+// pgStore is the admin_audit table.
+type pgStore struct {
+	db *db.DB
+}
+
+func (p pgStore) InAuditTx(ctx context.Context, fn func(Tx) error) error {
+	return p.db.WithTx(ctx, func(tx pgx.Tx) error {
+		return fn(pgTx{tx})
+	})
+}
+
+const columns = `seq, ts, actor_kind, actor_id, actor_name, ip, via, request_id, action, target, before, after, reason, prev_hash, hash`
+
+func scan(row pgx.Row) (Entry, error) {
+	var e Entry
+	var before, after string
+	err := row.Scan(&e.Seq, &e.At, &e.Actor.Kind, &e.Actor.ID, &e.Actor.Name, &e.Actor.IP, &e.Actor.Via,
+		&e.RequestID, &e.Action, &e.Target, &before, &after, &e.Reason, &e.PrevHash, &e.Hash)
+	if err != nil {
+		return Entry{}, err
+	}
+	e.At = e.At.UTC()
+	if before != "" {
+		e.Before = json.RawMessage(before)
+	}
+	if after != "" {
+		e.After = json.RawMessage(after)
+	}
+	return e, nil
+}
+
+func collect(rows pgx.Rows) ([]Entry, error) {
+	defer rows.Close()
+	out := []Entry{}
+	for rows.Next() {
+		e, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (p pgStore) AuditEntries(ctx context.Context, after int64, limit int) ([]Entry, error) {
+	rows, err := p.db.Pool.Query(ctx, `SELECT `+columns+` FROM admin_audit WHERE seq > $1 ORDER BY seq LIMIT $2`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return collect(rows)
+}
+
+func (p pgStore) ListAudit(ctx context.Context, f Filter) ([]Entry, error) {
+	q := `SELECT ` + columns + ` FROM admin_audit WHERE true`
+	args := []any{}
+	add := func(cond string, v any) {
+		args = append(args, v)
+		q += fmt.Sprintf(" AND "+cond, len(args))
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.ActorKind != "" {
+		add("actor_kind = $%d", f.ActorKind)
+	}
+	if f.ActorID != 0 {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.Target != "" {
+		add("target = $%d", f.Target)
+	}
+	if f.BeforeSeq > 0 {
+		add("seq < $%d", f.BeforeSeq)
+	}
+	args = append(args, f.Limit, f.Offset)
+	q += fmt.Sprintf(" ORDER BY seq DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := p.db.Pool.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return collect(rows)
+}
+
+func (p pgStore) CountAuditSince(ctx context.Context, actorKind string, t time.Time) (int64, error) {
+	var n int64
+	err := p.db.Pool.QueryRow(ctx, `
+SELECT COUNT(*) FROM admin_audit WHERE ts >= $1 AND ($2::text = '' OR actor_kind = $2)
+`, t, actorKind).Scan(&n)
+	return n, err
+}
@@ -8,6 +8,8 @@ import (
 	"sync"
 	"time"
 
+	"bkc_coin_v2/internal/metrics"
+
 	"github.com/redis/go-redis/v9"
 )
 
@@ -162,6 +164,24 @@ func NewRedisManager(config RedisConfig) *RedisManager {
 	return rm
 }
 
+// NewRedisManagerFromClient оборачивает уже подключенный клиент (REDIS_URL),
+// чтобы использовать Pub/Sub и кэш поверх общего соединения
+func NewRedisManagerFromClient(client *redis.Client, keyPrefix string) *RedisManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	config := DefaultRedisConfig()
+	config.Nodes = nil
+	config.EnableReplication = false
+	config.KeyPrefix = keyPrefix
+	return &RedisManager{
+		clients:     []*redis.Client{client},
+		subscribers: make(map[string][]chan Message),
+		config:      config,
+		ctx:         ctx,
+		cancel:      cancel,
+		metrics:     &RedisMetrics{},
+	}
+}
+
 // getClient получает клиента Redis (round-robin)
 func (rm *RedisManager) getClient() *redis.Client {
 	rm.mu.RLock()
@@ -389,6 +409,8 @@ func (rm *RedisManager) Subscribe(ctx context.Context, channel string) (<-chan M
 func (rm *RedisManager) handleSubscription(ctx context.Context, client *redis.Client, fullChannel, channel string, msgChan chan Message) {
 	pubsub := client.Subscribe(ctx, fullChannel)
 	defer pubsub.Close()
+	// Подписчик узнает о конце подписки по закрытому каналу
+	defer close(msgChan)
 	
 	ch := pubsub.Channel()
 	
@@ -396,7 +418,10 @@ func (rm *RedisManager) handleSubscription(ctx context.Context, client *redis.Cl
 		select {
 		case <-ctx.Done():
 			return
-		case msg := <-ch:
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
 			var message Message
 			if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
 				log.Printf("Failed to unmarshal message: %v", err)
@@ -552,10 +577,25 @@ func (rm *RedisManager) GetMetrics() RedisMetrics {
 	rm.metrics.mu.RLock()
 	defer rm.metrics.mu.RUnlock()
 	
-	metrics := *rm.metrics
-	metrics.ActiveConnections = int64(len(rm.clients))
-	
-	return metrics
+	return RedisMetrics{
+		TotalCommands:     rm.metrics.TotalCommands,
+		FailedCommands:    rm.metrics.FailedCommands,
+		CacheHits:         rm.metrics.CacheHits,
+		CacheMisses:       rm.metrics.CacheMisses,
+		PubSubMessages:    rm.metrics.PubSubMessages,
+		ActiveConnections: int64(len(rm.clients)),
+	}
+}
+
+// WriteMetrics отдает GetMetrics в /metrics (metrics.Collector)
+func (rm *RedisManager) WriteMetrics(ctx context.Context, w *metrics.Writer) {
+	m := rm.GetMetrics()
+	w.Counter("bkc_redis_commands_total", "Команды RedisManager", float64(m.TotalCommands))
+	w.Counter("bkc_redis_failed_commands_total", "Команды RedisManager с ошибкой", float64(m.FailedCommands))
+	w.Counter("bkc_redis_cache_hits_total", "Попадания в кэш", float64(m.CacheHits))
+	w.Counter("bkc_redis_cache_misses_total", "Промахи кэша", float64(m.CacheMisses))
+	w.Counter("bkc_redis_pubsub_messages_total", "Опубликованные сообщения Pub/Sub", float64(m.PubSubMessages))
+	w.Gauge("bkc_redis_clients", "Клиенты Redis", float64(m.ActiveConnections))
 }
 
 // Close закрывает все соединения
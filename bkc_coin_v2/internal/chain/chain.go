@@ -0,0 +1,414 @@
+package chain
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/logx"
+)
+
+var logger = logx.Component("chain")
+
+// Ledger rows are sealed into blocks in id order. A block stores the Merkle
+// root over its rows and the hash of the previous block, so rewriting any
+// sealed ledger row (or dropping a block) breaks every later block hash.
+// Membership is tracked by ledger.block_height rather than id ranges: a row
+// whose transaction commits late simply lands in a later block.
+
+// advisoryKey serializes sealers across replicas.
+const advisoryKey int64 = 0x626b63_626c6b // "bkc" "blk"
+
+var ErrNotFound = errors.New("not found")
+
+type Config struct {
+	Interval time.Duration // how often the sealer runs
+	MaxTxs   int           // rows per block
+	Lag      time.Duration // rows younger than this are left for the next run
+}
+
+func ConfigFromEnv() Config {
+	c := Config{Interval: 60 * time.Second, MaxTxs: 5000, Lag: 30 * time.Second}
+	if n, ok := envInt("BLOCK_INTERVAL_SEC"); ok {
+		if n < 0 {
+			n = 0
+		}
+		if n > 0 && n < 5 {
+			n = 5
+		}
+		c.Interval = time.Duration(n) * time.Second
+	}
+	if n, ok := envInt("BLOCK_MAX_TXS"); ok {
+		if n < 1 {
+			n = 1
+		}
+		if n > 50000 {
+			n = 50000
+		}
+		c.MaxTxs = int(n)
+	}
+	if n, ok := envInt("BLOCK_SEAL_LAG_SEC"); ok {
+		if n < 0 {
+			n = 0
+		}
+		if n > 3600 {
+			n = 3600
+		}
+		c.Lag = time.Duration(n) * time.Second
+	}
+	return c
+}
+
+func envInt(key string) (int64, bool) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+type Chain struct {
+	db  *db.DB
+	cfg Config
+}
+
+func New(database *db.DB, cfg Config) *Chain {
+	return &Chain{db: database, cfg: cfg}
+}
+
+type Block struct {
+	Height        int64     `json:"height"`
+	Hash          string    `json:"hash"`
+	PrevHash      string    `json:"prev_hash"`
+	MerkleRoot    string    `json:"merkle_root"`
+	TxCount       int       `json:"tx_count"`
+	FirstLedgerID int64     `json:"first_ledger_id"`
+	LastLedgerID  int64     `json:"last_ledger_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Run seals blocks until ctx is done. Interval 0 disables sealing.
+func (c *Chain) Run(ctx context.Context) {
+	if c.cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		// Backfill: keep sealing while blocks come out full.
+		for {
+			b, err := c.SealOnce(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.ErrorContext(ctx, "seal failed", "err", err)
+				}
+				break
+			}
+			if b == nil {
+				break
+			}
+			logger.InfoContext(ctx, "sealed block", "height", b.Height, "txs", b.TxCount, "hash", b.Hash)
+			if b.TxCount < c.cfg.MaxTxs {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SealOnce seals the next block from unsealed rows. Returns nil if nothing is due.
+func (c *Chain) SealOnce(ctx context.Context) (*Block, error) {
+	var out *Block
+	err := c.db.WithTx(ctx, func(tx pgx.Tx) error {
+		var locked bool
+		if err := tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1)`, advisoryKey).Scan(&locked); err != nil {
+			return err
+		}
+		if !locked {
+			return nil // another replica is sealing
+		}
+
+		lagSecs := c.cfg.Lag.Seconds()
+		rows, err := tx.Query(ctx, `
+SELECT id, COALESCE(event_id,''), ts, kind, from_id, to_id, amount, meta::text
+FROM ledger
+WHERE block_height IS NULL AND ts < now() - make_interval(secs => $1)
+ORDER BY id
+LIMIT $2
+FOR UPDATE`, lagSecs, c.cfg.MaxTxs)
+		if err != nil {
+			return err
+		}
+		entries, err := scanEntries(rows)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		prevHash := GenesisPrevHash
+		var prevHeight int64
+		err = tx.QueryRow(ctx, `SELECT height, hash FROM blocks ORDER BY height DESC LIMIT 1`).Scan(&prevHeight, &prevHash)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+
+		leaves := make([][]byte, len(entries))
+		ids := make([]int64, len(entries))
+		for i, e := range entries {
+			leaves[i] = LeafHash(e)
+			ids[i] = e.ID
+		}
+		b := &Block{
+			Height:        prevHeight + 1,
+			PrevHash:      prevHash,
+			MerkleRoot:    hex.EncodeToString(MerkleRoot(leaves)),
+			TxCount:       len(entries),
+			FirstLedgerID: entries[0].ID,
+			LastLedgerID:  entries[len(entries)-1].ID,
+			CreatedAt:     time.Now().UTC().Truncate(time.Microsecond),
+		}
+		b.Hash = BlockHash(b.Height, b.PrevHash, b.MerkleRoot, b.FirstLedgerID, b.LastLedgerID, b.TxCount, b.CreatedAt)
+
+		if _, err := tx.Exec(ctx, `UPDATE ledger SET block_height=$1 WHERE id = ANY($2)`, b.Height, ids); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+INSERT INTO blocks(height, prev_hash, merkle_root, hash, tx_count, first_ledger_id, last_ledger_id, created_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`,
+			b.Height, b.PrevHash, b.MerkleRoot, b.Hash, b.TxCount, b.FirstLedgerID, b.LastLedgerID, b.CreatedAt); err != nil {
+			return err
+		}
+		out = b
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func scanEntries(rows pgx.Rows) ([]Entry, error) {
+	defer rows.Close()
+	var out []Entry
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.ID, &e.EventID, &e.TS, &e.Kind, &e.FromID, &e.ToID, &e.Amount, &e.Meta); err != nil {
+			return nil, err
+		}
+		e.TS = e.TS.UTC()
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+const blockCols = `height, hash, prev_hash, merkle_root, tx_count, first_ledger_id, last_ledger_id, created_at`
+
+func scanBlock(row pgx.Row) (*Block, error) {
+	var b Block
+	if err := row.Scan(&b.Height, &b.Hash, &b.PrevHash, &b.MerkleRoot, &b.TxCount, &b.FirstLedgerID, &b.LastLedgerID, &b.CreatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	b.CreatedAt = b.CreatedAt.UTC()
+	return &b, nil
+}
+
+// Head returns the latest block, or nil before the first seal.
+func (c *Chain) Head(ctx context.Context) (*Block, error) {
+	b, err := scanBlock(c.db.Pool.QueryRow(ctx, `SELECT `+blockCols+` FROM blocks ORDER BY height DESC LIMIT 1`))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// ListBlocks returns blocks newest first, strictly below `before` when before > 0.
+func (c *Chain) ListBlocks(ctx context.Context, before int64, limit int) ([]Block, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	rows, err := c.db.Pool.Query(ctx, `
+SELECT `+blockCols+` FROM blocks
+WHERE ($1 <= 0 OR height < $1)
+ORDER BY height DESC
+LIMIT $2`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Block, 0, limit)
+	for rows.Next() {
+		b, err := scanBlock(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *b)
+	}
+	return out, rows.Err()
+}
+
+func (c *Chain) GetBlock(ctx context.Context, height int64) (*Block, error) {
+	return scanBlock(c.db.Pool.QueryRow(ctx, `SELECT `+blockCols+` FROM blocks WHERE height=$1`, height))
+}
+
+// BlockEntries returns a page of the block's rows in leaf order.
+func (c *Chain) BlockEntries(ctx context.Context, height int64, offset, limit int) ([]Entry, error) {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	rows, err := c.db.Pool.Query(ctx, `
+SELECT id, COALESCE(event_id,''), ts, kind, from_id, to_id, amount, meta::text
+FROM ledger WHERE block_height=$1
+ORDER BY id
+OFFSET $2 LIMIT $3`, height, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := scanEntries(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		redact(&entries[i])
+	}
+	return entries, nil
+}
+
+// redact drops the transfer memo from a row about to be served publicly.
+// Memos live in transfer_memos now; only rows sealed before that still carry
+// one in meta. Call it after hashing: the result no longer matches the leaf.
+func redact(e *Entry) {
+	if !strings.Contains(e.Meta, `"memo"`) {
+		return
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(e.Meta), &m); err != nil {
+		return
+	}
+	if _, ok := m["memo"]; !ok {
+		return
+	}
+	delete(m, "memo")
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	e.Meta = string(b)
+	e.Redacted = true
+}
+
+type Tx struct {
+	Entry
+	BlockHeight *int64 `json:"block_height"`
+	LeafHash    string `json:"leaf_hash"`
+	Status      string `json:"status"` // pending | sealed
+}
+
+func (c *Chain) GetTx(ctx context.Context, id int64) (*Tx, error) {
+	var t Tx
+	err := c.db.Pool.QueryRow(ctx, `
+SELECT id, COALESCE(event_id,''), ts, kind, from_id, to_id, amount, meta::text, block_height
+FROM ledger WHERE id=$1`, id).Scan(&t.ID, &t.EventID, &t.TS, &t.Kind, &t.FromID, &t.ToID, &t.Amount, &t.Meta, &t.BlockHeight)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	t.TS = t.TS.UTC()
+	t.LeafHash = hex.EncodeToString(LeafHash(t.Entry))
+	redact(&t.Entry)
+	t.Status = "pending"
+	if t.BlockHeight != nil {
+		t.Status = "sealed"
+	}
+	return &t, nil
+}
+
+type Proof struct {
+	LedgerID   int64    `json:"ledger_id"`
+	Leaf       string   `json:"leaf"`
+	LeafIndex  int      `json:"leaf_index"`
+	TreeSize   int      `json:"tree_size"`
+	Path       []string `json:"path"`
+	MerkleRoot string   `json:"merkle_root"`
+	Block      Block    `json:"block"`
+	Verified   bool     `json:"verified"`
+}
+
+// Proof builds an inclusion proof for a sealed ledger row. The leaf set is
+// recomputed from the ledger, so Verified is false if any row of the block
+// was altered after sealing.
+func (c *Chain) Proof(ctx context.Context, ledgerID int64) (*Proof, error) {
+	t, err := c.GetTx(ctx, ledgerID)
+	if err != nil {
+		return nil, err
+	}
+	if t.BlockHeight == nil {
+		return nil, ErrNotFound
+	}
+	b, err := c.GetBlock(ctx, *t.BlockHeight)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Pool.Query(ctx, `
+SELECT id, COALESCE(event_id,''), ts, kind, from_id, to_id, amount, meta::text
+FROM ledger WHERE block_height=$1
+ORDER BY id`, b.Height)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := scanEntries(rows)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make([][]byte, len(entries))
+	index := -1
+	for i, e := range entries {
+		leaves[i] = LeafHash(e)
+		if e.ID == ledgerID {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, ErrNotFound
+	}
+	path := InclusionProof(leaves, index)
+	root, err := hex.DecodeString(b.MerkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &Proof{
+		LedgerID:   ledgerID,
+		Leaf:       hex.EncodeToString(leaves[index]),
+		LeafIndex:  index,
+		TreeSize:   len(leaves),
+		Path:       hexList(path),
+		MerkleRoot: b.MerkleRoot,
+		Block:      *b,
+		Verified:   VerifyInclusion(leaves[index], index, len(leaves), path, root),
+	}, nil
+}
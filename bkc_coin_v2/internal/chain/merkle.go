@@ -0,0 +1,148 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Merkle trees follow RFC 6962: leaves are hashed as H(0x00 || data),
+// interior nodes as H(0x01 || left || right), and a tree of n leaves is
+// split at the largest power of two below n (no duplicated nodes).
+
+// Entry is a ledger row as committed to a block.
+type Entry struct {
+	ID      int64     `json:"id"`
+	EventID string    `json:"event_id,omitempty"`
+	TS      time.Time `json:"ts"`
+	Kind    string    `json:"kind"`
+	FromID  *int64    `json:"from_id"`
+	ToID    *int64    `json:"to_id"`
+	Amount  int64     `json:"amount"`
+	Meta    string    `json:"meta"` // jsonb text as returned by Postgres
+	// Redacted is set in public views when Meta had private fields removed;
+	// the leaf hash is still over the stored row.
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// LeafData is the canonical byte encoding of an entry:
+// id|event_id|ts_unix_micro|kind|from_id|to_id|amount|meta (NULL ids are empty).
+func LeafData(e Entry) []byte {
+	var b bytes.Buffer
+	b.WriteString(strconv.FormatInt(e.ID, 10))
+	b.WriteByte('|')
+	b.WriteString(e.EventID)
+	b.WriteByte('|')
+	b.WriteString(strconv.FormatInt(e.TS.UTC().UnixMicro(), 10))
+	b.WriteByte('|')
+	b.WriteString(e.Kind)
+	b.WriteByte('|')
+	if e.FromID != nil {
+		b.WriteString(strconv.FormatInt(*e.FromID, 10))
+	}
+	b.WriteByte('|')
+	if e.ToID != nil {
+		b.WriteString(strconv.FormatInt(*e.ToID, 10))
+	}
+	b.WriteByte('|')
+	b.WriteString(strconv.FormatInt(e.Amount, 10))
+	b.WriteByte('|')
+	b.WriteString(e.Meta)
+	return b.Bytes()
+}
+
+func LeafHash(e Entry) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(LeafData(e))
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint returns the largest power of two strictly below n (n > 1).
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// MerkleRoot returns the root over leaf hashes; an empty tree hashes to H("").
+func MerkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return nodeHash(MerkleRoot(leaves[:k]), MerkleRoot(leaves[k:]))
+}
+
+// InclusionProof returns the audit path for leaves[index], leaf level first.
+func InclusionProof(leaves [][]byte, index int) [][]byte {
+	if index < 0 || index >= len(leaves) || len(leaves) < 2 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(InclusionProof(leaves[:k], index), MerkleRoot(leaves[k:]))
+	}
+	return append(InclusionProof(leaves[k:], index-k), MerkleRoot(leaves[:k]))
+}
+
+// VerifyInclusion checks an audit path (RFC 9162, section 2.1.3.2).
+func VerifyInclusion(leaf []byte, index, size int, proof [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// GenesisPrevHash is the prev_hash of block 1.
+var GenesisPrevHash = hex.EncodeToString(make([]byte, sha256.Size))
+
+// BlockHash commits to the header fields, chaining the block to prevHash.
+func BlockHash(height int64, prevHash, merkleRoot string, firstID, lastID int64, txCount int, sealedAt time.Time) string {
+	data := fmt.Sprintf("%d|%s|%s|%d|%d|%d|%d", height, prevHash, merkleRoot, firstID, lastID, txCount, sealedAt.UTC().UnixMicro())
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func hexList(in [][]byte) []string {
+	out := make([]string, 0, len(in))
+	for _, b := range in {
+		out = append(out, hex.EncodeToString(b))
+	}
+	return out
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/url"
 	"os"
@@ -30,36 +32,53 @@ type Config struct {
 	StartRateCoinsPerUSD int64
 	MinRateCoinsPerUSD   int64
 
-	BankLoan7DInterestBP  int64
-	BankLoan30DInterestBP int64
-	BankLoanMaxAmount     int64
 	P2PRecallMinDays      int64
-	MarketListingFeeCoins int64
+	TransferFees          bool
+	TransferMemoMaxLen    int64
+	StandingOrdersPerUser int64
 
-	EnergyMax         int64
-	EnergyRegenPerSec float64
-	TapMaxPerRequest  int64
-	TapMaxMultiTouch  int64
-
-	TapDailyLimit           int64
-	ExtraTapsPackSize       int64
-	ExtraTapsPackPriceCoins int64
-
-	EnergyBoost1HPriceCoins      int64
-	EnergyBoost1HRegenMultiplier float64
-	EnergyBoost1HMaxMultiplier   float64
+	// Economy can change at runtime; read it through Econ(), the copy here is
+	// what the process started with.
+	Economy
 
 	CryptoPayToken         string
 	CryptoPayWebhookSecret string
+
+	IdempotencyTTLHours int64
 }
 
-func mustEnv(key string) string {
-	val := strings.TrimSpace(os.Getenv(key))
-	if val == "" {
-		log.Printf("missing env: %s, using default", key)
-		return ""
-	}
-	return val
+// Economy holds the economic knobs that are safe to change without a
+// restart: they only affect future taps and purchases.
+type Economy struct {
+	EnergyMax         int64   `json:"energy_max"`
+	EnergyRegenPerSec float64 `json:"energy_regen_per_sec"`
+	TapMaxPerRequest  int64   `json:"tap_max_per_request"`
+	TapMaxMultiTouch  int64   `json:"tap_max_multitouch"`
+
+	TapDailyLimit           int64 `json:"tap_daily_limit"`
+	ExtraTapsPackSize       int64 `json:"extra_taps_pack_size"`
+	ExtraTapsPackPriceCoins int64 `json:"extra_taps_pack_price_coins"`
+
+	EnergyBoost1HPriceCoins      int64   `json:"energy_boost_1h_price_coins"`
+	EnergyBoost1HRegenMultiplier float64 `json:"energy_boost_1h_regen_mult"`
+	EnergyBoost1HMaxMultiplier   float64 `json:"energy_boost_1h_max_mult"`
+
+	BankLoan7DInterestBP  int64 `json:"bank_loan_7d_interest_bp"`
+	BankLoan30DInterestBP int64 `json:"bank_loan_30d_interest_bp"`
+	BankLoanMaxAmount     int64 `json:"bank_loan_max_amount"`
+	MarketListingFeeCoins int64 `json:"market_listing_fee_coins"`
+}
+
+// economyKeys are the env names of the Economy fields.
+var economyKeys = strings.Fields(`ENERGY_MAX ENERGY_REGEN_PER_SEC TAP_MAX_PER_REQUEST TAP_MAX_MULTITOUCH
+	TAP_DAILY_LIMIT EXTRA_TAPS_PACK_SIZE EXTRA_TAPS_PACK_PRICE_COINS
+	ENERGY_BOOST_1H_PRICE_COINS ENERGY_BOOST_1H_REGEN_MULT ENERGY_BOOST_1H_MAX_MULT
+	BANK_LOAN_7D_INTEREST_BP BANK_LOAN_30D_INTEREST_BP BANK_LOAN_MAX_AMOUNT MARKET_LISTING_FEE_COINS`)
+
+// DatabaseURLFromEnv reads only DATABASE_URL, for tools that do not need the
+// rest of the config (e.g. the migrate subcommand).
+func DatabaseURLFromEnv() string {
+	return normalizeDatabaseURL(os.Getenv("DATABASE_URL"))
 }
 
 func normalizeDatabaseURL(raw string) string {
@@ -115,32 +134,54 @@ func normalizeRedisURL(raw string) string {
 	return s
 }
 
-func envInt64(key string, def int64) int64 {
-	val := strings.TrimSpace(os.Getenv(key))
+// source looks settings up by env name. Values that do not parse are
+// collected as errors instead of silently falling back to the default.
+type source struct {
+	lookup func(key string) (string, bool)
+	errs   []error
+}
+
+func (s *source) str(key string) string {
+	v, _ := s.lookup(key)
+	return strings.TrimSpace(v)
+}
+
+func (s *source) required(key string) string {
+	v := s.str(key)
+	if v == "" {
+		log.Printf("missing env: %s, using default", key)
+	}
+	return v
+}
+
+func (s *source) int64(key string, def int64) int64 {
+	val := s.str(key)
 	if val == "" {
 		return def
 	}
 	n, err := strconv.ParseInt(val, 10, 64)
 	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s: %q is not an integer", key, val))
 		return def
 	}
 	return n
 }
 
-func envFloat64(key string, def float64) float64 {
-	val := strings.TrimSpace(os.Getenv(key))
+func (s *source) float64(key string, def float64) float64 {
+	val := s.str(key)
 	if val == "" {
 		return def
 	}
 	n, err := strconv.ParseFloat(val, 64)
 	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s: %q is not a number", key, val))
 		return def
 	}
 	return n
 }
 
-func envBool(key string, def bool) bool {
-	val := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+func (s *source) bool(key string, def bool) bool {
+	val := strings.ToLower(s.str(key))
 	if val == "" {
 		return def
 	}
@@ -150,32 +191,109 @@ func envBool(key string, def bool) bool {
 	case "0", "false", "no", "n", "off":
 		return false
 	default:
+		s.errs = append(s.errs, fmt.Errorf("%s: %q is not a boolean", key, val))
 		return def
 	}
 }
 
-func Load() Config {
+// Load reads the file named by CONFIG_FILE (if set) and the environment.
+func Load() (Config, error) {
+	return LoadFile(strings.TrimSpace(os.Getenv("CONFIG_FILE")))
+}
+
+// LoadFile reads the config file at path (none if empty) with the
+// environment on top, and validates the result. File values are also
+// exported to the process environment (where it has no value of its own),
+// so packages that read their settings from env see them too.
+func LoadFile(path string) (Config, error) {
+	file, err := loadFileValues(path)
+	if err != nil {
+		return Config{}, err
+	}
+	for k, v := range file {
+		if _, ok := startEnv[k]; !ok {
+			_ = os.Setenv(k, v)
+		}
+	}
+	cfg, err := build(file)
+	if err != nil {
+		return Config{}, err
+	}
+	SetEconomy(cfg.Economy)
+	return cfg, nil
+}
+
+func loadFileValues(path string) (map[string]string, error) {
+	if path == "" {
+		return map[string]string{}, nil
+	}
+	return readFile(path)
+}
+
+// startEnv is the environment the process got, before file values were
+// exported into it; reloads layer it over the file again.
+var startEnv = func() map[string]string {
+	m := map[string]string{}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			m[k] = v
+		}
+	}
+	return m
+}()
+
+// settings returns the effective value of every known setting: the
+// process environment over the file.
+func settings(file map[string]string) map[string]string {
+	out := make(map[string]string, len(keys))
+	for k := range keys {
+		if v, ok := startEnv[k]; ok {
+			out[k] = v
+		} else if v, ok := file[k]; ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// build makes a validated Config from the environment over file.
+func build(file map[string]string) (Config, error) {
+	src := &source{lookup: func(key string) (string, bool) {
+		if v, ok := startEnv[key]; ok {
+			return v, true
+		}
+		v, ok := file[key]
+		return v, ok
+	}}
+	cfg := load(src)
+	if err := errors.Join(append(src.errs, cfg.Validate())...); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func load(src *source) Config {
 	// PUBLIC_BASE_URL and WEBAPP_URL are required for local development, but on Render we can
 	// derive them from platform-provided env vars.
-	publicBase := strings.TrimSpace(os.Getenv("PUBLIC_BASE_URL"))
+	publicBase := src.str("PUBLIC_BASE_URL")
 	if publicBase == "" {
-		publicBase = strings.TrimSpace(os.Getenv("RENDER_EXTERNAL_URL"))
+		publicBase = src.str("RENDER_EXTERNAL_URL")
 	}
 	if publicBase == "" {
-		host := strings.TrimSpace(os.Getenv("RENDER_EXTERNAL_HOSTNAME"))
+		host := src.str("RENDER_EXTERNAL_HOSTNAME")
 		if host != "" {
 			publicBase = "https://" + host
 		}
 	}
 	if publicBase == "" {
-		port := strings.TrimSpace(os.Getenv("PORT"))
+		port := src.str("PORT")
 		if port == "" {
 			port = "8080"
 		}
 		publicBase = "http://127.0.0.1:" + port
 	}
 
-	webappURL := strings.TrimSpace(os.Getenv("WEBAPP_URL"))
+	webappURL := src.str("WEBAPP_URL")
 	if webappURL == "" {
 		webappURL = publicBase
 	}
@@ -184,47 +302,55 @@ func Load() Config {
 	webappURL = strings.TrimRight(webappURL, "/")
 
 	cfg := Config{
-		BotToken:       mustEnv("BOT_TOKEN"),
-		DatabaseURL:    normalizeDatabaseURL(mustEnv("DATABASE_URL")),
-		RedisURL:       normalizeRedisURL(os.Getenv("REDIS_URL")),
+		BotToken:       src.required("BOT_TOKEN"),
+		DatabaseURL:    normalizeDatabaseURL(src.required("DATABASE_URL")),
+		RedisURL:       normalizeRedisURL(src.str("REDIS_URL")),
 		PublicBaseURL:  publicBase,
 		WebappURL:      webappURL,
-		CORSOrigins:    parseCSV(strings.TrimSpace(os.Getenv("CORS_ALLOWED_ORIGINS"))),
-		CoinImageURL:   strings.TrimSpace(os.Getenv("COIN_IMAGE_URL")),
+		CORSOrigins:    parseCSV(src.str("CORS_ALLOWED_ORIGINS")),
+		CoinImageURL:   src.str("COIN_IMAGE_URL"),
 		DepositWallets: map[string]string{},
-		APIProfile:     strings.ToLower(strings.TrimSpace(os.Getenv("API_PROFILE"))),
-		RunAPI:         envBool("RUN_API", true),
-		RunBot:         envBool("RUN_BOT", true),
-		RunOverdue:     envBool("RUN_OVERDUE_WORKER", true),
-		RunFasttap:     envBool("RUN_FASTTAP_WORKER", true),
-
-		AdminID:              envInt64("ADMIN_ID", 0),
-		TotalSupply:          envInt64("TOTAL_SUPPLY", 500_000_000),
-		AdminAllocationPct:   envInt64("ADMIN_ALLOCATION_PCT", 30),
-		StartRateCoinsPerUSD: envInt64("START_RATE_COINS_PER_USD", 60_000),
-		MinRateCoinsPerUSD:   envInt64("MIN_RATE_COINS_PER_USD", 50_000),
-
-		BankLoan7DInterestBP:  envInt64("BANK_LOAN_7D_INTEREST_BP", 1200),  // 12%
-		BankLoan30DInterestBP: envInt64("BANK_LOAN_30D_INTEREST_BP", 3500), // 35%
-		BankLoanMaxAmount:     envInt64("BANK_LOAN_MAX_AMOUNT", 2_000_000),
-		P2PRecallMinDays:      envInt64("P2P_RECALL_MIN_DAYS", 5),
-		MarketListingFeeCoins: envInt64("MARKET_LISTING_FEE_COINS", 2_000),
-
-		EnergyMax:         envInt64("ENERGY_MAX", 300),
-		EnergyRegenPerSec: envFloat64("ENERGY_REGEN_PER_SEC", 1.0),
-		TapMaxPerRequest:  envInt64("TAP_MAX_PER_REQUEST", 500),
-		TapMaxMultiTouch:  envInt64("TAP_MAX_MULTITOUCH", 13),
-
-		TapDailyLimit:           envInt64("TAP_DAILY_LIMIT", 100_000),
-		ExtraTapsPackSize:       envInt64("EXTRA_TAPS_PACK_SIZE", 13_000),
-		ExtraTapsPackPriceCoins: envInt64("EXTRA_TAPS_PACK_PRICE_COINS", 15_000),
-
-		EnergyBoost1HPriceCoins:      envInt64("ENERGY_BOOST_1H_PRICE_COINS", 25_000),
-		EnergyBoost1HRegenMultiplier: envFloat64("ENERGY_BOOST_1H_REGEN_MULT", 5.0),
-		EnergyBoost1HMaxMultiplier:   envFloat64("ENERGY_BOOST_1H_MAX_MULT", 5.0),
-
-		CryptoPayToken:         strings.TrimSpace(os.Getenv("CRYPTOPAY_API_TOKEN")),
-		CryptoPayWebhookSecret: strings.TrimSpace(os.Getenv("CRYPTOPAY_WEBHOOK_SECRET")),
+		APIProfile:     strings.ToLower(src.str("API_PROFILE")),
+		RunAPI:         src.bool("RUN_API", true),
+		RunBot:         src.bool("RUN_BOT", true),
+		RunOverdue:     src.bool("RUN_OVERDUE_WORKER", true),
+		RunFasttap:     src.bool("RUN_FASTTAP_WORKER", true),
+
+		AdminID:              src.int64("ADMIN_ID", 0),
+		TotalSupply:          src.int64("TOTAL_SUPPLY", 500_000_000),
+		AdminAllocationPct:   src.int64("ADMIN_ALLOCATION_PCT", 30),
+		StartRateCoinsPerUSD: src.int64("START_RATE_COINS_PER_USD", 60_000),
+		MinRateCoinsPerUSD:   src.int64("MIN_RATE_COINS_PER_USD", 50_000),
+
+		P2PRecallMinDays:      src.int64("P2P_RECALL_MIN_DAYS", 5),
+		TransferFees:          src.bool("TRANSFER_FEES", false),
+		TransferMemoMaxLen:    src.int64("TRANSFER_MEMO_MAX_LEN", 140),
+		StandingOrdersPerUser: src.int64("STANDING_ORDERS_PER_USER", 20),
+
+		Economy: Economy{
+			EnergyMax:         src.int64("ENERGY_MAX", 300),
+			EnergyRegenPerSec: src.float64("ENERGY_REGEN_PER_SEC", 1.0),
+			TapMaxPerRequest:  src.int64("TAP_MAX_PER_REQUEST", 500),
+			TapMaxMultiTouch:  src.int64("TAP_MAX_MULTITOUCH", 13),
+
+			TapDailyLimit:           src.int64("TAP_DAILY_LIMIT", 100_000),
+			ExtraTapsPackSize:       src.int64("EXTRA_TAPS_PACK_SIZE", 13_000),
+			ExtraTapsPackPriceCoins: src.int64("EXTRA_TAPS_PACK_PRICE_COINS", 15_000),
+
+			EnergyBoost1HPriceCoins:      src.int64("ENERGY_BOOST_1H_PRICE_COINS", 25_000),
+			EnergyBoost1HRegenMultiplier: src.float64("ENERGY_BOOST_1H_REGEN_MULT", 5.0),
+			EnergyBoost1HMaxMultiplier:   src.float64("ENERGY_BOOST_1H_MAX_MULT", 5.0),
+
+			BankLoan7DInterestBP:  src.int64("BANK_LOAN_7D_INTEREST_BP", 1200),  // 12%
+			BankLoan30DInterestBP: src.int64("BANK_LOAN_30D_INTEREST_BP", 3500), // 35%
+			BankLoanMaxAmount:     src.int64("BANK_LOAN_MAX_AMOUNT", 2_000_000),
+			MarketListingFeeCoins: src.int64("MARKET_LISTING_FEE_COINS", 2_000),
+		},
+
+		CryptoPayToken:         src.str("CRYPTOPAY_API_TOKEN"),
+		CryptoPayWebhookSecret: src.str("CRYPTOPAY_WEBHOOK_SECRET"),
+
+		IdempotencyTTLHours: src.int64("IDEMPOTENCY_TTL_HOURS", 24),
 	}
 
 	if cfg.CoinImageURL == "" {
@@ -234,47 +360,113 @@ func Load() Config {
 	// Optional: show deposit wallets in the Mini App (manual top-up instructions).
 	// Example:
 	//   DEPOSIT_WALLETS_JSON={"USDT":"T...","TRX":"T...","SOL":"..."}
-	if raw := strings.TrimSpace(os.Getenv("DEPOSIT_WALLETS_JSON")); raw != "" {
+	if raw := src.str("DEPOSIT_WALLETS_JSON"); raw != "" {
 		var m map[string]string
-		if err := json.Unmarshal([]byte(raw), &m); err == nil {
-			for k, v := range m {
-				kk := strings.ToUpper(strings.TrimSpace(k))
-				vv := strings.TrimSpace(v)
-				if kk == "" || vv == "" {
-					continue
-				}
-				cfg.DepositWallets[kk] = vv
+		if err := json.Unmarshal([]byte(raw), &m); err != nil {
+			src.errs = append(src.errs, fmt.Errorf("DEPOSIT_WALLETS_JSON: %w", err))
+		}
+		for k, v := range m {
+			kk := strings.ToUpper(strings.TrimSpace(k))
+			vv := strings.TrimSpace(v)
+			if kk == "" || vv == "" {
+				continue
 			}
+			cfg.DepositWallets[kk] = vv
 		}
 	}
 
-	if cfg.AdminID == 0 {
-		panic("missing/invalid env: ADMIN_ID")
-	}
-
-	if cfg.AdminAllocationPct < 0 || cfg.AdminAllocationPct > 100 {
-		panic("ADMIN_ALLOCATION_PCT must be 0..100")
-	}
-
 	if cfg.APIProfile == "" {
 		cfg.APIProfile = "full"
 	}
-
-	if cfg.MinRateCoinsPerUSD <= 0 || cfg.StartRateCoinsPerUSD <= 0 {
-		panic("rate must be > 0")
+	if cfg.TransferMemoMaxLen < 0 {
+		cfg.TransferMemoMaxLen = 0
+	}
+	if cfg.TransferMemoMaxLen > 500 {
+		cfg.TransferMemoMaxLen = 500
 	}
-	if cfg.MinRateCoinsPerUSD > cfg.StartRateCoinsPerUSD {
-		panic("MIN_RATE_COINS_PER_USD must be <= START_RATE_COINS_PER_USD")
+	if cfg.StandingOrdersPerUser < 1 {
+		cfg.StandingOrdersPerUser = 1
 	}
+	if cfg.StandingOrdersPerUser > 200 {
+		cfg.StandingOrdersPerUser = 200
+	}
+	if cfg.IdempotencyTTLHours < 1 {
+		cfg.IdempotencyTTLHours = 1
+	}
+	if cfg.IdempotencyTTLHours > 168 {
+		cfg.IdempotencyTTLHours = 168
+	}
+	return cfg
+}
 
-	if cfg.TapDailyLimit < 0 {
-		panic("TAP_DAILY_LIMIT must be >= 0")
+// Validate reports every setting that is out of range or inconsistent.
+func (c Config) Validate() error {
+	var errs []error
+	bad := func(format string, args ...any) { errs = append(errs, fmt.Errorf(format, args...)) }
+
+	if c.AdminID == 0 {
+		bad("ADMIN_ID is required")
+	}
+	switch c.APIProfile {
+	case "full", "all", "tap", "market", "bank", "admin":
+	default:
+		bad("API_PROFILE %q: want full, tap, market, bank or admin", c.APIProfile)
+	}
+	if c.TotalSupply <= 0 {
+		bad("TOTAL_SUPPLY must be > 0")
+	}
+	if c.AdminAllocationPct < 0 || c.AdminAllocationPct > 100 {
+		bad("ADMIN_ALLOCATION_PCT must be 0..100")
+	} else if c.TotalSupply > 0 && c.TotalSupply*c.AdminAllocationPct/100 >= c.TotalSupply {
+		bad("ADMIN_ALLOCATION_PCT leaves no reserve to mine")
 	}
-	if cfg.ExtraTapsPackSize < 0 || cfg.ExtraTapsPackPriceCoins < 0 {
-		panic("EXTRA_TAPS_* must be >= 0")
+	if c.MinRateCoinsPerUSD <= 0 || c.StartRateCoinsPerUSD <= 0 {
+		bad("START_RATE_COINS_PER_USD and MIN_RATE_COINS_PER_USD must be > 0")
+	} else if c.MinRateCoinsPerUSD > c.StartRateCoinsPerUSD {
+		bad("MIN_RATE_COINS_PER_USD must be <= START_RATE_COINS_PER_USD")
 	}
+	if c.P2PRecallMinDays < 0 {
+		bad("P2P_RECALL_MIN_DAYS must be >= 0")
+	}
+	return errors.Join(append(errs, c.Economy.Validate())...)
+}
 
-	return cfg
+// Validate checks the reloadable settings.
+func (e Economy) Validate() error {
+	var errs []error
+	bad := func(format string, args ...any) { errs = append(errs, fmt.Errorf(format, args...)) }
+
+	if e.EnergyMax <= 0 {
+		bad("ENERGY_MAX must be > 0")
+	}
+	if e.EnergyRegenPerSec <= 0 {
+		bad("ENERGY_REGEN_PER_SEC must be > 0")
+	}
+	if e.TapMaxPerRequest < 1 || e.TapMaxMultiTouch < 1 {
+		bad("TAP_MAX_PER_REQUEST and TAP_MAX_MULTITOUCH must be >= 1")
+	}
+	if e.TapDailyLimit < 0 {
+		bad("TAP_DAILY_LIMIT must be >= 0")
+	}
+	if e.ExtraTapsPackSize < 0 || e.ExtraTapsPackPriceCoins < 0 {
+		bad("EXTRA_TAPS_* must be >= 0")
+	}
+	if e.EnergyBoost1HPriceCoins < 0 {
+		bad("ENERGY_BOOST_1H_PRICE_COINS must be >= 0")
+	}
+	if e.EnergyBoost1HRegenMultiplier < 1 || e.EnergyBoost1HMaxMultiplier < 1 {
+		bad("ENERGY_BOOST_1H_*_MULT must be >= 1")
+	}
+	if e.BankLoan7DInterestBP < 0 || e.BankLoan7DInterestBP > 10_000 || e.BankLoan30DInterestBP < 0 || e.BankLoan30DInterestBP > 10_000 {
+		bad("BANK_LOAN_*_INTEREST_BP must be 0..10000")
+	}
+	if e.BankLoanMaxAmount <= 0 {
+		bad("BANK_LOAN_MAX_AMOUNT must be > 0")
+	}
+	if e.MarketListingFeeCoins < 0 {
+		bad("MARKET_LISTING_FEE_COINS must be >= 0")
+	}
+	return errors.Join(errs...)
 }
 
 func parseCSV(raw string) []string {
@@ -0,0 +1,248 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The config file is a TOML subset: [section] headers, key = value pairs
+// and # comments. Values are strings ("..." or '...'), integers (1_000 is
+// allowed), floats, booleans and arrays of strings. A key maps to the env
+// variable named SECTION_KEY in upper case, so
+//
+//	[memtap]
+//	flush_interval_ms = 500
+//
+// sets MEMTAP_FLUSH_INTERVAL_MS. Keys outside any section map to their own
+// upper-case name. The environment always wins over the file.
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+	kindFloat
+	kindBool
+	kindList // comma-separated in env, an array of strings in the file
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindInt:
+		return "integer"
+	case kindFloat:
+		return "number"
+	case kindBool:
+		return "boolean"
+	case kindList:
+		return "array of strings"
+	}
+	return "string"
+}
+
+// keys are the settings the file may set, by env name.
+var keys = func() map[string]kind {
+	m := map[string]kind{}
+	add := func(k kind, names string) {
+		for _, n := range strings.Fields(names) {
+			m[n] = k
+		}
+	}
+	add(kindString, `BOT_TOKEN DATABASE_URL REDIS_URL PUBLIC_BASE_URL WEBAPP_URL COIN_IMAGE_URL API_PROFILE
+		DEPOSIT_WALLETS_JSON CRYPTOPAY_API_TOKEN CRYPTOPAY_WEBHOOK_SECRET TELEGRAM_WEBHOOK_SECRET
+		LOG_LEVEL LOG_FORMAT METRICS_TOKEN SESSION_SECRET SHUTDOWN_TIMEOUTS
+		MEMTAP_ADVERTISE_URL MEMTAP_INSTANCE_ID MEMTAP_WAL_DIR
+		REDIS_STREAM_KEY REDIS_STREAM_GROUP REDIS_STREAM_CONSUMER`)
+	add(kindList, `CORS_ALLOWED_ORIGINS`)
+	add(kindBool, `RUN_API RUN_BOT RUN_OVERDUE_WORKER RUN_FASTTAP_WORKER TRANSFER_FEES
+		TELEGRAM_FORCE_POLLING TELEGRAM_FORCE_WEBHOOK METRICS_ENABLED AUTH_REQUIRE_SESSION SECURITY_ENABLED
+		MEMTAP_ENABLED MEMTAP_WAL MEMTAP_WAL_FSYNC MEMTAP_LEASES FASTTAP_RECONCILE_APPLY SUPPLY_AUDIT_STRICT_LEDGER`)
+	add(kindFloat, `ENERGY_REGEN_PER_SEC ENERGY_BOOST_1H_REGEN_MULT ENERGY_BOOST_1H_MAX_MULT
+		SECURITY_API_RATE SECURITY_API_BURST SECURITY_PUBLIC_RATE SECURITY_PUBLIC_BURST
+		SECURITY_TAP_IP_RATE SECURITY_TAP_IP_BURST SECURITY_TAP_USER_RATE SECURITY_TAP_USER_BURST`)
+	add(kindInt, `ADMIN_ID TOTAL_SUPPLY ADMIN_ALLOCATION_PCT START_RATE_COINS_PER_USD MIN_RATE_COINS_PER_USD
+		BANK_LOAN_7D_INTEREST_BP BANK_LOAN_30D_INTEREST_BP BANK_LOAN_MAX_AMOUNT P2P_RECALL_MIN_DAYS
+		MARKET_LISTING_FEE_COINS TRANSFER_MEMO_MAX_LEN STANDING_ORDERS_PER_USER
+		ENERGY_MAX TAP_MAX_PER_REQUEST TAP_MAX_MULTITOUCH TAP_DAILY_LIMIT
+		EXTRA_TAPS_PACK_SIZE EXTRA_TAPS_PACK_PRICE_COINS ENERGY_BOOST_1H_PRICE_COINS IDEMPOTENCY_TTL_HOURS
+		PORT DB_SLOW_QUERY_MS ADMIN_SESSION_TTL_HOURS SHUTDOWN_STAGE_SEC HALVING_CHECK_EVERY_SEC
+		BLOCK_INTERVAL_SEC BLOCK_MAX_TXS BLOCK_SEAL_LAG_SEC
+		SUPPLY_AUDIT_EVERY_SEC SUPPLY_AUDIT_LEDGER_EVERY_SEC
+		STANDING_ORDERS_EVERY_SEC STANDING_ORDERS_BATCH STANDING_ORDERS_MAX_FAILURES STANDING_ORDERS_RETRY_MIN
+		SESSION_TTL_MIN SESSION_REFRESH_TTL_HOURS SESSION_REVOKED_POLL_SEC INITDATA_MAX_AGE_SEC INITDATA_LEGACY_MAX_AGE_SEC
+		EVENTS_BACKLOG EVENTS_BACKLOG_TTL_MIN EVENTS_HEARTBEAT_SEC EVENTS_MAX_STREAMS_PER_USER
+		SECURITY_MAX_BODY_BYTES SECURITY_AUTH_FAIL_WINDOW_SEC SECURITY_AUTH_FAIL_THRESHOLD SECURITY_BAN_SEC SECURITY_ENTRY_TTL_MIN
+		MEMTAP_FLUSH_INTERVAL_MS MEMTAP_SYSTEM_REFRESH_SEC MEMTAP_CACHE_TTL_SEC MEMTAP_WAL_SEGMENT_MB MEMTAP_SHARDS MEMTAP_LEASE_TTL_SEC
+		REDIS_STREAM_MAXLEN REDIS_STREAM_READ_COUNT REDIS_STREAM_READ_BLOCK_MS REDIS_STREAM_APPLY_BATCH
+		REDIS_STREAM_CLAIM_MIN_IDLE_SEC REDIS_STREAM_CLAIM_COUNT REDIS_STREAM_CLAIM_EVERY_SEC REDIS_STREAM_CLAIM_MAX_ROUNDS
+		REDIS_STREAM_DLQ_MAX_DELIVERIES REDIS_WORKER_COUNT REDIS_HEALTH_PENDING_SCAN FASTTAP_RECONCILE_EVERY_SEC`)
+	return m
+}()
+
+// readFile parses path into env-style values: booleans become "1"/"0" and
+// arrays are joined with commas, the forms the env readers expect.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseFile(path, data)
+}
+
+func parseFile(name string, data []byte) (map[string]string, error) {
+	out := map[string]string{}
+	var errs []string
+	fail := func(line int, format string, args ...any) {
+		errs = append(errs, fmt.Sprintf("%s:%d: %s", name, line, fmt.Sprintf(format, args...)))
+	}
+	section := ""
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				fail(n, "bad section header")
+				continue
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			fail(n, "want key = value")
+			continue
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		env := strings.ToUpper(k)
+		if section != "" {
+			env = strings.ToUpper(section) + "_" + env
+		}
+		typ, known := keys[env]
+		if !known {
+			fail(n, "unknown setting %q (%s)", k, env)
+			continue
+		}
+		if _, dup := out[env]; dup {
+			fail(n, "%s set twice", env)
+			continue
+		}
+		val, err := parseValue(v, typ)
+		if err != nil {
+			fail(n, "%s: %v", env, err)
+			continue
+		}
+		out[env] = val
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("config file:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return out, nil
+}
+
+// stripComment cuts a # comment that is not inside a string.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func parseValue(v string, typ kind) (string, error) {
+	switch typ {
+	case kindString:
+		return parseString(v)
+	case kindList:
+		if !strings.HasPrefix(v, "[") || !strings.HasSuffix(v, "]") {
+			return "", fmt.Errorf("want %s", typ)
+		}
+		body := strings.TrimSpace(v[1 : len(v)-1])
+		var items []string
+		for _, part := range splitList(body) {
+			s, err := parseString(part)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case kindBool:
+		switch v {
+		case "true":
+			return "1", nil
+		case "false":
+			return "0", nil
+		}
+	case kindInt:
+		s := strings.ReplaceAll(v, "_", "")
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return s, nil
+		}
+	case kindFloat:
+		s := strings.ReplaceAll(v, "_", "")
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("want %s, got %s", typ, v)
+}
+
+func parseString(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		return v[1 : len(v)-1], nil
+	}
+	if len(v) >= 2 && v[0] == '"' {
+		return strconv.Unquote(v)
+	}
+	return "", fmt.Errorf("want quoted string, got %s", v)
+}
+
+// splitList splits an array body on commas outside strings.
+func splitList(body string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, body[start:i])
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(body[start:]); last != "" {
+		parts = append(parts, last)
+	}
+	return parts
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var economy atomic.Pointer[Economy]
+
+// Econ returns the current economy settings. Callers must not modify the
+// result; it is replaced as a whole on reload.
+func Econ() *Economy {
+	if e := economy.Load(); e != nil {
+		return e
+	}
+	return &Economy{}
+}
+
+// SetEconomy replaces the current economy settings.
+func SetEconomy(e Economy) {
+	economy.Store(&e)
+}
+
+// Reloader re-reads the config file on demand (SIGHUP, admin endpoint) and
+// applies the Economy part. Other settings only take effect on restart; a
+// reload reports the ones that differ from what the process runs with.
+type Reloader struct {
+	path string
+
+	mu      sync.Mutex
+	running map[string]string // effective settings at start or last reload
+	hooks   []func(ctx context.Context, e Economy)
+}
+
+// NewReloader is for the file at path (none if empty) that cfg was loaded
+// from.
+func NewReloader(path string) (*Reloader, error) {
+	file, err := loadFileValues(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Reloader{path: path, running: settings(file)}, nil
+}
+
+// OnChange registers fn to run after a reload changed the economy, e.g. to
+// push new tap limits into a shared cache.
+func (r *Reloader) OnChange(fn func(ctx context.Context, e Economy)) {
+	r.mu.Lock()
+	r.hooks = append(r.hooks, fn)
+	r.mu.Unlock()
+}
+
+type ReloadResult struct {
+	Changed []string `json:"changed"`          // economy settings now in effect
+	Restart []string `json:"restart_required"` // other settings that changed
+	Economy Economy  `json:"economy"`
+}
+
+// Reload reads and validates the file; on success the new economy is in
+// effect and the hooks have run. An invalid file changes nothing. confirm,
+// if set, sees the result before anything is applied (the audit log records
+// it there); its error aborts the reload and is returned as is.
+func (r *Reloader) Reload(ctx context.Context, confirm func(ReloadResult) error) (ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file, err := loadFileValues(r.path)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	cfg, err := build(file)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	next := settings(file)
+	res := ReloadResult{Economy: cfg.Economy}
+	reloadable := make(map[string]bool, len(economyKeys))
+	for _, k := range economyKeys {
+		reloadable[k] = true
+	}
+	for k := range keys {
+		if next[k] == r.running[k] {
+			continue
+		}
+		if reloadable[k] {
+			res.Changed = append(res.Changed, k)
+		} else {
+			res.Restart = append(res.Restart, k)
+		}
+	}
+	sort.Strings(res.Changed)
+	sort.Strings(res.Restart)
+	if confirm != nil {
+		if err := confirm(res); err != nil {
+			return ReloadResult{}, err
+		}
+	}
+
+	// Only economy values move; the rest keeps comparing against what runs.
+	for _, k := range res.Changed {
+		if v, ok := next[k]; ok {
+			r.running[k] = v
+		} else {
+			delete(r.running, k)
+		}
+	}
+	if len(res.Changed) > 0 {
+		SetEconomy(cfg.Economy)
+		for _, fn := range r.hooks {
+			fn(ctx, cfg.Economy)
+		}
+	}
+	return res, nil
+}
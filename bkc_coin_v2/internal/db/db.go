@@ -4,9 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"strconv"
 	"strings"
 	"time"
 
+	"bkc_coin_v2/internal/metrics"
+
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -26,6 +29,10 @@ type SystemState struct {
 	MinRateCoinsUSD   int64
 	ReferralStep      int64
 	ReferralBonus     int64
+	TapRewardBP       int64 // reward per unit of tap power, basis points of a coin; halved each epoch
+	TotalMined        int64
+	HalvingThreshold  int64 // coins mined per halving epoch
+	CurrentHalving    int64
 	CreatedAt         time.Time
 	UpdatedAt         time.Time
 }
@@ -43,6 +50,8 @@ type UserState struct {
 	EnergyBoostUntil           time.Time
 	EnergyBoostRegenMultiplier float64
 	EnergyBoostMaxMultiplier   float64
+	Level                      int64
+	TapsPower                  int64 // coins minted per tap
 	ReferralsCount             int64
 	ReferralBonusTotal         int64
 }
@@ -182,6 +191,7 @@ func Connect(ctx context.Context, databaseURL string) (*DB, error) {
 		return nil, err
 	}
 	cfg.MaxConns = 5
+	cfg.ConnConfig.Tracer = queryTracer{slow: slowQueryFromEnv()}
 	pool, err := pgxpool.NewWithConfig(ctx, cfg)
 	if err != nil {
 		return nil, err
@@ -195,205 +205,6 @@ func (d *DB) Close() {
 	}
 }
 
-func (d *DB) Migrate(ctx context.Context) error {
-	sql := `
-CREATE TABLE IF NOT EXISTS system_state (
-  id INT PRIMARY KEY DEFAULT 1,
-  total_supply BIGINT NOT NULL,
-  reserve_supply BIGINT NOT NULL,
-  reserved_supply BIGINT NOT NULL DEFAULT 0,
-  initial_reserve BIGINT NOT NULL,
-  admin_user_id BIGINT NOT NULL,
-  admin_allocated BIGINT NOT NULL,
-  start_rate_coins_usd BIGINT NOT NULL,
-  min_rate_coins_usd BIGINT NOT NULL,
-  referral_step BIGINT NOT NULL,
-  referral_bonus BIGINT NOT NULL,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-ALTER TABLE system_state ADD COLUMN IF NOT EXISTS reserved_supply BIGINT NOT NULL DEFAULT 0;
-
-	CREATE TABLE IF NOT EXISTS users (
-	  user_id BIGINT PRIMARY KEY,
-	  username TEXT,
-	  first_name TEXT,
-	  balance BIGINT NOT NULL DEFAULT 0,
-	  frozen_balance BIGINT NOT NULL DEFAULT 0,
-	  taps_total BIGINT NOT NULL DEFAULT 0,
-	  energy DOUBLE PRECISION NOT NULL DEFAULT 0,
-	  energy_max DOUBLE PRECISION NOT NULL DEFAULT 0,
-	  energy_updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-	  energy_boost_until TIMESTAMPTZ,
-  energy_boost_regen_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1,
-  energy_boost_max_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1,
-  referrals_count BIGINT NOT NULL DEFAULT 0,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-	ALTER TABLE users ADD COLUMN IF NOT EXISTS energy_boost_until TIMESTAMPTZ;
-	ALTER TABLE users ADD COLUMN IF NOT EXISTS energy_boost_regen_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1;
-	ALTER TABLE users ADD COLUMN IF NOT EXISTS energy_boost_max_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1;
-	ALTER TABLE users ADD COLUMN IF NOT EXISTS taps_total BIGINT NOT NULL DEFAULT 0;
-	ALTER TABLE users ADD COLUMN IF NOT EXISTS frozen_balance BIGINT NOT NULL DEFAULT 0;
-
-CREATE TABLE IF NOT EXISTS referrals (
-  id BIGSERIAL PRIMARY KEY,
-  referrer_id BIGINT NOT NULL,
-  referred_id BIGINT NOT NULL UNIQUE,
-  bonus BIGINT NOT NULL DEFAULT 0,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-CREATE TABLE IF NOT EXISTS ledger (
-  id BIGSERIAL PRIMARY KEY,
-  event_id TEXT,
-  ts TIMESTAMPTZ NOT NULL DEFAULT now(),
-  kind TEXT NOT NULL,
-  from_id BIGINT,
-  to_id BIGINT,
-  amount BIGINT NOT NULL,
-  meta JSONB NOT NULL DEFAULT '{}'::jsonb
-);
-
-ALTER TABLE ledger ADD COLUMN IF NOT EXISTS event_id TEXT;
-
-CREATE INDEX IF NOT EXISTS ledger_ts_idx ON ledger(ts DESC);
-CREATE INDEX IF NOT EXISTS ledger_to_idx ON ledger(to_id);
-CREATE INDEX IF NOT EXISTS ledger_from_idx ON ledger(from_id);
-CREATE UNIQUE INDEX IF NOT EXISTS ledger_event_id_uniq ON ledger(event_id);
-
-CREATE TABLE IF NOT EXISTS cryptopay_invoices (
-  invoice_id BIGINT PRIMARY KEY,
-  user_id BIGINT NOT NULL,
-  amount_usd BIGINT NOT NULL,
-  coins BIGINT NOT NULL,
-  status TEXT NOT NULL,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  paid_at TIMESTAMPTZ,
-  credited_at TIMESTAMPTZ,
-  released_at TIMESTAMPTZ
-);
-
-CREATE INDEX IF NOT EXISTS cryptopay_invoices_user_idx ON cryptopay_invoices(user_id);
-
-CREATE TABLE IF NOT EXISTS deposits (
-  deposit_id BIGSERIAL PRIMARY KEY,
-  user_id BIGINT NOT NULL,
-  tx_hash TEXT NOT NULL,
-  amount_usd BIGINT NOT NULL,
-  currency TEXT NOT NULL,
-  coins BIGINT NOT NULL,
-  status TEXT NOT NULL DEFAULT 'pending',
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  approved_at TIMESTAMPTZ,
-  approved_by BIGINT
-);
-
-CREATE INDEX IF NOT EXISTS deposits_status_idx ON deposits(status, created_at DESC);
-
-CREATE TABLE IF NOT EXISTS nfts (
-  nft_id BIGSERIAL PRIMARY KEY,
-  title TEXT NOT NULL,
-  image_url TEXT NOT NULL,
-  price_coins BIGINT NOT NULL,
-  supply_total BIGINT NOT NULL,
-  supply_left BIGINT NOT NULL,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-
-CREATE TABLE IF NOT EXISTS nft_owns (
-  user_id BIGINT NOT NULL,
-  nft_id BIGINT NOT NULL,
-  qty BIGINT NOT NULL DEFAULT 0,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  PRIMARY KEY (user_id, nft_id)
-);
-
--- Bank loans (reserve -> user)
-CREATE TABLE IF NOT EXISTS bank_loans (
-  loan_id BIGSERIAL PRIMARY KEY,
-  user_id BIGINT NOT NULL,
-  principal BIGINT NOT NULL,
-  interest BIGINT NOT NULL,
-  total_due BIGINT NOT NULL,
-  term_days INT NOT NULL,
-  status TEXT NOT NULL DEFAULT 'active', -- active|repaid|overdue
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  due_at TIMESTAMPTZ NOT NULL,
-  closed_at TIMESTAMPTZ
-);
-CREATE INDEX IF NOT EXISTS bank_loans_user_idx ON bank_loans(user_id, status, created_at DESC);
-CREATE INDEX IF NOT EXISTS bank_loans_status_due_idx ON bank_loans(status, due_at);
-
--- P2P loans (user -> user)
-CREATE TABLE IF NOT EXISTS p2p_loans (
-  loan_id BIGSERIAL PRIMARY KEY,
-  lender_id BIGINT NOT NULL,
-  borrower_id BIGINT NOT NULL,
-  principal BIGINT NOT NULL,
-  interest BIGINT NOT NULL,
-  total_due BIGINT NOT NULL,
-  interest_bp INT NOT NULL,
-  term_days INT NOT NULL,
-  status TEXT NOT NULL DEFAULT 'requested', -- requested|active|rejected|cancelled|repaid
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  accepted_at TIMESTAMPTZ,
-  due_at TIMESTAMPTZ,
-  closed_at TIMESTAMPTZ
-);
-CREATE INDEX IF NOT EXISTS p2p_loans_lender_idx ON p2p_loans(lender_id, status, created_at DESC);
-CREATE INDEX IF NOT EXISTS p2p_loans_borrower_idx ON p2p_loans(borrower_id, status, created_at DESC);
-
--- Marketplace (bazaar)
-CREATE TABLE IF NOT EXISTS market_listings (
-  listing_id BIGSERIAL PRIMARY KEY,
-  seller_id BIGINT NOT NULL,
-  title TEXT NOT NULL,
-  description TEXT NOT NULL,
-  category TEXT NOT NULL DEFAULT 'other',
-  price_coins BIGINT NOT NULL,
-  contact TEXT NOT NULL,
-  status TEXT NOT NULL DEFAULT 'active', -- active|sold|cancelled
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  sold_at TIMESTAMPTZ,
-  buyer_id BIGINT
-);
-CREATE INDEX IF NOT EXISTS market_listings_status_idx ON market_listings(status, created_at DESC);
-CREATE INDEX IF NOT EXISTS market_listings_seller_idx ON market_listings(seller_id, created_at DESC);
-
-CREATE TABLE IF NOT EXISTS market_listing_images (
-  image_id BIGSERIAL PRIMARY KEY,
-  listing_id BIGINT NOT NULL REFERENCES market_listings(listing_id) ON DELETE CASCADE,
-  mime TEXT NOT NULL,
-  data BYTEA NOT NULL,
-  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-CREATE INDEX IF NOT EXISTS market_listing_images_listing_idx ON market_listing_images(listing_id, created_at DESC);
-
--- Daily tap limits / quotas
-CREATE TABLE IF NOT EXISTS user_daily (
-  user_id BIGINT NOT NULL,
-  day DATE NOT NULL,
-  tapped BIGINT NOT NULL DEFAULT 0,
-  extra_quota BIGINT NOT NULL DEFAULT 0,
-  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-  PRIMARY KEY (user_id, day)
-);
-CREATE INDEX IF NOT EXISTS user_daily_day_idx ON user_daily(day, tapped DESC);
-
--- Deposit wallets (manual top-up instructions)
-CREATE TABLE IF NOT EXISTS deposit_wallets (
-  currency TEXT PRIMARY KEY,
-  address TEXT NOT NULL,
-  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
-`
-	_, err := d.Pool.Exec(ctx, sql)
-	return err
-}
-
 func (d *DB) EnsureSystemState(ctx context.Context, totalSupply, adminUserID, adminAllocated, reserveSupply, startRate, minRate, refStep, refBonus int64) (SystemState, error) {
 	_, err := d.Pool.Exec(ctx, `
 INSERT INTO system_state (id, total_supply, reserve_supply, reserved_supply, initial_reserve, admin_user_id, admin_allocated, start_rate_coins_usd, min_rate_coins_usd, referral_step, referral_bonus)
@@ -425,14 +236,14 @@ func (d *DB) GetUser(ctx context.Context, userID int64) (UserState, error) {
 	row := d.Pool.QueryRow(ctx, `
 SELECT user_id, COALESCE(username,''), COALESCE(first_name,''), balance, frozen_balance, taps_total, energy, energy_max, energy_updated_at,
        COALESCE(energy_boost_until, to_timestamp(0)), energy_boost_regen_multiplier, energy_boost_max_multiplier,
-       referrals_count
+       level, taps_power, referrals_count
 	FROM users
 	WHERE user_id=$1
 	`, userID)
 	if err := row.Scan(
 		&u.UserID, &u.Username, &u.FirstName, &u.Balance, &u.FrozenBalance, &u.TapsTotal, &u.Energy, &u.EnergyMax, &u.EnergyUpdatedAt,
 		&u.EnergyBoostUntil, &u.EnergyBoostRegenMultiplier, &u.EnergyBoostMaxMultiplier,
-		&u.ReferralsCount,
+		&u.Level, &u.TapsPower, &u.ReferralsCount,
 	); err != nil {
 		return UserState{}, err
 	}
@@ -444,11 +255,13 @@ SELECT user_id, COALESCE(username,''), COALESCE(first_name,''), balance, frozen_
 func (d *DB) GetSystem(ctx context.Context) (SystemState, error) {
 	var s SystemState
 	row := d.Pool.QueryRow(ctx, `
-SELECT total_supply, reserve_supply, reserved_supply, initial_reserve, admin_user_id, admin_allocated, start_rate_coins_usd, min_rate_coins_usd, referral_step, referral_bonus, created_at, updated_at
+SELECT total_supply, reserve_supply, reserved_supply, initial_reserve, admin_user_id, admin_allocated, start_rate_coins_usd, min_rate_coins_usd, referral_step, referral_bonus,
+       tap_reward_bp, total_mined, halving_threshold, current_halving, created_at, updated_at
 FROM system_state
 WHERE id=1
 `)
-	if err := row.Scan(&s.TotalSupply, &s.ReserveSupply, &s.ReservedSupply, &s.InitialReserve, &s.AdminUserID, &s.AdminAllocated, &s.StartRateCoinsUSD, &s.MinRateCoinsUSD, &s.ReferralStep, &s.ReferralBonus, &s.CreatedAt, &s.UpdatedAt); err != nil {
+	if err := row.Scan(&s.TotalSupply, &s.ReserveSupply, &s.ReservedSupply, &s.InitialReserve, &s.AdminUserID, &s.AdminAllocated, &s.StartRateCoinsUSD, &s.MinRateCoinsUSD, &s.ReferralStep, &s.ReferralBonus,
+		&s.TapRewardBP, &s.TotalMined, &s.HalvingThreshold, &s.CurrentHalving, &s.CreatedAt, &s.UpdatedAt); err != nil {
 		return SystemState{}, err
 	}
 	return s, nil
@@ -466,9 +279,23 @@ func (d *DB) WithTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
 	return tx.Commit(ctx)
 }
 
+// TxHook runs inside the transaction of a privileged helper, after its
+// writes and before commit, with the affected state before and after the
+// change. An error rolls the change back. The audit log passes one so an
+// admin action never commits without its entry; nil skips it.
+type TxHook func(ctx context.Context, tx pgx.Tx, before, after any) error
+
+func (h TxHook) run(ctx context.Context, tx pgx.Tx, before, after any) error {
+	if h == nil {
+		return nil
+	}
+	return h(ctx, tx, before, after)
+}
+
 var ErrNotEnough = errors.New("not enough")
 var ErrAlreadyExists = errors.New("already exists")
 var ErrForbidden = errors.New("forbidden")
+var ErrAmbiguous = errors.New("ambiguous")
 
 func (d *DB) ApplyTapEvents(ctx context.Context, events []TapEvent) error {
 	if len(events) == 0 {
@@ -481,7 +308,7 @@ func (d *DB) ApplyTapEvents(ctx context.Context, events []TapEvent) error {
 	days := make([]string, 0, len(events))
 	reqs := make([]int64, 0, len(events))
 	for _, ev := range events {
-		if strings.TrimSpace(ev.EventID) == "" || ev.UserID <= 0 || ev.Coins <= 0 || ev.Taps <= 0 || strings.TrimSpace(ev.Day) == "" {
+		if strings.TrimSpace(ev.EventID) == "" || ev.UserID <= 0 || ev.Coins < 0 || ev.Taps <= 0 || strings.TrimSpace(ev.Day) == "" {
 			continue
 		}
 		ids = append(ids, strings.TrimSpace(ev.EventID))
@@ -540,6 +367,7 @@ up_daily AS (
 )
 UPDATE system_state
 SET reserve_supply = reserve_supply - (SELECT COALESCE(SUM(coins),0) FROM ins),
+    total_mined = total_mined + (SELECT COALESCE(SUM(coins),0) FROM ins),
     updated_at = now()
 WHERE id=1
 `, ids, uids, coins, taps, days, reqs)
@@ -548,8 +376,13 @@ WHERE id=1
 }
 
 // ApplyTapAggregates persists in-memory tap deltas in one transactional batch.
-// reserveDelta should be negative for tap mints (reserve decreases).
-func (d *DB) ApplyTapAggregates(ctx context.Context, users []UserTapAggregate, daily []DailyTapAggregate, reserveDelta int64, source string) error {
+// reserveDelta should be negative for tap mints (reserve decreases). Energy
+// is absolute, so it is only written if it is not older than the stored
+// energy_updated_at: a late flush from a node that lost its shard must not
+// overwrite the new owner's energy.
+// eventIDs (optional) are recorded as ledger markers in the same transaction;
+// if any of them was already recorded the batch is skipped with ErrAlreadyExists.
+func (d *DB) ApplyTapAggregates(ctx context.Context, users []UserTapAggregate, daily []DailyTapAggregate, reserveDelta int64, source string, eventIDs []string) error {
 	if len(users) == 0 && len(daily) == 0 && reserveDelta == 0 {
 		return nil
 	}
@@ -591,6 +424,21 @@ func (d *DB) ApplyTapAggregates(ctx context.Context, users []UserTapAggregate, d
 	}
 
 	return d.WithTx(ctx, func(tx pgx.Tx) error {
+		if len(eventIDs) > 0 {
+			tag, err := tx.Exec(ctx, `
+INSERT INTO ledger(event_id, kind, from_id, to_id, amount, meta)
+SELECT id, 'tap_flush_segment', NULL, NULL, 0, jsonb_build_object('source', $2::text)
+FROM UNNEST($1::text[]) AS t(id)
+ON CONFLICT (event_id) DO NOTHING
+`, eventIDs, source)
+			if err != nil {
+				return err
+			}
+			if tag.RowsAffected() != int64(len(eventIDs)) {
+				return ErrAlreadyExists
+			}
+		}
+
 		if len(userIDs) > 0 {
 			_, err := tx.Exec(ctx, `
 WITH data AS (
@@ -600,8 +448,9 @@ WITH data AS (
 UPDATE users
 SET balance = users.balance + data.balance_delta,
     taps_total = users.taps_total + data.taps_delta,
-    energy = data.energy,
-    energy_updated_at = data.energy_updated_at
+    energy = CASE WHEN users.energy_updated_at IS NULL OR data.energy_updated_at >= users.energy_updated_at
+                  THEN data.energy ELSE users.energy END,
+    energy_updated_at = GREATEST(users.energy_updated_at, data.energy_updated_at)
 FROM data
 WHERE users.user_id = data.user_id
 `, userIDs, userBalance, userTaps, userEnergy, userEnergyAt)
@@ -641,6 +490,9 @@ WHERE id=1
 		}
 
 		if totalCoins > 0 {
+			if _, err := tx.Exec(ctx, `UPDATE system_state SET total_mined = total_mined + $1, updated_at=now() WHERE id=1`, totalCoins); err != nil {
+				return err
+			}
 			meta := toJSON(map[string]any{
 				"source": source,
 				"users":  len(userIDs),
@@ -659,7 +511,9 @@ VALUES('tap_flush_batch', NULL, NULL, $1, $2::jsonb)
 	})
 }
 
-func (d *DB) CreditFromReserve(ctx context.Context, userID int64, amount int64, kind string, meta any) error {
+// CreditFromReserve pays amount from the free reserve to an existing user.
+// hook sees the user's balance and the reserve before and after.
+func (d *DB) CreditFromReserve(ctx context.Context, userID int64, amount int64, kind string, meta any, hook TxHook) error {
 	if amount <= 0 {
 		return nil
 	}
@@ -673,14 +527,23 @@ func (d *DB) CreditFromReserve(ctx context.Context, userID int64, amount int64,
 		if available < amount {
 			return ErrNotEnough
 		}
+		var balance int64
+		if err := tx.QueryRow(ctx, `SELECT balance FROM users WHERE user_id=$1 FOR UPDATE`, userID).Scan(&balance); err != nil {
+			return err
+		}
 		if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply - $1, updated_at=now() WHERE id=1`, amount); err != nil {
 			return err
 		}
 		if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance + $1 WHERE user_id=$2`, amount, userID); err != nil {
 			return err
 		}
-		_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES($1, NULL, $2, $3, $4::jsonb)`, kind, userID, amount, toJSON(meta))
-		return err
+		if _, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES($1, NULL, $2, $3, $4::jsonb)`, kind, userID, amount, toJSON(meta)); err != nil {
+			return err
+		}
+		return hook.run(ctx, tx,
+			map[string]any{"balance": balance, "reserve": reserve},
+			map[string]any{"balance": balance + amount, "reserve": reserve - amount, "amount": amount},
+		)
 	})
 }
 
@@ -707,32 +570,166 @@ func (d *DB) DebitToReserve(ctx context.Context, userID int64, amount int64, kin
 	})
 }
 
-func (d *DB) Transfer(ctx context.Context, fromID, toID, amount int64) error {
-	if amount <= 0 || fromID == toID {
-		return nil
+// UpgradeLevel moves the user from fromLevel to toLevel and debits cost to
+// the reserve. ErrAlreadyExists means the level changed concurrently.
+func (d *DB) UpgradeLevel(ctx context.Context, userID, fromLevel, toLevel, power, cost int64) error {
+	if cost < 0 || toLevel <= fromLevel || power < 1 {
+		return errors.New("bad upgrade")
 	}
 	return d.WithTx(ctx, func(tx pgx.Tx) error {
-		var fromBal int64
-		if err := tx.QueryRow(ctx, `SELECT balance FROM users WHERE user_id=$1 FOR UPDATE`, fromID).Scan(&fromBal); err != nil {
+		// Lock system reserve first (avoid deadlocks with other reserve ops).
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM system_state WHERE id=1 FOR UPDATE`); err != nil {
+			return err
+		}
+		var bal, level int64
+		if err := tx.QueryRow(ctx, `SELECT balance, level FROM users WHERE user_id=$1 FOR UPDATE`, userID).Scan(&bal, &level); err != nil {
 			return err
 		}
-		if fromBal < amount {
+		if level != fromLevel {
+			return ErrAlreadyExists
+		}
+		if bal < cost {
 			return ErrNotEnough
 		}
-		// Ensure receiver exists and lock
-		var toBal int64
-		if err := tx.QueryRow(ctx, `SELECT balance FROM users WHERE user_id=$1 FOR UPDATE`, toID).Scan(&toBal); err != nil {
+		if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance - $1, level=$2, taps_power=$3 WHERE user_id=$4`, cost, toLevel, power, userID); err != nil {
 			return err
 		}
-		if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance - $1 WHERE user_id=$2`, amount, fromID); err != nil {
+		if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply + $1, updated_at=now() WHERE id=1`, cost); err != nil {
 			return err
 		}
-		if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance + $1 WHERE user_id=$2`, amount, toID); err != nil {
+		_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('upgrade_level', $1, NULL, $2, $3::jsonb)`,
+			userID, cost, toJSON(map[string]any{"from_level": fromLevel, "level": toLevel, "taps_power": power}))
+		return err
+	})
+}
+
+// TransferSpec is a user-to-user transfer. Amount is the gross debited from
+// the sender; FeeBurn is destroyed, FeeReserve goes back to the reserve and
+// the receiver gets the rest (Net).
+type TransferSpec struct {
+	FromID     int64
+	ToID       int64
+	Amount     int64
+	FeeBurn    int64
+	FeeReserve int64
+	Memo       string
+
+	StandingOrderID int64 // set when a standing order pays
+}
+
+// Fee is the total fee taken from the sender.
+func (s TransferSpec) Fee() int64 { return s.FeeBurn + s.FeeReserve }
+
+// Net is what the receiver gets.
+func (s TransferSpec) Net() int64 { return s.Amount - s.Fee() }
+
+// Validate rejects negative fees and fees that eat the whole amount.
+func (s TransferSpec) Validate() error {
+	if s.FeeBurn < 0 || s.FeeReserve < 0 || s.Net() <= 0 {
+		return errors.New("bad transfer fee")
+	}
+	return nil
+}
+
+// LegMeta is the meta of the net "transfer" leg: nil for a plain transfer,
+// so old and fee-less rows look the same. The memo is not part of it: ledger
+// rows are public through the chain endpoints, so it goes to transfer_memos.
+func (s TransferSpec) LegMeta() any {
+	if s.Fee() == 0 && s.StandingOrderID == 0 {
+		return nil
+	}
+	m := map[string]any{"gross": s.Amount, "fee": s.Fee()}
+	if s.StandingOrderID != 0 {
+		m["standing_order_id"] = s.StandingOrderID
+	}
+	return m
+}
+
+// FeeMeta is the meta of the fee legs; it points back at the receiver.
+func (s TransferSpec) FeeMeta() any {
+	return map[string]any{"to_id": s.ToID, "gross": s.Amount}
+}
+
+// Transfer moves amount between users without a fee.
+func (d *DB) Transfer(ctx context.Context, fromID, toID, amount int64) error {
+	return d.TransferWithFee(ctx, TransferSpec{FromID: fromID, ToID: toID, Amount: amount})
+}
+
+// TransferWithFee debits s.Amount from the sender and writes up to three
+// ledger legs: "transfer" (net, sender -> receiver, memo in transfer_memos),
+// "transfer_fee_burn" (sender -> destroyed) and "transfer_fee" (sender ->
+// reserve).
+func (d *DB) TransferWithFee(ctx context.Context, s TransferSpec) error {
+	if s.Amount <= 0 || s.FromID == s.ToID {
+		return nil
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	return d.WithTx(ctx, func(tx pgx.Tx) error {
+		return transferTx(ctx, tx, s)
+	})
+}
+
+// transferTx is the body of TransferWithFee, shared with standing orders so
+// scheduled payments move coins exactly like /transfer.
+func transferTx(ctx context.Context, tx pgx.Tx, s TransferSpec) error {
+	if s.Fee() > 0 {
+		// Lock system reserve first (avoid deadlocks with other reserve ops).
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM system_state WHERE id=1 FOR UPDATE`); err != nil {
 			return err
 		}
-		_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount) VALUES('transfer', $1, $2, $3)`, fromID, toID, amount)
+	}
+	var fromBal int64
+	if err := tx.QueryRow(ctx, `SELECT balance FROM users WHERE user_id=$1 FOR UPDATE`, s.FromID).Scan(&fromBal); err != nil {
 		return err
-	})
+	}
+	if fromBal < s.Amount {
+		return ErrNotEnough
+	}
+	// Ensure receiver exists and lock
+	var toBal int64
+	if err := tx.QueryRow(ctx, `SELECT balance FROM users WHERE user_id=$1 FOR UPDATE`, s.ToID).Scan(&toBal); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance - $1 WHERE user_id=$2`, s.Amount, s.FromID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance + $1 WHERE user_id=$2`, s.Net(), s.ToID); err != nil {
+		return err
+	}
+	var legID int64
+	if err := tx.QueryRow(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('transfer', $1, $2, $3, $4::jsonb) RETURNING id`, s.FromID, s.ToID, s.Net(), toJSON(s.LegMeta())).Scan(&legID); err != nil {
+		return err
+	}
+	if s.Memo != "" {
+		if _, err := tx.Exec(ctx, `INSERT INTO transfer_memos(ledger_id, memo) VALUES($1, $2)`, legID, s.Memo); err != nil {
+			return err
+		}
+	}
+	if s.FeeBurn > 0 {
+		if _, err := tx.Exec(ctx, `UPDATE system_state SET total_supply=GREATEST(total_supply-$1, 0), total_burned=total_burned+$1, updated_at=now() WHERE id=1`, s.FeeBurn); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('transfer_fee_burn', $1, NULL, $2, $3::jsonb)`, s.FromID, s.FeeBurn, toJSON(s.FeeMeta())); err != nil {
+			return err
+		}
+	}
+	if s.FeeReserve > 0 {
+		if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply + $1, updated_at=now() WHERE id=1`, s.FeeReserve); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('transfer_fee', $1, NULL, $2, $3::jsonb)`, s.FromID, s.FeeReserve, toJSON(s.FeeMeta())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordLedger writes a standalone ledger row. Zero ids are stored as NULL.
+func (d *DB) RecordLedger(ctx context.Context, kind string, fromID, toID, amount int64, meta any) error {
+	_, err := d.Pool.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES($1, NULLIF($2::bigint, 0), NULLIF($3::bigint, 0), $4, $5::jsonb)`, kind, fromID, toID, amount, toJSON(meta))
+	return err
 }
 
 func toJSON(v any) string {
@@ -830,6 +827,143 @@ func (d *DB) RegisterReferral(ctx context.Context, referrerID, referredID, step,
 	return bonus, nil
 }
 
+// Ping checks that the database answers.
+func (d *DB) Ping(ctx context.Context) error {
+	var one int
+	if err := d.Pool.QueryRow(ctx, `SELECT 1`).Scan(&one); err != nil {
+		return err
+	}
+	if one != 1 {
+		return errors.New("bad ping")
+	}
+	return nil
+}
+
+func (d *DB) UserExists(ctx context.Context, userID int64) (bool, error) {
+	var ok bool
+	err := d.Pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE user_id=$1)`, userID).Scan(&ok)
+	return ok, err
+}
+
+// UserProfile is what other users may see about an account.
+type UserProfile struct {
+	UserID    int64
+	Username  string
+	FirstName string
+	PhotoURL  string
+}
+
+const userProfileSelect = `SELECT user_id, COALESCE(username,''), COALESCE(first_name,''), COALESCE(photo_url,'') FROM users`
+
+func (d *DB) GetUserProfile(ctx context.Context, userID int64) (UserProfile, error) {
+	var p UserProfile
+	err := d.Pool.QueryRow(ctx, userProfileSelect+` WHERE user_id=$1`, userID).Scan(&p.UserID, &p.Username, &p.FirstName, &p.PhotoURL)
+	return p, err
+}
+
+// FindUserByUsername looks a user up by @username, case-insensitively.
+// Usernames are only refreshed when their owner shows up, so a stale copy can
+// linger on another account; two matches are ErrAmbiguous.
+func (d *DB) FindUserByUsername(ctx context.Context, username string) (UserProfile, error) {
+	rows, err := d.Pool.Query(ctx, userProfileSelect+` WHERE lower(username)=lower($1) LIMIT 2`, username)
+	if err != nil {
+		return UserProfile{}, err
+	}
+	defer rows.Close()
+	var out []UserProfile
+	for rows.Next() {
+		var p UserProfile
+		if err := rows.Scan(&p.UserID, &p.Username, &p.FirstName, &p.PhotoURL); err != nil {
+			return UserProfile{}, err
+		}
+		out = append(out, p)
+	}
+	if err := rows.Err(); err != nil {
+		return UserProfile{}, err
+	}
+	switch len(out) {
+	case 0:
+		return UserProfile{}, pgx.ErrNoRows
+	case 1:
+		return out[0], nil
+	default:
+		return UserProfile{}, ErrAmbiguous
+	}
+}
+
+// SetUserPhoto stores the Telegram avatar URL; it skips the write when unchanged.
+func (d *DB) SetUserPhoto(ctx context.Context, userID int64, photoURL string) error {
+	_, err := d.Pool.Exec(ctx, `UPDATE users SET photo_url=$2 WHERE user_id=$1 AND photo_url IS DISTINCT FROM $2`, userID, photoURL)
+	return err
+}
+
+// SetUserEnergy stores regenerated energy as of at.
+func (d *DB) SetUserEnergy(ctx context.Context, userID int64, energy float64, at time.Time) error {
+	_, err := d.Pool.Exec(ctx, `UPDATE users SET energy=$1, energy_updated_at=$2 WHERE user_id=$3`, energy, at, userID)
+	return err
+}
+
+// Counters are the explorer-level totals shown by /blockchain.
+type Counters struct {
+	Users      int64
+	LedgerRows int64
+	TapsMinted int64
+}
+
+func (d *DB) GetCounters(ctx context.Context) (Counters, error) {
+	var c Counters
+	err := d.Pool.QueryRow(ctx, `
+SELECT (SELECT COUNT(*) FROM users),
+       (SELECT COUNT(*) FROM ledger),
+       (SELECT COALESCE(SUM(amount),0) FROM ledger WHERE kind='tap')
+`).Scan(&c.Users, &c.LedgerRows, &c.TapsMinted)
+	return c, err
+}
+
+// LoanExposure is the open loans of one kind ("bank" or "p2p") and status:
+// how many and how much is still due on them.
+type LoanExposure struct {
+	Kind   string
+	Status string
+	Count  int64
+	Due    int64
+}
+
+// GetLoanExposure sums loans that are lent out and not yet repaid.
+func (d *DB) GetLoanExposure(ctx context.Context) ([]LoanExposure, error) {
+	rows, err := d.Pool.Query(ctx, `
+SELECT 'bank', status, COUNT(*), COALESCE(SUM(total_due),0) FROM bank_loans WHERE status IN ('active','overdue') GROUP BY status
+UNION ALL
+SELECT 'p2p', status, COUNT(*), COALESCE(SUM(total_due),0) FROM p2p_loans WHERE status='active' GROUP BY status
+`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []LoanExposure
+	for rows.Next() {
+		var e LoanExposure
+		if err := rows.Scan(&e.Kind, &e.Status, &e.Count, &e.Due); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// WriteMetrics exports connection pool stats (metrics.Collector).
+func (d *DB) WriteMetrics(ctx context.Context, w *metrics.Writer) {
+	st := d.Pool.Stat()
+	w.Gauge("bkc_db_pool_conns", "Postgres pool connections by state.", float64(st.AcquiredConns()), "state", "acquired")
+	w.Gauge("bkc_db_pool_conns", "", float64(st.IdleConns()), "state", "idle")
+	w.Gauge("bkc_db_pool_conns", "", float64(st.ConstructingConns()), "state", "constructing")
+	w.Gauge("bkc_db_pool_max_conns", "Postgres pool size limit.", float64(st.MaxConns()))
+	w.Counter("bkc_db_pool_acquires_total", "Connections acquired from the pool.", float64(st.AcquireCount()))
+	w.Counter("bkc_db_pool_empty_acquires_total", "Acquires that had to wait for a connection.", float64(st.EmptyAcquireCount()))
+	w.Counter("bkc_db_pool_acquire_wait_seconds_total", "Time spent waiting for connections.", st.AcquireDuration().Seconds())
+	w.Counter("bkc_db_pool_canceled_acquires_total", "Acquires canceled by their context.", float64(st.CanceledAcquireCount()))
+}
+
 func (d *DB) ListUserIDs(ctx context.Context) ([]int64, error) {
 	rows, err := d.Pool.Query(ctx, `SELECT user_id FROM users ORDER BY created_at ASC`)
 	if err != nil {
@@ -1068,7 +1202,8 @@ ORDER BY o.qty DESC, o.nft_id DESC
 	return out, rows.Err()
 }
 
-func (d *DB) CreateNFT(ctx context.Context, title, imageURL string, priceCoins, supply int64) (int64, error) {
+// CreateNFT adds an NFT to the shop; hook sees the new item as after.
+func (d *DB) CreateNFT(ctx context.Context, title, imageURL string, priceCoins, supply int64, hook TxHook) (int64, error) {
 	title = strings.TrimSpace(title)
 	imageURL = strings.TrimSpace(imageURL)
 	if title == "" || imageURL == "" || priceCoins <= 0 || supply <= 0 {
@@ -1076,17 +1211,25 @@ func (d *DB) CreateNFT(ctx context.Context, title, imageURL string, priceCoins,
 	}
 
 	var id int64
-	err := d.Pool.QueryRow(ctx, `
+	err := d.WithTx(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, `
 INSERT INTO nfts(title, image_url, price_coins, supply_total, supply_left)
 VALUES($1, $2, $3, $4, $4)
 RETURNING nft_id
 `, title, imageURL, priceCoins, supply).Scan(&id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('nft_create', NULL, NULL, 0, $1::jsonb)`,
+			toJSON(map[string]any{"nft_id": id, "title": title, "price": priceCoins, "supply": supply}),
+		); err != nil {
+			return err
+		}
+		return hook.run(ctx, tx, nil, map[string]any{"nft_id": id, "title": title, "image_url": imageURL, "price_coins": priceCoins, "supply_total": supply})
+	})
 	if err != nil {
 		return 0, err
 	}
-	_, _ = d.Pool.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('nft_create', NULL, NULL, 0, $1::jsonb)`,
-		toJSON(map[string]any{"nft_id": id, "title": title, "price": priceCoins, "supply": supply}),
-	)
 	return id, nil
 }
 
@@ -1141,6 +1284,74 @@ ON CONFLICT (user_id, nft_id) DO UPDATE SET qty = nft_owns.qty + 1
 	})
 }
 
+// BuyEnergyBoost charges price into the reserve and boosts the user's energy
+// until until: max energy times maxMult (energy refilled to it), regen times
+// regenMult. Returns the unboosted energy_max.
+func (d *DB) BuyEnergyBoost(ctx context.Context, userID, price int64, until time.Time, regenMult, maxMult float64, now time.Time) (float64, error) {
+	if userID <= 0 || price < 0 {
+		return 0, errors.New("bad params")
+	}
+	var baseMax float64
+	err := d.WithTx(ctx, func(tx pgx.Tx) error {
+		var bal int64
+		if err := tx.QueryRow(ctx, `SELECT balance, energy_max FROM users WHERE user_id=$1 FOR UPDATE`, userID).Scan(&bal, &baseMax); err != nil {
+			return err
+		}
+		if bal < price {
+			return ErrNotEnough
+		}
+		// debit to reserve
+		if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance - $1 WHERE user_id=$2`, price, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply + $1, updated_at=now() WHERE id=1`, price); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE users SET energy_boost_until=$1, energy_boost_regen_multiplier=$2, energy_boost_max_multiplier=$3, energy=$4, energy_updated_at=$5 WHERE user_id=$6`, until, regenMult, maxMult, baseMax*maxMult, now, userID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('buy_energy_1h', $1, NULL, $2, $3::jsonb)`, userID, price, toJSON(map[string]any{"until": until.Unix()}))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return baseMax, nil
+}
+
+// BuyTapPack charges price into the reserve and adds packSize taps to the
+// user's quota for day.
+func (d *DB) BuyTapPack(ctx context.Context, userID, price, packSize int64, day time.Time) error {
+	if userID <= 0 || price < 0 || packSize <= 0 {
+		return errors.New("bad params")
+	}
+	return d.WithTx(ctx, func(tx pgx.Tx) error {
+		var bal int64
+		if err := tx.QueryRow(ctx, `SELECT balance FROM users WHERE user_id=$1 FOR UPDATE`, userID).Scan(&bal); err != nil {
+			return err
+		}
+		if bal < price {
+			return ErrNotEnough
+		}
+		if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance - $1 WHERE user_id=$2`, price, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply + $1, updated_at=now() WHERE id=1`, price); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO user_daily(user_id, day) VALUES($1,$2) ON CONFLICT DO NOTHING`, userID, day); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE user_daily SET extra_quota = extra_quota + $1, updated_at=now() WHERE user_id=$2 AND day=$3`, packSize, userID, day); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('buy_tap_pack', $1, NULL, $2, $3::jsonb)`,
+			userID, price, toJSON(map[string]any{"day": day.Format("2006-01-02"), "pack_size": packSize}),
+		)
+		return err
+	})
+}
+
 func (d *DB) CreateDeposit(ctx context.Context, userID int64, txHash string, amountUSD int64, currency string, coins int64) (int64, error) {
 	txHash = strings.TrimSpace(txHash)
 	currency = strings.ToUpper(strings.TrimSpace(currency))
@@ -1194,7 +1405,7 @@ func (d *DB) ListDeposits(ctx context.Context, status string, limit int64) ([]De
 	}
 
 	rows, err := d.Pool.Query(ctx, `
-SELECT deposit_id, user_id, tx_hash, amount_usd, currency, coins, status, created_at, approved_at, approved_by
+SELECT `+depositCols+`
 FROM deposits
 WHERE status=$1
 ORDER BY created_at DESC
@@ -1208,7 +1419,7 @@ LIMIT $2
 	var out []Deposit
 	for rows.Next() {
 		var dps Deposit
-		if err := rows.Scan(&dps.DepositID, &dps.UserID, &dps.TxHash, &dps.AmountUSD, &dps.Currency, &dps.Coins, &dps.Status, &dps.CreatedAt, &dps.ApprovedAt, &dps.ApprovedBy); err != nil {
+		if err := scanDeposit(rows, &dps); err != nil {
 			return nil, err
 		}
 		out = append(out, dps)
@@ -1216,44 +1427,54 @@ LIMIT $2
 	return out, rows.Err()
 }
 
+const depositCols = `deposit_id, user_id, tx_hash, amount_usd, currency, coins, status, created_at, approved_at, approved_by`
+
+func scanDeposit(row pgx.Row, out *Deposit) error {
+	return row.Scan(&out.DepositID, &out.UserID, &out.TxHash, &out.AmountUSD, &out.Currency, &out.Coins, &out.Status, &out.CreatedAt, &out.ApprovedAt, &out.ApprovedBy)
+}
+
 func (d *DB) GetDeposit(ctx context.Context, depositID int64) (Deposit, error) {
 	if depositID <= 0 {
 		return Deposit{}, errors.New("bad deposit_id")
 	}
 	var out Deposit
 	row := d.Pool.QueryRow(ctx, `
-SELECT deposit_id, user_id, tx_hash, amount_usd, currency, coins, status, created_at, approved_at, approved_by
+SELECT `+depositCols+`
 FROM deposits
 WHERE deposit_id=$1
 `, depositID)
-	if err := row.Scan(&out.DepositID, &out.UserID, &out.TxHash, &out.AmountUSD, &out.Currency, &out.Coins, &out.Status, &out.CreatedAt, &out.ApprovedAt, &out.ApprovedBy); err != nil {
+	if err := scanDeposit(row, &out); err != nil {
 		return Deposit{}, err
 	}
 	return out, nil
 }
 
-func (d *DB) ProcessDeposit(ctx context.Context, depositID int64, adminID int64, approve bool) error {
+// ProcessDeposit approves or rejects a pending deposit. A deposit that is no
+// longer pending is left alone and hook is not called; otherwise hook sees
+// the Deposit before and after.
+func (d *DB) ProcessDeposit(ctx context.Context, depositID int64, adminID int64, approve bool, hook TxHook) error {
 	if depositID <= 0 || adminID <= 0 {
 		return errors.New("bad params")
 	}
 
 	return d.WithTx(ctx, func(tx pgx.Tx) error {
-		var userID int64
-		var coins int64
-		var status string
-		if err := tx.QueryRow(ctx, `
-SELECT user_id, coins, status
+		var before Deposit
+		if err := scanDeposit(tx.QueryRow(ctx, `
+SELECT `+depositCols+`
 FROM deposits
 WHERE deposit_id=$1
 FOR UPDATE
-`, depositID).Scan(&userID, &coins, &status); err != nil {
+`, depositID), &before); err != nil {
 			return err
 		}
+		userID, coins := before.UserID, before.Coins
 
-		status = strings.ToLower(strings.TrimSpace(status))
+		status := strings.ToLower(strings.TrimSpace(before.Status))
 		if status != "pending" {
 			return nil
 		}
+		after := before
+		after.ApprovedBy = &adminID
 
 		if approve {
 			var reserve int64
@@ -1278,10 +1499,13 @@ FOR UPDATE
 			if _, err := tx.Exec(ctx, `UPDATE deposits SET status='approved', approved_at=$1, approved_by=$2 WHERE deposit_id=$3`, now, adminID, depositID); err != nil {
 				return err
 			}
-			_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('deposit_approve', NULL, $1, $2, $3::jsonb)`,
+			if _, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('deposit_approve', NULL, $1, $2, $3::jsonb)`,
 				userID, coins, toJSON(map[string]any{"deposit_id": depositID, "by": adminID}),
-			)
-			return err
+			); err != nil {
+				return err
+			}
+			after.Status, after.ApprovedAt = "approved", &now
+			return hook.run(ctx, tx, before, after)
 		}
 
 		// reject -> release reserved
@@ -1301,10 +1525,13 @@ FOR UPDATE
 		if _, err := tx.Exec(ctx, `UPDATE deposits SET status='rejected', approved_at=$1, approved_by=$2 WHERE deposit_id=$3`, now, adminID, depositID); err != nil {
 			return err
 		}
-		_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('deposit_reject', $1, NULL, 0, $2::jsonb)`,
+		if _, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('deposit_reject', $1, NULL, 0, $2::jsonb)`,
 			userID, toJSON(map[string]any{"deposit_id": depositID, "by": adminID}),
-		)
-		return err
+		); err != nil {
+			return err
+		}
+		after.Status, after.ApprovedAt = "rejected", &now
+		return hook.run(ctx, tx, before, after)
 	})
 }
 
@@ -1332,7 +1559,7 @@ func (d *DB) Burn(ctx context.Context, userID int64, amount int64, kind string,
 			return err
 		}
 		// Reduce total supply (burn)
-		if _, err := tx.Exec(ctx, `UPDATE system_state SET total_supply=GREATEST(total_supply-$1, 0), updated_at=now() WHERE id=1`, amount); err != nil {
+		if _, err := tx.Exec(ctx, `UPDATE system_state SET total_supply=GREATEST(total_supply-$1, 0), total_burned=total_burned+$1, updated_at=now() WHERE id=1`, amount); err != nil {
 			return err
 		}
 		_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES($1, $2, NULL, $3, $4::jsonb)`, kind, userID, amount, toJSON(meta))
@@ -1583,6 +1810,16 @@ RETURNING loan_id
 	return out, nil
 }
 
+func (d *DB) GetP2PLoan(ctx context.Context, loanID int64) (P2PLoan, error) {
+	var l P2PLoan
+	err := d.Pool.QueryRow(ctx, `
+SELECT loan_id, lender_id, borrower_id, principal, interest, total_due, interest_bp, term_days, status, created_at, accepted_at, due_at, closed_at
+FROM p2p_loans
+WHERE loan_id=$1
+`, loanID).Scan(&l.LoanID, &l.LenderID, &l.BorrowerID, &l.Principal, &l.Interest, &l.TotalDue, &l.InterestBP, &l.TermDays, &l.Status, &l.CreatedAt, &l.AcceptedAt, &l.DueAt, &l.ClosedAt)
+	return l, err
+}
+
 func (d *DB) ListIncomingP2PRequests(ctx context.Context, lenderID int64, limit int64) ([]P2PLoan, error) {
 	if limit <= 0 || limit > 200 {
 		limit = 50
@@ -1864,7 +2101,7 @@ func (d *DB) CreateMarketListing(ctx context.Context, sellerID int64, title, des
 			if _, err := tx.Exec(ctx, `UPDATE users SET balance=balance-$1 WHERE user_id=$2`, listingFee, sellerID); err != nil {
 				return err
 			}
-			if _, err := tx.Exec(ctx, `UPDATE system_state SET total_supply=GREATEST(total_supply-$1,0), updated_at=now() WHERE id=1`, listingFee); err != nil {
+			if _, err := tx.Exec(ctx, `UPDATE system_state SET total_supply=GREATEST(total_supply-$1, 0), total_burned=total_burned+$1, updated_at=now() WHERE id=1`, listingFee); err != nil {
 				return err
 			}
 			if _, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('market_listing_fee_burn', $1, NULL, $2, $3::jsonb)`,
@@ -1955,6 +2192,17 @@ LIMIT $2
 	return out, rows.Err()
 }
 
+func (d *DB) GetMarketListing(ctx context.Context, listingID int64) (MarketListing, error) {
+	var l MarketListing
+	err := d.Pool.QueryRow(ctx, `
+SELECT l.listing_id, l.seller_id, l.title, l.description, l.category, l.price_coins, l.contact, l.status, l.created_at, l.sold_at, l.buyer_id,
+       (SELECT image_id FROM market_listing_images WHERE listing_id=l.listing_id ORDER BY created_at ASC LIMIT 1) AS image_id
+FROM market_listings l
+WHERE l.listing_id=$1
+`, listingID).Scan(&l.ListingID, &l.SellerID, &l.Title, &l.Description, &l.Category, &l.PriceCoins, &l.Contact, &l.Status, &l.CreatedAt, &l.SoldAt, &l.BuyerID, &l.ImageID)
+	return l, err
+}
+
 func (d *DB) ListMyMarketListings(ctx context.Context, sellerID int64, limit int64) ([]MarketListing, error) {
 	if limit <= 0 || limit > 200 {
 		limit = 50
@@ -2050,6 +2298,38 @@ func (d *DB) BuyMarketListing(ctx context.Context, buyerID int64, listingID int6
 	})
 }
 
+// CancelMarketListing cancels an active listing. sellerID 0 cancels any
+// seller's listing (admin). Returns false if nothing matched; hook runs only
+// when a listing was cancelled.
+func (d *DB) CancelMarketListing(ctx context.Context, listingID, sellerID int64, hook TxHook) (bool, error) {
+	if listingID <= 0 || sellerID < 0 {
+		return false, errors.New("bad params")
+	}
+	var found bool
+	err := d.WithTx(ctx, func(tx pgx.Tx) error {
+		var seller, price int64
+		var title string
+		err := tx.QueryRow(ctx, `
+UPDATE market_listings
+SET status='cancelled'
+WHERE listing_id=$1 AND ($2::bigint = 0 OR seller_id=$2) AND status='active'
+RETURNING seller_id, title, price_coins
+`, listingID, sellerID).Scan(&seller, &title, &price)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		return hook.run(ctx, tx,
+			map[string]any{"status": "active", "seller_id": seller, "title": title, "price_coins": price},
+			map[string]any{"status": "cancelled"},
+		)
+	})
+	return found, err
+}
+
 func (d *DB) FreezeBalance(ctx context.Context, userID int64, amount int64) error {
 	if userID <= 0 || amount <= 0 {
 		return errors.New("bad params")
@@ -2152,14 +2432,34 @@ func (d *DB) EnsureDepositWalletsIfEmpty(ctx context.Context, wallets map[string
 	if n > 0 {
 		return nil
 	}
-	return d.SetDepositWallets(ctx, wallets)
+	return d.SetDepositWallets(ctx, wallets, nil)
 }
 
-func (d *DB) SetDepositWallets(ctx context.Context, wallets map[string]string) error {
+// SetDepositWallets replaces the deposit wallets; hook sees the old and the
+// new currency -> address maps.
+func (d *DB) SetDepositWallets(ctx context.Context, wallets map[string]string, hook TxHook) error {
 	return d.WithTx(ctx, func(tx pgx.Tx) error {
+		before := map[string]string{}
+		rows, err := tx.Query(ctx, `SELECT currency, address FROM deposit_wallets FOR UPDATE`)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var c, a string
+			if err := rows.Scan(&c, &a); err != nil {
+				rows.Close()
+				return err
+			}
+			before[c] = a
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
 		if _, err := tx.Exec(ctx, `DELETE FROM deposit_wallets`); err != nil {
 			return err
 		}
+		after := map[string]string{}
 		for k, v := range wallets {
 			kk := strings.ToUpper(strings.TrimSpace(k))
 			vv := strings.TrimSpace(v)
@@ -2169,8 +2469,733 @@ func (d *DB) SetDepositWallets(ctx context.Context, wallets map[string]string) e
 			if _, err := tx.Exec(ctx, `INSERT INTO deposit_wallets(currency, address) VALUES($1,$2) ON CONFLICT (currency) DO UPDATE SET address=EXCLUDED.address, updated_at=now()`, kk, vv); err != nil {
 				return err
 			}
+			after[kk] = vv
 		}
-		_, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('admin_set_deposit_wallets', NULL, NULL, 0, '{}'::jsonb)`)
-		return err
+		if _, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('admin_set_deposit_wallets', NULL, NULL, 0, '{}'::jsonb)`); err != nil {
+			return err
+		}
+		return hook.run(ctx, tx, before, after)
 	})
 }
+
+type MemtapLease struct {
+	Shard   int
+	Owner   string
+	Addr    string
+	Expired bool
+}
+
+// HeartbeatMemtapMember refreshes this replica's membership row and returns
+// the number of live members (including itself). Expiry uses the DB clock.
+func (d *DB) HeartbeatMemtapMember(ctx context.Context, owner, addr string, ttl time.Duration) (int, error) {
+	var live int
+	err := d.WithTx(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+INSERT INTO memtap_members(owner, addr, expires_at) VALUES($1, $2, now() + make_interval(secs => $3))
+ON CONFLICT (owner) DO UPDATE SET addr=EXCLUDED.addr, expires_at=EXCLUDED.expires_at
+`, owner, addr, ttl.Seconds()); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM memtap_members WHERE expires_at < now() - interval '1 hour'`); err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `SELECT COUNT(*) FROM memtap_members WHERE expires_at > now()`).Scan(&live)
+	})
+	return live, err
+}
+
+func (d *DB) RemoveMemtapMember(ctx context.Context, owner string) error {
+	_, err := d.Pool.Exec(ctx, `DELETE FROM memtap_members WHERE owner=$1`, owner)
+	return err
+}
+
+func (d *DB) ListMemtapLeases(ctx context.Context) ([]MemtapLease, error) {
+	rows, err := d.Pool.Query(ctx, `SELECT shard, owner, addr, expires_at <= now() FROM memtap_leases ORDER BY shard ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]MemtapLease, 0, 64)
+	for rows.Next() {
+		var l MemtapLease
+		if err := rows.Scan(&l.Shard, &l.Owner, &l.Addr, &l.Expired); err != nil {
+			return nil, err
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+// AcquireMemtapLease takes a shard that is free, expired or already ours.
+func (d *DB) AcquireMemtapLease(ctx context.Context, shard int, owner, addr string, ttl time.Duration) (bool, error) {
+	var got int
+	err := d.Pool.QueryRow(ctx, `
+INSERT INTO memtap_leases(shard, owner, addr, expires_at) VALUES($1, $2, $3, now() + make_interval(secs => $4))
+ON CONFLICT (shard) DO UPDATE SET owner=EXCLUDED.owner, addr=EXCLUDED.addr, expires_at=EXCLUDED.expires_at
+WHERE memtap_leases.owner = EXCLUDED.owner OR memtap_leases.expires_at <= now()
+RETURNING shard
+`, shard, owner, addr, ttl.Seconds()).Scan(&got)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// RenewMemtapLeases extends the given shards and returns those still owned.
+func (d *DB) RenewMemtapLeases(ctx context.Context, owner, addr string, shards []int, ttl time.Duration) ([]int, error) {
+	if len(shards) == 0 {
+		return nil, nil
+	}
+	rows, err := d.Pool.Query(ctx, `
+UPDATE memtap_leases SET addr=$2, expires_at=now() + make_interval(secs => $4)
+WHERE owner=$1 AND shard = ANY($3)
+RETURNING shard
+`, owner, addr, shards, ttl.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]int, 0, len(shards))
+	for rows.Next() {
+		var shard int
+		if err := rows.Scan(&shard); err != nil {
+			return nil, err
+		}
+		out = append(out, shard)
+	}
+	return out, rows.Err()
+}
+
+func (d *DB) ReleaseMemtapLeases(ctx context.Context, owner string, shards []int) error {
+	if len(shards) == 0 {
+		return nil
+	}
+	_, err := d.Pool.Exec(ctx, `DELETE FROM memtap_leases WHERE owner=$1 AND shard = ANY($2)`, owner, shards)
+	return err
+}
+
+const memtapInvalidateChannel = "memtap_invalidate"
+
+// NotifyMemtapInvalidate asks every replica to drop its cached copy of the user.
+func (d *DB) NotifyMemtapInvalidate(ctx context.Context, userID int64) error {
+	_, err := d.Pool.Exec(ctx, `SELECT pg_notify($1, $2)`, memtapInvalidateChannel, strconv.FormatInt(userID, 10))
+	return err
+}
+
+// ListenMemtapInvalidate blocks on a dedicated connection (outside the pool)
+// and calls fn for every invalidated user id until ctx is done.
+func (d *DB) ListenMemtapInvalidate(ctx context.Context, fn func(userID int64)) error {
+	conn, err := pgx.ConnectConfig(ctx, d.Pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+memtapInvalidateChannel); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if userID, err := strconv.ParseInt(n.Payload, 10, 64); err == nil && userID > 0 {
+			fn(userID)
+		}
+	}
+}
+
+// LedgerEntry is a ledger row as seen in a user's history.
+type LedgerEntry struct {
+	ID     int64
+	TS     time.Time
+	Kind   string
+	FromID int64 // 0 = reserve / system
+	ToID   int64
+	Amount int64
+	Meta   map[string]any
+}
+
+// HistoryFilter selects a user's ledger rows. Zero values mean "no bound".
+// The cursor (BeforeTS, BeforeID) continues a newest-first listing.
+type HistoryFilter struct {
+	UserID   int64
+	Kinds    []string
+	From     time.Time // inclusive
+	To       time.Time // exclusive
+	BeforeTS time.Time
+	BeforeID int64
+	Limit    int
+	Asc      bool // oldest first (exports); the cursor is ignored
+}
+
+// ForEachUserLedger streams the user's ledger rows (as sender or receiver)
+// ordered by (ts, id) and calls fn for each. Returning an error from fn stops.
+// Transfer memos are merged back into Meta["memo"].
+func (d *DB) ForEachUserLedger(ctx context.Context, f HistoryFilter, fn func(LedgerEntry) error) error {
+	var from, to, beforeTS *time.Time
+	if !f.From.IsZero() {
+		from = &f.From
+	}
+	if !f.To.IsZero() {
+		to = &f.To
+	}
+	order := "DESC"
+	if f.Asc {
+		order = "ASC"
+	} else if !f.BeforeTS.IsZero() {
+		beforeTS = &f.BeforeTS
+	}
+	var limit *int
+	if f.Limit > 0 {
+		limit = &f.Limit
+	}
+	kinds := f.Kinds
+	if kinds == nil {
+		kinds = []string{}
+	}
+	rows, err := d.Pool.Query(ctx, `
+SELECT l.id, l.ts, l.kind, COALESCE(l.from_id,0), COALESCE(l.to_id,0), l.amount,
+       CASE WHEN m.memo IS NULL THEN l.meta ELSE l.meta || jsonb_build_object('memo', m.memo) END
+FROM ledger l
+LEFT JOIN transfer_memos m ON m.ledger_id = l.id
+WHERE (l.from_id=$1 OR l.to_id=$1)
+  AND (cardinality($2::text[]) = 0 OR l.kind = ANY($2))
+  AND ($3::timestamptz IS NULL OR l.ts >= $3)
+  AND ($4::timestamptz IS NULL OR l.ts < $4)
+  AND ($5::timestamptz IS NULL OR (l.ts, l.id) < ($5, $6))
+ORDER BY l.ts `+order+`, l.id `+order+`
+LIMIT $7
+`, f.UserID, kinds, from, to, beforeTS, f.BeforeID, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.ID, &e.TS, &e.Kind, &e.FromID, &e.ToID, &e.Amount, &e.Meta); err != nil {
+			return err
+		}
+		e.TS = e.TS.UTC()
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ListUserHistory returns one page of the user's history, newest first.
+func (d *DB) ListUserHistory(ctx context.Context, f HistoryFilter) ([]LedgerEntry, error) {
+	f.Asc = false
+	out := make([]LedgerEntry, 0, f.Limit)
+	err := d.ForEachUserLedger(ctx, f, func(e LedgerEntry) error {
+		out = append(out, e)
+		return nil
+	})
+	return out, err
+}
+
+// IdempotencyRecord is a stored idempotency key. State is "pending" while the
+// first request runs and "done" once Status/Response are stored.
+type IdempotencyRecord struct {
+	Endpoint    string
+	RequestHash string
+	State       string
+	Status      int
+	Response    string
+	CreatedAt   time.Time
+}
+
+// idempotencyStaleAfter lets a retry take over a key whose first request died
+// mid-flight (node crash). It is a lease far longer than the API's deadline
+// for keyed requests, so a request that is still running is never taken over.
+const idempotencyStaleAfter = 15 * time.Minute
+
+// ClaimIdempotencyKey reserves (userID, key) for a new request. If the key is
+// already taken (and not expired or stale) it returns claimed=false and the
+// stored record so the caller can replay or reject.
+func (d *DB) ClaimIdempotencyKey(ctx context.Context, userID int64, key, endpoint, requestHash string, ttl time.Duration) (bool, IdempotencyRecord, error) {
+	var claimed bool
+	err := d.Pool.QueryRow(ctx, `
+INSERT INTO idempotency_keys(user_id, key, endpoint, request_hash, expires_at)
+VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5))
+ON CONFLICT (user_id, key) DO UPDATE SET
+  endpoint=EXCLUDED.endpoint, request_hash=EXCLUDED.request_hash, state='pending', status=0, response=NULL,
+  created_at=now(), expires_at=EXCLUDED.expires_at
+WHERE idempotency_keys.expires_at < now()
+   OR (idempotency_keys.state='pending' AND idempotency_keys.created_at < now() - make_interval(secs => $6)
+       AND idempotency_keys.request_hash=EXCLUDED.request_hash)
+RETURNING true
+`, userID, key, endpoint, requestHash, ttl.Seconds(), idempotencyStaleAfter.Seconds()).Scan(&claimed)
+	if err == nil {
+		return true, IdempotencyRecord{}, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return false, IdempotencyRecord{}, err
+	}
+	var rec IdempotencyRecord
+	var resp *string
+	err = d.Pool.QueryRow(ctx, `
+SELECT endpoint, request_hash, state, status, response, created_at
+FROM idempotency_keys WHERE user_id=$1 AND key=$2
+`, userID, key).Scan(&rec.Endpoint, &rec.RequestHash, &rec.State, &rec.Status, &resp, &rec.CreatedAt)
+	if err != nil {
+		return false, IdempotencyRecord{}, err
+	}
+	if resp != nil {
+		rec.Response = *resp
+	}
+	return false, rec, nil
+}
+
+func (d *DB) CompleteIdempotencyKey(ctx context.Context, userID int64, key string, status int, response string) error {
+	_, err := d.Pool.Exec(ctx, `
+UPDATE idempotency_keys SET state='done', status=$3, response=$4
+WHERE user_id=$1 AND key=$2
+`, userID, key, status, response)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a pending key so the client may retry it.
+func (d *DB) ReleaseIdempotencyKey(ctx context.Context, userID int64, key string) error {
+	_, err := d.Pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE user_id=$1 AND key=$2 AND state='pending'`, userID, key)
+	return err
+}
+
+func (d *DB) PurgeIdempotencyKeys(ctx context.Context) (int64, error) {
+	tag, err := d.Pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE expires_at < now()`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Standing order statuses.
+const (
+	StandingActive    = "active"
+	StandingPaused    = "paused"
+	StandingCancelled = "cancelled"
+	StandingDone      = "done"
+)
+
+var ErrLimit = errors.New("limit reached")
+
+// StandingOrder is a scheduled transfer. Slot is the index of the next
+// payment; NextRunAt is when it is due and RetryAt, if set, when the
+// executor tries it again after a failure.
+type StandingOrder struct {
+	OrderID   int64      `json:"order_id"`
+	FromID    int64      `json:"from_id"`
+	ToID      int64      `json:"to_id"`
+	Amount    int64      `json:"amount"`
+	Memo      string     `json:"memo"`
+	Schedule  string     `json:"schedule"`
+	StartAt   time.Time  `json:"start_at"`
+	Slot      int64      `json:"slot"`
+	NextRunAt time.Time  `json:"next_run_at"`
+	RetryAt   *time.Time `json:"retry_at"`
+	Status    string     `json:"status"`
+	FailCount int64      `json:"fail_count"`
+	RunsCount int64      `json:"runs_count"`
+	LastError string     `json:"last_error"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+const standingOrderCols = `order_id, from_id, to_id, amount, memo, schedule, start_at, slot, next_run_at, retry_at, status, fail_count, runs_count, last_error, created_at, updated_at`
+
+func scanStandingOrder(row pgx.Row) (StandingOrder, error) {
+	var o StandingOrder
+	err := row.Scan(&o.OrderID, &o.FromID, &o.ToID, &o.Amount, &o.Memo, &o.Schedule, &o.StartAt, &o.Slot, &o.NextRunAt, &o.RetryAt,
+		&o.Status, &o.FailCount, &o.RunsCount, &o.LastError, &o.CreatedAt, &o.UpdatedAt)
+	return o, err
+}
+
+func collectStandingOrders(rows pgx.Rows) ([]StandingOrder, error) {
+	defer rows.Close()
+	var out []StandingOrder
+	for rows.Next() {
+		o, err := scanStandingOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// CreateStandingOrder stores a new active order. The sender may have at most
+// maxOpen active or paused orders (ErrLimit).
+func (d *DB) CreateStandingOrder(ctx context.Context, o StandingOrder, maxOpen int64) (StandingOrder, error) {
+	if o.FromID <= 0 || o.ToID <= 0 || o.FromID == o.ToID || o.Amount <= 0 {
+		return StandingOrder{}, errors.New("bad params")
+	}
+	var out StandingOrder
+	err := d.WithTx(ctx, func(tx pgx.Tx) error {
+		// Lock the sender so concurrent creates count correctly.
+		var id int64
+		if err := tx.QueryRow(ctx, `SELECT user_id FROM users WHERE user_id=$1 FOR UPDATE`, o.FromID).Scan(&id); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(ctx, `SELECT user_id FROM users WHERE user_id=$1`, o.ToID).Scan(&id); err != nil {
+			return err
+		}
+		var open int64
+		if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM standing_orders WHERE from_id=$1 AND status IN ('active','paused')`, o.FromID).Scan(&open); err != nil {
+			return err
+		}
+		if open >= maxOpen {
+			return ErrLimit
+		}
+		var err error
+		out, err = scanStandingOrder(tx.QueryRow(ctx, `
+INSERT INTO standing_orders(from_id, to_id, amount, memo, schedule, start_at, next_run_at)
+VALUES($1, $2, $3, $4, $5, $6, $6)
+RETURNING `+standingOrderCols, o.FromID, o.ToID, o.Amount, o.Memo, o.Schedule, o.StartAt))
+		return err
+	})
+	return out, err
+}
+
+func (d *DB) GetStandingOrder(ctx context.Context, orderID int64) (StandingOrder, error) {
+	return scanStandingOrder(d.Pool.QueryRow(ctx, `SELECT `+standingOrderCols+` FROM standing_orders WHERE order_id=$1`, orderID))
+}
+
+// ListStandingOrders returns orders the user pays or receives, newest first.
+func (d *DB) ListStandingOrders(ctx context.Context, userID int64, limit int64) ([]StandingOrder, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	rows, err := d.Pool.Query(ctx, `
+SELECT `+standingOrderCols+`
+FROM standing_orders
+WHERE from_id=$1 OR to_id=$1
+ORDER BY order_id DESC
+LIMIT $2
+`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return collectStandingOrders(rows)
+}
+
+// DueStandingOrders lists active orders whose payment (or retry) is due.
+func (d *DB) DueStandingOrders(ctx context.Context, now time.Time, limit int64) ([]StandingOrder, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := d.Pool.Query(ctx, `
+SELECT `+standingOrderCols+`
+FROM standing_orders
+WHERE status='active' AND COALESCE(retry_at, next_run_at) <= $1
+ORDER BY COALESCE(retry_at, next_run_at), order_id
+LIMIT $2
+`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return collectStandingOrders(rows)
+}
+
+// SetStandingOrderStatus lets the sender pause an active order, resume a
+// paused one (failures are forgotten) or cancel either. On resume a non-nil
+// reschedule picks the slot the order continues from, so slots missed while
+// it was paused are not paid. false means there is no such order of fromID in
+// a state that allows the change.
+func (d *DB) SetStandingOrderStatus(ctx context.Context, orderID, fromID int64, status string, reschedule func(StandingOrder) (int64, time.Time)) (bool, error) {
+	var from []string
+	switch status {
+	case StandingPaused:
+		from = []string{StandingActive}
+	case StandingActive:
+		from = []string{StandingPaused}
+	case StandingCancelled:
+		from = []string{StandingActive, StandingPaused}
+	default:
+		return false, errors.New("bad status")
+	}
+	var changed bool
+	err := d.WithTx(ctx, func(tx pgx.Tx) error {
+		o, err := scanStandingOrder(tx.QueryRow(ctx, `
+SELECT `+standingOrderCols+` FROM standing_orders
+WHERE order_id=$1 AND from_id=$2 AND status = ANY($3)
+FOR UPDATE
+`, orderID, fromID, from))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		slot, next := o.Slot, o.NextRunAt
+		if status == StandingActive && reschedule != nil {
+			slot, next = reschedule(o)
+		}
+		_, err = tx.Exec(ctx, `
+UPDATE standing_orders
+SET status=$2, slot=$3, next_run_at=$4,
+    fail_count = CASE WHEN $2='active' THEN 0 ELSE fail_count END,
+    retry_at = CASE WHEN $2='active' THEN NULL ELSE retry_at END,
+    updated_at=now()
+WHERE order_id=$1
+`, orderID, status, slot, next)
+		changed = err == nil
+		return err
+	})
+	return changed, err
+}
+
+// lockStandingSlot locks the order and reports whether o.Slot is still the
+// active, unpaid slot. Another replica may have run or changed it meanwhile.
+func lockStandingSlot(ctx context.Context, tx pgx.Tx, o StandingOrder) (bool, error) {
+	var status string
+	var slot int64
+	err := tx.QueryRow(ctx, `SELECT status, slot FROM standing_orders WHERE order_id=$1 FOR UPDATE`, o.OrderID).Scan(&status, &slot)
+	if err != nil {
+		return false, err
+	}
+	return status == StandingActive && slot == o.Slot, nil
+}
+
+// ExecuteStandingOrder pays slot o.Slot with spec and moves the order to
+// slot nextSlot due at next (a zero next finishes the order). The run row and
+// the transfer commit together, so a slot is paid at most once. false means
+// the slot was no longer due.
+func (d *DB) ExecuteStandingOrder(ctx context.Context, o StandingOrder, spec TransferSpec, nextSlot int64, next time.Time) (bool, error) {
+	if err := spec.Validate(); err != nil {
+		return false, err
+	}
+	var ran bool
+	err := d.WithTx(ctx, func(tx pgx.Tx) error {
+		ok, err := lockStandingSlot(ctx, tx, o)
+		if err != nil || !ok {
+			return err
+		}
+		var paid bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM standing_order_runs WHERE order_id=$1 AND slot=$2 AND status='ok')`, o.OrderID, o.Slot).Scan(&paid); err != nil {
+			return err
+		}
+		if !paid {
+			if err := transferTx(ctx, tx, spec); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, `
+INSERT INTO standing_order_runs(order_id, slot, due_at, status, gross, fee)
+VALUES($1, $2, $3, 'ok', $4, $5)
+ON CONFLICT (order_id, slot) DO UPDATE SET status='ok', attempts=standing_order_runs.attempts+1,
+  gross=EXCLUDED.gross, fee=EXCLUDED.fee, error='', updated_at=now()
+`, o.OrderID, o.Slot, o.NextRunAt, spec.Amount, spec.Fee()); err != nil {
+				return err
+			}
+			ran = true
+		}
+		status, nextRun := StandingActive, next
+		if next.IsZero() {
+			status, nextRun = StandingDone, o.NextRunAt
+		}
+		_, err = tx.Exec(ctx, `
+UPDATE standing_orders
+SET slot=$5, next_run_at=$2, status=$3, retry_at=NULL, fail_count=0, last_error='',
+    runs_count = runs_count + CASE WHEN $4 THEN 1 ELSE 0 END, updated_at=now()
+WHERE order_id=$1
+`, o.OrderID, nextRun, status, ran, nextSlot)
+		return err
+	})
+	return ran, err
+}
+
+// FailStandingOrder records a failed attempt of slot o.Slot and schedules a
+// retry. After maxFailures failures in a row the order is paused; paused
+// reports that this call did it.
+func (d *DB) FailStandingOrder(ctx context.Context, o StandingOrder, reason string, retryAt time.Time, maxFailures int64) (bool, error) {
+	var paused bool
+	err := d.WithTx(ctx, func(tx pgx.Tx) error {
+		ok, err := lockStandingSlot(ctx, tx, o)
+		if err != nil || !ok {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+INSERT INTO standing_order_runs(order_id, slot, due_at, status, error)
+VALUES($1, $2, $3, 'failed', $4)
+ON CONFLICT (order_id, slot) DO UPDATE SET attempts=standing_order_runs.attempts+1, error=EXCLUDED.error, updated_at=now()
+`, o.OrderID, o.Slot, o.NextRunAt, reason); err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `
+UPDATE standing_orders
+SET fail_count=fail_count+1, retry_at=$2, last_error=$3,
+    status = CASE WHEN fail_count+1 >= $4 THEN 'paused' ELSE status END,
+    updated_at=now()
+WHERE order_id=$1
+RETURNING status='paused'
+`, o.OrderID, retryAt, reason, maxFailures).Scan(&paused)
+	})
+	return paused, err
+}
+
+// CreateAuthSession stores a new WebApp session at refresh generation 1.
+func (d *DB) CreateAuthSession(ctx context.Context, sessionID string, userID int64, expiresAt time.Time) error {
+	_, err := d.Pool.Exec(ctx, `INSERT INTO auth_sessions(session_id, user_id, expires_at) VALUES($1, $2, $3)`, sessionID, userID, expiresAt)
+	return err
+}
+
+// RotateAuthSession moves a live session from generation gen to gen+1 and
+// extends it to expiresAt. false means the session is unknown, revoked,
+// expired or already past gen.
+func (d *DB) RotateAuthSession(ctx context.Context, sessionID string, gen int64, expiresAt time.Time) (bool, error) {
+	tag, err := d.Pool.Exec(ctx, `
+UPDATE auth_sessions
+SET refresh_gen=refresh_gen+1, refreshed_at=now(), expires_at=$3
+WHERE session_id=$1 AND refresh_gen=$2 AND revoked_at IS NULL AND expires_at > now()
+`, sessionID, gen, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// RevokeAuthSession revokes one session; userID 0 skips the owner check.
+func (d *DB) RevokeAuthSession(ctx context.Context, sessionID string, userID int64, reason string) (bool, error) {
+	tag, err := d.Pool.Exec(ctx, `
+UPDATE auth_sessions SET revoked_at=now(), revoke_reason=$3
+WHERE session_id=$1 AND ($2::bigint = 0 OR user_id=$2) AND revoked_at IS NULL
+`, sessionID, userID, reason)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// RevokeUserAuthSessions revokes every live session of the user.
+func (d *DB) RevokeUserAuthSessions(ctx context.Context, userID int64, reason string) ([]string, error) {
+	rows, err := d.Pool.Query(ctx, `
+UPDATE auth_sessions SET revoked_at=now(), revoke_reason=$2
+WHERE user_id=$1 AND revoked_at IS NULL AND expires_at > now()
+RETURNING session_id
+`, userID, reason)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// RevokedAuthSessions lists revoked sessions that have not expired yet: the
+// revocation list access tokens are checked against.
+func (d *DB) RevokedAuthSessions(ctx context.Context) ([]string, error) {
+	rows, err := d.Pool.Query(ctx, `SELECT session_id FROM auth_sessions WHERE revoked_at IS NOT NULL AND expires_at > now()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// PurgeAuthSessions deletes sessions expired for more than a day.
+func (d *DB) PurgeAuthSessions(ctx context.Context) (int64, error) {
+	tag, err := d.Pool.Exec(ctx, `DELETE FROM auth_sessions WHERE expires_at < now() - interval '1 day'`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Broadcast is a bot message sent to every user. Cursor is the last user_id
+// handled; users are sent to in user_id order.
+type Broadcast struct {
+	BroadcastID int64     `json:"broadcast_id"`
+	AdminChatID int64     `json:"admin_chat_id"`
+	Text        string    `json:"text"`
+	Status      string    `json:"status"` // running, paused, done
+	Cursor      int64     `json:"cursor"`
+	Total       int64     `json:"total"`
+	OK          int64     `json:"ok_count"`
+	Fail        int64     `json:"fail_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+const broadcastCols = `broadcast_id, admin_chat_id, text, status, cursor, total, ok_count, fail_count, created_at, updated_at`
+
+func scanBroadcast(row pgx.Row) (Broadcast, error) {
+	var b Broadcast
+	err := row.Scan(&b.BroadcastID, &b.AdminChatID, &b.Text, &b.Status, &b.Cursor, &b.Total, &b.OK, &b.Fail, &b.CreatedAt, &b.UpdatedAt)
+	return b, err
+}
+
+// CreateBroadcast stores a running broadcast to every current user.
+func (d *DB) CreateBroadcast(ctx context.Context, adminChatID int64, text string) (Broadcast, error) {
+	return scanBroadcast(d.Pool.QueryRow(ctx, `
+INSERT INTO broadcasts(admin_chat_id, text, total)
+VALUES ($1, $2, (SELECT count(*) FROM users))
+RETURNING `+broadcastCols, adminChatID, text))
+}
+
+// ClaimBroadcasts marks running and returns the paused broadcasts and the
+// running ones not saved for staleAfter (their process died).
+func (d *DB) ClaimBroadcasts(ctx context.Context, staleAfter time.Duration) ([]Broadcast, error) {
+	rows, err := d.Pool.Query(ctx, `
+UPDATE broadcasts SET status='running', updated_at=now()
+WHERE status='paused' OR (status='running' AND updated_at < now() - make_interval(secs => $1))
+RETURNING `+broadcastCols, staleAfter.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Broadcast
+	for rows.Next() {
+		b, err := scanBroadcast(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// SaveBroadcast records progress and status.
+func (d *DB) SaveBroadcast(ctx context.Context, b Broadcast) error {
+	_, err := d.Pool.Exec(ctx, `
+UPDATE broadcasts SET status=$2, cursor=$3, ok_count=$4, fail_count=$5, updated_at=now()
+WHERE broadcast_id=$1`, b.BroadcastID, b.Status, b.Cursor, b.OK, b.Fail)
+	return err
+}
+
+// ListUserIDsAfter returns up to limit user ids greater than after, in order.
+func (d *DB) ListUserIDsAfter(ctx context.Context, after int64, limit int64) ([]int64, error) {
+	rows, err := d.Pool.Query(ctx, `SELECT user_id FROM users WHERE user_id > $1 ORDER BY user_id LIMIT $2`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
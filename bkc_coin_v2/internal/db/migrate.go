@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Schema migrations live in migrations/NNNN_name.{up,down}.sql and are
+// embedded into the binary. Applied versions are recorded in
+// schema_migrations; each migration runs in its own transaction and all
+// runners serialize on an advisory lock, so replicas may start together.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+const migrateLockID int64 = 0x626b635f6d6967 // "bkc_mig"
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var ErrUnknownMigration = errors.New("unknown migration version")
+
+// Migrations returns the embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+		base, dir, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		if !ok || (dir != "up" && dir != "down") {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.up.sql or NNNN_name.down.sql", name)
+		}
+		num, label, _ := strings.Cut(base, "_")
+		v, err := strconv.Atoi(num)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("migration %s: bad version", name)
+		}
+		body, err := fs.ReadFile(migrationFiles, "migrations/"+name)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[v]
+		if m == nil {
+			m = &Migration{Version: v, Name: label}
+			byVersion[v] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d: name mismatch %q vs %q", v, m.Name, label)
+		}
+		if dir == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	for i, m := range out {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d: versions must be contiguous from 1", m.Version)
+		}
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			return nil, fmt.Errorf("migration %d: both up and down files are required", m.Version)
+		}
+	}
+	return out, nil
+}
+
+// Migrate brings the schema to the latest embedded version.
+func (d *DB) Migrate(ctx context.Context) error {
+	_, err := d.MigrateUp(ctx)
+	return err
+}
+
+// MigrateUp applies every pending migration and returns the applied ones.
+func (d *DB) MigrateUp(ctx context.Context) ([]Migration, error) {
+	all, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	return d.MigrateTo(ctx, len(all))
+}
+
+// MigrateDown rolls back the last steps applied migrations.
+func (d *DB) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	if steps <= 0 {
+		return nil, nil
+	}
+	var done []Migration
+	err := d.withMigrateLock(ctx, func(conn *pgx.Conn, all []Migration, current int) error {
+		target := current - steps
+		if target < 0 {
+			target = 0
+		}
+		var err error
+		done, err = stepTo(ctx, conn, all, current, target)
+		return err
+	})
+	return done, err
+}
+
+// MigrateTo moves the schema up or down to version (0 = empty) and returns
+// the migrations it ran, in the order it ran them.
+func (d *DB) MigrateTo(ctx context.Context, version int) ([]Migration, error) {
+	var done []Migration
+	err := d.withMigrateLock(ctx, func(conn *pgx.Conn, all []Migration, current int) error {
+		if version < 0 || version > len(all) {
+			return fmt.Errorf("%w: %d (latest is %d)", ErrUnknownMigration, version, len(all))
+		}
+		var err error
+		done, err = stepTo(ctx, conn, all, current, version)
+		return err
+	})
+	return done, err
+}
+
+// MigrateStatus lists every embedded migration with its applied state.
+func (d *DB) MigrateStatus(ctx context.Context) ([]MigrationStatus, error) {
+	all, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.Pool.Exec(ctx, schemaMigrationsSQL); err != nil {
+		return nil, err
+	}
+	rows, err := d.Pool.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		applied[v] = at
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]MigrationStatus, 0, len(all))
+	for _, m := range all {
+		at, ok := applied[m.Version]
+		out = append(out, MigrationStatus{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: at})
+	}
+	return out, nil
+}
+
+const schemaMigrationsSQL = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INT PRIMARY KEY,
+  name TEXT NOT NULL,
+  applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+// withMigrateLock pins one connection, takes the session advisory lock and
+// hands fn the embedded migrations and the current schema version.
+func (d *DB) withMigrateLock(ctx context.Context, fn func(conn *pgx.Conn, all []Migration, current int) error) error {
+	all, err := Migrations()
+	if err != nil {
+		return err
+	}
+	pc, err := d.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer pc.Release()
+	conn := pc.Conn()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrateLockID); err != nil {
+		return err
+	}
+	defer func() {
+		// Unlock on a fresh context: ctx may be the reason we are leaving.
+		uctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, _ = conn.Exec(uctx, `SELECT pg_advisory_unlock($1)`, migrateLockID)
+	}()
+
+	if _, err := conn.Exec(ctx, schemaMigrationsSQL); err != nil {
+		return err
+	}
+	var current int
+	if err := conn.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if current > len(all) {
+		return fmt.Errorf("%w: database is at %d, binary knows up to %d", ErrUnknownMigration, current, len(all))
+	}
+	return fn(conn, all, current)
+}
+
+// stepTo runs up or down migrations one transaction at a time.
+func stepTo(ctx context.Context, conn *pgx.Conn, all []Migration, current, target int) ([]Migration, error) {
+	var done []Migration
+	for current < target {
+		m := all[current]
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, m.Up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations(version, name) VALUES($1, $2)`, m.Version, m.Name)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+		current++
+	}
+	for current > target {
+		m := all[current-1]
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, m.Down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+			return err
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s down: %w", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+		current--
+	}
+	return done, nil
+}
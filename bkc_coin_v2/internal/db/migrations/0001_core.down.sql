@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS user_daily;
+DROP TABLE IF EXISTS deposit_wallets;
+DROP TABLE IF EXISTS deposits;
+DROP TABLE IF EXISTS cryptopay_invoices;
+DROP TABLE IF EXISTS ledger;
+DROP TABLE IF EXISTS referrals;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS system_state;
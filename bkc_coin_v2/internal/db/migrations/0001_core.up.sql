@@ -0,0 +1,123 @@
+-- Core state: system supply, users, referrals, the ledger and deposits.
+-- Every statement is IF NOT EXISTS so databases created by the old
+-- single-blob Migrate adopt the versioned scheme without changes.
+
+CREATE TABLE IF NOT EXISTS system_state (
+  id INT PRIMARY KEY DEFAULT 1,
+  total_supply BIGINT NOT NULL,
+  reserve_supply BIGINT NOT NULL,
+  reserved_supply BIGINT NOT NULL DEFAULT 0,
+  initial_reserve BIGINT NOT NULL,
+  admin_user_id BIGINT NOT NULL,
+  admin_allocated BIGINT NOT NULL,
+  start_rate_coins_usd BIGINT NOT NULL,
+  min_rate_coins_usd BIGINT NOT NULL,
+  referral_step BIGINT NOT NULL,
+  referral_bonus BIGINT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS reserved_supply BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS current_tap_reward BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS total_mined BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS halving_threshold BIGINT NOT NULL DEFAULT 100000000;
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS current_halving INT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS users (
+  user_id BIGINT PRIMARY KEY,
+  username TEXT,
+  first_name TEXT,
+  balance BIGINT NOT NULL DEFAULT 0,
+  frozen_balance BIGINT NOT NULL DEFAULT 0,
+  taps_total BIGINT NOT NULL DEFAULT 0,
+  energy DOUBLE PRECISION NOT NULL DEFAULT 0,
+  energy_max DOUBLE PRECISION NOT NULL DEFAULT 0,
+  energy_updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  energy_boost_until TIMESTAMPTZ,
+  energy_boost_regen_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1,
+  energy_boost_max_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1,
+  referrals_count BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS energy_boost_until TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS energy_boost_regen_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS energy_boost_max_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS taps_total BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS frozen_balance BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS level INT NOT NULL DEFAULT 1;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS taps_power INT NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS referrals (
+  id BIGSERIAL PRIMARY KEY,
+  referrer_id BIGINT NOT NULL,
+  referred_id BIGINT NOT NULL UNIQUE,
+  bonus BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS ledger (
+  id BIGSERIAL PRIMARY KEY,
+  event_id TEXT,
+  ts TIMESTAMPTZ NOT NULL DEFAULT now(),
+  kind TEXT NOT NULL,
+  from_id BIGINT,
+  to_id BIGINT,
+  amount BIGINT NOT NULL,
+  meta JSONB NOT NULL DEFAULT '{}'::jsonb
+);
+
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS event_id TEXT;
+
+CREATE INDEX IF NOT EXISTS ledger_ts_idx ON ledger(ts DESC);
+CREATE INDEX IF NOT EXISTS ledger_to_idx ON ledger(to_id);
+CREATE INDEX IF NOT EXISTS ledger_from_idx ON ledger(from_id);
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_event_id_uniq ON ledger(event_id);
+
+CREATE TABLE IF NOT EXISTS cryptopay_invoices (
+  invoice_id BIGINT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  amount_usd BIGINT NOT NULL,
+  coins BIGINT NOT NULL,
+  status TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  paid_at TIMESTAMPTZ,
+  credited_at TIMESTAMPTZ,
+  released_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS cryptopay_invoices_user_idx ON cryptopay_invoices(user_id);
+
+CREATE TABLE IF NOT EXISTS deposits (
+  deposit_id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  tx_hash TEXT NOT NULL,
+  amount_usd BIGINT NOT NULL,
+  currency TEXT NOT NULL,
+  coins BIGINT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  approved_at TIMESTAMPTZ,
+  approved_by BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS deposits_status_idx ON deposits(status, created_at DESC);
+
+-- Deposit wallets (manual top-up instructions)
+CREATE TABLE IF NOT EXISTS deposit_wallets (
+  currency TEXT PRIMARY KEY,
+  address TEXT NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Daily tap limits / quotas
+CREATE TABLE IF NOT EXISTS user_daily (
+  user_id BIGINT NOT NULL,
+  day DATE NOT NULL,
+  tapped BIGINT NOT NULL DEFAULT 0,
+  extra_quota BIGINT NOT NULL DEFAULT 0,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (user_id, day)
+);
+CREATE INDEX IF NOT EXISTS user_daily_day_idx ON user_daily(day, tapped DESC);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS market_listing_images;
+DROP TABLE IF EXISTS market_listings;
+DROP TABLE IF EXISTS p2p_loans;
+DROP TABLE IF EXISTS bank_loans;
+DROP TABLE IF EXISTS nft_owns;
+DROP TABLE IF EXISTS nfts;
@@ -0,0 +1,78 @@
+CREATE TABLE IF NOT EXISTS nfts (
+  nft_id BIGSERIAL PRIMARY KEY,
+  title TEXT NOT NULL,
+  image_url TEXT NOT NULL,
+  price_coins BIGINT NOT NULL,
+  supply_total BIGINT NOT NULL,
+  supply_left BIGINT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS nft_owns (
+  user_id BIGINT NOT NULL,
+  nft_id BIGINT NOT NULL,
+  qty BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (user_id, nft_id)
+);
+
+-- Bank loans (reserve -> user)
+CREATE TABLE IF NOT EXISTS bank_loans (
+  loan_id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  principal BIGINT NOT NULL,
+  interest BIGINT NOT NULL,
+  total_due BIGINT NOT NULL,
+  term_days INT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'active', -- active|repaid|overdue
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  due_at TIMESTAMPTZ NOT NULL,
+  closed_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS bank_loans_user_idx ON bank_loans(user_id, status, created_at DESC);
+CREATE INDEX IF NOT EXISTS bank_loans_status_due_idx ON bank_loans(status, due_at);
+
+-- P2P loans (user -> user)
+CREATE TABLE IF NOT EXISTS p2p_loans (
+  loan_id BIGSERIAL PRIMARY KEY,
+  lender_id BIGINT NOT NULL,
+  borrower_id BIGINT NOT NULL,
+  principal BIGINT NOT NULL,
+  interest BIGINT NOT NULL,
+  total_due BIGINT NOT NULL,
+  interest_bp INT NOT NULL,
+  term_days INT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'requested', -- requested|active|rejected|cancelled|repaid
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  accepted_at TIMESTAMPTZ,
+  due_at TIMESTAMPTZ,
+  closed_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS p2p_loans_lender_idx ON p2p_loans(lender_id, status, created_at DESC);
+CREATE INDEX IF NOT EXISTS p2p_loans_borrower_idx ON p2p_loans(borrower_id, status, created_at DESC);
+
+-- Marketplace (bazaar)
+CREATE TABLE IF NOT EXISTS market_listings (
+  listing_id BIGSERIAL PRIMARY KEY,
+  seller_id BIGINT NOT NULL,
+  title TEXT NOT NULL,
+  description TEXT NOT NULL,
+  category TEXT NOT NULL DEFAULT 'other',
+  price_coins BIGINT NOT NULL,
+  contact TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'active', -- active|sold|cancelled
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  sold_at TIMESTAMPTZ,
+  buyer_id BIGINT
+);
+CREATE INDEX IF NOT EXISTS market_listings_status_idx ON market_listings(status, created_at DESC);
+CREATE INDEX IF NOT EXISTS market_listings_seller_idx ON market_listings(seller_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS market_listing_images (
+  image_id BIGSERIAL PRIMARY KEY,
+  listing_id BIGINT NOT NULL REFERENCES market_listings(listing_id) ON DELETE CASCADE,
+  mime TEXT NOT NULL,
+  data BYTEA NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS market_listing_images_listing_idx ON market_listing_images(listing_id, created_at DESC);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS memtap_leases;
+DROP TABLE IF EXISTS memtap_members;
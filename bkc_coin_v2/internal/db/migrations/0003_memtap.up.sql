@@ -0,0 +1,12 @@
+-- Memtap ownership: replicas heartbeat in memtap_members and lease user shards (user_id % shards).
+CREATE TABLE IF NOT EXISTS memtap_members (
+  owner TEXT PRIMARY KEY,
+  addr TEXT NOT NULL DEFAULT '',
+  expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS memtap_leases (
+  shard INT PRIMARY KEY,
+  owner TEXT NOT NULL,
+  addr TEXT NOT NULL DEFAULT '',
+  expires_at TIMESTAMPTZ NOT NULL
+);
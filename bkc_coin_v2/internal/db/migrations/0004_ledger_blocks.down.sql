@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS blocks;
+DROP INDEX IF EXISTS ledger_unsealed_idx;
+DROP INDEX IF EXISTS ledger_block_idx;
+ALTER TABLE ledger DROP COLUMN IF EXISTS block_height;
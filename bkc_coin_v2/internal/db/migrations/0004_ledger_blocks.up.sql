@@ -0,0 +1,15 @@
+-- Ledger hash chain: rows are sealed into Merkle-rooted blocks by internal/chain.
+ALTER TABLE ledger ADD COLUMN IF NOT EXISTS block_height BIGINT;
+CREATE INDEX IF NOT EXISTS ledger_block_idx ON ledger(block_height, id);
+CREATE INDEX IF NOT EXISTS ledger_unsealed_idx ON ledger(id) WHERE block_height IS NULL;
+
+CREATE TABLE IF NOT EXISTS blocks (
+  height BIGINT PRIMARY KEY,
+  prev_hash TEXT NOT NULL,
+  merkle_root TEXT NOT NULL,
+  hash TEXT NOT NULL UNIQUE,
+  tx_count INT NOT NULL,
+  first_ledger_id BIGINT NOT NULL,
+  last_ledger_id BIGINT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS supply_audits;
+DROP TABLE IF EXISTS supply_halt;
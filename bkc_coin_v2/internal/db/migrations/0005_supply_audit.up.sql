@@ -0,0 +1,23 @@
+-- Supply auditor (internal/supply): a single halt flag shared by all replicas plus a log of violations.
+CREATE TABLE IF NOT EXISTS supply_halt (
+  id INT PRIMARY KEY DEFAULT 1,
+  halted BOOLEAN NOT NULL DEFAULT false,
+  reason TEXT NOT NULL DEFAULT '',
+  signature TEXT NOT NULL DEFAULT '',
+  report JSONB NOT NULL DEFAULT '{}'::jsonb,
+  halted_at TIMESTAMPTZ,
+  acked_signature TEXT NOT NULL DEFAULT '',
+  acked_by BIGINT,
+  acked_at TIMESTAMPTZ,
+  ack_note TEXT NOT NULL DEFAULT ''
+);
+INSERT INTO supply_halt(id) VALUES (1) ON CONFLICT (id) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS supply_audits (
+  id BIGSERIAL PRIMARY KEY,
+  ts TIMESTAMPTZ NOT NULL DEFAULT now(),
+  signature TEXT NOT NULL,
+  acknowledged BOOLEAN NOT NULL DEFAULT false,
+  report JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS supply_audits_ts_idx ON supply_audits(ts DESC);
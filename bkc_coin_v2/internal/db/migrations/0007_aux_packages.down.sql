@@ -0,0 +1,33 @@
+DROP TABLE IF EXISTS user_subscriptions;
+DROP TABLE IF EXISTS subscriptions;
+DROP TABLE IF EXISTS p2p_orders;
+DROP TABLE IF EXISTS user_nfts;
+DROP TABLE IF EXISTS god_mode_actions;
+DROP TABLE IF EXISTS admin_users;
+DROP TABLE IF EXISTS abuse_reports;
+DROP TABLE IF EXISTS cheat_alerts;
+DROP TABLE IF EXISTS exchange_prices;
+DROP TABLE IF EXISTS crash_bets;
+DROP TABLE IF EXISTS crash_games;
+
+ALTER TABLE system_state
+  DROP COLUMN IF EXISTS unfrozen_schedule,
+  DROP COLUMN IF EXISTS tax_rate_system,
+  DROP COLUMN IF EXISTS tax_rate_burn,
+  DROP COLUMN IF EXISTS total_burned,
+  DROP COLUMN IF EXISTS frozen_supply;
+
+ALTER TABLE users
+  DROP COLUMN IF EXISTS loan_debt,
+  DROP COLUMN IF EXISTS collector_mode,
+  DROP COLUMN IF EXISTS last_tap_date,
+  DROP COLUMN IF EXISTS daily_taps_used,
+  DROP COLUMN IF EXISTS daily_taps_limit,
+  DROP COLUMN IF EXISTS premium_until,
+  DROP COLUMN IF EXISTS premium_type,
+  DROP COLUMN IF EXISTS is_premium,
+  DROP COLUMN IF EXISTS is_subscribed,
+  DROP COLUMN IF EXISTS last_active,
+  DROP COLUMN IF EXISTS ban_expires_at,
+  DROP COLUMN IF EXISTS ban_reason,
+  DROP COLUMN IF EXISTS is_banned;
@@ -0,0 +1,194 @@
+-- Tables and columns used by the auxiliary packages (games, antiabuse, admin,
+-- marketplace, mining, credits, tokenomics) that the core schema never created.
+--
+-- Not covered here: those packages also address nfts, bank_loans, p2p_loans and
+-- market_listings by an "id" column and use ledger.created_at, while the core
+-- schema names them nft_id/loan_id/listing_id and ledger.ts. Renaming would
+-- break the core handlers, so those queries stay incompatible until the
+-- packages are ported.
+
+-- mining / admin / credits: user flags and premium quotas
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_banned BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS ban_reason TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS ban_expires_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_active TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_subscribed BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_premium BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS premium_type TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS premium_until TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS daily_taps_limit BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS daily_taps_used BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_tap_date DATE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS collector_mode BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS loan_debt BIGINT NOT NULL DEFAULT 0;
+
+-- tokenomics: frozen tranche, burn counter and tax rates
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS frozen_supply BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS total_burned BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS tax_rate_burn DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS tax_rate_system DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS unfrozen_schedule JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+-- games: crash rounds, bets and exchange price ticks
+CREATE TABLE IF NOT EXISTS crash_games (
+  id BIGSERIAL PRIMARY KEY,
+  game_id TEXT NOT NULL UNIQUE,
+  hash TEXT NOT NULL,
+  salt TEXT NOT NULL,
+  crash_point DOUBLE PRECISION NOT NULL,
+  status TEXT NOT NULL DEFAULT 'waiting', -- waiting|active|crashed
+  started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  crashed_at TIMESTAMPTZ,
+  total_bets BIGINT NOT NULL DEFAULT 0,
+  total_winners INT NOT NULL DEFAULT 0,
+  system_profit BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS crash_games_status_idx ON crash_games(status, started_at DESC);
+
+CREATE TABLE IF NOT EXISTS crash_bets (
+  id BIGSERIAL PRIMARY KEY,
+  bet_id TEXT NOT NULL UNIQUE,
+  game_id TEXT NOT NULL,
+  user_id BIGINT NOT NULL,
+  amount BIGINT NOT NULL,
+  auto_cashout DOUBLE PRECISION NOT NULL DEFAULT 0,
+  cashed_out_at DOUBLE PRECISION NOT NULL DEFAULT 0, -- multiplier, not a timestamp
+  win_amount BIGINT NOT NULL DEFAULT 0,
+  status TEXT NOT NULL DEFAULT 'active', -- active|cashed_out|lost
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS crash_bets_game_idx ON crash_bets(game_id, status);
+CREATE INDEX IF NOT EXISTS crash_bets_user_idx ON crash_bets(user_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS exchange_prices (
+  id BIGSERIAL PRIMARY KEY,
+  pair TEXT NOT NULL,
+  price DOUBLE PRECISION NOT NULL,
+  volume_24h DOUBLE PRECISION NOT NULL DEFAULT 0,
+  change_24h DOUBLE PRECISION NOT NULL DEFAULT 0,
+  high_24h DOUBLE PRECISION NOT NULL DEFAULT 0,
+  low_24h DOUBLE PRECISION NOT NULL DEFAULT 0,
+  last_trade TIMESTAMPTZ NOT NULL DEFAULT now(),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS exchange_prices_pair_idx ON exchange_prices(pair, created_at DESC);
+
+-- antiabuse
+CREATE TABLE IF NOT EXISTS cheat_alerts (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  alert_type TEXT NOT NULL,
+  severity TEXT NOT NULL, -- low|medium|high|critical
+  description TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  device_id TEXT NOT NULL DEFAULT '',
+  metadata TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  is_resolved BOOLEAN NOT NULL DEFAULT false,
+  resolved_at TIMESTAMPTZ,
+  resolved_by BIGINT
+);
+CREATE INDEX IF NOT EXISTS cheat_alerts_user_idx ON cheat_alerts(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS cheat_alerts_open_idx ON cheat_alerts(created_at DESC) WHERE NOT is_resolved;
+
+CREATE TABLE IF NOT EXISTS abuse_reports (
+  id BIGSERIAL PRIMARY KEY,
+  reporter_id BIGINT NOT NULL,
+  target_id BIGINT NOT NULL,
+  reason TEXT NOT NULL,
+  description TEXT NOT NULL DEFAULT '',
+  evidence TEXT NOT NULL DEFAULT '',
+  status TEXT NOT NULL DEFAULT 'pending', -- pending|reviewing|resolved|dismissed
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS abuse_reports_status_idx ON abuse_reports(status, created_at DESC);
+
+-- admin: panel accounts (password_hash is checked with pgcrypto crypt()) and the god-mode log.
+-- Managed Postgres may refuse CREATE EXTENSION; admin login then fails but nothing else does.
+DO $$
+BEGIN
+  CREATE EXTENSION IF NOT EXISTS pgcrypto;
+EXCEPTION WHEN insufficient_privilege THEN
+  RAISE NOTICE 'pgcrypto not installed: %', SQLERRM;
+END
+$$;
+
+CREATE TABLE IF NOT EXISTS admin_users (
+  id BIGSERIAL PRIMARY KEY,
+  username TEXT NOT NULL UNIQUE,
+  email TEXT NOT NULL DEFAULT '',
+  role TEXT NOT NULL DEFAULT 'moderator', -- super_admin|admin|moderator
+  permissions TEXT[] NOT NULL DEFAULT '{}',
+  password_hash TEXT NOT NULL,
+  is_active BOOLEAN NOT NULL DEFAULT true,
+  last_login TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS god_mode_actions (
+  id BIGSERIAL PRIMARY KEY,
+  admin_id BIGINT NOT NULL,
+  action_type TEXT NOT NULL,
+  target_id BIGINT NOT NULL DEFAULT 0,
+  amount BIGINT NOT NULL DEFAULT 0,
+  reason TEXT NOT NULL DEFAULT '',
+  metadata TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS god_mode_actions_ts_idx ON god_mode_actions(created_at DESC);
+
+-- marketplace / credits: NFT holdings with collateral flags and the P2P BKC order book
+CREATE TABLE IF NOT EXISTS user_nfts (
+  user_id BIGINT NOT NULL,
+  nft_id BIGINT NOT NULL,
+  qty BIGINT NOT NULL DEFAULT 0,
+  is_collateral BOOLEAN NOT NULL DEFAULT false,
+  loan_id BIGINT,
+  acquired_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (user_id, nft_id)
+);
+
+CREATE TABLE IF NOT EXISTS p2p_orders (
+  id BIGSERIAL PRIMARY KEY,
+  seller_id BIGINT NOT NULL,
+  buyer_id BIGINT,
+  amount_bkc BIGINT NOT NULL,
+  price_ton DOUBLE PRECISION NOT NULL DEFAULT 0,
+  price_usd DOUBLE PRECISION,
+  status TEXT NOT NULL DEFAULT 'open', -- open|locked|completed|cancelled|disputed
+  escrow_bkc BIGINT NOT NULL DEFAULT 0,
+  contact_method TEXT NOT NULL DEFAULT '',
+  description TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  locked_at TIMESTAMPTZ,
+  completed_at TIMESTAMPTZ,
+  dispute_reason TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS p2p_orders_status_idx ON p2p_orders(status, created_at DESC);
+
+-- mining premium plans (one row per user and is_active value, see ON CONFLICT in mining)
+CREATE TABLE IF NOT EXISTS subscriptions (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  plan_type TEXT NOT NULL,
+  price_paid BIGINT NOT NULL DEFAULT 0,
+  expires_at TIMESTAMPTZ NOT NULL,
+  is_active BOOLEAN NOT NULL DEFAULT true,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  UNIQUE (user_id, is_active)
+);
+
+-- admin subscription checks
+CREATE TABLE IF NOT EXISTS user_subscriptions (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  plan_type TEXT NOT NULL,
+  expires_at TIMESTAMPTZ,
+  is_active BOOLEAN NOT NULL DEFAULT true,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS user_subscriptions_user_idx ON user_subscriptions(user_id) WHERE is_active;
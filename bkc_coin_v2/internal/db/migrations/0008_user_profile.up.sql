@@ -0,0 +1,3 @@
+-- Telegram avatar for the recipient preview and case-insensitive @username lookup.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS photo_url TEXT;
+CREATE INDEX IF NOT EXISTS users_username_lower_idx ON users(lower(username));
@@ -0,0 +1,38 @@
+-- Standing orders: scheduled one-off and recurring user-to-user transfers.
+-- Slot N of an order is due at start_at + N periods; a run row per (order, slot)
+-- keeps each slot from being paid twice.
+CREATE TABLE IF NOT EXISTS standing_orders (
+  order_id BIGSERIAL PRIMARY KEY,
+  from_id BIGINT NOT NULL REFERENCES users(user_id),
+  to_id BIGINT NOT NULL REFERENCES users(user_id),
+  amount BIGINT NOT NULL CHECK (amount > 0),
+  memo TEXT NOT NULL DEFAULT '',
+  schedule TEXT NOT NULL,
+  start_at TIMESTAMPTZ NOT NULL,
+  slot BIGINT NOT NULL DEFAULT 0,
+  next_run_at TIMESTAMPTZ NOT NULL,
+  retry_at TIMESTAMPTZ,
+  status TEXT NOT NULL DEFAULT 'active',
+  fail_count INT NOT NULL DEFAULT 0,
+  runs_count BIGINT NOT NULL DEFAULT 0,
+  last_error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS standing_orders_due_idx ON standing_orders(COALESCE(retry_at, next_run_at)) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS standing_orders_from_idx ON standing_orders(from_id, order_id DESC);
+CREATE INDEX IF NOT EXISTS standing_orders_to_idx ON standing_orders(to_id, order_id DESC);
+
+CREATE TABLE IF NOT EXISTS standing_order_runs (
+  order_id BIGINT NOT NULL REFERENCES standing_orders(order_id) ON DELETE CASCADE,
+  slot BIGINT NOT NULL,
+  due_at TIMESTAMPTZ NOT NULL,
+  status TEXT NOT NULL,
+  attempts INT NOT NULL DEFAULT 1,
+  gross BIGINT NOT NULL DEFAULT 0,
+  fee BIGINT NOT NULL DEFAULT 0,
+  error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (order_id, slot)
+);
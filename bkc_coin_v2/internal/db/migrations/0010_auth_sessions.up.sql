@@ -0,0 +1,14 @@
+-- WebApp sessions issued by /auth/session. refresh_gen rotates on every refresh;
+-- a reused older refresh token revokes the session.
+CREATE TABLE IF NOT EXISTS auth_sessions (
+  session_id TEXT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  refresh_gen BIGINT NOT NULL DEFAULT 1,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  refreshed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  revoked_at TIMESTAMPTZ,
+  revoke_reason TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS auth_sessions_user_idx ON auth_sessions(user_id);
+CREATE INDEX IF NOT EXISTS auth_sessions_revoked_idx ON auth_sessions(expires_at) WHERE revoked_at IS NOT NULL;
@@ -0,0 +1,17 @@
+-- Bot broadcasts. cursor is the last user_id sent to (users go out in
+-- user_id order), so a broadcast paused by a restart continues where it
+-- stopped. A 'running' row whose updated_at stopped moving belongs to a
+-- process that died and is picked up again too.
+CREATE TABLE IF NOT EXISTS broadcasts (
+  broadcast_id BIGSERIAL PRIMARY KEY,
+  admin_chat_id BIGINT NOT NULL,
+  text TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'running',
+  cursor BIGINT NOT NULL DEFAULT 0,
+  total BIGINT NOT NULL DEFAULT 0,
+  ok_count BIGINT NOT NULL DEFAULT 0,
+  fail_count BIGINT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS broadcasts_open_idx ON broadcasts(updated_at) WHERE status IN ('running', 'paused');
@@ -0,0 +1,13 @@
+DROP INDEX IF EXISTS users_banned_idx;
+
+ALTER TABLE market_listings
+  DROP COLUMN IF EXISTS reject_reason,
+  DROP COLUMN IF EXISTS rejected_at,
+  DROP COLUMN IF EXISTS rejected_by,
+  DROP COLUMN IF EXISTS approved_at,
+  DROP COLUMN IF EXISTS approved_by;
+
+DROP TABLE IF EXISTS admin_sessions;
+
+DROP INDEX IF EXISTS admin_users_telegram_uniq;
+ALTER TABLE admin_users DROP COLUMN IF EXISTS telegram_id;
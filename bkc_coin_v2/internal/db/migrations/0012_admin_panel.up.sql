@@ -0,0 +1,26 @@
+-- /admin/v2: Telegram accounts linked to admin_users (ADMIN_ID gets a
+-- super_admin row on start), panel sessions and listing review.
+
+ALTER TABLE admin_users ADD COLUMN IF NOT EXISTS telegram_id BIGINT;
+CREATE UNIQUE INDEX IF NOT EXISTS admin_users_telegram_uniq ON admin_users(telegram_id) WHERE telegram_id IS NOT NULL;
+
+-- Password logins. Only the SHA-256 of the token is stored.
+CREATE TABLE IF NOT EXISTS admin_sessions (
+  token_hash TEXT PRIMARY KEY,
+  admin_id BIGINT NOT NULL REFERENCES admin_users(id) ON DELETE CASCADE,
+  ip TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS admin_sessions_admin_idx ON admin_sessions(admin_id);
+
+-- Listings are live from creation; review marks them checked (approved) or
+-- takes them down (status 'rejected').
+ALTER TABLE market_listings ADD COLUMN IF NOT EXISTS approved_by BIGINT;
+ALTER TABLE market_listings ADD COLUMN IF NOT EXISTS approved_at TIMESTAMPTZ;
+ALTER TABLE market_listings ADD COLUMN IF NOT EXISTS rejected_by BIGINT;
+ALTER TABLE market_listings ADD COLUMN IF NOT EXISTS rejected_at TIMESTAMPTZ;
+ALTER TABLE market_listings ADD COLUMN IF NOT EXISTS reject_reason TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS users_banned_idx ON users(user_id) WHERE is_banned;
@@ -0,0 +1,39 @@
+-- Audit log of privileged actions (admin endpoints, /admin/v2, bot admin
+-- commands). Rows form a hash chain: hash covers the row and prev_hash, and
+-- seq has no gaps, so an edited or deleted row breaks verification. The
+-- triggers make the table append-only for everyone but its owner disabling
+-- them. Supersedes god_mode_actions, which is kept for old rows.
+CREATE TABLE IF NOT EXISTS admin_audit (
+  seq BIGINT PRIMARY KEY,
+  ts TIMESTAMPTZ NOT NULL,
+  actor_kind TEXT NOT NULL, -- telegram|admin|system
+  actor_id BIGINT NOT NULL DEFAULT 0,
+  actor_name TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  via TEXT NOT NULL DEFAULT '', -- api|admin_v2|bot
+  request_id TEXT NOT NULL DEFAULT '',
+  action TEXT NOT NULL,
+  target TEXT NOT NULL DEFAULT '', -- "user:123", "listing:5", ...
+  before TEXT NOT NULL DEFAULT '', -- JSON exactly as hashed
+  after TEXT NOT NULL DEFAULT '',
+  reason TEXT NOT NULL DEFAULT '',
+  prev_hash TEXT NOT NULL,
+  hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS admin_audit_actor_idx ON admin_audit(actor_kind, actor_id, seq DESC);
+CREATE INDEX IF NOT EXISTS admin_audit_action_idx ON admin_audit(action, seq DESC);
+CREATE INDEX IF NOT EXISTS admin_audit_target_idx ON admin_audit(target, seq DESC);
+CREATE INDEX IF NOT EXISTS admin_audit_ts_idx ON admin_audit(ts);
+
+CREATE OR REPLACE FUNCTION admin_audit_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'admin_audit is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS admin_audit_no_change ON admin_audit;
+CREATE TRIGGER admin_audit_no_change BEFORE UPDATE OR DELETE ON admin_audit
+  FOR EACH ROW EXECUTE FUNCTION admin_audit_append_only();
+DROP TRIGGER IF EXISTS admin_audit_no_truncate ON admin_audit;
+CREATE TRIGGER admin_audit_no_truncate BEFORE TRUNCATE ON admin_audit
+  FOR EACH STATEMENT EXECUTE FUNCTION admin_audit_append_only();
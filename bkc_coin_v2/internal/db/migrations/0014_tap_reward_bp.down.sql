@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS tap_reward_carry;
+ALTER TABLE system_state DROP COLUMN IF EXISTS tap_reward_bp;
@@ -0,0 +1,13 @@
+-- Fractional halving reward. tap_reward_bp is the reward per unit of tap
+-- power in basis points of a coin (10000 = 1 BKC); each halving halves it.
+-- current_tap_reward stayed an integer clamped to 1, so halvings done while
+-- it was 1 changed nothing: apply exactly those here.
+ALTER TABLE system_state ADD COLUMN IF NOT EXISTS tap_reward_bp BIGINT NOT NULL DEFAULT 10000;
+UPDATE system_state SET tap_reward_bp = GREATEST(1, (GREATEST(current_tap_reward, 1) * 10000) >> LEAST(62, (
+  SELECT COUNT(*) FROM ledger
+  WHERE kind = 'halving' AND meta->>'old_reward' = meta->>'new_reward'
+)::int))
+WHERE id = 1;
+
+-- Fraction of a coin (in basis points) a user has tapped but not yet been paid.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tap_reward_carry BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+UPDATE ledger l SET meta = l.meta || jsonb_build_object('memo', m.memo)
+FROM transfer_memos m
+WHERE m.ledger_id = l.id AND l.block_height IS NULL;
+
+DROP TABLE IF EXISTS transfer_memos;
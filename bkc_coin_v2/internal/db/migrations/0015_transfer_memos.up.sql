@@ -0,0 +1,17 @@
+-- Transfer memos are private to the two parties, but ledger rows are served
+-- verbatim by the public chain endpoints. Keep memos in a side table keyed by
+-- the net "transfer" leg; it is not part of the sealed row contents.
+CREATE TABLE IF NOT EXISTS transfer_memos (
+  ledger_id BIGINT PRIMARY KEY REFERENCES ledger(id),
+  memo TEXT NOT NULL
+);
+
+-- Rows not sealed yet can still be rewritten without breaking block hashes.
+-- Sealed rows keep their meta; the chain views redact the memo instead.
+INSERT INTO transfer_memos(ledger_id, memo)
+SELECT id, meta->>'memo' FROM ledger
+WHERE kind = 'transfer' AND block_height IS NULL AND COALESCE(meta->>'memo', '') <> ''
+ON CONFLICT (ledger_id) DO NOTHING;
+
+UPDATE ledger SET meta = meta - 'memo'
+WHERE kind = 'transfer' AND block_height IS NULL AND meta ? 'memo';
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/logx"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var logger = logx.Component("db")
+
+// queryTracer logs failed queries at DEBUG and slow ones at WARN. It logs
+// with the caller's context, so the records carry the request ID of the API
+// call or job that ran the query.
+type queryTracer struct {
+	slow time.Duration // 0 = do not report slow queries
+}
+
+type traceKey struct{}
+
+type traceStart struct {
+	at  time.Time
+	sql string
+}
+
+// slowQueryFromEnv reads DB_SLOW_QUERY_MS (default 500, 0 = off).
+func slowQueryFromEnv() time.Duration {
+	ms := int64(500)
+	if v := strings.TrimSpace(os.Getenv("DB_SLOW_QUERY_MS")); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			ms = n
+		}
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (t queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceStart{at: time.Now(), sql: data.SQL})
+}
+
+func (t queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	st, ok := ctx.Value(traceKey{}).(traceStart)
+	if !ok {
+		return
+	}
+	d := time.Since(st.at)
+	switch {
+	case data.Err != nil:
+		logger.DebugContext(ctx, "query failed", "sql", compactSQL(st.sql), "duration_ms", d.Milliseconds(), "err", data.Err)
+	case t.slow > 0 && d >= t.slow:
+		logger.WarnContext(ctx, "slow query", "sql", compactSQL(st.sql), "duration_ms", d.Milliseconds())
+	}
+}
+
+// compactSQL folds whitespace and cuts long statements for a log line.
+func compactSQL(sql string) string {
+	sql = strings.Join(strings.Fields(sql), " ")
+	if len(sql) > 200 {
+		sql = sql[:200] + "..."
+	}
+	return sql
+}
@@ -0,0 +1,387 @@
+// Package events pushes per-user domain events (incoming transfers, loan and
+// market updates, deposit credits) to connected WebApp clients.
+//
+// Producers call Publish after their ledger write has committed. The hub
+// stamps the event with an id and the user's balance and publishes it on the
+// Redis channel "events", which every replica subscribes to, so a client gets
+// its events whichever node holds its stream. Without Redis events stay on
+// the node that produced them.
+//
+// Each node keeps the last Backlog events of every recently active user. A
+// client that reconnects with the id of the last event it saw gets what it
+// missed; if that id has already left the backlog the stream starts with a
+// "resync" event and the client reloads /state instead.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bkc_coin_v2/internal/cache"
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/metrics"
+)
+
+var logger = logx.Component("events")
+
+// Event types.
+const (
+	TransferIn      = "transfer_in"
+	TransferOut     = "transfer_out"
+	LoanRequest     = "loan_request"
+	LoanAccepted    = "loan_accepted"
+	LoanRejected    = "loan_rejected"
+	LoanRepaid      = "loan_repaid"
+	LoanRecalled    = "loan_recalled"
+	MarketSale      = "market_sale"
+	DepositCredited = "deposit_credited"
+	Credit          = "credit"
+	Debit           = "debit"
+	Resync          = "resync"
+)
+
+const channel = "events"
+
+var (
+	ErrTooManyStreams = errors.New("too many event streams")
+	ErrClosed         = errors.New("event hub closed")
+)
+
+type Event struct {
+	ID      string         `json:"id"`
+	UserID  int64          `json:"user_id"`
+	Type    string         `json:"type"`
+	Data    map[string]any `json:"data,omitempty"`
+	Balance *int64         `json:"balance,omitempty"` // balance after the event
+	At      time.Time      `json:"at"`
+}
+
+// Balances reads a user's balance for the event; *db.DB implements it.
+type Balances interface {
+	GetUser(ctx context.Context, userID int64) (db.UserState, error)
+}
+
+type Config struct {
+	Backlog        int           // events kept per user for resume
+	BacklogTTL     time.Duration // how long an idle user's backlog is kept
+	Heartbeat      time.Duration // keep-alive period of a stream
+	StreamsPerUser int           // open streams per user
+}
+
+func ConfigFromEnv() Config {
+	c := Config{Backlog: 50, BacklogTTL: 30 * time.Minute, Heartbeat: 20 * time.Second, StreamsPerUser: 5}
+	if n, ok := envInt("EVENTS_BACKLOG"); ok {
+		if n < 0 {
+			n = 0
+		}
+		if n > 500 {
+			n = 500
+		}
+		c.Backlog = int(n)
+	}
+	if n, ok := envInt("EVENTS_BACKLOG_TTL_MIN"); ok {
+		if n < 1 {
+			n = 1
+		}
+		if n > 24*60 {
+			n = 24 * 60
+		}
+		c.BacklogTTL = time.Duration(n) * time.Minute
+	}
+	if n, ok := envInt("EVENTS_HEARTBEAT_SEC"); ok {
+		if n < 5 {
+			n = 5
+		}
+		if n > 120 {
+			n = 120
+		}
+		c.Heartbeat = time.Duration(n) * time.Second
+	}
+	if n, ok := envInt("EVENTS_MAX_STREAMS_PER_USER"); ok {
+		if n < 1 {
+			n = 1
+		}
+		if n > 50 {
+			n = 50
+		}
+		c.StreamsPerUser = int(n)
+	}
+	return c
+}
+
+func envInt(key string) (int64, bool) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// Stream is one connected client. C is closed when the hub drops the stream
+// (the client fell behind); the client then reconnects and resumes.
+type Stream struct {
+	C      <-chan Event
+	ch     chan Event
+	userID int64
+	hub    *Hub
+	closed bool // guarded by hub.mu
+}
+
+// Close unregisters the stream.
+func (s *Stream) Close() {
+	s.hub.mu.Lock()
+	s.hub.drop(s)
+	s.hub.mu.Unlock()
+}
+
+type userEvents struct {
+	backlog []Event
+	streams map[*Stream]struct{}
+	seen    time.Time
+}
+
+type Hub struct {
+	redis    *cache.RedisManager
+	balances Balances
+	cfg      Config
+	node     string
+	seq      atomic.Int64
+	queue    chan Event
+
+	mu     sync.Mutex
+	users  map[int64]*userEvents
+	closed bool // CloseStreams was called; guarded by mu
+}
+
+// New builds a hub. redis and balances may be nil: events then stay on this
+// node and carry no balance.
+func New(redis *cache.RedisManager, balances Balances, cfg Config) *Hub {
+	b := make([]byte, 3)
+	_, _ = rand.Read(b)
+	return &Hub{
+		redis:    redis,
+		balances: balances,
+		cfg:      cfg,
+		node:     hex.EncodeToString(b),
+		queue:    make(chan Event, 1024),
+		users:    map[int64]*userEvents{},
+	}
+}
+
+func (h *Hub) Config() Config { return h.cfg }
+
+// Publish queues an event for userID. It never blocks the caller; a nil hub
+// ignores the event.
+func (h *Hub) Publish(userID int64, typ string, data map[string]any) {
+	if h == nil || userID <= 0 {
+		return
+	}
+	ev := Event{UserID: userID, Type: typ, Data: data, At: time.Now().UTC()}
+	select {
+	case h.queue <- ev:
+	default:
+		logger.Warn("queue full, event dropped", "type", typ, "to_user", userID)
+	}
+}
+
+// Run sends queued events and, with Redis, relays the channel to local
+// streams until ctx is done.
+func (h *Hub) Run(ctx context.Context) {
+	if h.redis != nil {
+		go h.relay(ctx)
+	}
+	sweep := time.NewTicker(time.Minute)
+	defer sweep.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			h.drain(context.WithoutCancel(ctx))
+			return
+		case <-sweep.C:
+			h.sweep(time.Now())
+		case ev := <-h.queue:
+			h.send(ctx, ev)
+		}
+	}
+}
+
+// drain sends what is still queued when Run is stopped, so events of the
+// last requests reach other nodes' streams. It gives up after 2 seconds.
+func (h *Hub) drain(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	for ctx.Err() == nil {
+		select {
+		case ev := <-h.queue:
+			h.send(ctx, ev)
+		default:
+			return
+		}
+	}
+}
+
+// CloseStreams ends every open stream and refuses new ones with ErrClosed.
+// Called when the HTTP server shuts down: the clients reconnect to another
+// node and resume from their last event id.
+func (h *Hub) CloseStreams() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, u := range h.users {
+		for s := range u.streams {
+			h.drop(s)
+		}
+	}
+}
+
+func (h *Hub) send(ctx context.Context, ev Event) {
+	ev.ID = strconv.FormatInt(ev.At.UnixMilli(), 36) + "-" + h.node + "-" + strconv.FormatInt(h.seq.Add(1), 36)
+	if h.balances != nil {
+		if u, err := h.balances.GetUser(ctx, ev.UserID); err == nil {
+			bal := u.Balance
+			ev.Balance = &bal
+		}
+	}
+	if h.redis != nil {
+		if err := h.redis.Publish(ctx, channel, ev); err == nil {
+			return // comes back through relay, like on every other node
+		} else if ctx.Err() == nil {
+			logger.WarnContext(ctx, "publish failed", "err", err)
+		}
+	}
+	h.deliver(ev)
+}
+
+func (h *Hub) relay(ctx context.Context) {
+	for ctx.Err() == nil {
+		msgs, err := h.redis.Subscribe(ctx, channel)
+		if err != nil {
+			logger.WarnContext(ctx, "subscribe failed", "err", err)
+		} else {
+			for msg := range msgs {
+				raw, err := json.Marshal(msg.Data)
+				if err != nil {
+					continue
+				}
+				var ev Event
+				if err := json.Unmarshal(raw, &ev); err != nil || ev.UserID <= 0 || ev.ID == "" {
+					continue
+				}
+				h.deliver(ev)
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func (h *Hub) deliver(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u := h.users[ev.UserID]
+	if u == nil {
+		u = &userEvents{streams: map[*Stream]struct{}{}}
+		h.users[ev.UserID] = u
+	}
+	u.seen = time.Now()
+	if h.cfg.Backlog > 0 {
+		u.backlog = append(u.backlog, ev)
+		if over := len(u.backlog) - h.cfg.Backlog; over > 0 {
+			u.backlog = append(u.backlog[:0], u.backlog[over:]...)
+		}
+	}
+	for s := range u.streams {
+		select {
+		case s.ch <- ev:
+		default:
+			h.drop(s) // slow client: it resumes from its last id
+		}
+	}
+}
+
+// Subscribe opens a stream for userID. With lastID it also returns the
+// events after lastID, or resync=true if lastID is no longer known.
+func (h *Hub) Subscribe(userID int64, lastID string) (s *Stream, replay []Event, resync bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil, false, ErrClosed
+	}
+	u := h.users[userID]
+	if u == nil {
+		u = &userEvents{streams: map[*Stream]struct{}{}}
+		h.users[userID] = u
+	}
+	if len(u.streams) >= h.cfg.StreamsPerUser {
+		return nil, nil, false, ErrTooManyStreams
+	}
+	u.seen = time.Now()
+	if lastID != "" {
+		resync = true
+		for i, ev := range u.backlog {
+			if ev.ID == lastID {
+				replay = append([]Event(nil), u.backlog[i+1:]...)
+				resync = false
+				break
+			}
+		}
+	}
+	ch := make(chan Event, 32)
+	s = &Stream{C: ch, ch: ch, userID: userID, hub: h}
+	u.streams[s] = struct{}{}
+	return s, replay, resync, nil
+}
+
+// WriteMetrics exports open streams and the send queue (metrics.Collector).
+func (h *Hub) WriteMetrics(ctx context.Context, w *metrics.Writer) {
+	h.mu.Lock()
+	streams := 0
+	for _, u := range h.users {
+		streams += len(u.streams)
+	}
+	users := len(h.users)
+	h.mu.Unlock()
+	w.Gauge("bkc_event_streams", "Open event streams on this node.", float64(streams))
+	w.Gauge("bkc_event_users", "Users with a stream or a kept backlog.", float64(users))
+	w.Gauge("bkc_event_queue", "Events waiting to be sent.", float64(len(h.queue)))
+}
+
+// drop unregisters s; h.mu must be held.
+func (h *Hub) drop(s *Stream) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.ch)
+	if u := h.users[s.userID]; u != nil {
+		delete(u.streams, s)
+		u.seen = time.Now()
+	}
+}
+
+// sweep forgets idle users whose backlog is older than BacklogTTL.
+func (h *Hub) sweep(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, u := range h.users {
+		if len(u.streams) == 0 && now.Sub(u.seen) > h.cfg.BacklogTTL {
+			delete(h.users, id)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package fasttap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/logx"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Dead-letter handling: a tap event that keeps failing ApplyTapEvents is
+// isolated by bisecting its batch and, once it has been delivered
+// DLQMaxDeliveries times, moved to DLQKey together with the error so it no
+// longer blocks the rest of the stream.
+
+type DLQEntry struct {
+	ID         string `json:"id"`
+	OriginalID string `json:"original_id"`
+	UserID     int64  `json:"user_id"`
+	Coins      int64  `json:"coins"`
+	Taps       int64  `json:"taps"`
+	Day        string `json:"day"`
+	Req        int64  `json:"req"`
+	RequestID  string `json:"request_id,omitempty"`
+	Deliveries int64  `json:"deliveries"`
+	Error      string `json:"error"`
+	FailedAt   int64  `json:"failed_at"`
+}
+
+type DLQResult struct {
+	ID    string `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// deliveryCounts returns XPENDING delivery counts for the given message ids.
+func (e *Engine) deliveryCounts(ctx context.Context, part []queuedTap) map[string]int64 {
+	out := make(map[string]int64, len(part))
+	if len(part) == 0 {
+		return out
+	}
+	start, end := part[0].id, part[0].id
+	for _, x := range part[1:] {
+		if compareStreamIDs(x.id, start) < 0 {
+			start = x.id
+		}
+		if compareStreamIDs(x.id, end) > 0 {
+			end = x.id
+		}
+	}
+	pe, err := e.Rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: e.StreamKey,
+		Group:  e.StreamGroup,
+		Start:  start,
+		End:    end,
+		Count:  int64(len(part)) + 1000,
+	}).Result()
+	if err != nil {
+		logger.WarnContext(ctx, "XPENDING failed", "err", err)
+		return out
+	}
+	for _, p := range pe {
+		out[p.ID] = p.RetryCount
+	}
+	return out
+}
+
+// applyOrIsolate retries a failed chunk by bisection. Events that still fail
+// on their own are dead-lettered once they reached DLQMaxDeliveries; the rest
+// stay pending for a later claim. Returns false if anything is left pending.
+func (e *Engine) applyOrIsolate(ctx context.Context, part []queuedTap, deliveries map[string]int64) bool {
+	if len(part) == 0 {
+		return true
+	}
+	events := make([]db.TapEvent, 0, len(part))
+	ids := make([]string, 0, len(part))
+	for _, x := range part {
+		events = append(events, x.ev)
+		ids = append(ids, x.id)
+	}
+	err := e.DB.ApplyTapEvents(ctx, events)
+	if err == nil {
+		if err := e.Rdb.XAck(ctx, e.StreamKey, e.StreamGroup, ids...).Err(); err != nil {
+			logger.WarnContext(ctx, "XACK failed", "err", err)
+			return false
+		}
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	if len(part) == 1 {
+		x := part[0]
+		if deliveries[x.id] < e.DLQMaxDeliveries {
+			return false
+		}
+		// A Postgres outage fails every event; only dead-letter when the DB itself is reachable.
+		if perr := e.DB.Pool.Ping(ctx); perr != nil {
+			return false
+		}
+		// Log with the request that emitted the event.
+		ectx := ctx
+		if x.rid != "" {
+			ectx = logx.WithRequestID(ctx, x.rid)
+			logx.SetUser(ectx, x.ev.UserID)
+		}
+		if err := e.deadLetter(ctx, x, deliveries[x.id], err); err != nil {
+			logger.ErrorContext(ectx, "dead-letter failed", "event_id", x.id, "err", err)
+			return false
+		}
+		logger.ErrorContext(ectx, "event dead-lettered", "event_id", x.id, "dlq", e.DLQKey, "deliveries", deliveries[x.id], "err", err)
+		return true
+	}
+	mid := len(part) / 2
+	okLeft := e.applyOrIsolate(ctx, part[:mid], deliveries)
+	okRight := e.applyOrIsolate(ctx, part[mid:], deliveries)
+	return okLeft && okRight
+}
+
+func (e *Engine) deadLetter(ctx context.Context, x queuedTap, deliveries int64, cause error) error {
+	pipe := e.Rdb.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: e.DLQKey,
+		Values: map[string]any{
+			"original_id": x.id,
+			"uid":         x.ev.UserID,
+			"coins":       x.ev.Coins,
+			"taps":        x.ev.Taps,
+			"day":         x.ev.Day,
+			"req":         x.ev.Req,
+			"rid":         x.rid,
+			"deliveries":  deliveries,
+			"error":       cause.Error(),
+			"failed_at":   time.Now().UTC().Unix(),
+		},
+	})
+	pipe.XAck(ctx, e.StreamKey, e.StreamGroup, x.id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (e *Engine) ListDLQ(ctx context.Context, start string, count int64) ([]DLQEntry, error) {
+	if !e.Enabled() {
+		return nil, errors.New("fasttap disabled")
+	}
+	start = strings.TrimSpace(start)
+	if start == "" {
+		start = "-"
+	} else {
+		// Exclusive start so the last id of the previous page can be passed as cursor.
+		start = "(" + start
+	}
+	if count <= 0 || count > 500 {
+		count = 100
+	}
+	msgs, err := e.Rdb.XRangeN(ctx, e.DLQKey, start, "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]DLQEntry, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, dlqEntryFromMessage(m))
+	}
+	return out, nil
+}
+
+func (e *Engine) dlqEntries(ctx context.Context, ids []string) ([]DLQEntry, error) {
+	out := make([]DLQEntry, 0, len(ids))
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		msgs, err := e.Rdb.XRangeN(ctx, e.DLQKey, id, id, 1).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+		out = append(out, dlqEntryFromMessage(msgs[0]))
+	}
+	return out, nil
+}
+
+// ReplayDLQ applies dead-lettered events directly to Postgres. The original
+// stream id is kept as ledger event_id, so replaying twice never double-credits.
+func (e *Engine) ReplayDLQ(ctx context.Context, ids []string) ([]DLQResult, error) {
+	if !e.Enabled() {
+		return nil, errors.New("fasttap disabled")
+	}
+	entries, err := e.dlqEntries(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]DLQResult, 0, len(entries))
+	for _, ent := range entries {
+		ev := db.TapEvent{
+			EventID: ent.OriginalID,
+			UserID:  ent.UserID,
+			Coins:   ent.Coins,
+			Taps:    ent.Taps,
+			Day:     ent.Day,
+			Req:     ent.Req,
+		}
+		if err := e.DB.ApplyTapEvents(ctx, []db.TapEvent{ev}); err != nil {
+			out = append(out, DLQResult{ID: ent.ID, Error: err.Error()})
+			continue
+		}
+		if err := e.Rdb.XDel(ctx, e.DLQKey, ent.ID).Err(); err != nil {
+			out = append(out, DLQResult{ID: ent.ID, Error: fmt.Sprintf("applied, but XDEL failed: %v", err)})
+			continue
+		}
+		out = append(out, DLQResult{ID: ent.ID, OK: true})
+	}
+	return out, nil
+}
+
+// discardDLQLua removes a dead-lettered event and returns its coins to the
+// Redis reserve in one step, so a failure can neither lose the refund nor
+// pay it twice. Returns 1 if the entry was removed, 0 if it was already gone.
+var discardDLQLua = redis.NewScript(`
+local n = redis.call('XDEL', KEYS[1], ARGV[1])
+if n > 0 and tonumber(ARGV[2]) ~= 0 then
+  redis.call('HINCRBY', KEYS[2], 'reserve_supply', ARGV[2])
+end
+return n
+`)
+
+// DiscardDLQ drops dead-lettered events. Their coins were already taken from
+// the Redis reserve by the tap script, so they are returned to it.
+func (e *Engine) DiscardDLQ(ctx context.Context, ids []string) ([]DLQResult, error) {
+	if !e.Enabled() {
+		return nil, errors.New("fasttap disabled")
+	}
+	entries, err := e.dlqEntries(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]DLQResult, 0, len(entries))
+	for _, ent := range entries {
+		if err := discardDLQLua.Run(ctx, e.Rdb, []string{e.DLQKey, e.SysKey}, ent.ID, ent.Coins).Err(); err != nil {
+			out = append(out, DLQResult{ID: ent.ID, Error: err.Error()})
+			continue
+		}
+		out = append(out, DLQResult{ID: ent.ID, OK: true})
+	}
+	return out, nil
+}
+
+func dlqEntryFromMessage(m redis.XMessage) DLQEntry {
+	i64 := func(k string) int64 {
+		n, _ := strconv.ParseInt(asString(m.Values[k]), 10, 64)
+		return n
+	}
+	return DLQEntry{
+		ID:         m.ID,
+		OriginalID: asString(m.Values["original_id"]),
+		UserID:     i64("uid"),
+		Coins:      i64("coins"),
+		Taps:       i64("taps"),
+		Day:        asString(m.Values["day"]),
+		Req:        i64("req"),
+		RequestID:  asString(m.Values["rid"]),
+		Deliveries: i64("deliveries"),
+		Error:      asString(m.Values["error"]),
+		FailedAt:   i64("failed_at"),
+	}
+}
+
+// compareStreamIDs orders Redis stream ids ("ms-seq").
+func compareStreamIDs(a, b string) int {
+	am, as := splitStreamID(a)
+	bm, bs := splitStreamID(b)
+	switch {
+	case am < bm:
+		return -1
+	case am > bm:
+		return 1
+	case as < bs:
+		return -1
+	case as > bs:
+		return 1
+	}
+	return 0
+}
+
+func splitStreamID(id string) (uint64, uint64) {
+	ms, seq, _ := strings.Cut(id, "-")
+	a, _ := strconv.ParseUint(ms, 10, 64)
+	b, _ := strconv.ParseUint(seq, 10, 64)
+	return a, b
+}
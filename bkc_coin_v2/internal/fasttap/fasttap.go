@@ -10,10 +10,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"bkc_coin_v2/internal/config"
 	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/tapcore"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -36,6 +39,11 @@ type Engine struct {
 	StreamGroup    string
 	StreamConsumer string
 	StreamMaxLen   int64
+	DLQKey         string
+
+	DLQMaxDeliveries int64
+	ReconcileEvery   time.Duration
+	ReconcileApply   bool
 
 	WorkerCount       int
 	ReadCount         int64
@@ -48,18 +56,14 @@ type Engine struct {
 	HealthPendingScan int64
 
 	scriptTap *redis.Script
-}
 
-type TapResult struct {
-	Gained         int64
-	Reason         string
-	Energy         int64
-	EnergyMax      int64
-	DailyTapped    int64
-	DailyExtra     int64
-	DailyRemaining int64
+	stop     chan struct{} // closed by Stop
+	stopOnce sync.Once
+	running  sync.WaitGroup // workers and reconciler
 }
 
+var logger = logx.Component("fasttap")
+
 func Connect(ctx context.Context, redisURL string) (*redis.Client, error) {
 	redisURL = normalizeRedisURL(redisURL)
 	if redisURL == "" {
@@ -171,6 +175,17 @@ func New(cfg config.Config, database *db.DB, rdb *redis.Client) *Engine {
 	if claimMaxRounds > 50 {
 		claimMaxRounds = 50
 	}
+	dlqMaxDeliveries := envInt64("REDIS_STREAM_DLQ_MAX_DELIVERIES", 5)
+	if dlqMaxDeliveries < 1 {
+		dlqMaxDeliveries = 1
+	}
+	if dlqMaxDeliveries > 100 {
+		dlqMaxDeliveries = 100
+	}
+	reconcileEverySec := envInt64("FASTTAP_RECONCILE_EVERY_SEC", 600)
+	if reconcileEverySec > 0 && reconcileEverySec < 30 {
+		reconcileEverySec = 30
+	}
 	healthPendingScan := envInt64("REDIS_HEALTH_PENDING_SCAN", 20)
 	if healthPendingScan < 0 {
 		healthPendingScan = 0
@@ -188,6 +203,10 @@ func New(cfg config.Config, database *db.DB, rdb *redis.Client) *Engine {
 		StreamGroup:       group,
 		StreamConsumer:    consumer,
 		StreamMaxLen:      maxLen,
+		DLQKey:            streamKey + ":dlq",
+		DLQMaxDeliveries:  dlqMaxDeliveries,
+		ReconcileEvery:    time.Duration(reconcileEverySec) * time.Second,
+		ReconcileApply:    strings.TrimSpace(os.Getenv("FASTTAP_RECONCILE_APPLY")) == "1",
 		WorkerCount:       workerCount,
 		ReadCount:         readCount,
 		ReadBlock:         time.Duration(readBlockMs) * time.Millisecond,
@@ -198,12 +217,15 @@ func New(cfg config.Config, database *db.DB, rdb *redis.Client) *Engine {
 		ClaimMaxRounds:    claimMaxRounds,
 		HealthPendingScan: healthPendingScan,
 		scriptTap:         redis.NewScript(tapLua),
+		stop:              make(chan struct{}),
 	}
 	return e
 }
 
 func (e *Engine) Enabled() bool { return e != nil && e.Rdb != nil }
 
+func (e *Engine) Name() string { return "fasttap" }
+
 func (e *Engine) EnsureSystemCached(ctx context.Context) error {
 	if !e.Enabled() {
 		return nil
@@ -227,6 +249,34 @@ func (e *Engine) EnsureSystemCached(ctx context.Context) error {
 		"initial_reserve", sys.InitialReserve,
 		"start_rate", sys.StartRateCoinsUSD,
 		"min_rate", sys.MinRateCoinsUSD,
+		"tap_reward_bp", tapcore.NormalizeRewardBP(sys.TapRewardBP),
+		"halving_epoch", sys.CurrentHalving,
+	).Err()
+}
+
+// SetTapReward pushes the halving reward into the shared system hash; the
+// tap script reads it on every call, so all replicas switch together.
+func (e *Engine) SetTapReward(ctx context.Context, rewardBP, epoch int64) error {
+	if !e.Enabled() {
+		return nil
+	}
+	return e.Rdb.HSet(ctx, e.SysKey,
+		"tap_reward_bp", tapcore.NormalizeRewardBP(rewardBP),
+		"halving_epoch", epoch,
+	).Err()
+}
+
+// SetTapParams pushes the reloadable tap settings into the shared system
+// hash, where the tap script prefers them over its own arguments. Without it
+// a reload on one replica would leave the others on the old limits.
+func (e *Engine) SetTapParams(ctx context.Context, econ config.Economy) error {
+	if !e.Enabled() {
+		return nil
+	}
+	return e.Rdb.HSet(ctx, e.SysKey,
+		"regen_per_sec", strconv.FormatFloat(econ.EnergyRegenPerSec, 'f', 6, 64),
+		"daily_limit", econ.TapDailyLimit,
+		"energy_max", econ.EnergyMax,
 	).Err()
 }
 
@@ -248,6 +298,7 @@ func dayUTC(t time.Time) time.Time {
 }
 
 func (e *Engine) EnsureUserCached(ctx context.Context, userID int64, username, firstName string, now time.Time) error {
+	econ := config.Econ()
 	if !e.Enabled() {
 		return nil
 	}
@@ -263,7 +314,7 @@ func (e *Engine) EnsureUserCached(ctx context.Context, userID int64, username, f
 		return nil
 	}
 
-	u, err := e.DB.EnsureUser(ctx, userID, username, firstName, float64(e.Cfg.EnergyMax))
+	u, err := e.DB.EnsureUser(ctx, userID, username, firstName, float64(econ.EnergyMax))
 	if err != nil {
 		return err
 	}
@@ -279,12 +330,14 @@ func (e *Engine) EnsureUserCached(ctx context.Context, userID int64, username, f
 		"boost_until", u.EnergyBoostUntil.UTC().Unix(),
 		"boost_regen_mult", u.EnergyBoostRegenMultiplier,
 		"boost_max_mult", u.EnergyBoostMaxMultiplier,
+		"level", tapcore.NormalizeLevel(u.Level),
+		"tap_power", tapcore.NormalizePower(u.TapsPower),
 	).Err(); err != nil {
 		return err
 	}
 
 	// Cache daily counters for today (prevents easy bypass if Redis restarts mid-day).
-	if e.Cfg.TapDailyLimit > 0 {
+	if econ.TapDailyLimit > 0 {
 		ud, err := e.DB.GetUserDaily(ctx, userID, now)
 		if err != nil {
 			return err
@@ -301,22 +354,25 @@ func (e *Engine) EnsureUserCached(ctx context.Context, userID int64, username, f
 	return nil
 }
 
-func (e *Engine) Tap(ctx context.Context, userID int64, requested int64, now time.Time) (TapResult, error) {
+func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName string, requested int64, now time.Time) (tapcore.TapResult, error) {
+	econ := config.Econ()
 	if !e.Enabled() {
-		return TapResult{}, errors.New("fasttap disabled")
-	}
-	if requested <= 0 {
-		requested = 1
-	}
-	if requested > e.Cfg.TapMaxPerRequest {
-		requested = e.Cfg.TapMaxPerRequest
+		return tapcore.TapResult{}, errors.New("fasttap disabled")
 	}
+	requested = tapcore.ClampRequested(econ, requested)
 	if now.IsZero() {
 		now = time.Now().UTC()
 	}
 	now = now.UTC()
 	day := dayUTC(now)
 
+	if err := e.EnsureSystemCached(ctx); err != nil {
+		return tapcore.TapResult{}, fmt.Errorf("fasttap system: %w", err)
+	}
+	if err := e.EnsureUserCached(ctx, userID, username, firstName, now); err != nil {
+		return tapcore.TapResult{}, fmt.Errorf("fasttap user: %w", err)
+	}
+
 	userKey := e.userKey(userID)
 	dailyKey := e.dailyKey(userID, day)
 
@@ -327,22 +383,23 @@ func (e *Engine) Tap(ctx context.Context, userID int64, requested int64, now tim
 		[]string{userKey, dailyKey, e.SysKey, e.StreamKey},
 		now.Unix(),
 		requested,
-		fmt.Sprintf("%.6f", e.Cfg.EnergyRegenPerSec),
-		e.Cfg.TapDailyLimit,
-		e.Cfg.EnergyMax,
+		fmt.Sprintf("%.6f", econ.EnergyRegenPerSec),
+		econ.TapDailyLimit,
+		econ.EnergyMax,
 		e.StreamMaxLen,
 		coinPerTap,
 		userID,
 		day.Format("2006-01-02"),
 		ttlSec,
+		logx.RequestID(ctx),
 	).Result()
 	if err != nil {
-		return TapResult{}, err
+		return tapcore.TapResult{}, err
 	}
 
 	parts, ok := out.([]interface{})
-	if !ok || len(parts) < 7 {
-		return TapResult{}, errors.New("bad tap response")
+	if !ok || len(parts) < 9 {
+		return tapcore.TapResult{}, errors.New("bad tap response")
 	}
 
 	getI64 := func(i int) int64 {
@@ -376,8 +433,11 @@ func (e *Engine) Tap(ctx context.Context, userID int64, requested int64, now tim
 		}
 	}
 
-	res := TapResult{
-		Gained:         getI64(0),
+	res := tapcore.TapResult{
+		Gained:         getI64(7),
+		Taps:           getI64(0),
+		TapPower:       getI64(8),
+		RewardBP:       getI64(9),
 		Reason:         getStr(1),
 		Energy:         getI64(2),
 		EnergyMax:      getI64(3),
@@ -403,6 +463,24 @@ func (e *Engine) Tap(ctx context.Context, userID int64, requested int64, now tim
 	return res, nil
 }
 
+// Snapshot reads Postgres: Redis only caches energy and daily counters, and
+// balances are applied by the stream worker.
+func (e *Engine) Snapshot(ctx context.Context, u db.UserState, now time.Time) (tapcore.Snapshot, error) {
+	return tapcore.LoadSnapshot(ctx, config.Econ(), e.DB, u, now)
+}
+
+// InvalidateUser drops the cached energy hash; it is reseeded from Postgres on the next tap.
+// Daily counters are kept since Redis is ahead of Postgres for them.
+func (e *Engine) InvalidateUser(ctx context.Context, userID int64) {
+	if !e.Enabled() || userID <= 0 {
+		return
+	}
+	_ = e.Rdb.Del(ctx, e.userKey(userID)).Err()
+}
+
+// Flush is a no-op: taps are persisted asynchronously by the stream worker.
+func (e *Engine) Flush(ctx context.Context) error { return nil }
+
 func (e *Engine) UpdateEnergyBoost(ctx context.Context, userID int64, until time.Time, regenMult, maxMult float64, energy float64, energyMax float64, now time.Time) error {
 	if !e.Enabled() {
 		return nil
@@ -421,7 +499,7 @@ func (e *Engine) UpdateEnergyBoost(ctx context.Context, userID int64, until time
 		maxMult = 1
 	}
 	if energyMax <= 0 {
-		energyMax = float64(e.Cfg.EnergyMax)
+		energyMax = float64(config.Econ().EnergyMax)
 	}
 	energy = math.Max(0, math.Min(energy, energyMax*maxMult))
 	return e.Rdb.HSet(ctx, key,
@@ -434,6 +512,26 @@ func (e *Engine) UpdateEnergyBoost(ctx context.Context, userID int64, until time
 	).Err()
 }
 
+// setIfCachedLua updates hash fields only when the user is already cached;
+// a missing hash is seeded from Postgres on the next tap.
+var setIfCachedLua = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+redis.call('HSET', KEYS[1], unpack(ARGV))
+return 1
+`)
+
+// UpdateLevel refreshes level and tap power in the cached user hash without
+// touching its energy state.
+func (e *Engine) UpdateLevel(ctx context.Context, userID, level, power int64) error {
+	if !e.Enabled() || userID <= 0 {
+		return nil
+	}
+	return setIfCachedLua.Run(ctx, e.Rdb, []string{e.userKey(userID)},
+		"level", tapcore.NormalizeLevel(level),
+		"tap_power", tapcore.NormalizePower(power),
+	).Err()
+}
+
 func (e *Engine) AddDailyExtraQuota(ctx context.Context, userID int64, day time.Time, extra int64) error {
 	if !e.Enabled() || extra == 0 || userID <= 0 {
 		return nil
@@ -461,7 +559,7 @@ func (e *Engine) AdjustReserved(ctx context.Context, delta int64) error {
 	return e.Rdb.HIncrBy(ctx, e.SysKey, "reserved_supply", delta).Err()
 }
 
-func (e *Engine) QueueStats(ctx context.Context) map[string]any {
+func (e *Engine) Stats(ctx context.Context) map[string]any {
 	out := map[string]any{
 		"enabled":      e.Enabled(),
 		"stream_key":   e.StreamKey,
@@ -473,6 +571,17 @@ func (e *Engine) QueueStats(ctx context.Context) map[string]any {
 	if xlen, err := e.Rdb.XLen(ctx, e.StreamKey).Result(); err == nil {
 		out["stream_len"] = xlen
 	}
+	if dlqLen, err := e.Rdb.XLen(ctx, e.DLQKey).Result(); err == nil {
+		out["dlq_len"] = dlqLen
+	}
+	// Lag is how many stream entries the group has not read yet (Redis 7+).
+	if groups, err := e.Rdb.XInfoGroups(ctx, e.StreamKey).Result(); err == nil {
+		for _, g := range groups {
+			if g.Name == e.StreamGroup {
+				out["stream_lag"] = g.Lag
+			}
+		}
+	}
 	if p, err := e.Rdb.XPending(ctx, e.StreamKey, e.StreamGroup).Result(); err == nil {
 		out["pending_count"] = p.Count
 		out["pending_consumers"] = len(p.Consumers)
@@ -1,10 +1,14 @@
 package fasttap
 
 // Lua script notes:
-// - Uses user hash for energy state (float), boost params, updated_at timestamp
+// - Uses user hash for energy state (float), boost params, updated_at timestamp, tap_power
+// - ARGV coinPerTap is only the fallback when the hash has no tap_power
 // - Uses daily hash for counters (tapped, extra_quota)
-// - Uses system hash for reserve_supply / reserved_supply checks
-// - Emits a compact event to a Redis Stream for async persistence
+// - Uses system hash for reserve_supply / reserved_supply checks and tap_reward_bp (halving)
+// - Keeps the user's unpaid fraction of a coin in the user hash as reward_carry
+// - Emits an event for every tap that consumed energy, even with 0 coins, so taps persist
+// - System hash regen_per_sec / daily_limit / energy_max (config reload) win over ARGV
+// - Emits a compact event to a Redis Stream for async persistence ("rid" is the /tap request ID)
 const tapLua = `
 local userKey = KEYS[1]
 local dailyKey = KEYS[2]
@@ -21,6 +25,7 @@ local coinPerTap = tonumber(ARGV[7])
 local userID = tostring(ARGV[8])
 local dayStr = tostring(ARGV[9])
 local dailyTTL = tonumber(ARGV[10])
+local requestID = tostring(ARGV[11] or '')
 
 if requested == nil or requested <= 0 then requested = 1 end
 if baseRegen == nil or baseRegen < 0 then baseRegen = 0 end
@@ -30,6 +35,12 @@ if streamMaxLen == nil or streamMaxLen < 10000 then streamMaxLen = 10000 end
 if coinPerTap == nil or coinPerTap <= 0 then coinPerTap = 1 end
 if dailyTTL == nil or dailyTTL <= 0 then dailyTTL = 259200 end
 
+-- Economy pushed by SetTapParams, so replicas agree between reloads.
+local params = redis.call('HMGET', sysKey, 'regen_per_sec', 'daily_limit', 'energy_max')
+if tonumber(params[1]) ~= nil and tonumber(params[1]) >= 0 then baseRegen = tonumber(params[1]) end
+if tonumber(params[2]) ~= nil then dailyLimit = tonumber(params[2]) end
+if tonumber(params[3]) ~= nil and tonumber(params[3]) >= 0 then defaultEnergyMax = tonumber(params[3]) end
+
 -- Load user energy state.
 local energy = tonumber(redis.call('HGET', userKey, 'energy') or '0')
 local energyMax = tonumber(redis.call('HGET', userKey, 'energy_max') or tostring(defaultEnergyMax))
@@ -38,6 +49,7 @@ local updatedAt = tonumber(redis.call('HGET', userKey, 'energy_updated_at') or t
 local boostUntil = tonumber(redis.call('HGET', userKey, 'boost_until') or '0')
 local regenMult = tonumber(redis.call('HGET', userKey, 'boost_regen_mult') or '1')
 local maxMult = tonumber(redis.call('HGET', userKey, 'boost_max_mult') or '1')
+local tapPower = tonumber(redis.call('HGET', userKey, 'tap_power') or tostring(coinPerTap))
 
 if energy == nil then energy = 0 end
 if energyMax == nil then energyMax = defaultEnergyMax end
@@ -45,6 +57,8 @@ if updatedAt == nil then updatedAt = now end
 if boostUntil == nil then boostUntil = 0 end
 if regenMult == nil or regenMult <= 0 then regenMult = 1 end
 if maxMult == nil or maxMult <= 0 then maxMult = 1 end
+if tapPower == nil or tapPower < 1 then tapPower = coinPerTap end
+coinPerTap = math.floor(tapPower)
 
 local eMax = energyMax
 local eRegen = baseRegen
@@ -78,6 +92,15 @@ if dailyLimit ~= nil and dailyLimit > 0 then
   if remainingDaily < 0 then remainingDaily = 0 end
 end
 
+-- Halving reward in basis points of a coin per unit of tap power (see
+-- tapcore.MintCoins); the unpaid fraction carries over between calls.
+local rewardBP = tonumber(redis.call('HGET', sysKey, 'tap_reward_bp') or '10000')
+if rewardBP == nil or rewardBP < 1 then rewardBP = 10000 end
+rewardBP = math.floor(rewardBP)
+local carry = tonumber(redis.call('HGET', userKey, 'reward_carry') or '0')
+if carry == nil or carry < 0 then carry = 0 end
+local perTap = coinPerTap * rewardBP
+
 -- System reserve (respect reserved_supply).
 local reserve = tonumber(redis.call('HGET', sysKey, 'reserve_supply') or '0')
 local reserved = tonumber(redis.call('HGET', sysKey, 'reserved_supply') or '0')
@@ -85,7 +108,7 @@ if reserve == nil then reserve = 0 end
 if reserved == nil then reserved = 0 end
 local availableReserve = reserve - reserved
 if availableReserve < 0 then availableReserve = 0 end
-local reserveTaps = math.floor(availableReserve / coinPerTap)
+local reserveTaps = math.floor((availableReserve * 10000 + 9999 - carry) / perTap)
 if reserveTaps < 0 then reserveTaps = 0 end
 
 local gained = requested
@@ -119,8 +142,10 @@ if dailyLimit ~= nil and dailyLimit > 0 then
   redis.call('EXPIRE', dailyKey, dailyTTL)
 end
 
-local coins = gained * coinPerTap
-if coins > 0 then
+local units = gained * perTap + carry
+local coins = math.floor(units / 10000)
+if gained > 0 then
+  redis.call('HSET', userKey, 'reward_carry', units - coins * 10000)
   redis.call('HINCRBY', sysKey, 'reserve_supply', -coins)
   local id = redis.call('XADD', streamKey, 'MAXLEN', '~', streamMaxLen, '*',
     'kind', 'tap',
@@ -129,7 +154,8 @@ if coins > 0 then
     'coins', tostring(coins),
     'day', dayStr,
     'ts', tostring(now),
-    'req', tostring(requested)
+    'req', tostring(requested),
+    'rid', requestID
   )
 end
 
@@ -145,5 +171,5 @@ else
   outRemaining = 9223372036854775807
 end
 
-return {tostring(gained), reason, tostring(outEnergy), tostring(outEnergyMax), tostring(outTapped), tostring(outExtra), tostring(outRemaining)}
+return {tostring(gained), reason, tostring(outEnergy), tostring(outEnergyMax), tostring(outTapped), tostring(outExtra), tostring(outRemaining), tostring(coins), tostring(coinPerTap), tostring(rewardBP)}
 `
@@ -0,0 +1,436 @@
+package fasttap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/tapcore"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Reconciliation compares the Redis caches (system hash, per-user energy hash
+// and today's daily counters) with Postgres. It only runs when the stream is
+// drained and no new tap arrived while comparing, so both sides describe the
+// same set of applied events. Postgres wins: in apply mode Redis is rewritten
+// and every correction is recorded in the ledger as "fasttap_reconcile".
+
+var ErrStreamBusy = errors.New("fasttap stream not drained")
+
+type ReconcileDiff struct {
+	Key      string `json:"key"`
+	Field    string `json:"field"`
+	UserID   int64  `json:"user_id,omitempty"`
+	Redis    string `json:"redis"`
+	Postgres string `json:"postgres"`
+	Applied  bool   `json:"applied"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ReconcileReport struct {
+	Apply        bool            `json:"apply"`
+	StartedAt    int64           `json:"started_at"`
+	FinishedAt   int64           `json:"finished_at"`
+	UsersScanned int             `json:"users_scanned"`
+	DLQCoins     int64           `json:"dlq_coins"`
+	Diffs        []ReconcileDiff `json:"diffs"`
+}
+
+// StartReconciler runs Reconcile every ReconcileEvery. Without
+// ReconcileApply it only logs drift.
+func (e *Engine) StartReconciler(ctx context.Context) {
+	if !e.Enabled() || e.DB == nil || e.ReconcileEvery <= 0 {
+		return
+	}
+	apply := e.ReconcileApply
+	e.running.Add(1)
+	go func() {
+		defer e.running.Done()
+		ticker := time.NewTicker(e.ReconcileEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				runCtx := logx.WithRequestID(ctx, "")
+				rep, err := e.Reconcile(runCtx, apply, nil)
+				if err != nil {
+					if !errors.Is(err, ErrStreamBusy) {
+						logger.ErrorContext(runCtx, "reconcile failed", "err", err)
+					}
+					continue
+				}
+				if len(rep.Diffs) > 0 {
+					logger.WarnContext(runCtx, "reconcile found differences", "diffs", len(rep.Diffs), "apply", apply, "users", rep.UsersScanned)
+				}
+			}
+		}
+	}()
+}
+
+type streamMark struct {
+	lastID  string
+	drained bool
+}
+
+func (e *Engine) streamMark(ctx context.Context) (streamMark, error) {
+	info, err := e.Rdb.XInfoStream(ctx, e.StreamKey).Result()
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "no such key") {
+			return streamMark{drained: true}, nil
+		}
+		return streamMark{}, err
+	}
+	groups, err := e.Rdb.XInfoGroups(ctx, e.StreamKey).Result()
+	if err != nil {
+		return streamMark{}, err
+	}
+	drained := info.Length == 0
+	for _, g := range groups {
+		if g.Name != e.StreamGroup {
+			continue
+		}
+		drained = g.Pending == 0 && (info.Length == 0 || g.LastDeliveredID == info.LastGeneratedID)
+	}
+	return streamMark{lastID: info.LastGeneratedID, drained: drained}, nil
+}
+
+// Reconcile compares Redis with Postgres and, with apply, corrects Redis.
+// confirm, if set, sees the diffs before they are applied (the audit log
+// records them there); its error aborts the run with nothing applied.
+func (e *Engine) Reconcile(ctx context.Context, apply bool, confirm func(context.Context, []ReconcileDiff) error) (ReconcileReport, error) {
+	rep := ReconcileReport{Apply: apply, StartedAt: time.Now().UTC().Unix(), Diffs: []ReconcileDiff{}}
+	if !e.Enabled() || e.DB == nil {
+		return rep, errors.New("fasttap disabled")
+	}
+
+	before, err := e.streamMark(ctx)
+	if err != nil {
+		return rep, err
+	}
+	if !before.drained {
+		return rep, ErrStreamBusy
+	}
+
+	// Dead-lettered events were minted in Redis but never reached Postgres.
+	dlqCoins, dlqTaps, err := e.dlqTotals(ctx)
+	if err != nil {
+		return rep, err
+	}
+	rep.DLQCoins = dlqCoins
+
+	var diffs []ReconcileDiff
+	sysDiffs, err := e.compareSystem(ctx, dlqCoins)
+	if err != nil {
+		return rep, err
+	}
+	diffs = append(diffs, sysDiffs...)
+
+	now := time.Now().UTC()
+	var cursor uint64
+	for {
+		keys, next, err := e.Rdb.Scan(ctx, cursor, "bkc:u:*", 500).Result()
+		if err != nil {
+			return rep, err
+		}
+		userIDs := make([]int64, 0, len(keys))
+		for _, k := range keys {
+			uid, err := strconv.ParseInt(strings.TrimPrefix(k, "bkc:u:"), 10, 64)
+			if err == nil && uid > 0 {
+				userIDs = append(userIDs, uid)
+			}
+		}
+		userDiffs, err := e.compareUsers(ctx, userIDs, now, dlqTaps)
+		if err != nil {
+			return rep, err
+		}
+		diffs = append(diffs, userDiffs...)
+		rep.UsersScanned += len(userIDs)
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	after, err := e.streamMark(ctx)
+	if err != nil {
+		return rep, err
+	}
+	if !after.drained || after.lastID != before.lastID {
+		return rep, ErrStreamBusy
+	}
+
+	if apply && len(diffs) > 0 && confirm != nil {
+		if err := confirm(ctx, diffs); err != nil {
+			return rep, err
+		}
+	}
+	if apply {
+		for i := range diffs {
+			e.applyDiff(ctx, &diffs[i])
+		}
+	}
+	rep.Diffs = append(rep.Diffs, diffs...)
+	rep.FinishedAt = time.Now().UTC().Unix()
+	return rep, nil
+}
+
+func (e *Engine) dlqTotals(ctx context.Context) (int64, map[string]int64, error) {
+	var coins int64
+	taps := map[string]int64{}
+	start := "-"
+	for {
+		msgs, err := e.Rdb.XRangeN(ctx, e.DLQKey, start, "+", 1000).Result()
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, m := range msgs {
+			ent := dlqEntryFromMessage(m)
+			coins += ent.Coins
+			taps[fmt.Sprintf("%d:%s", ent.UserID, ent.Day)] += ent.Taps
+		}
+		if len(msgs) < 1000 {
+			return coins, taps, nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
+
+func (e *Engine) compareSystem(ctx context.Context, dlqCoins int64) ([]ReconcileDiff, error) {
+	vals, err := e.Rdb.HMGet(ctx, e.SysKey, "reserve_supply", "reserved_supply", "tap_reward_bp").Result()
+	if err != nil {
+		return nil, err
+	}
+	sys, err := e.DB.GetSystem(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []ReconcileDiff
+	check := func(field string, raw any, want int64) {
+		got, ok := parseRedisInt(raw)
+		if ok && got == want {
+			return
+		}
+		out = append(out, ReconcileDiff{
+			Key:      e.SysKey,
+			Field:    field,
+			Redis:    asString(raw),
+			Postgres: strconv.FormatInt(want, 10),
+		})
+	}
+	check("reserve_supply", vals[0], sys.ReserveSupply-dlqCoins)
+	check("reserved_supply", vals[1], sys.ReservedSupply)
+	check("tap_reward_bp", vals[2], tapcore.NormalizeRewardBP(sys.TapRewardBP))
+	return out, nil
+}
+
+func (e *Engine) compareUsers(ctx context.Context, userIDs []int64, now time.Time, dlqTaps map[string]int64) ([]ReconcileDiff, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+	day := dayUTC(now)
+	dayStr := day.Format("2006-01-02")
+
+	type pgUser struct {
+		energyMax  float64
+		boostUntil int64
+		regenMult  float64
+		maxMult    float64
+		level      int64
+		power      int64
+		tapped     int64
+		extra      int64
+	}
+	pg := make(map[int64]*pgUser, len(userIDs))
+	rows, err := e.DB.Pool.Query(ctx, `
+SELECT u.user_id, u.energy_max,
+       EXTRACT(EPOCH FROM COALESCE(u.energy_boost_until, to_timestamp(0)))::bigint,
+       u.energy_boost_regen_multiplier, u.energy_boost_max_multiplier,
+       u.level, u.taps_power,
+       d.tapped, d.extra_quota
+FROM users u
+LEFT JOIN user_daily d ON d.user_id = u.user_id AND d.day = $2
+WHERE u.user_id = ANY($1)
+`, userIDs, day)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var uid int64
+		var p pgUser
+		var tapped, extra *int64
+		if err := rows.Scan(&uid, &p.energyMax, &p.boostUntil, &p.regenMult, &p.maxMult, &p.level, &p.power, &tapped, &extra); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if tapped != nil {
+			p.tapped = *tapped
+		}
+		if extra != nil {
+			p.extra = *extra
+		}
+		p.level = tapcore.NormalizeLevel(p.level)
+		p.power = tapcore.NormalizePower(p.power)
+		pg[uid] = &p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	pipe := e.Rdb.Pipeline()
+	userCmds := make([]*redis.SliceCmd, len(userIDs))
+	dailyCmds := make([]*redis.SliceCmd, len(userIDs))
+	for i, uid := range userIDs {
+		userCmds[i] = pipe.HMGet(ctx, e.userKey(uid), "energy_max", "boost_until", "boost_regen_mult", "boost_max_mult", "level", "tap_power")
+		dailyCmds[i] = pipe.HMGet(ctx, e.dailyKey(uid, day), "tapped", "extra_quota")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	var out []ReconcileDiff
+	for i, uid := range userIDs {
+		p := pg[uid]
+		if p == nil {
+			out = append(out, ReconcileDiff{Key: e.userKey(uid), Field: "*", UserID: uid, Redis: "cached", Postgres: "missing"})
+			continue
+		}
+		uk := e.userKey(uid)
+		uv := userCmds[i].Val()
+		if len(uv) == 6 {
+			checkFloat := func(field string, raw any, want float64) {
+				if raw == nil {
+					return
+				}
+				got, err := strconv.ParseFloat(asString(raw), 64)
+				if err == nil && math.Abs(got-want) < 1e-6 {
+					return
+				}
+				out = append(out, ReconcileDiff{Key: uk, Field: field, UserID: uid, Redis: asString(raw), Postgres: strconv.FormatFloat(want, 'f', -1, 64)})
+			}
+			checkFloat("energy_max", uv[0], p.energyMax)
+			if uv[1] != nil {
+				if got, ok := parseRedisInt(uv[1]); !ok || got != p.boostUntil {
+					out = append(out, ReconcileDiff{Key: uk, Field: "boost_until", UserID: uid, Redis: asString(uv[1]), Postgres: strconv.FormatInt(p.boostUntil, 10)})
+				}
+			}
+			checkFloat("boost_regen_mult", uv[2], p.regenMult)
+			checkFloat("boost_max_mult", uv[3], p.maxMult)
+			checkInt := func(field string, raw any, want int64) {
+				if raw == nil {
+					return
+				}
+				if got, ok := parseRedisInt(raw); ok && got == want {
+					return
+				}
+				out = append(out, ReconcileDiff{Key: uk, Field: field, UserID: uid, Redis: asString(raw), Postgres: strconv.FormatInt(want, 10)})
+			}
+			checkInt("level", uv[4], p.level)
+			checkInt("tap_power", uv[5], p.power)
+		}
+
+		dv := dailyCmds[i].Val()
+		if len(dv) == 2 && dv[0] != nil {
+			dk := e.dailyKey(uid, day)
+			wantTapped := p.tapped + dlqTaps[fmt.Sprintf("%d:%s", uid, dayStr)]
+			if got, ok := parseRedisInt(dv[0]); !ok || got != wantTapped {
+				out = append(out, ReconcileDiff{Key: dk, Field: "tapped", UserID: uid, Redis: asString(dv[0]), Postgres: strconv.FormatInt(wantTapped, 10)})
+			}
+			if dv[1] != nil {
+				if got, ok := parseRedisInt(dv[1]); !ok || got != p.extra {
+					out = append(out, ReconcileDiff{Key: dk, Field: "extra_quota", UserID: uid, Redis: asString(dv[1]), Postgres: strconv.FormatInt(p.extra, 10)})
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// casFieldLua sets a hash field only if it still holds the value the
+// comparison saw ("" = missing). A tap that ran the script since then has
+// changed the field; overwriting it would lose that tap, so the diff is
+// skipped and the next run compares again.
+var casFieldLua = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+if cur == false then cur = '' end
+if cur ~= ARGV[2] then return 0 end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+return 1
+`)
+
+var errChangedSinceCompare = errors.New("value changed since compare, skipped")
+
+func (e *Engine) applyDiff(ctx context.Context, d *ReconcileDiff) {
+	if d.Field == "*" {
+		// User row is gone from Postgres: drop the stale cache.
+		if err := e.Rdb.Del(ctx, d.Key).Err(); err != nil {
+			d.Error = err.Error()
+			return
+		}
+	} else {
+		ok, err := casFieldLua.Run(ctx, e.Rdb, []string{d.Key}, d.Field, d.Redis, d.Postgres).Int()
+		if err != nil {
+			d.Error = err.Error()
+			return
+		}
+		if ok == 0 {
+			d.Error = errChangedSinceCompare.Error()
+			return
+		}
+	}
+	d.Applied = true
+
+	// Only the Redis cache changes. reserve_supply is the only coin amount:
+	// its row carries |delta| and meta.delta keeps the sign. Counters,
+	// levels and the like are not money, so their rows have amount 0 with
+	// the user as to_id and the change in meta.delta only.
+	var delta int64
+	got, err1 := strconv.ParseInt(d.Redis, 10, 64)
+	want, err2 := strconv.ParseInt(d.Postgres, 10, 64)
+	if err1 == nil && err2 == nil {
+		delta = want - got
+	}
+	var amount int64
+	if d.Field == "reserve_supply" {
+		amount = delta
+		if amount < 0 {
+			amount = -amount
+		}
+	}
+	meta := map[string]any{
+		"key":      d.Key,
+		"field":    d.Field,
+		"redis":    d.Redis,
+		"postgres": d.Postgres,
+		"delta":    delta,
+	}
+	if err := e.DB.RecordLedger(ctx, "fasttap_reconcile", 0, d.UserID, amount, meta); err != nil {
+		d.Error = "ledger: " + err.Error()
+	}
+}
+
+func parseRedisInt(raw any) (int64, bool) {
+	s := strings.TrimSpace(asString(raw))
+	if s == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil {
+			return 0, false
+		}
+		return int64(f), true
+	}
+	return n, true
+}
@@ -3,16 +3,24 @@ package fasttap
 import (
 	"context"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"time"
 
 	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/lifecycle"
+	"bkc_coin_v2/internal/metrics"
 
 	"github.com/redis/go-redis/v9"
 )
 
+var (
+	applySeconds = metrics.Default.Histogram("bkc_fasttap_apply_duration_seconds",
+		"Time to apply one chunk of stream events to Postgres, by result.", metrics.DefBuckets, "result")
+	appliedEvents = metrics.Default.Counter("bkc_fasttap_applied_events_total",
+		"Tap events from the stream applied to Postgres.")
+)
+
 func (e *Engine) StartWorker(ctx context.Context) {
 	if !e.Enabled() || e.DB == nil {
 		return
@@ -20,26 +28,50 @@ func (e *Engine) StartWorker(ctx context.Context) {
 	// Create consumer group (idempotent).
 	if err := e.Rdb.XGroupCreateMkStream(ctx, e.StreamKey, e.StreamGroup, "$").Err(); err != nil {
 		if !strings.Contains(strings.ToLower(err.Error()), "busygroup") {
-			log.Printf("fasttap: XGROUP CREATE error: %v", err)
+			logger.ErrorContext(ctx, "XGROUP CREATE failed", "err", err)
 		}
 	}
+	// Stop ends reads; batches already read are applied with ctx.
+	readCtx, cancelRead := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-e.stop:
+		case <-readCtx.Done():
+		}
+		cancelRead()
+	}()
 	for i := 0; i < e.WorkerCount; i++ {
 		consumer := fmt.Sprintf("%s-%d", e.StreamConsumer, i+1)
 		enableClaim := i == 0
-		go e.workerLoop(ctx, consumer, enableClaim)
+		e.running.Add(1)
+		go func() {
+			defer e.running.Done()
+			e.workerLoop(ctx, readCtx, consumer, enableClaim)
+		}()
 	}
 }
 
-func (e *Engine) workerLoop(ctx context.Context, consumer string, enableClaim bool) {
+// Stop stops the workers and the reconciler from taking new work and waits
+// until the workers have applied and acked the batch in hand. A batch cut
+// off by ctx stays pending in the group and is claimed after restart.
+func (e *Engine) Stop(ctx context.Context) error {
+	if !e.Enabled() {
+		return nil
+	}
+	e.stopOnce.Do(func() { close(e.stop) })
+	return lifecycle.WaitGroup(ctx, &e.running)
+}
+
+func (e *Engine) workerLoop(ctx, readCtx context.Context, consumer string, enableClaim bool) {
 	nextClaimAt := time.Now().Add(e.ClaimEvery)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
+	maybeClaim := func() {
+		if enableClaim && readCtx.Err() == nil && time.Now().After(nextClaimAt) {
+			e.claimPending(ctx, consumer)
+			nextClaimAt = time.Now().Add(e.ClaimEvery)
 		}
-
-		res, err := e.Rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+	}
+	for readCtx.Err() == nil {
+		res, err := e.Rdb.XReadGroup(readCtx, &redis.XReadGroupArgs{
 			Group:    e.StreamGroup,
 			Consumer: consumer,
 			Streams:  []string{e.StreamKey, ">"},
@@ -47,27 +79,15 @@ func (e *Engine) workerLoop(ctx context.Context, consumer string, enableClaim bo
 			Block:    e.ReadBlock,
 		}).Result()
 		if err != nil {
-			if err == redis.Nil {
-				if enableClaim && time.Now().After(nextClaimAt) {
-					e.claimPending(ctx, consumer)
-					nextClaimAt = time.Now().Add(e.ClaimEvery)
-				}
-				continue
+			if readCtx.Err() != nil {
+				return
 			}
-			// transient
-			log.Printf("fasttap: XREADGROUP error: %v", err)
-			time.Sleep(750 * time.Millisecond)
-			if enableClaim && time.Now().After(nextClaimAt) {
-				e.claimPending(ctx, consumer)
-				nextClaimAt = time.Now().Add(e.ClaimEvery)
-			}
-			continue
-		}
-		if len(res) == 0 {
-			if enableClaim && time.Now().After(nextClaimAt) {
-				e.claimPending(ctx, consumer)
-				nextClaimAt = time.Now().Add(e.ClaimEvery)
+			if err != redis.Nil {
+				// transient
+				logger.WarnContext(ctx, "XREADGROUP failed", "err", err)
+				time.Sleep(750 * time.Millisecond)
 			}
+			maybeClaim()
 			continue
 		}
 
@@ -80,11 +100,7 @@ func (e *Engine) workerLoop(ctx context.Context, consumer string, enableClaim bo
 				time.Sleep(250 * time.Millisecond)
 			}
 		}
-
-		if enableClaim && time.Now().After(nextClaimAt) {
-			e.claimPending(ctx, consumer)
-			nextClaimAt = time.Now().Add(e.ClaimEvery)
-		}
+		maybeClaim()
 	}
 }
 
@@ -101,7 +117,7 @@ func (e *Engine) claimPending(ctx context.Context, consumer string) {
 		}).Result()
 		if err != nil {
 			if err != redis.Nil {
-				log.Printf("fasttap: XAUTOCLAIM error: %v", err)
+				logger.WarnContext(ctx, "XAUTOCLAIM failed", "err", err)
 			}
 			return
 		}
@@ -117,8 +133,9 @@ func (e *Engine) claimPending(ctx context.Context, consumer string) {
 }
 
 type queuedTap struct {
-	id string
-	ev db.TapEvent
+	id  string
+	rid string // request ID of the /tap call that emitted the event
+	ev  db.TapEvent
 }
 
 func (e *Engine) processMessages(ctx context.Context, msgs []redis.XMessage) bool {
@@ -144,13 +161,16 @@ func (e *Engine) processMessages(ctx context.Context, msgs []redis.XMessage) boo
 		coins, _ := strconv.ParseInt(asString(msg.Values["coins"]), 10, 64)
 		taps, _ := strconv.ParseInt(asString(msg.Values["taps"]), 10, 64)
 		req, _ := strconv.ParseInt(asString(msg.Values["req"]), 10, 64)
+		rid := asString(msg.Values["rid"])
 		day := strings.TrimSpace(asString(msg.Values["day"]))
-		if uid <= 0 || coins <= 0 || taps <= 0 || day == "" {
+		// coins may be 0: after a halving a small tap can only grow the carry.
+		if uid <= 0 || coins < 0 || taps <= 0 || day == "" {
 			ackNow = append(ackNow, msg.ID)
 			continue
 		}
 		tapBatch = append(tapBatch, queuedTap{
-			id: msg.ID,
+			id:  msg.ID,
+			rid: rid,
 			ev: db.TapEvent{
 				EventID: msg.ID,
 				UserID:  uid,
@@ -180,13 +200,32 @@ func (e *Engine) processMessages(ctx context.Context, msgs []redis.XMessage) boo
 			ackIDs = append(ackIDs, x.id)
 		}
 
+		start := time.Now()
 		if err := e.DB.ApplyTapEvents(ctx, events); err != nil {
-			log.Printf("fasttap: apply events error: %v", err)
-			return false
+			applySeconds.With("error").Since(start)
+			logger.WarnContext(ctx, "apply events failed", "events", len(events), "first_id", part[0].id, "err", err)
+			// Bisect only once some event in the chunk has been redelivered enough times;
+			// until then keep the whole chunk pending (usually a transient DB error).
+			deliveries := e.deliveryCounts(ctx, part)
+			var maxDeliveries int64
+			for _, n := range deliveries {
+				if n > maxDeliveries {
+					maxDeliveries = n
+				}
+			}
+			if maxDeliveries < e.DLQMaxDeliveries {
+				return false
+			}
+			if !e.applyOrIsolate(ctx, part, deliveries) {
+				return false
+			}
+			continue
 		}
+		applySeconds.With("ok").Since(start)
+		appliedEvents.With().Add(float64(len(events)))
 		if len(ackIDs) > 0 {
 			if err := e.Rdb.XAck(ctx, e.StreamKey, e.StreamGroup, ackIDs...).Err(); err != nil {
-				log.Printf("fasttap: XACK error: %v", err)
+				logger.WarnContext(ctx, "XACK failed", "err", err)
 				return false
 			}
 		}
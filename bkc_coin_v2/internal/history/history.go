@@ -0,0 +1,283 @@
+package history
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/db"
+)
+
+// Item is a ledger row from one user's point of view.
+type Item struct {
+	ID          int64          `json:"id"`
+	TS          int64          `json:"ts"`
+	Kind        string         `json:"kind"`
+	Amount      int64          `json:"amount"` // signed: + credited to the user, - debited
+	Counterpart int64          `json:"counterpart,omitempty"`
+	Description string         `json:"description"`
+	Meta        map[string]any `json:"meta,omitempty"`
+}
+
+func FromEntry(e db.LedgerEntry, userID int64) Item {
+	it := Item{
+		ID:          e.ID,
+		TS:          e.TS.Unix(),
+		Kind:        e.Kind,
+		Amount:      e.Amount,
+		Description: Describe(e, userID),
+		Meta:        e.Meta,
+	}
+	if e.FromID == userID && e.ToID != userID {
+		it.Amount = -e.Amount
+		it.Counterpart = e.ToID
+	} else {
+		it.Counterpart = e.FromID
+	}
+	return it
+}
+
+func metaInt(m map[string]any, key string) (int64, bool) {
+	switch v := m[key].(type) {
+	case float64:
+		return int64(v), true
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func metaStr(m map[string]any, key string) string {
+	if s, ok := m[key].(string); ok {
+		return s
+	}
+	if n, ok := metaInt(m, key); ok {
+		return strconv.FormatInt(n, 10)
+	}
+	return ""
+}
+
+// Describe renders a short human-readable line for the entry.
+func Describe(e db.LedgerEntry, userID int64) string {
+	m := e.Meta
+	outgoing := e.FromID == userID
+	switch e.Kind {
+	case "tap":
+		if n, ok := metaInt(m, "taps"); ok {
+			return fmt.Sprintf("Майнинг: %d тапов", n)
+		}
+		return "Майнинг"
+	case "transfer":
+		var line string
+		if id := metaStr(m, "standing_order_id"); id != "" {
+			line = "Автоплатёж #" + id + ": "
+		}
+		if outgoing {
+			line += fmt.Sprintf("Перевод пользователю %d", e.ToID)
+			if fee, ok := metaInt(m, "fee"); ok && fee > 0 {
+				line += fmt.Sprintf(" (комиссия %d)", fee)
+			}
+		} else {
+			line += fmt.Sprintf("Перевод от %d", e.FromID)
+		}
+		if memo := metaStr(m, "memo"); memo != "" {
+			line += ": " + memo
+		}
+		return line
+	case "transfer_fee":
+		return "Комиссия за перевод пользователю " + metaStr(m, "to_id")
+	case "transfer_fee_burn":
+		return "Комиссия за перевод пользователю " + metaStr(m, "to_id") + " (сожжена)"
+	case "ref_bonus":
+		if n, ok := metaInt(m, "count"); ok {
+			return fmt.Sprintf("Реферальный бонус (приглашено: %d)", n)
+		}
+		return "Реферальный бонус"
+	case "admin_reserve_send", "admin_add":
+		return "Начисление от администрации"
+	case "admin_remove":
+		return "Списание администрацией"
+	case "genesis_admin":
+		return "Стартовое распределение"
+	case "cryptopay_deposit":
+		return "Пополнение через CryptoBot, счёт #" + metaStr(m, "invoice_id")
+	case "cryptopay_invoice":
+		return fmt.Sprintf("Счёт CryptoBot #%s на $%s", metaStr(m, "invoice_id"), metaStr(m, "usd"))
+	case "cryptopay_release":
+		return "Счёт CryptoBot #" + metaStr(m, "invoice_id") + " закрыт без оплаты"
+	case "deposit_create":
+		return fmt.Sprintf("Заявка на пополнение #%s: %s %s", metaStr(m, "deposit_id"), metaStr(m, "usd"), metaStr(m, "currency"))
+	case "deposit_approve":
+		return "Пополнение #" + metaStr(m, "deposit_id") + " подтверждено"
+	case "deposit_reject":
+		return "Пополнение #" + metaStr(m, "deposit_id") + " отклонено"
+	case "buy_energy_1h":
+		return "Покупка: буст энергии на 1 час"
+	case "buy_tap_pack":
+		if n, ok := metaInt(m, "pack_size"); ok {
+			return fmt.Sprintf("Покупка: +%d тапов на день", n)
+		}
+		return "Покупка: пакет тапов"
+	case "upgrade_level":
+		if n, ok := metaInt(m, "level"); ok {
+			return fmt.Sprintf("Повышение уровня до %d", n)
+		}
+		return "Повышение уровня"
+	case "nft_buy":
+		return "Покупка NFT #" + metaStr(m, "nft_id")
+	case "bank_loan_issue":
+		return "Кредит банка #" + metaStr(m, "loan_id")
+	case "bank_loan_repay":
+		return "Погашение кредита #" + metaStr(m, "loan_id")
+	case "bank_loan_overdue":
+		return "Просрочка кредита #" + metaStr(m, "loan_id") + ": долг списан"
+	case "p2p_loan_issue":
+		if outgoing {
+			return fmt.Sprintf("Займ #%s выдан пользователю %d", metaStr(m, "loan_id"), e.ToID)
+		}
+		return fmt.Sprintf("Займ #%s получен от %d", metaStr(m, "loan_id"), e.FromID)
+	case "p2p_loan_repay", "p2p_loan_recall":
+		if outgoing {
+			return fmt.Sprintf("Возврат займа #%s пользователю %d", metaStr(m, "loan_id"), e.ToID)
+		}
+		return fmt.Sprintf("Возврат займа #%s от %d", metaStr(m, "loan_id"), e.FromID)
+	case "market_buy", "market_buy_fiat":
+		if outgoing {
+			return "Покупка на барахолке, объявление #" + metaStr(m, "listing_id")
+		}
+		return "Продажа на барахолке, объявление #" + metaStr(m, "listing_id")
+	case "market_listing_fee_burn":
+		return "Комиссия за объявление (сожжена)"
+	case "balance_freeze":
+		return "Заморозка средств"
+	case "balance_unfreeze":
+		return "Разморозка средств"
+	case "fasttap_reconcile":
+		if f := metaStr(m, "field"); f != "" {
+			return "Техническая корректировка (" + f + ")"
+		}
+		return "Техническая корректировка"
+	}
+	if strings.HasSuffix(e.Kind, "_burn") {
+		return "Сжигание"
+	}
+	return e.Kind
+}
+
+// Cursor encodes the (ts, id) position of the last item of a page.
+func EncodeCursor(ts time.Time, id int64) string {
+	raw := strconv.FormatInt(ts.UnixMicro(), 10) + ":" + strconv.FormatInt(id, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+var ErrBadCursor = errors.New("bad cursor")
+
+func DecodeCursor(s string) (time.Time, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}, 0, ErrBadCursor
+	}
+	tsStr, idStr, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return time.Time{}, 0, ErrBadCursor
+	}
+	micros, err1 := strconv.ParseInt(tsStr, 10, 64)
+	id, err2 := strconv.ParseInt(idStr, 10, 64)
+	if err1 != nil || err2 != nil || id <= 0 {
+		return time.Time{}, 0, ErrBadCursor
+	}
+	return time.UnixMicro(micros).UTC(), id, nil
+}
+
+// ParseTime accepts RFC3339, YYYY-MM-DD (UTC midnight) or unix seconds.
+func ParseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("bad time %q", s)
+}
+
+var csvHeader = []string{"id", "time_utc", "kind", "amount", "counterpart", "description"}
+
+// CSVWriter writes history items as CSV rows, header first.
+type CSVWriter struct {
+	w      *csv.Writer
+	userID int64
+	header bool
+	rows   int
+
+	OnFlush func() // called after each buffered chunk is written (http.Flusher)
+}
+
+func NewCSVWriter(w io.Writer, userID int64) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w), userID: userID}
+}
+
+func (c *CSVWriter) Write(e db.LedgerEntry) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	it := FromEntry(e, c.userID)
+	counterpart := ""
+	if it.Counterpart != 0 {
+		counterpart = strconv.FormatInt(it.Counterpart, 10)
+	}
+	if err := c.w.Write([]string{
+		strconv.FormatInt(it.ID, 10),
+		e.TS.Format(time.RFC3339),
+		it.Kind,
+		strconv.FormatInt(it.Amount, 10),
+		counterpart,
+		it.Description,
+	}); err != nil {
+		return err
+	}
+	c.rows++
+	if c.rows%500 == 0 {
+		c.w.Flush()
+		if err := c.w.Error(); err != nil {
+			return err
+		}
+		if c.OnFlush != nil {
+			c.OnFlush()
+		}
+	}
+	return nil
+}
+
+// Flush writes the header for empty exports and flushes buffered rows.
+func (c *CSVWriter) Flush() error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		return err
+	}
+	if c.OnFlush != nil {
+		c.OnFlush()
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package i18n
+
+import "strings"
+
+// errorMessages тексты ошибок API по коду ошибки: ключ "api_error_" + code.
+// Коды стабильны, клиенты сравнивают именно их; тексты можно править.
+var errorMessages = map[Language]map[string]string{
+	Russian: {
+		"api_error_bad_json":                       "Некорректный запрос",
+		"api_error_bad_param":                      "Неверное значение поля %s",
+		"api_error_bad_request":                    "Запрос отклонён",
+		"api_error_too_long":                       "Слишком длинное значение поля %s",
+		"api_error_unauthorized":                   "Не авторизован, перезапустите приложение",
+		"api_error_init_data_expired":              "Данные входа устарели, перезапустите приложение",
+		"api_error_bad_refresh_token":              "Сессия истекла, войдите заново",
+		"api_error_session_revoked":                "Сессия завершена, войдите заново",
+		"api_error_no_session_token":               "Нет токена сессии",
+		"api_error_bad_signature":                  "Неверная подпись",
+		"api_error_forbidden":                      "Доступ запрещен",
+		"api_error_banned":                         "Аккаунт заблокирован",
+		"api_error_not_found":                      "Не найдено",
+		"api_error_recipient_not_found":            "Получатель не найден",
+		"api_error_user_not_found":                 "Пользователь не найден",
+		"api_error_listing_not_found":              "Объявление не найдено",
+		"api_error_invoice_not_found":              "Счёт не найден",
+		"api_error_invalid_recipient":              "Неверный получатель: укажите ID, адрес BKC или @username",
+		"api_error_bad_checksum":                   "В адресе ошибка: проверьте его",
+		"api_error_address_without_checksum":       "Адрес без контрольной суммы: укажите полный адрес",
+		"api_error_ambiguous_username":             "Этот @username занят несколькими аккаунтами, укажите адрес",
+		"api_error_self_transfer":                  "Нельзя переводить самому себе",
+		"api_error_not_enough_balance":             "Недостаточно средств",
+		"api_error_not_enough_balance_or_sold_out": "Недостаточно средств или товар закончился",
+		"api_error_not_enough_frozen":              "Недостаточно замороженных средств",
+		"api_error_borrower_not_enough_balance":    "У заёмщика недостаточно средств",
+		"api_error_not_enough_reserve":             "В резерве недостаточно средств",
+		"api_error_active_loan_exists":             "У вас уже есть активный кредит",
+		"api_error_max_level":                      "Достигнут максимальный уровень",
+		"api_error_limit_reached":                  "Достигнут лимит",
+		"api_error_standing_order_state":           "Автоплатёж не найден или его нельзя изменить",
+		"api_error_idempotency_mismatch":           "Ключ повтора уже использован для другого запроса",
+		"api_error_idempotency_in_progress":        "Запрос уже выполняется",
+		"api_error_rate_limited":                   "Слишком много запросов, попробуйте позже",
+		"api_error_retry_later":                    "Сервер занят, повторите попытку",
+		"api_error_halted":                         "Переводы временно остановлены",
+		"api_error_not_halted":                     "Переводы не остановлены",
+		"api_error_feature_disabled":               "Функция недоступна",
+		"api_error_db_error":                       "Ошибка базы данных, попробуйте позже",
+		"api_error_server_error":                   "Ошибка сервера",
+		"api_error_upstream_error":                 "Внешний сервис недоступен, попробуйте позже",
+	},
+	English: {
+		"api_error_bad_json":                       "Malformed request",
+		"api_error_bad_param":                      "Invalid value of %s",
+		"api_error_bad_request":                    "Request refused",
+		"api_error_too_long":                       "%s is too long",
+		"api_error_unauthorized":                   "Not authorized, restart the app",
+		"api_error_init_data_expired":              "Login data expired, restart the app",
+		"api_error_bad_refresh_token":              "Session expired, sign in again",
+		"api_error_session_revoked":                "Session ended, sign in again",
+		"api_error_no_session_token":               "No session token",
+		"api_error_bad_signature":                  "Bad signature",
+		"api_error_forbidden":                      "Access denied",
+		"api_error_banned":                         "Account is banned",
+		"api_error_not_found":                      "Not found",
+		"api_error_recipient_not_found":            "Recipient not found",
+		"api_error_user_not_found":                 "User not found",
+		"api_error_listing_not_found":              "Listing not found",
+		"api_error_invoice_not_found":              "Invoice not found",
+		"api_error_invalid_recipient":              "Invalid recipient: use an ID, a BKC address or @username",
+		"api_error_bad_checksum":                   "The address has a typo, check it",
+		"api_error_address_without_checksum":       "The address has no checksum, use the full address",
+		"api_error_ambiguous_username":             "This @username matches several accounts, use the address",
+		"api_error_self_transfer":                  "You cannot transfer to yourself",
+		"api_error_not_enough_balance":             "Not enough balance",
+		"api_error_not_enough_balance_or_sold_out": "Not enough balance or sold out",
+		"api_error_not_enough_frozen":              "Not enough frozen balance",
+		"api_error_borrower_not_enough_balance":    "The borrower does not have enough balance",
+		"api_error_not_enough_reserve":             "Not enough reserve",
+		"api_error_active_loan_exists":             "You already have an active loan",
+		"api_error_max_level":                      "Max level reached",
+		"api_error_limit_reached":                  "Limit reached",
+		"api_error_standing_order_state":           "The standing order was not found or cannot be changed",
+		"api_error_idempotency_mismatch":           "The idempotency key was used for another request",
+		"api_error_idempotency_in_progress":        "The request is already in progress",
+		"api_error_rate_limited":                   "Too many requests, try again later",
+		"api_error_retry_later":                    "Server busy, retry",
+		"api_error_halted":                         "Transfers are temporarily halted",
+		"api_error_not_halted":                     "Transfers are not halted",
+		"api_error_feature_disabled":               "Feature unavailable",
+		"api_error_db_error":                       "Database error, try again later",
+		"api_error_server_error":                   "Server error",
+		"api_error_upstream_error":                 "External service unavailable, try again later",
+	},
+}
+
+// FromLanguageCode переводит language_code клиента Telegram или тег
+// Accept-Language ("ru", "en-US", "uk;q=0.9", ...) в поддерживаемый язык.
+// Пустой код дает язык по умолчанию, русскоязычные регионы получают
+// русский, остальные английский.
+func FromLanguageCode(code string) Language {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if i := strings.IndexAny(code, "-_;"); i >= 0 {
+		code = code[:i]
+	}
+	switch code {
+	case "":
+		return DefaultLocaleManager.DefaultLanguage()
+	case "ru", "uk", "be", "kk", "uz", "ky", "tg":
+		return Russian
+	default:
+		return English
+	}
+}
@@ -312,6 +312,13 @@ func (lm *LocaleManager) loadDefaultMessages() {
 	
 	lm.messages[Russian] = ruMessages
 	lm.messages[English] = enMessages
+
+	// Ошибки API (errors.go)
+	for lang, msgs := range errorMessages {
+		for key, value := range msgs {
+			lm.messages[lang][key] = value
+		}
+	}
 }
 
 // GetMessage получает сообщение для указанного языка
@@ -353,6 +360,13 @@ func (lm *LocaleManager) SetDefaultLanguage(lang Language) {
 	lm.defaultLang = lang
 }
 
+// DefaultLanguage возвращает язык по умолчанию
+func (lm *LocaleManager) DefaultLanguage() Language {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	return lm.defaultLang
+}
+
 // AddMessages добавляет переводы для языка
 func (lm *LocaleManager) AddMessages(lang Language, messages map[string]string) {
 	lm.mu.Lock()
@@ -0,0 +1,239 @@
+// Package lifecycle starts the server's components in dependency order and
+// stops them in reverse, each stop with its own deadline.
+//
+// A component that others rely on lists nothing; the ones relying on it name
+// it in After. The HTTP server, for example, comes after the tap backend and
+// the event hub, so on shutdown it stops accepting requests and drains the
+// in-flight ones before the backend does its final flush.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bkc_coin_v2/internal/logx"
+)
+
+var logger = logx.Component("lifecycle")
+
+type Config struct {
+	StopTimeout time.Duration            // per component unless overridden
+	Timeouts    map[string]time.Duration // by component name
+}
+
+// ConfigFromEnv reads SHUTDOWN_STAGE_SEC (default 10, 1..300) and
+// SHUTDOWN_TIMEOUTS, a list like "http=20,memtap=30" overriding it per
+// component.
+func ConfigFromEnv() Config {
+	c := Config{StopTimeout: 10 * time.Second, Timeouts: map[string]time.Duration{}}
+	if n, ok := envInt("SHUTDOWN_STAGE_SEC"); ok {
+		c.StopTimeout = clampSec(n)
+	}
+	for _, part := range strings.Split(os.Getenv("SHUTDOWN_TIMEOUTS"), ",") {
+		name, sec, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(sec), 10, 64)
+		if err != nil {
+			continue
+		}
+		c.Timeouts[strings.TrimSpace(name)] = clampSec(n)
+	}
+	return c
+}
+
+func clampSec(n int64) time.Duration {
+	if n < 1 {
+		n = 1
+	}
+	if n > 300 {
+		n = 300
+	}
+	return time.Duration(n) * time.Second
+}
+
+func envInt(key string) (int64, bool) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// Component is one unit of the process. Start must not block: long-running
+// work goes to a goroutine that Stop waits for. Either hook may be nil.
+type Component struct {
+	Name  string
+	After []string // components started before this one and stopped after it
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+type Manager struct {
+	cfg     Config
+	comps   []Component
+	started []Component
+}
+
+func New(cfg Config) *Manager {
+	return &Manager{cfg: cfg}
+}
+
+// Add registers c. Components are started in registration order as far as
+// their dependencies allow.
+func (m *Manager) Add(c Component) {
+	m.comps = append(m.comps, c)
+}
+
+// order sorts the components so each comes after everything in its After.
+func (m *Manager) order() ([]Component, error) {
+	byName := make(map[string]int, len(m.comps))
+	for i, c := range m.comps {
+		if _, dup := byName[c.Name]; dup {
+			return nil, fmt.Errorf("lifecycle: component %q added twice", c.Name)
+		}
+		byName[c.Name] = i
+	}
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(m.comps))
+	out := make([]Component, 0, len(m.comps))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("lifecycle: dependency cycle through %q", m.comps[i].Name)
+		}
+		state[i] = visiting
+		for _, dep := range m.comps[i].After {
+			j, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("lifecycle: %q depends on unknown %q", m.comps[i].Name, dep)
+			}
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		state[i] = done
+		out = append(out, m.comps[i])
+		return nil
+	}
+	for i := range m.comps {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Start starts every component. If one fails, the ones already started are
+// stopped and the error is returned.
+func (m *Manager) Start(ctx context.Context) error {
+	comps, err := m.order()
+	if err != nil {
+		return err
+	}
+	for _, c := range comps {
+		if c.Start != nil {
+			if err := c.Start(ctx); err != nil {
+				_ = m.Stop(context.WithoutCancel(ctx))
+				return fmt.Errorf("start %s: %w", c.Name, err)
+			}
+		}
+		m.started = append(m.started, c)
+		logger.DebugContext(ctx, "component started", "name", c.Name)
+	}
+	return nil
+}
+
+// Stop stops the started components in reverse order. Each gets its own
+// timeout; one that overruns is logged and left behind so the rest still
+// get their turn. ctx bounds the whole shutdown.
+func (m *Manager) Stop(ctx context.Context) error {
+	var errs []error
+	for i := len(m.started) - 1; i >= 0; i-- {
+		c := m.started[i]
+		if c.Stop == nil {
+			continue
+		}
+		timeout := m.cfg.StopTimeout
+		if t, ok := m.cfg.Timeouts[c.Name]; ok {
+			timeout = t
+		}
+		start := time.Now()
+		stageCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := c.Stop(stageCtx)
+		cancel()
+		if err != nil {
+			logger.ErrorContext(ctx, "component stop failed", "name", c.Name, "took", time.Since(start), "err", err)
+			errs = append(errs, fmt.Errorf("stop %s: %w", c.Name, err))
+			continue
+		}
+		logger.InfoContext(ctx, "component stopped", "name", c.Name, "took", time.Since(start))
+	}
+	m.started = nil
+	return errors.Join(errs...)
+}
+
+// Background is a component running run in a goroutine. Stop cancels the
+// context given to run and waits for it to return, so run should check its
+// context between units of work and leave each unit whole.
+func Background(name string, run func(ctx context.Context), after ...string) Component {
+	var (
+		cancel context.CancelFunc
+		done   = make(chan struct{})
+	)
+	return Component{
+		Name:  name,
+		After: after,
+		Start: func(ctx context.Context) error {
+			var runCtx context.Context
+			runCtx, cancel = context.WithCancel(ctx)
+			go func() {
+				defer close(done)
+				run(runCtx)
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			return Wait(ctx, done)
+		},
+	}
+}
+
+// Wait blocks until done is closed or ctx ends.
+func Wait(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitGroup is Wait for a sync.WaitGroup.
+func WaitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return Wait(ctx, done)
+}
@@ -0,0 +1,177 @@
+// Package logx sets up log/slog for the server and carries request
+// correlation in contexts.
+//
+// A request ID is put into the context where work starts (API middleware,
+// bot update, background job run) and every record logged with that context
+// gets request_id and, once known, user_id. The ID also travels with work
+// handed off to other processes, e.g. in the fasttap stream payload, so a
+// failure in a worker can be traced back to the request that caused it.
+//
+// Old log.Printf calls keep working: Setup routes the log package through
+// the same handler at level INFO.
+package logx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type Config struct {
+	Level  slog.Level
+	Format string // "text" or "json"
+}
+
+// ConfigFromEnv reads LOG_LEVEL (debug|info|warn|error, default info) and
+// LOG_FORMAT (text|json, default text).
+func ConfigFromEnv() Config {
+	c := Config{Level: slog.LevelInfo, Format: "text"}
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("LOG_LEVEL"))) {
+	case "debug":
+		c.Level = slog.LevelDebug
+	case "warn", "warning":
+		c.Level = slog.LevelWarn
+	case "error":
+		c.Level = slog.LevelError
+	}
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("LOG_FORMAT")), "json") {
+		c.Format = "json"
+	}
+	return c
+}
+
+// Setup installs the default logger writing to stderr.
+func Setup(cfg Config) {
+	opts := &slog.HandlerOptions{Level: cfg.Level}
+	var h slog.Handler
+	if cfg.Format == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(ctxHandler{h}))
+}
+
+// Component returns a logger tagged with component=name. It resolves the
+// default handler on every record, so package-level loggers created before
+// Setup still follow it.
+func Component(name string) *slog.Logger {
+	return slog.New(lazyHandler{wrap: func(h slog.Handler) slog.Handler {
+		return h.WithAttrs([]slog.Attr{slog.String("component", name)})
+	}})
+}
+
+type lazyHandler struct {
+	wrap func(slog.Handler) slog.Handler
+}
+
+func (h lazyHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, l)
+}
+
+func (h lazyHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.wrap(slog.Default().Handler()).Handle(ctx, r)
+}
+
+func (h lazyHandler) WithAttrs(as []slog.Attr) slog.Handler {
+	return lazyHandler{wrap: func(b slog.Handler) slog.Handler { return h.wrap(b).WithAttrs(as) }}
+}
+
+func (h lazyHandler) WithGroup(name string) slog.Handler {
+	return lazyHandler{wrap: func(b slog.Handler) slog.Handler { return h.wrap(b).WithGroup(name) }}
+}
+
+// ctxHandler adds the correlation fields of the record's context.
+type ctxHandler struct {
+	slog.Handler
+}
+
+func (h ctxHandler) Handle(ctx context.Context, r slog.Record) error {
+	if f := fromContext(ctx); f != nil {
+		r.AddAttrs(slog.String("request_id", f.requestID))
+		if uid := f.userID.Load(); uid != 0 {
+			r.AddAttrs(slog.Int64("user_id", uid))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h ctxHandler) WithAttrs(as []slog.Attr) slog.Handler {
+	return ctxHandler{h.Handler.WithAttrs(as)}
+}
+
+func (h ctxHandler) WithGroup(name string) slog.Handler {
+	return ctxHandler{h.Handler.WithGroup(name)}
+}
+
+type fields struct {
+	requestID string
+	userID    atomic.Int64 // set once auth has run, after the context exists
+}
+
+type fieldsKey struct{}
+
+func fromContext(ctx context.Context) *fields {
+	if ctx == nil {
+		return nil
+	}
+	f, _ := ctx.Value(fieldsKey{}).(*fields)
+	return f
+}
+
+// NewRequestID returns a random 16-hex-digit ID.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID returns ctx carrying id (a new one if id is empty).
+func WithRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		id = NewRequestID()
+	}
+	return context.WithValue(ctx, fieldsKey{}, &fields{requestID: id})
+}
+
+// RequestID returns the request ID of ctx, or "".
+func RequestID(ctx context.Context) string {
+	if f := fromContext(ctx); f != nil {
+		return f.requestID
+	}
+	return ""
+}
+
+// SetUser records the authenticated user on ctx's request, so records
+// logged later with the same context carry user_id.
+func SetUser(ctx context.Context, userID int64) {
+	if f := fromContext(ctx); f != nil {
+		f.userID.Store(userID)
+	}
+}
+
+// UserID returns the user recorded by SetUser, or 0.
+func UserID(ctx context.Context) int64 {
+	if f := fromContext(ctx); f != nil {
+		return f.userID.Load()
+	}
+	return 0
+}
+
+// ValidRequestID reports whether an inbound ID (X-Request-ID from a proxy)
+// is safe to reuse in logs and stream payloads.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"bkc_coin_v2/internal/i18n"
+	"bkc_coin_v2/internal/metrics"
 )
 
 // ItemType тип товара
@@ -777,7 +778,29 @@ func (nm *NFTMarketplace) GetMetrics() MarketplaceMetrics {
 	nm.metrics.mu.RLock()
 	defer nm.metrics.mu.RUnlock()
 
-	return *nm.metrics
+	return MarketplaceMetrics{
+		TotalListings:        nm.metrics.TotalListings,
+		ActiveListings:       nm.metrics.ActiveListings,
+		TotalSales:           nm.metrics.TotalSales,
+		TotalRevenue:         nm.metrics.TotalRevenue,
+		TotalUsers:           nm.metrics.TotalUsers,
+		VerifiedUsers:        nm.metrics.VerifiedUsers,
+		PremiumUsers:         nm.metrics.PremiumUsers,
+		EscrowTransactions:   nm.metrics.EscrowTransactions,
+		DisputedTransactions: nm.metrics.DisputedTransactions,
+		LastUpdated:          nm.metrics.LastUpdated,
+	}
+}
+
+// WriteMetrics отдает GetMetrics в /metrics (metrics.Collector)
+func (nm *NFTMarketplace) WriteMetrics(ctx context.Context, w *metrics.Writer) {
+	m := nm.GetMetrics()
+	w.Counter("bkc_nft_listings_created_total", "Созданные объявления", float64(m.TotalListings))
+	w.Gauge("bkc_nft_listings_active", "Активные объявления", float64(m.ActiveListings))
+	w.Counter("bkc_nft_sales_total", "Продажи", float64(m.TotalSales))
+	w.Counter("bkc_nft_revenue_coins_total", "Оборот продаж в монетах", float64(m.TotalRevenue))
+	w.Counter("bkc_nft_escrow_transactions_total", "Сделки через эскроу", float64(m.EscrowTransactions))
+	w.Counter("bkc_nft_disputed_transactions_total", "Оспоренные сделки", float64(m.DisputedTransactions))
 }
 
 // ListingFilters фильтры для поиска объявлений
@@ -0,0 +1,287 @@
+package memtap
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/tapcore"
+)
+
+// Ownership leases let several API replicas run memtap side by side. Users
+// are split into shards (user_id % shards) and a replica mints only for
+// users whose shard it holds a live lease on; other replicas forward or
+// reject the tap. Leases live in memtap_leases with a DB-clock expiry, are
+// renewed every ttl/3, handed off after a final flush on shutdown and simply
+// expire when a replica dies.
+type leaseManager struct {
+	owner  string
+	addr   string
+	shards int
+	ttl    time.Duration
+
+	mu     sync.RWMutex
+	owned  map[int]time.Time // shard -> local deadline for minting
+	others map[int]db.MemtapLease
+	live   int
+}
+
+func newLeaseManager(owner, addr string, shards int, ttl time.Duration) *leaseManager {
+	return &leaseManager{
+		owner:  owner,
+		addr:   addr,
+		shards: shards,
+		ttl:    ttl,
+		owned:  map[int]time.Time{},
+		others: map[int]db.MemtapLease{},
+	}
+}
+
+func (l *leaseManager) shardOf(userID int64) int {
+	return int(userID % int64(l.shards))
+}
+
+// deadline is when a lease renewed at start stops being trusted locally.
+// The DB expiry is start+ttl on the DB clock; the last third of the TTL is
+// a margin for clock drift and a slow renew round trip.
+func (l *leaseManager) deadline(start time.Time) time.Time {
+	return start.Add(l.ttl * 2 / 3)
+}
+
+// check returns nil when this replica may mint for the user right now.
+func (l *leaseManager) check(userID int64) error {
+	shard := l.shardOf(userID)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if deadline, ok := l.owned[shard]; ok && time.Now().Before(deadline) {
+		return nil
+	}
+	other := l.others[shard]
+	if other.Expired || other.Owner == l.owner {
+		return &tapcore.NotOwnerError{}
+	}
+	return &tapcore.NotOwnerError{Owner: other.Owner, Addr: other.Addr}
+}
+
+func (l *leaseManager) ownedShards() []int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]int, 0, len(l.owned))
+	for shard := range l.owned {
+		out = append(out, shard)
+	}
+	return out
+}
+
+// revoke stops minting for the shards and returns their previous deadlines
+// so a failed handoff can restore them.
+func (l *leaseManager) revoke(shards []int) map[int]time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev := make(map[int]time.Time, len(shards))
+	for _, shard := range shards {
+		if deadline, ok := l.owned[shard]; ok {
+			prev[shard] = deadline
+			delete(l.owned, shard)
+		}
+	}
+	return prev
+}
+
+func (l *leaseManager) restore(prev map[int]time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for shard, deadline := range prev {
+		l.owned[shard] = deadline
+	}
+}
+
+// leaseTick heartbeats membership, renews held shards and moves towards a
+// fair share of ceil(shards / live members): free or expired shards are
+// acquired, surplus shards are handed off.
+func (e *Engine) leaseTick(ctx context.Context) error {
+	l := e.leases
+	live, err := e.db.HeartbeatMemtapMember(ctx, l.owner, l.addr, l.ttl)
+	if err != nil {
+		return err
+	}
+	if live < 1 {
+		live = 1
+	}
+
+	held := l.ownedShards()
+	start := time.Now()
+	kept, err := e.db.RenewMemtapLeases(ctx, l.owner, l.addr, held, l.ttl)
+	if err != nil {
+		return err
+	}
+	keptSet := make(map[int]struct{}, len(kept))
+	for _, shard := range kept {
+		keptSet[shard] = struct{}{}
+	}
+	var lost []int
+	e.mu.Lock()
+	l.mu.Lock()
+	for _, shard := range held {
+		if _, ok := keptSet[shard]; ok {
+			l.owned[shard] = l.deadline(start)
+			continue
+		}
+		delete(l.owned, shard)
+		lost = append(lost, shard)
+	}
+	l.mu.Unlock()
+	e.dropShardUsersLocked(lost)
+	e.mu.Unlock()
+	if len(lost) > 0 {
+		logger.WarnContext(ctx, "lost shard leases to another replica", "shards", len(lost))
+	}
+
+	leases, err := e.db.ListMemtapLeases(ctx)
+	if err != nil {
+		return err
+	}
+	taken := make(map[int]bool, len(leases))
+	l.mu.Lock()
+	l.live = live
+	l.others = make(map[int]db.MemtapLease, len(leases))
+	for _, ls := range leases {
+		if ls.Owner != l.owner {
+			l.others[ls.Shard] = ls
+		}
+		taken[ls.Shard] = !ls.Expired
+	}
+	owned := len(l.owned)
+	l.mu.Unlock()
+
+	target := (l.shards + live - 1) / live
+	switch {
+	case owned < target:
+		// Start the scan at an owner-specific offset so replicas joining together do not race for the same shards.
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(l.owner))
+		offset := int(h.Sum32() % uint32(l.shards))
+		for i := 0; i < l.shards && owned < target; i++ {
+			shard := (offset + i) % l.shards
+			if taken[shard] {
+				continue
+			}
+			start := time.Now()
+			ok, err := e.db.AcquireMemtapLease(ctx, shard, l.owner, l.addr, l.ttl)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			e.mu.Lock()
+			// Anything cached for this shard predates our ownership.
+			e.dropShardUsersLocked([]int{shard})
+			l.mu.Lock()
+			l.owned[shard] = l.deadline(start)
+			delete(l.others, shard)
+			l.mu.Unlock()
+			e.mu.Unlock()
+			owned++
+		}
+	case owned > target:
+		held = l.ownedShards()
+		if err := e.handoff(ctx, held[:owned-target]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handoff stops minting for the shards, flushes everything minted so far and
+// only then deletes the lease rows, so the next owner loads complete state
+// from Postgres. On flush failure the shards stay ours.
+func (e *Engine) handoff(ctx context.Context, shards []int) error {
+	if len(shards) == 0 {
+		return nil
+	}
+	l := e.leases
+	e.mu.Lock()
+	prev := l.revoke(shards)
+	e.mu.Unlock()
+
+	if err := e.flushAll(ctx); err != nil {
+		l.restore(prev)
+		return err
+	}
+	e.mu.Lock()
+	e.dropShardUsersLocked(shards)
+	e.mu.Unlock()
+	if err := e.db.ReleaseMemtapLeases(ctx, l.owner, shards); err != nil {
+		// Not renewed any more, so the rows expire after ttl.
+		return err
+	}
+	logger.InfoContext(ctx, "handed off shard leases", "shards", len(shards))
+	return nil
+}
+
+// releaseAll is the shutdown path: hand off every shard and leave the member list.
+func (e *Engine) releaseAll(ctx context.Context) {
+	l := e.leases
+	if err := e.handoff(ctx, l.ownedShards()); err != nil {
+		logger.ErrorContext(ctx, "lease handoff failed, leases will expire", "ttl", l.ttl, "err", err)
+		return
+	}
+	if err := e.db.RemoveMemtapMember(ctx, l.owner); err != nil {
+		logger.WarnContext(ctx, "leave members failed", "err", err)
+	}
+}
+
+// dropShardUsersLocked removes cached users of the given shards. Pending
+// deltas are kept and flushed as usual. Caller holds e.mu.
+func (e *Engine) dropShardUsersLocked(shards []int) {
+	if len(shards) == 0 {
+		return
+	}
+	drop := make(map[int]struct{}, len(shards))
+	for _, shard := range shards {
+		drop[shard] = struct{}{}
+	}
+	for userID := range e.users {
+		if _, ok := drop[e.leases.shardOf(userID)]; ok {
+			delete(e.users, userID)
+		}
+	}
+}
+
+// listenInvalidations drops cached users invalidated on any replica (e.g. an
+// energy boost bought through another API instance).
+func (e *Engine) listenInvalidations(ctx context.Context) {
+	for {
+		err := e.db.ListenMemtapInvalidate(ctx, func(userID int64) {
+			e.mu.Lock()
+			delete(e.users, userID)
+			e.mu.Unlock()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		logger.WarnContext(ctx, "invalidation listener failed", "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func (e *Engine) leaseStats() map[string]any {
+	l := e.leases
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return map[string]any{
+		"owner":        l.owner,
+		"addr":         l.addr,
+		"shards":       l.shards,
+		"owned_shards": len(l.owned),
+		"live_members": l.live,
+		"ttl_sec":      int64(l.ttl / time.Second),
+	}
+}
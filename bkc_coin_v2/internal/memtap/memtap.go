@@ -2,7 +2,10 @@ package memtap
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"math"
 	"os"
 	"strconv"
@@ -13,8 +16,16 @@ import (
 
 	"bkc_coin_v2/internal/config"
 	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/metrics"
+	"bkc_coin_v2/internal/tapcore"
 )
 
+var logger = logx.Component("memtap")
+
+var flushSeconds = metrics.Default.Histogram("bkc_memtap_flush_duration_seconds",
+	"Time to write buffered taps to Postgres, by result.", metrics.DefBuckets, "result")
+
 type Engine struct {
 	cfg config.Config
 	db  *db.DB
@@ -34,6 +45,8 @@ type Engine struct {
 	initialReserve int64
 	startRate      int64
 	minRate        int64
+	tapRewardBP    int64
+	halvingEpoch   int64
 
 	users map[int64]*userState
 
@@ -41,6 +54,14 @@ type Engine struct {
 	pendingDaily   map[dailyKey]int64
 	pendingReserve int64
 
+	wal    *wal
+	walErr error
+
+	leases   *leaseManager
+	stopC    chan context.Context
+	done     chan struct{}
+	finalErr error // set by the loop before done is closed
+
 	flushInFlight atomic.Bool
 	lastFlushUnix atomic.Int64
 	flushErrors   atomic.Int64
@@ -54,6 +75,8 @@ type userState struct {
 
 	Balance   int64
 	TapsTotal int64
+	Level     int64
+	TapPower  int64
 
 	Energy          float64
 	EnergyMax       float64
@@ -67,6 +90,10 @@ type userState struct {
 	DailyTapped int64
 	DailyExtra  int64
 
+	// RewardCarry is the unpaid fraction of a coin (tapcore.MintCoins). It
+	// lives only in memory: eviction or a restart drops less than a coin.
+	RewardCarry int64
+
 	LastTouched time.Time
 }
 
@@ -82,26 +109,6 @@ type dailyKey struct {
 	Day    string
 }
 
-type TapResult struct {
-	Gained         int64
-	Reason         string
-	Energy         int64
-	EnergyMax      int64
-	DailyTapped    int64
-	DailyExtra     int64
-	DailyRemaining int64
-}
-
-type UserSnapshot struct {
-	Balance        int64
-	TapsTotal      int64
-	Energy         int64
-	EnergyMax      int64
-	DailyTapped    int64
-	DailyExtra     int64
-	DailyRemaining int64
-}
-
 func New(cfg config.Config, database *db.DB) *Engine {
 	if database == nil {
 		return nil
@@ -133,7 +140,7 @@ func New(cfg config.Config, database *db.DB) *Engine {
 		cacheTTLSec = 86_400
 	}
 
-	return &Engine{
+	e := &Engine{
 		cfg: cfg,
 		db:  database,
 
@@ -146,41 +153,189 @@ func New(cfg config.Config, database *db.DB) *Engine {
 		users:        map[int64]*userState{},
 		pendingUsers: map[int64]pendingUserDelta{},
 		pendingDaily: map[dailyKey]int64{},
+
+		stopC: make(chan context.Context, 1),
+		done:  make(chan struct{}),
+	}
+
+	// Write-ahead log of minted taps (MEMTAP_WAL=0 disables it).
+	if strings.TrimSpace(os.Getenv("MEMTAP_WAL")) != "0" {
+		dir := strings.TrimSpace(os.Getenv("MEMTAP_WAL_DIR"))
+		if dir == "" {
+			dir = "data/memtap_wal"
+		}
+		segmentMB := envInt64("MEMTAP_WAL_SEGMENT_MB", 16)
+		if segmentMB < 1 {
+			segmentMB = 1
+		}
+		if segmentMB > 512 {
+			segmentMB = 512
+		}
+		e.wal, e.walErr = openWAL(dir, segmentMB<<20, strings.TrimSpace(os.Getenv("MEMTAP_WAL_FSYNC")) == "1")
+	}
+
+	// Per-user ownership leases for running memtap on several replicas (MEMTAP_LEASES=1).
+	if strings.TrimSpace(os.Getenv("MEMTAP_LEASES")) == "1" {
+		shards := envInt64("MEMTAP_SHARDS", 64)
+		if shards < 1 {
+			shards = 1
+		}
+		if shards > 4096 {
+			shards = 4096
+		}
+		ttlSec := envInt64("MEMTAP_LEASE_TTL_SEC", 15)
+		if ttlSec < 5 {
+			ttlSec = 5
+		}
+		if ttlSec > 300 {
+			ttlSec = 300
+		}
+		owner := strings.TrimSpace(os.Getenv("MEMTAP_INSTANCE_ID"))
+		if owner == "" {
+			host, _ := os.Hostname()
+			b := make([]byte, 4)
+			_, _ = rand.Read(b)
+			owner = strings.TrimSpace(host) + "-" + hex.EncodeToString(b)
+		}
+		addr := strings.TrimRight(strings.TrimSpace(os.Getenv("MEMTAP_ADVERTISE_URL")), "/")
+		e.leases = newLeaseManager(owner, addr, int(shards), time.Duration(ttlSec)*time.Second)
 	}
+	return e
 }
 
 func (e *Engine) Enabled() bool {
 	return e != nil && e.enabled
 }
 
+func (e *Engine) Name() string { return "memtap" }
+
 func (e *Engine) Start(ctx context.Context) {
 	if !e.Enabled() {
 		return
 	}
 	e.startOnce.Do(func() {
+		if e.leases != nil {
+			// First round synchronously so a lone replica owns every shard before serving.
+			if err := e.leaseTick(ctx); err != nil {
+				logger.ErrorContext(ctx, "lease tick failed", "err", err)
+			}
+			go e.listenInvalidations(ctx)
+		}
 		go e.loop(ctx)
 	})
 }
 
+// Stop makes the loop hand off its leases and flush every buffered tap to
+// Postgres, and waits for that within ctx. Taps must no longer be served
+// (the HTTP server is stopped first). A failed final flush is returned; the
+// taps stay in the WAL and are replayed on the next start.
+func (e *Engine) Stop(ctx context.Context) error {
+	if !e.Enabled() {
+		return nil
+	}
+	select {
+	case e.stopC <- ctx:
+	default: // already stopping
+	}
+	select {
+	case <-e.done:
+		return e.finalErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ReplayWAL applies WAL segments left by a previous process (crash between
+// flushes). Segments already persisted are recognized by their ledger
+// event_id and only removed. Must run before Start and before any Tap.
+func (e *Engine) ReplayWAL(ctx context.Context) error {
+	if !e.Enabled() {
+		return nil
+	}
+	if e.walErr != nil {
+		return e.walErr
+	}
+	if e.wal == nil {
+		return nil
+	}
+	segments, err := e.wal.cut()
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		users, daily, reserveDelta, err := e.wal.readSegment(name)
+		if err != nil {
+			return fmt.Errorf("read segment %s: %w", name, err)
+		}
+		err = e.db.ApplyTapAggregates(ctx, users, daily, reserveDelta, "memtap_wal_replay", []string{walEventID(name)})
+		switch {
+		case err == nil:
+			logger.InfoContext(ctx, "wal segment replayed", "segment", name, "users", len(users), "reserve_delta", reserveDelta)
+		case errors.Is(err, db.ErrAlreadyExists):
+			logger.InfoContext(ctx, "wal segment already flushed", "segment", name)
+		default:
+			return fmt.Errorf("replay segment %s: %w", name, err)
+		}
+		e.wal.truncate([]string{name})
+	}
+	return nil
+}
+
 func (e *Engine) loop(ctx context.Context) {
 	flushTicker := time.NewTicker(e.flushInterval)
 	cleanupTicker := time.NewTicker(60 * time.Second)
 	defer flushTicker.Stop()
 	defer cleanupTicker.Stop()
+	defer close(e.done)
+
+	var leaseC <-chan time.Time
+	if e.leases != nil {
+		leaseTicker := time.NewTicker(e.leases.ttl / 3)
+		defer leaseTicker.Stop()
+		leaseC = leaseTicker.C
+	}
 
 	for {
 		select {
+		case stopCtx := <-e.stopC:
+			e.finalErr = e.shutdown(stopCtx)
+			return
 		case <-ctx.Done():
-			_ = e.Flush(context.Background())
+			// Cancelled without Stop: still try to persist what we have.
+			shutCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			e.finalErr = e.shutdown(shutCtx)
+			cancel()
 			return
 		case <-flushTicker.C:
-			_ = e.Flush(ctx)
+			if err := e.Flush(ctx); err != nil && ctx.Err() == nil {
+				logger.WarnContext(ctx, "flush failed, taps stay buffered", "err", err)
+			}
 		case <-cleanupTicker.C:
 			e.cleanupStaleUsers()
+		case <-leaseC:
+			if err := e.leaseTick(ctx); err != nil && ctx.Err() == nil {
+				logger.ErrorContext(ctx, "lease tick failed", "err", err)
+			}
 		}
 	}
 }
 
+// shutdown hands off the leases (which flushes their shards) and flushes the
+// rest.
+func (e *Engine) shutdown(ctx context.Context) error {
+	if e.leases != nil {
+		e.releaseAll(ctx)
+	}
+	err := e.flushAll(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "final flush failed", "err", err)
+	}
+	if e.wal != nil {
+		_ = e.wal.close()
+	}
+	return err
+}
+
 func (e *Engine) ensureSystem(ctx context.Context) error {
 	if !e.Enabled() {
 		return errors.New("memtap disabled")
@@ -204,12 +359,15 @@ func (e *Engine) ensureSystem(ctx context.Context) error {
 	e.initialReserve = sys.InitialReserve
 	e.startRate = sys.StartRateCoinsUSD
 	e.minRate = sys.MinRateCoinsUSD
+	e.tapRewardBP = sys.TapRewardBP
+	e.halvingEpoch = sys.CurrentHalving
 	e.systemLoadedAt = time.Now().UTC()
 	e.mu.Unlock()
 	return nil
 }
 
 func (e *Engine) ensureUser(ctx context.Context, userID int64, username, firstName string, now time.Time) (*userState, error) {
+	econ := config.Econ()
 	e.mu.RLock()
 	if u := e.users[userID]; u != nil {
 		e.mu.RUnlock()
@@ -217,7 +375,7 @@ func (e *Engine) ensureUser(ctx context.Context, userID int64, username, firstNa
 	}
 	e.mu.RUnlock()
 
-	dbUser, err := e.db.EnsureUser(ctx, userID, username, firstName, float64(e.cfg.EnergyMax))
+	dbUser, err := e.db.EnsureUser(ctx, userID, username, firstName, float64(econ.EnergyMax))
 	if err != nil {
 		return nil, err
 	}
@@ -234,6 +392,8 @@ func (e *Engine) ensureUser(ctx context.Context, userID int64, username, firstNa
 
 		Balance:   dbUser.Balance,
 		TapsTotal: dbUser.TapsTotal,
+		Level:     tapcore.NormalizeLevel(dbUser.Level),
+		TapPower:  tapcore.NormalizePower(dbUser.TapsPower),
 
 		Energy:          dbUser.Energy,
 		EnergyMax:       dbUser.EnergyMax,
@@ -250,7 +410,7 @@ func (e *Engine) ensureUser(ctx context.Context, userID int64, username, firstNa
 		LastTouched: now.UTC(),
 	}
 	if loaded.EnergyMax <= 0 {
-		loaded.EnergyMax = float64(e.cfg.EnergyMax)
+		loaded.EnergyMax = float64(econ.EnergyMax)
 	}
 	if loaded.BoostRegenMul <= 0 {
 		loaded.BoostRegenMul = 1
@@ -271,34 +431,43 @@ func (e *Engine) ensureUser(ctx context.Context, userID int64, username, firstNa
 		e.mu.Unlock()
 		return existing, nil
 	}
+	// Unflushed deltas are not in Postgres yet (user was invalidated mid-batch).
+	if pu, ok := e.pendingUsers[userID]; ok {
+		loaded.Balance += pu.BalanceDelta
+		loaded.TapsTotal += pu.TapsDelta
+		loaded.Energy = pu.Energy
+		loaded.EnergyUpdatedAt = pu.EnergyAt
+	}
+	loaded.DailyTapped += e.pendingDaily[dailyKey{UserID: userID, Day: day}]
 	e.users[userID] = loaded
 	e.mu.Unlock()
 	return loaded, nil
 }
 
-func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName string, requested int64, now time.Time) (TapResult, error) {
+func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName string, requested int64, now time.Time) (tapcore.TapResult, error) {
+	econ := config.Econ()
 	if !e.Enabled() {
-		return TapResult{}, errors.New("memtap disabled")
+		return tapcore.TapResult{}, errors.New("memtap disabled")
 	}
 	if userID <= 0 {
-		return TapResult{}, errors.New("bad user_id")
-	}
-	if requested <= 0 {
-		requested = 1
-	}
-	if requested > e.cfg.TapMaxPerRequest {
-		requested = e.cfg.TapMaxPerRequest
+		return tapcore.TapResult{}, errors.New("bad user_id")
 	}
+	requested = tapcore.ClampRequested(econ, requested)
 	if now.IsZero() {
 		now = time.Now().UTC()
 	}
 	now = now.UTC()
 
+	if e.leases != nil {
+		if err := e.leases.check(userID); err != nil {
+			return tapcore.TapResult{}, err
+		}
+	}
 	if err := e.ensureSystem(ctx); err != nil {
-		return TapResult{}, err
+		return tapcore.TapResult{}, err
 	}
 	if _, err := e.ensureUser(ctx, userID, username, firstName, now); err != nil {
-		return TapResult{}, err
+		return tapcore.TapResult{}, err
 	}
 
 	day := now.Format("2006-01-02")
@@ -306,9 +475,15 @@ func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName stri
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	// Re-check under the lock: a handoff revokes shards while holding e.mu.
+	if e.leases != nil {
+		if err := e.leases.check(userID); err != nil {
+			return tapcore.TapResult{}, err
+		}
+	}
 	u := e.users[userID]
 	if u == nil {
-		return TapResult{}, errors.New("user not cached")
+		return tapcore.TapResult{}, errors.New("user not cached")
 	}
 
 	if u.Day != day {
@@ -317,8 +492,8 @@ func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName stri
 		u.DailyExtra = 0
 	}
 
-	regen, eMax := energyParams(u, now, e.cfg.EnergyRegenPerSec)
-	u.Energy = regenEnergy(u.Energy, eMax, regen, u.EnergyUpdatedAt, now)
+	eMax, regen := e.energyParams(u, now)
+	u.Energy = tapcore.RegenEnergy(u.Energy, eMax, regen, u.EnergyUpdatedAt, now)
 	u.EnergyUpdatedAt = now
 
 	mintable := int64(math.Floor(u.Energy))
@@ -326,9 +501,9 @@ func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName stri
 		mintable = 0
 	}
 
-	dailyMax := e.cfg.TapDailyLimit + u.DailyExtra
+	dailyMax := econ.TapDailyLimit + u.DailyExtra
 	dailyRemaining := int64(1 << 60)
-	if e.cfg.TapDailyLimit > 0 {
+	if econ.TapDailyLimit > 0 {
 		dailyRemaining = dailyMax - u.DailyTapped
 		if dailyRemaining < 0 {
 			dailyRemaining = 0
@@ -339,8 +514,12 @@ func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName stri
 	if availableReserve < 0 {
 		availableReserve = 0
 	}
+	power := tapcore.NormalizePower(u.TapPower)
+	rewardBP := tapcore.NormalizeRewardBP(e.tapRewardBP)
+	reserveTaps := tapcore.ReserveTaps(availableReserve, power, rewardBP, u.RewardCarry)
 
-	gained := min4(requested, mintable, dailyRemaining, availableReserve)
+	// gained counts taps (energy, daily quota); coins come from MintCoins.
+	gained := min4(requested, mintable, dailyRemaining, reserveTaps)
 	if gained < 0 {
 		gained = 0
 	}
@@ -348,9 +527,9 @@ func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName stri
 	reason := "ok"
 	if gained == 0 {
 		switch {
-		case e.cfg.TapDailyLimit > 0 && dailyRemaining == 0 && mintable > 0:
+		case econ.TapDailyLimit > 0 && dailyRemaining == 0 && mintable > 0:
 			reason = "daily_limit"
-		case availableReserve == 0 && mintable > 0:
+		case reserveTaps == 0 && mintable > 0:
 			reason = "reserve_empty"
 		case mintable <= 0:
 			reason = "no_energy"
@@ -359,21 +538,30 @@ func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName stri
 		}
 	}
 
+	coins, carry := tapcore.MintCoins(gained, power, rewardBP, u.RewardCarry)
 	if gained > 0 {
-		u.Energy -= float64(gained)
-		if u.Energy < 0 {
-			u.Energy = 0
+		u.RewardCarry = carry
+		energyAfter := u.Energy - float64(gained)
+		if energyAfter < 0 {
+			energyAfter = 0
+		}
+		if e.wal != nil {
+			rec := walRecord{UserID: userID, Gained: coins, Taps: gained, Day: day, Energy: energyAfter, EnergyAt: now.UnixNano()}
+			if err := e.wal.append(rec); err != nil {
+				return tapcore.TapResult{}, fmt.Errorf("memtap wal: %w", err)
+			}
 		}
-		u.Balance += gained
+		u.Energy = energyAfter
+		u.Balance += coins
 		u.TapsTotal += gained
 		u.DailyTapped += gained
 		u.LastTouched = now
 
-		e.reserve -= gained
-		e.pendingReserve -= gained
+		e.reserve -= coins
+		e.pendingReserve -= coins
 
 		pu := e.pendingUsers[userID]
-		pu.BalanceDelta += gained
+		pu.BalanceDelta += coins
 		pu.TapsDelta += gained
 		pu.Energy = u.Energy
 		pu.EnergyAt = now
@@ -388,8 +576,11 @@ func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName stri
 		dailyRemainingOut = 0
 	}
 
-	return TapResult{
-		Gained:         gained,
+	return tapcore.TapResult{
+		Gained:         coins,
+		Taps:           gained,
+		TapPower:       power,
+		RewardBP:       rewardBP,
 		Reason:         reason,
 		Energy:         int64(math.Floor(u.Energy)),
 		EnergyMax:      int64(math.Floor(eMax)),
@@ -399,11 +590,19 @@ func (e *Engine) Tap(ctx context.Context, userID int64, username, firstName stri
 	}, nil
 }
 
-// SnapshotIfPending returns current in-memory state only when user has
-// unflushed tap deltas. This avoids overriding fresh DB data after flush.
-func (e *Engine) SnapshotIfPending(userID int64, now time.Time) (UserSnapshot, bool) {
+// Snapshot returns the in-memory state when the user has unflushed tap
+// deltas; otherwise it reads Postgres so fresh DB data is not overridden
+// after a flush.
+func (e *Engine) Snapshot(ctx context.Context, dbUser db.UserState, now time.Time) (tapcore.Snapshot, error) {
+	if snap, ok := e.snapshotIfPending(dbUser.UserID, now); ok {
+		return snap, nil
+	}
+	return tapcore.LoadSnapshot(ctx, config.Econ(), e.db, dbUser, now)
+}
+
+func (e *Engine) snapshotIfPending(userID int64, now time.Time) (tapcore.Snapshot, bool) {
 	if !e.Enabled() || userID <= 0 {
-		return UserSnapshot{}, false
+		return tapcore.Snapshot{}, false
 	}
 	if now.IsZero() {
 		now = time.Now().UTC()
@@ -414,11 +613,11 @@ func (e *Engine) SnapshotIfPending(userID int64, now time.Time) (UserSnapshot, b
 	defer e.mu.Unlock()
 
 	if _, ok := e.pendingUsers[userID]; !ok {
-		return UserSnapshot{}, false
+		return tapcore.Snapshot{}, false
 	}
 	u := e.users[userID]
 	if u == nil {
-		return UserSnapshot{}, false
+		return tapcore.Snapshot{}, false
 	}
 	day := now.Format("2006-01-02")
 	if u.Day != day {
@@ -426,19 +625,21 @@ func (e *Engine) SnapshotIfPending(userID int64, now time.Time) (UserSnapshot, b
 		u.DailyTapped = 0
 		u.DailyExtra = 0
 	}
-	regen, eMax := energyParams(u, now, e.cfg.EnergyRegenPerSec)
-	u.Energy = regenEnergy(u.Energy, eMax, regen, u.EnergyUpdatedAt, now)
+	eMax, regen := e.energyParams(u, now)
+	u.Energy = tapcore.RegenEnergy(u.Energy, eMax, regen, u.EnergyUpdatedAt, now)
 	u.EnergyUpdatedAt = now
 
-	dailyMax := e.cfg.TapDailyLimit + u.DailyExtra
+	dailyMax := config.Econ().TapDailyLimit + u.DailyExtra
 	dailyRemaining := dailyMax - u.DailyTapped
 	if dailyRemaining < 0 {
 		dailyRemaining = 0
 	}
 
-	return UserSnapshot{
+	return tapcore.Snapshot{
 		Balance:        u.Balance,
 		TapsTotal:      u.TapsTotal,
+		Level:          u.Level,
+		TapPower:       u.TapPower,
 		Energy:         int64(math.Floor(u.Energy)),
 		EnergyMax:      int64(math.Floor(eMax)),
 		DailyTapped:    u.DailyTapped,
@@ -447,18 +648,23 @@ func (e *Engine) SnapshotIfPending(userID int64, now time.Time) (UserSnapshot, b
 	}, true
 }
 
-// ReserveSnapshotIfPending returns reserve/rate params when there is an
+// ReserveSnapshot returns reserve/rate params when there is an
 // unflushed reserve delta.
-func (e *Engine) ReserveSnapshotIfPending() (reserve, initialReserve, startRate, minRate int64, ok bool) {
+func (e *Engine) ReserveSnapshot() (tapcore.ReserveSnapshot, bool) {
 	if !e.Enabled() {
-		return 0, 0, 0, 0, false
+		return tapcore.ReserveSnapshot{}, false
 	}
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 	if e.pendingReserve == 0 {
-		return 0, 0, 0, 0, false
+		return tapcore.ReserveSnapshot{}, false
 	}
-	return e.reserve, e.initialReserve, e.startRate, e.minRate, true
+	return tapcore.ReserveSnapshot{
+		Reserve:        e.reserve,
+		InitialReserve: e.initialReserve,
+		StartRate:      e.startRate,
+		MinRate:        e.minRate,
+	}, true
 }
 
 func (e *Engine) Flush(ctx context.Context) error {
@@ -469,8 +675,32 @@ func (e *Engine) Flush(ctx context.Context) error {
 		return nil
 	}
 	defer e.flushInFlight.Store(false)
+	return e.flushPending(ctx)
+}
 
-	users, daily, reserveDelta := e.snapshotPending()
+// flushAll waits for an in-flight flush and then flushes again, so every
+// tap minted before the call is in Postgres when it returns nil.
+func (e *Engine) flushAll(ctx context.Context) error {
+	if !e.Enabled() {
+		return nil
+	}
+	for !e.flushInFlight.CompareAndSwap(false, true) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	defer e.flushInFlight.Store(false)
+	return e.flushPending(ctx)
+}
+
+func (e *Engine) flushPending(ctx context.Context) error {
+	users, daily, reserveDelta, segments, err := e.snapshotPending()
+	if err != nil {
+		e.flushErrors.Add(1)
+		return err
+	}
 	if len(users) == 0 && len(daily) == 0 && reserveDelta == 0 {
 		return nil
 	}
@@ -481,21 +711,91 @@ func (e *Engine) Flush(ctx context.Context) error {
 	ctxTimeout, cancel := context.WithTimeout(ctx, 8*time.Second)
 	defer cancel()
 
-	if err := e.db.ApplyTapAggregates(ctxTimeout, users, daily, reserveDelta, "memtap"); err != nil {
+	start := time.Now()
+	err = e.db.ApplyTapAggregates(ctxTimeout, users, daily, reserveDelta, "memtap", walEventIDs(segments))
+	if errors.Is(err, db.ErrAlreadyExists) {
+		// An earlier flush of some sealed segment committed but reported an
+		// error (timeout, lost connection). Retrying the whole batch would hit
+		// the same marker forever, so persist segment by segment instead.
+		logger.WarnContext(ctx, "memtap flush hit an already flushed segment, flushing per segment", "segments", len(segments))
+		err = e.flushSegments(ctxTimeout, segments, users, daily, reserveDelta)
+		if err != nil {
+			flushSeconds.With("error").Since(start)
+			e.flushErrors.Add(1)
+			return err
+		}
+		flushSeconds.With("ok").Since(start)
+		e.lastFlushUnix.Store(time.Now().UTC().Unix())
+		e.flushCount.Add(1)
+		return nil
+	}
+	if err != nil {
+		flushSeconds.With("error").Since(start)
 		e.mergePending(users, daily, reserveDelta)
 		e.flushErrors.Add(1)
 		return err
 	}
+	flushSeconds.With("ok").Since(start)
+	if e.wal != nil {
+		e.wal.truncate(segments)
+	}
 
 	e.lastFlushUnix.Store(time.Now().UTC().Unix())
 	e.flushCount.Add(1)
 	return nil
 }
 
-func (e *Engine) snapshotPending() ([]db.UserTapAggregate, []db.DailyTapAggregate, int64) {
+// flushSegments persists sealed segments one at a time, the way ReplayWAL
+// does. The snapshot passed in equals the union of the segments: segments
+// that commit now or were committed earlier are truncated, and only the
+// deltas of segments still unpersisted go back to pending.
+func (e *Engine) flushSegments(ctx context.Context, segments []string, users []db.UserTapAggregate, daily []db.DailyTapAggregate, reserveDelta int64) error {
+	type segmentDeltas struct {
+		users        []db.UserTapAggregate
+		daily        []db.DailyTapAggregate
+		reserveDelta int64
+	}
+	read := make([]segmentDeltas, 0, len(segments))
+	for _, name := range segments {
+		u, d, r, err := e.wal.readSegment(name)
+		if err != nil {
+			e.mergePending(users, daily, reserveDelta)
+			return fmt.Errorf("read segment %s: %w", name, err)
+		}
+		read = append(read, segmentDeltas{users: u, daily: d, reserveDelta: r})
+	}
+
+	for i, name := range segments {
+		seg := read[i]
+		err := e.db.ApplyTapAggregates(ctx, seg.users, seg.daily, seg.reserveDelta, "memtap", []string{walEventID(name)})
+		switch {
+		case err == nil:
+		case errors.Is(err, db.ErrAlreadyExists):
+			logger.InfoContext(ctx, "wal segment already flushed", "segment", name)
+		default:
+			for _, rest := range read[i:] {
+				e.mergePending(rest.users, rest.daily, rest.reserveDelta)
+			}
+			return fmt.Errorf("flush segment %s: %w", name, err)
+		}
+		e.wal.truncate([]string{name})
+	}
+	return nil
+}
+
+func (e *Engine) snapshotPending() ([]db.UserTapAggregate, []db.DailyTapAggregate, int64, []string, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	// Seal the WAL under the same lock so the sealed segments hold exactly the pending deltas.
+	var segments []string
+	if e.wal != nil {
+		var err error
+		if segments, err = e.wal.cut(); err != nil {
+			return nil, nil, 0, nil, err
+		}
+	}
+
 	users := make([]db.UserTapAggregate, 0, len(e.pendingUsers))
 	for userID, delta := range e.pendingUsers {
 		if userID <= 0 {
@@ -527,7 +827,7 @@ func (e *Engine) snapshotPending() ([]db.UserTapAggregate, []db.DailyTapAggregat
 	e.pendingDaily = map[dailyKey]int64{}
 	e.pendingReserve = 0
 
-	return users, daily, reserveDelta
+	return users, daily, reserveDelta, segments, nil
 }
 
 func (e *Engine) mergePending(users []db.UserTapAggregate, daily []db.DailyTapAggregate, reserveDelta int64) {
@@ -541,8 +841,9 @@ func (e *Engine) mergePending(users []db.UserTapAggregate, daily []db.DailyTapAg
 		d := e.pendingUsers[u.UserID]
 		d.BalanceDelta += u.BalanceDelta
 		d.TapsDelta += u.TapsDelta
-		d.Energy = u.Energy
-		if u.EnergyUpdatedAt.After(d.EnergyAt) {
+		// Taps made since the snapshot carry newer energy; keep it.
+		if !u.EnergyUpdatedAt.Before(d.EnergyAt) {
+			d.Energy = u.Energy
 			d.EnergyAt = u.EnergyUpdatedAt
 		}
 		e.pendingUsers[u.UserID] = d
@@ -559,19 +860,36 @@ func (e *Engine) mergePending(users []db.UserTapAggregate, daily []db.DailyTapAg
 	e.pendingReserve += reserveDelta
 }
 
-func (e *Engine) InvalidateUser(userID int64) {
+// InvalidateUser drops the cached user so it is reloaded from Postgres.
+// Pending deltas are kept: they are already in the WAL and will be flushed.
+func (e *Engine) InvalidateUser(ctx context.Context, userID int64) {
 	if !e.Enabled() || userID <= 0 {
 		return
 	}
 	e.mu.Lock()
 	delete(e.users, userID)
-	delete(e.pendingUsers, userID)
-	for k := range e.pendingDaily {
-		if k.UserID == userID {
-			delete(e.pendingDaily, k)
+	e.mu.Unlock()
+	if e.leases != nil {
+		// The owner may be another replica.
+		if err := e.db.NotifyMemtapInvalidate(ctx, userID); err != nil {
+			logger.WarnContext(ctx, "notify invalidate failed", "target_user", userID, "err", err)
 		}
 	}
+}
+
+// SetTapReward switches minting to a new halving reward right away instead
+// of waiting for the next system refresh.
+func (e *Engine) SetTapReward(ctx context.Context, rewardBP, epoch int64) error {
+	if !e.Enabled() {
+		return nil
+	}
+	e.mu.Lock()
+	if epoch >= e.halvingEpoch {
+		e.tapRewardBP = rewardBP
+		e.halvingEpoch = epoch
+	}
 	e.mu.Unlock()
+	return nil
 }
 
 func (e *Engine) MarkSystemDirty() {
@@ -597,6 +915,10 @@ func (e *Engine) cleanupStaleUsers() {
 		if _, hasPending := e.pendingUsers[userID]; hasPending {
 			continue
 		}
+		if e.leases != nil && e.leases.check(userID) != nil {
+			delete(e.users, userID)
+			continue
+		}
 		if u.LastTouched.Before(cutoff) {
 			delete(e.users, userID)
 		}
@@ -604,7 +926,7 @@ func (e *Engine) cleanupStaleUsers() {
 	e.mu.Unlock()
 }
 
-func (e *Engine) Stats() map[string]any {
+func (e *Engine) Stats(ctx context.Context) map[string]any {
 	out := map[string]any{
 		"enabled": e.Enabled(),
 	}
@@ -618,6 +940,8 @@ func (e *Engine) Stats() map[string]any {
 	out["pending_daily"] = len(e.pendingDaily)
 	out["pending_reserve_delta"] = e.pendingReserve
 	out["reserve_cached"] = e.reserve
+	out["tap_reward_bp"] = e.tapRewardBP
+	out["halving_epoch"] = e.halvingEpoch
 	out["system_loaded"] = !e.systemLoadedAt.IsZero()
 	if !e.systemLoadedAt.IsZero() {
 		out["system_loaded_at"] = e.systemLoadedAt.Unix()
@@ -628,46 +952,22 @@ func (e *Engine) Stats() map[string]any {
 	out["last_flush_ts"] = e.lastFlushUnix.Load()
 	out["flush_count"] = e.flushCount.Load()
 	out["flush_errors"] = e.flushErrors.Load()
-	return out
-}
-
-func energyParams(u *userState, now time.Time, baseRegen float64) (regen float64, eMax float64) {
-	eMax = u.EnergyMax
-	if eMax <= 0 {
-		eMax = 0
-	}
-	regen = baseRegen
-	if regen < 0 {
-		regen = 0
+	out["wal_enabled"] = e.wal != nil
+	if e.wal != nil {
+		e.wal.mu.Lock()
+		out["wal_sealed_segments"] = len(e.wal.sealed)
+		out["wal_active_bytes"] = e.wal.size
+		e.wal.mu.Unlock()
 	}
-	if now.Before(u.BoostUntil) {
-		regen = regen * u.BoostRegenMul
-		eMax = eMax * u.BoostMaxMul
+	out["leases_enabled"] = e.leases != nil
+	if e.leases != nil {
+		out["leases"] = e.leaseStats()
 	}
-	if regen < 0 {
-		regen = 0
-	}
-	if eMax < 0 {
-		eMax = 0
-	}
-	return regen, eMax
+	return out
 }
 
-func regenEnergy(current float64, eMax float64, regenPerSec float64, updatedAt, now time.Time) float64 {
-	if eMax <= 0 {
-		return 0
-	}
-	if current < 0 {
-		current = 0
-	}
-	dt := now.Sub(updatedAt).Seconds()
-	if dt > 0 {
-		current = current + dt*regenPerSec
-	}
-	if current > eMax {
-		current = eMax
-	}
-	return current
+func (e *Engine) energyParams(u *userState, now time.Time) (eMax float64, regen float64) {
+	return tapcore.EnergyParams(u.EnergyMax, config.Econ().EnergyRegenPerSec, u.BoostUntil, u.BoostRegenMul, u.BoostMaxMul, now)
 }
 
 func min4(a, b, c, d int64) int64 {
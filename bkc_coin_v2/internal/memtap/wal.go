@@ -0,0 +1,259 @@
+package memtap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bkc_coin_v2/internal/db"
+)
+
+// wal is an append-only log of minted taps. Every successful Tap appends one
+// record before returning, so pending deltas survive a crash between flushes.
+//
+// Invariant: the union of all segments on disk equals the engine's pending
+// deltas. Flush seals the active segment, persists the pending snapshot and
+// then deletes the sealed segments. Each segment name doubles as a ledger
+// event_id so replaying an already-flushed segment is a no-op.
+type wal struct {
+	dir          string
+	segmentBytes int64
+	fsync        bool
+
+	mu     sync.Mutex
+	active *os.File
+	name   string
+	size   int64
+	sealed []string
+}
+
+type walRecord struct {
+	UserID   int64   `json:"u"`
+	Gained   int64   `json:"g"` // coins
+	Taps     int64   `json:"n,omitempty"`
+	Day      string  `json:"d"`
+	Energy   float64 `json:"e"`
+	EnergyAt int64   `json:"t"`
+}
+
+const walExt = ".wal"
+
+func openWAL(dir string, segmentBytes int64, fsync bool) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	w := &wal{dir: dir, segmentBytes: segmentBytes, fsync: fsync}
+	existing, err := w.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	// Segments left from a previous run are sealed until replay removes them.
+	w.sealed = existing
+	return w, nil
+}
+
+func (w *wal) listSegments() ([]string, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(entries))
+	for _, ent := range entries {
+		if ent.IsDir() || !strings.HasSuffix(ent.Name(), walExt) {
+			continue
+		}
+		out = append(out, strings.TrimSuffix(ent.Name(), walExt))
+	}
+	// Names start with a zero-padded unix-nano timestamp, so lexical order is creation order.
+	sort.Strings(out)
+	return out, nil
+}
+
+func (w *wal) path(name string) string {
+	return filepath.Join(w.dir, name+walExt)
+}
+
+func (w *wal) append(rec walRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.active != nil && w.size+int64(len(line)) > w.segmentBytes {
+		if err := w.sealLocked(); err != nil {
+			return err
+		}
+	}
+	if w.active == nil {
+		if err := w.openSegmentLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := w.active.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if w.fsync {
+		return w.active.Sync()
+	}
+	return nil
+}
+
+func (w *wal) openSegmentLocked() error {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	name := fmt.Sprintf("%020d-%s", time.Now().UTC().UnixNano(), hex.EncodeToString(b))
+	f, err := os.OpenFile(w.path(name), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	w.active = f
+	w.name = name
+	w.size = 0
+	return nil
+}
+
+func (w *wal) sealLocked() error {
+	if w.active == nil {
+		return nil
+	}
+	err := w.active.Sync()
+	if cerr := w.active.Close(); err == nil {
+		err = cerr
+	}
+	w.sealed = append(w.sealed, w.name)
+	w.active = nil
+	w.name = ""
+	w.size = 0
+	return err
+}
+
+// cut seals the active segment and returns every sealed segment. Must be
+// called under the engine lock so the result matches the pending snapshot.
+func (w *wal) cut() ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.sealLocked(); err != nil {
+		return nil, err
+	}
+	return append([]string(nil), w.sealed...), nil
+}
+
+// truncate removes segments whose records are now persisted in Postgres.
+func (w *wal) truncate(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	done := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		done[name] = struct{}{}
+		_ = os.Remove(w.path(name))
+	}
+	w.mu.Lock()
+	kept := w.sealed[:0]
+	for _, name := range w.sealed {
+		if _, ok := done[name]; !ok {
+			kept = append(kept, name)
+		}
+	}
+	w.sealed = kept
+	w.mu.Unlock()
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sealLocked()
+}
+
+// readSegment aggregates one segment into tap deltas. Only a torn trailing
+// line (crash mid-write, no newline) is ignored; any other line that does not
+// decode to a valid record fails the read, so the segment is kept for an
+// operator instead of being truncated with taps silently missing.
+func (w *wal) readSegment(name string) ([]db.UserTapAggregate, []db.DailyTapAggregate, int64, error) {
+	f, err := os.Open(w.path(name))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer f.Close()
+
+	users := map[int64]*db.UserTapAggregate{}
+	daily := map[dailyKey]int64{}
+	var reserveDelta int64
+
+	rd := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := rd.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, nil, 0, err
+		}
+		complete := len(line) > 0 && line[len(line)-1] == '\n'
+		if !complete {
+			// EOF: either a clean end or a torn tail.
+			break
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, nil, 0, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if rec.UserID <= 0 || rec.Gained < 0 || rec.Taps < 0 || (rec.Gained == 0 && rec.Taps == 0) {
+			return nil, nil, 0, fmt.Errorf("line %d: invalid record %s", lineNo, bytes.TrimSpace(line))
+		}
+		u := users[rec.UserID]
+		if u == nil {
+			u = &db.UserTapAggregate{UserID: rec.UserID}
+			users[rec.UserID] = u
+		}
+		taps := rec.Taps
+		if taps <= 0 {
+			// Segments written before per-user tap power: one coin per tap.
+			taps = rec.Gained
+		}
+		u.BalanceDelta += rec.Gained
+		u.TapsDelta += taps
+		at := time.Unix(0, rec.EnergyAt).UTC()
+		if !at.Before(u.EnergyUpdatedAt) {
+			u.Energy = rec.Energy
+			u.EnergyUpdatedAt = at
+		}
+		daily[dailyKey{UserID: rec.UserID, Day: rec.Day}] += taps
+		reserveDelta -= rec.Gained
+	}
+	outUsers := make([]db.UserTapAggregate, 0, len(users))
+	for _, u := range users {
+		outUsers = append(outUsers, *u)
+	}
+	outDaily := make([]db.DailyTapAggregate, 0, len(daily))
+	for k, tapped := range daily {
+		outDaily = append(outDaily, db.DailyTapAggregate{UserID: k.UserID, Day: k.Day, TappedDelta: tapped})
+	}
+	return outUsers, outDaily, reserveDelta, nil
+}
+
+func walEventID(segment string) string {
+	return "memtap-wal:" + segment
+}
+
+func walEventIDs(segments []string) []string {
+	out := make([]string, 0, len(segments))
+	for _, s := range segments {
+		out = append(out, walEventID(s))
+	}
+	return out
+}
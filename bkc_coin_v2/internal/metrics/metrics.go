@@ -0,0 +1,413 @@
+// Package metrics exposes process metrics in the Prometheus text format
+// (version 0.0.4) without the client library.
+//
+// Hot paths record into counters, gauges and histograms registered once at
+// package level. Values that already live elsewhere (queue lengths, pool
+// stats, subsystem GetMetrics structs) are read at scrape time by
+// collectors, so nothing has to be mirrored.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefBuckets are latency buckets in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry served on /metrics.
+var Default = NewRegistry()
+
+// Collector writes values read at scrape time.
+type Collector func(ctx context.Context, w *Writer)
+
+type Registry struct {
+	mu         sync.Mutex
+	vecs       []*vec
+	byName     map[string]*vec
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{byName: map[string]*vec{}}
+}
+
+type vec struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	bits   atomic.Uint64   // counter/gauge value; histogram sum
+	counts []atomic.Uint64 // histogram: per bucket, the last one is +Inf
+}
+
+func (s *series) add(d float64) {
+	for {
+		old := s.bits.Load()
+		if s.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+d)) {
+			return
+		}
+	}
+}
+
+func (s *series) value() float64 { return math.Float64frombits(s.bits.Load()) }
+
+// register returns the vec called name, creating it on first use. Packages
+// declare their metrics as package vars, so a clash is a programming error.
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.byName[name]; ok {
+		if v.typ != typ || len(v.labels) != len(labels) {
+			panic("metrics: " + name + " registered twice with different shapes")
+		}
+		return v
+	}
+	v := &vec{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: map[string]*series{}}
+	r.vecs = append(r.vecs, v)
+	r.byName[name] = v
+	return v
+}
+
+// Collect adds a collector run on every scrape.
+func (r *Registry) Collect(c Collector) {
+	if c == nil {
+		return
+	}
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+func (v *vec) with(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	s := v.series[key]
+	v.mu.RUnlock()
+	if s != nil {
+		return s
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s = v.series[key]; s == nil {
+		s = &series{values: append([]string(nil), values...)}
+		if v.typ == "histogram" {
+			s.counts = make([]atomic.Uint64, len(v.buckets)+1)
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+type CounterVec struct{ v *vec }
+
+// Counter registers a counter; labels are the label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, "counter", nil, labels)}
+}
+
+func (c *CounterVec) With(values ...string) Counter { return Counter{c.v.with(values)} }
+
+type Counter struct{ s *series }
+
+func (c Counter) Inc() { c.s.add(1) }
+
+// Add adds d; negative values are ignored, counters only go up.
+func (c Counter) Add(d float64) {
+	if d > 0 {
+		c.s.add(d)
+	}
+}
+
+type GaugeVec struct{ v *vec }
+
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, "gauge", nil, labels)}
+}
+
+func (g *GaugeVec) With(values ...string) Gauge { return Gauge{g.v.with(values)} }
+
+type Gauge struct{ s *series }
+
+func (g Gauge) Set(v float64) { g.s.bits.Store(math.Float64bits(v)) }
+func (g Gauge) Add(d float64) { g.s.add(d) }
+
+type HistogramVec struct{ v *vec }
+
+// Histogram registers a histogram with the given upper bounds (sorted).
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.register(name, help, "histogram", buckets, labels)}
+}
+
+func (h *HistogramVec) With(values ...string) Histogram {
+	return Histogram{h.v.with(values), h.v.buckets}
+}
+
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+func (h Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.s.counts[i].Add(1)
+	h.s.add(v)
+}
+
+// Since observes the seconds elapsed since start.
+func (h Histogram) Since(start time.Time) { h.Observe(time.Since(start).Seconds()) }
+
+// Writer collects samples grouped by metric name, so collectors may write
+// in any order and every family still comes out in one block.
+type Writer struct {
+	fams  map[string]*family
+	order []string
+}
+
+type family struct {
+	help  string
+	typ   string
+	lines []string
+}
+
+func (w *Writer) family(name, help, typ string) *family {
+	if w.fams == nil {
+		w.fams = map[string]*family{}
+	}
+	f := w.fams[name]
+	if f == nil {
+		f = &family{help: help, typ: typ}
+		w.fams[name] = f
+		w.order = append(w.order, name)
+	}
+	return f
+}
+
+// Gauge writes one gauge sample; labels are name/value pairs.
+func (w *Writer) Gauge(name, help string, v float64, labels ...string) {
+	f := w.family(name, help, "gauge")
+	f.lines = append(f.lines, sample(name, labels, v))
+}
+
+// Counter writes one counter sample of a total kept elsewhere.
+func (w *Writer) Counter(name, help string, v float64, labels ...string) {
+	f := w.family(name, help, "counter")
+	f.lines = append(f.lines, sample(name, labels, v))
+}
+
+// Values writes the numeric and boolean entries of a stats map (the shape
+// the tap backends return from Stats) as gauges named prefix_key. Nested
+// maps extend the prefix; strings are skipped.
+func (w *Writer) Values(prefix string, m map[string]any, labels ...string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := prefix + "_" + sanitize(k)
+		switch x := m[k].(type) {
+		case map[string]any:
+			w.Values(name, x, labels...)
+		default:
+			if v, ok := number(x); ok {
+				w.Gauge(name, "", v, labels...)
+			}
+		}
+	}
+}
+
+func number(x any) (float64, bool) {
+	switch v := x.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case time.Duration:
+		return v.Seconds(), true
+	}
+	return 0, false
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func sample(name string, labels []string, v float64) string {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) >= 2 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escape(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	return b.String()
+}
+
+func escape(s string) string {
+	if !strings.ContainsAny(s, "\\\"\n") {
+		return s
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (v *vec) write(w *Writer) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	all := make([]*series, len(keys))
+	for i, k := range keys {
+		all[i] = v.series[k]
+	}
+	v.mu.RUnlock()
+
+	f := w.family(v.name, v.help, v.typ)
+	for _, s := range all {
+		labels := make([]string, 0, 2*len(v.labels)+2)
+		for i, name := range v.labels {
+			labels = append(labels, name, s.values[i])
+		}
+		if v.typ != "histogram" {
+			f.lines = append(f.lines, sample(v.name, labels, s.value()))
+			continue
+		}
+		var cum uint64
+		for i := range s.counts {
+			cum += s.counts[i].Load()
+			le := math.Inf(1)
+			if i < len(v.buckets) {
+				le = v.buckets[i]
+			}
+			f.lines = append(f.lines, sample(v.name+"_bucket", append(labels, "le", formatFloat(le)), float64(cum)))
+		}
+		f.lines = append(f.lines,
+			sample(v.name+"_sum", labels, s.value()),
+			sample(v.name+"_count", labels, float64(cum)))
+	}
+}
+
+// WriteTo writes every registered metric and the collectors' samples.
+func (r *Registry) WriteTo(ctx context.Context, out io.Writer) error {
+	r.mu.Lock()
+	vecs := append([]*vec(nil), r.vecs...)
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	w := &Writer{}
+	for _, v := range vecs {
+		v.write(w)
+	}
+	for _, c := range collectors {
+		c(ctx, w)
+	}
+
+	bw := bufio.NewWriter(out)
+	for _, name := range w.order {
+		f := w.fams[name]
+		if len(f.lines) == 0 {
+			continue
+		}
+		if f.help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", name, f.help)
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, f.typ)
+		for _, l := range f.lines {
+			bw.WriteString(l)
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry. With a non-empty token the scraper must send
+// it as a Bearer token.
+func (r *Registry) Handler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got := []byte(req.Header.Get("Authorization"))
+		if token != "" && subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		defer cancel()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteTo(ctx, w)
+	})
+}
+
+// Runtime is a collector of Go runtime stats.
+func Runtime(ctx context.Context, w *Writer) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	w.Gauge("go_goroutines", "Goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	w.Gauge("go_memstats_heap_alloc_bytes", "Heap bytes allocated and in use.", float64(m.HeapAlloc))
+	w.Gauge("go_memstats_sys_bytes", "Bytes obtained from the OS.", float64(m.Sys))
+	w.Counter("go_gc_cycles_total", "Completed GC cycles.", float64(m.NumGC))
+	w.Counter("go_gc_pause_seconds_total", "Total GC stop-the-world pause.", float64(m.PauseTotalNs)/1e9)
+}
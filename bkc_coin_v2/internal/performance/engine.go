@@ -7,6 +7,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"bkc_coin_v2/internal/metrics"
 )
 
 // HighPerformanceEngine высокопроизводительный движок для обработки нагрузки
@@ -460,7 +462,27 @@ func (e *HighPerformanceEngine) GetMetrics() Metrics {
 	e.metrics.mu.RLock()
 	defer e.metrics.mu.RUnlock()
 
-	return *e.metrics
+	return Metrics{
+		TasksProcessed: atomic.LoadInt64(&e.metrics.TasksProcessed),
+		TasksFailed:    atomic.LoadInt64(&e.metrics.TasksFailed),
+		TasksRetried:   atomic.LoadInt64(&e.metrics.TasksRetried),
+		AvgProcessTime: e.metrics.AvgProcessTime,
+		ActiveWorkers:  atomic.LoadInt64(&e.metrics.ActiveWorkers),
+		QueueSize:      atomic.LoadInt64(&e.metrics.QueueSize),
+		MemoryUsage:    atomic.LoadInt64(&e.metrics.MemoryUsage),
+		Goroutines:     atomic.LoadInt64(&e.metrics.Goroutines),
+	}
+}
+
+// WriteMetrics отдает GetMetrics в /metrics (metrics.Collector)
+func (e *HighPerformanceEngine) WriteMetrics(ctx context.Context, w *metrics.Writer) {
+	m := e.GetMetrics()
+	w.Counter("bkc_engine_tasks_processed_total", "Обработанные задачи", float64(m.TasksProcessed))
+	w.Counter("bkc_engine_tasks_failed_total", "Задачи с ошибкой", float64(m.TasksFailed))
+	w.Counter("bkc_engine_tasks_retried_total", "Повторенные задачи", float64(m.TasksRetried))
+	w.Gauge("bkc_engine_avg_process_seconds", "Среднее время обработки задачи", m.AvgProcessTime.Seconds())
+	w.Gauge("bkc_engine_active_workers", "Занятые воркеры", float64(m.ActiveWorkers))
+	w.Gauge("bkc_engine_queue_size", "Задачи в очередях", float64(m.QueueSize))
 }
 
 // Stop останавливает движок
@@ -8,8 +8,25 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"bkc_coin_v2/internal/metrics"
+)
+
+var (
+	rejections = metrics.Default.Counter("bkc_guard_rejections_total",
+		"Requests refused by the guard, by reason.", "reason")
+	bans = metrics.Default.Counter("bkc_guard_bans_total",
+		"IPs banned after repeated auth failures.")
 )
 
+// count records a refusal for reason and passes allow through.
+func count(reason string, allow bool) bool {
+	if !allow {
+		rejections.With(reason).Inc()
+	}
+	return allow
+}
+
 type Config struct {
 	Enabled bool
 
@@ -188,19 +205,20 @@ func (g *Guard) IsBanned(ip string) bool {
 		delete(g.bannedUntil, ip)
 		return false
 	}
+	rejections.With("banned").Inc()
 	return true
 }
 
 func (g *Guard) AllowPublic(ip string) bool {
-	return g.allowIP(ip, g.cfg.PublicRate, g.cfg.PublicBurst)
+	return count("public_rate", g.allowIP(ip, g.cfg.PublicRate, g.cfg.PublicBurst))
 }
 
 func (g *Guard) AllowAPI(ip string) bool {
-	return g.allowIP(ip, g.cfg.APIRate, g.cfg.APIBurst)
+	return count("api_rate", g.allowIP(ip, g.cfg.APIRate, g.cfg.APIBurst))
 }
 
 func (g *Guard) AllowTapIP(ip string) bool {
-	return g.allowIP(ip, g.cfg.TapIPRate, g.cfg.TapIPBurst)
+	return count("tap_ip_rate", g.allowIP(ip, g.cfg.TapIPRate, g.cfg.TapIPBurst))
 }
 
 func (g *Guard) AllowTapUser(userID int64) bool {
@@ -218,7 +236,7 @@ func (g *Guard) AllowTapUser(userID int64) bool {
 	}
 	allow := allowBucket(b, now, g.cfg.TapUserRate, g.cfg.TapUserBurst, 1)
 	b.LastSeen = now
-	return allow
+	return count("tap_user_rate", allow)
 }
 
 func (g *Guard) RecordAuthFail(ip string) {
@@ -251,6 +269,7 @@ func (g *Guard) RecordAuthFail(ip string) {
 	fs.LastSeen = now
 	if fs.Count >= g.cfg.AuthFailThreshold {
 		g.bannedUntil[ip] = now.Add(time.Duration(g.cfg.BanSec) * time.Second)
+		bans.With().Inc()
 		fs.Count = 0
 		fs.WindowFrom = now
 	}
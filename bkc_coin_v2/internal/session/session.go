@@ -0,0 +1,360 @@
+// Package session issues WebApp session tokens in exchange for Telegram
+// initData.
+//
+// /auth/session verifies initData once (HMAC and auth_date age) and returns a
+// short-lived access token plus a refresh token. Both are
+// "bkc1.<payload>.<mac>" with an HMAC-SHA256 over the base64url JSON payload.
+// Access tokens are checked offline against the signature, the expiry and
+// a revocation list that every node reloads from auth_sessions. Refresh
+// tokens are checked against the database and rotate: each refresh bumps the
+// session's generation, and presenting an older refresh token again revokes
+// the whole session (it was copied).
+package session
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/telegram"
+)
+
+var logger = logx.Component("session")
+
+const tokenPrefix = "bkc1."
+
+const (
+	KindAccess  = "a"
+	KindRefresh = "r"
+)
+
+var (
+	ErrInvalid = errors.New("invalid token")
+	ErrExpired = errors.New("token expired")
+	ErrRevoked = errors.New("session revoked")
+)
+
+// Repo is the auth_sessions table; *db.DB implements it.
+type Repo interface {
+	CreateAuthSession(ctx context.Context, sessionID string, userID int64, expiresAt time.Time) error
+	RotateAuthSession(ctx context.Context, sessionID string, gen int64, expiresAt time.Time) (bool, error)
+	RevokeAuthSession(ctx context.Context, sessionID string, userID int64, reason string) (bool, error)
+	RevokeUserAuthSessions(ctx context.Context, userID int64, reason string) ([]string, error)
+	RevokedAuthSessions(ctx context.Context) ([]string, error)
+	PurgeAuthSessions(ctx context.Context) (int64, error)
+}
+
+type Config struct {
+	Secret         string        // HMAC key; empty = derived from the bot token
+	AccessTTL      time.Duration // access token lifetime
+	RefreshTTL     time.Duration // refresh token lifetime, renewed on every refresh
+	InitDataMaxAge time.Duration // max auth_date age accepted by /auth/session
+	LegacyMaxAge   time.Duration // max auth_date age of raw initData on other endpoints
+	RequireSession bool          // reject raw initData on other endpoints
+	RevokedPoll    time.Duration // how often the revocation list is reloaded
+}
+
+func ConfigFromEnv() Config {
+	c := Config{
+		Secret:         strings.TrimSpace(os.Getenv("SESSION_SECRET")),
+		AccessTTL:      15 * time.Minute,
+		RefreshTTL:     7 * 24 * time.Hour,
+		InitDataMaxAge: time.Hour,
+		LegacyMaxAge:   24 * time.Hour,
+		RevokedPoll:    15 * time.Second,
+	}
+	if n, ok := envInt("SESSION_TTL_MIN"); ok {
+		c.AccessTTL = time.Duration(clamp(n, 1, 24*60)) * time.Minute
+	}
+	if n, ok := envInt("SESSION_REFRESH_TTL_HOURS"); ok {
+		c.RefreshTTL = time.Duration(clamp(n, 1, 720)) * time.Hour
+	}
+	if n, ok := envInt("INITDATA_MAX_AGE_SEC"); ok {
+		c.InitDataMaxAge = time.Duration(clamp(n, 60, 7*24*3600)) * time.Second
+	}
+	if n, ok := envInt("INITDATA_LEGACY_MAX_AGE_SEC"); ok {
+		// No "unlimited": a leaked initData must expire eventually.
+		c.LegacyMaxAge = time.Duration(clamp(n, 60, 30*24*3600)) * time.Second
+	}
+	if n, ok := envInt("SESSION_REVOKED_POLL_SEC"); ok {
+		c.RevokedPoll = time.Duration(clamp(n, 1, 300)) * time.Second
+	}
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("AUTH_REQUIRE_SESSION"))) {
+	case "1", "true", "yes", "y", "on":
+		c.RequireSession = true
+	}
+	if c.RefreshTTL < c.AccessTTL {
+		c.RefreshTTL = c.AccessTTL
+	}
+	return c
+}
+
+func clamp(n, lo, hi int64) int64 {
+	if n < lo {
+		return lo
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
+
+func envInt(key string) (int64, bool) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// Claims is the token payload.
+type Claims struct {
+	Kind      string `json:"k"`
+	UserID    int64  `json:"uid"`
+	Username  string `json:"un,omitempty"`
+	FirstName string `json:"fn,omitempty"`
+	Lang      string `json:"lc,omitempty"` // Telegram language_code
+	SessionID string `json:"sid"`
+	Gen       int64  `json:"gen,omitempty"` // refresh generation, refresh tokens only
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Pair is what /auth/session and /auth/refresh return.
+type Pair struct {
+	SessionID        string    `json:"session_id"`
+	AccessToken      string    `json:"access_token"`
+	AccessExpiresAt  time.Time `json:"access_expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+type Manager struct {
+	repo Repo
+	cfg  Config
+	key  []byte
+
+	mu      sync.RWMutex
+	revoked map[string]struct{}
+}
+
+// New builds a manager. With no SESSION_SECRET the key is derived from the
+// bot token, which already guards initData.
+func New(repo Repo, botToken string, cfg Config) *Manager {
+	secret := cfg.Secret
+	if secret == "" {
+		secret = botToken
+	}
+	mac := hmac.New(sha256.New, []byte("BKCSession"))
+	mac.Write([]byte(secret))
+	return &Manager{repo: repo, cfg: cfg, key: mac.Sum(nil), revoked: map[string]struct{}{}}
+}
+
+func (m *Manager) Config() Config { return m.cfg }
+
+// IsToken tells a session token from raw initData.
+func IsToken(s string) bool { return strings.HasPrefix(s, tokenPrefix) }
+
+func (m *Manager) sign(c Claims) string {
+	payload, _ := json.Marshal(c)
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(tokenPrefix + body))
+	return tokenPrefix + body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parse checks the signature, kind and expiry.
+func (m *Manager) parse(token, kind string, now time.Time) (Claims, error) {
+	if !IsToken(token) {
+		return Claims{}, ErrInvalid
+	}
+	body, sig, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), ".")
+	if !ok {
+		return Claims{}, ErrInvalid
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return Claims{}, ErrInvalid
+	}
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(tokenPrefix + body))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return Claims{}, ErrInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return Claims{}, ErrInvalid
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil || c.Kind != kind || c.UserID == 0 || c.SessionID == "" {
+		return Claims{}, ErrInvalid
+	}
+	if now.Unix() >= c.ExpiresAt {
+		return Claims{}, ErrExpired
+	}
+	return c, nil
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (m *Manager) pair(c Claims, now time.Time, refreshExp time.Time) Pair {
+	access := c
+	access.Kind, access.Gen = KindAccess, 0
+	access.IssuedAt, access.ExpiresAt = now.Unix(), now.Add(m.cfg.AccessTTL).Unix()
+	if access.ExpiresAt > refreshExp.Unix() {
+		access.ExpiresAt = refreshExp.Unix()
+	}
+	refresh := c
+	refresh.Kind = KindRefresh
+	refresh.IssuedAt, refresh.ExpiresAt = now.Unix(), refreshExp.Unix()
+	return Pair{
+		SessionID:        c.SessionID,
+		AccessToken:      m.sign(access),
+		AccessExpiresAt:  time.Unix(access.ExpiresAt, 0).UTC(),
+		RefreshToken:     m.sign(refresh),
+		RefreshExpiresAt: refreshExp.UTC(),
+	}
+}
+
+// Issue opens a session for an already verified user.
+func (m *Manager) Issue(ctx context.Context, user telegram.AuthUser, now time.Time) (Pair, error) {
+	sid, err := newSessionID()
+	if err != nil {
+		return Pair{}, err
+	}
+	exp := now.Add(m.cfg.RefreshTTL)
+	if err := m.repo.CreateAuthSession(ctx, sid, user.ID, exp); err != nil {
+		return Pair{}, err
+	}
+	c := Claims{UserID: user.ID, Username: user.Username, FirstName: user.FirstName, Lang: user.LanguageCode, SessionID: sid, Gen: 1}
+	return m.pair(c, now, exp), nil
+}
+
+// Refresh trades a refresh token for a new pair. A refresh token that was
+// already used revokes the session.
+func (m *Manager) Refresh(ctx context.Context, refreshToken string, now time.Time) (Pair, error) {
+	c, err := m.parse(refreshToken, KindRefresh, now)
+	if err != nil {
+		return Pair{}, err
+	}
+	exp := now.Add(m.cfg.RefreshTTL)
+	ok, err := m.repo.RotateAuthSession(ctx, c.SessionID, c.Gen, exp)
+	if err != nil {
+		return Pair{}, err
+	}
+	if !ok {
+		if _, err := m.repo.RevokeAuthSession(ctx, c.SessionID, 0, "refresh token reuse"); err != nil {
+			return Pair{}, err
+		}
+		m.markRevoked(c.SessionID)
+		return Pair{}, ErrRevoked
+	}
+	c.Gen++
+	return m.pair(c, now, exp), nil
+}
+
+// Verify checks an access token offline.
+func (m *Manager) Verify(token string, now time.Time) (Claims, error) {
+	c, err := m.parse(token, KindAccess, now)
+	if err != nil {
+		return Claims{}, err
+	}
+	m.mu.RLock()
+	_, revoked := m.revoked[c.SessionID]
+	m.mu.RUnlock()
+	if revoked {
+		return Claims{}, ErrRevoked
+	}
+	return c, nil
+}
+
+// Revoke ends one session of the user.
+func (m *Manager) Revoke(ctx context.Context, userID int64, sessionID, reason string) error {
+	if _, err := m.repo.RevokeAuthSession(ctx, sessionID, userID, reason); err != nil {
+		return err
+	}
+	m.markRevoked(sessionID)
+	return nil
+}
+
+// RevokeAll ends every session of the user and returns how many were live.
+func (m *Manager) RevokeAll(ctx context.Context, userID int64, reason string) (int, error) {
+	ids, err := m.repo.RevokeUserAuthSessions(ctx, userID, reason)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		m.markRevoked(id)
+	}
+	return len(ids), nil
+}
+
+func (m *Manager) markRevoked(sessionID string) {
+	m.mu.Lock()
+	m.revoked[sessionID] = struct{}{}
+	m.mu.Unlock()
+}
+
+// Reload replaces the revocation list with the database's.
+func (m *Manager) Reload(ctx context.Context) error {
+	ids, err := m.repo.RevokedAuthSessions(ctx)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	m.mu.Lock()
+	m.revoked = set
+	m.mu.Unlock()
+	return nil
+}
+
+// Run keeps the revocation list fresh and purges old sessions hourly.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.RevokedPoll)
+	defer ticker.Stop()
+	lastPurge := time.Time{}
+	for {
+		if err := m.Reload(ctx); err != nil && ctx.Err() == nil {
+			logger.WarnContext(ctx, "revocations reload failed", "err", err)
+		}
+		if time.Since(lastPurge) > time.Hour {
+			lastPurge = time.Now()
+			if n, err := m.repo.PurgeAuthSessions(ctx); err != nil {
+				if ctx.Err() == nil {
+					logger.WarnContext(ctx, "purge failed", "err", err)
+				}
+			} else if n > 0 {
+				logger.InfoContext(ctx, "sessions purged", "purged", n)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Package standing runs standing orders: one-off transfers at a given time
+// and daily, weekly or monthly recurring ones.
+//
+// The executor polls Postgres for due orders and pays each slot through the
+// same transfer path as /transfer (fees included). A slot that fails for lack
+// of balance is retried after RetryAfter; after MaxFailures failures in a row
+// the order is paused until the sender resumes it. Both parties get a bot
+// message for every payment and when an order is paused.
+package standing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"bkc_coin_v2/internal/address"
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/events"
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/store"
+	"bkc_coin_v2/internal/tokenomics"
+)
+
+var logger = logx.Component("standing")
+
+// Schedules.
+const (
+	Once    = "once"
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+)
+
+var ErrBadSchedule = errors.New("bad schedule")
+
+// ParseSchedule normalizes a schedule name.
+func ParseSchedule(s string) (string, error) {
+	switch s = strings.ToLower(strings.TrimSpace(s)); s {
+	case Once, Daily, Weekly, Monthly:
+		return s, nil
+	}
+	return "", ErrBadSchedule
+}
+
+// SlotTime is when slot n of an order starting at start is due. Monthly
+// orders keep the day of month of start, clamped to the month's last day
+// (Jan 31 -> Feb 28 -> Mar 31). A one-off order has only slot 0; for later
+// slots SlotTime returns the zero time.
+func SlotTime(schedule string, start time.Time, n int64) time.Time {
+	switch schedule {
+	case Daily:
+		return start.AddDate(0, 0, int(n))
+	case Weekly:
+		return start.AddDate(0, 0, 7*int(n))
+	case Monthly:
+		y, m, d := start.Date()
+		first := time.Date(y, m+time.Month(n), 1, start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), start.Location())
+		if last := first.AddDate(0, 1, -1).Day(); d > last {
+			d = last
+		}
+		return first.AddDate(0, 0, d-1)
+	default:
+		if n == 0 {
+			return start
+		}
+		return time.Time{}
+	}
+}
+
+// NextSlot returns the first slot from or later that is due at or after now,
+// so slots missed while the executor was down are skipped instead of being
+// paid one per pass. A one-off order has no later slot and keeps from.
+func NextSlot(schedule string, start time.Time, from int64, now time.Time) (int64, time.Time) {
+	n, at := from, SlotTime(schedule, start, from)
+	for !at.IsZero() && at.Before(now) {
+		n++
+		at = SlotTime(schedule, start, n)
+	}
+	if at.IsZero() {
+		return from, at
+	}
+	return n, at
+}
+
+// Resume is the reschedule for SetStandingOrderStatus: a recurring order
+// continues from its first slot at or after now, a one-off order keeps its
+// only slot and is paid on the next pass.
+func Resume(now time.Time) func(db.StandingOrder) (int64, time.Time) {
+	return func(o db.StandingOrder) (int64, time.Time) {
+		if o.Schedule == Once {
+			return o.Slot, o.NextRunAt
+		}
+		return NextSlot(o.Schedule, o.StartAt, o.Slot, now)
+	}
+}
+
+// Notifier delivers a text to a Telegram user.
+type Notifier interface {
+	Notify(userID int64, text string) error
+}
+
+// Publisher pushes an event to a user's WebApp stream; *events.Hub
+// implements it.
+type Publisher interface {
+	Publish(userID int64, typ string, data map[string]any)
+}
+
+// HaltChecker reports the supply auditor's halt flag.
+type HaltChecker interface {
+	Halted(ctx context.Context) (bool, string)
+}
+
+type Config struct {
+	Interval    time.Duration // poll period; 0 disables the executor on this node
+	Batch       int64         // orders per poll
+	MaxFailures int64         // failed attempts in a row before the order is paused
+	RetryAfter  time.Duration // delay before a failed slot is tried again
+	Fees        bool          // charge transfer fees; main copies TRANSFER_FEES here
+}
+
+func ConfigFromEnv() Config {
+	c := Config{Interval: 30 * time.Second, Batch: 100, MaxFailures: 3, RetryAfter: time.Hour}
+	if n, ok := envInt("STANDING_ORDERS_EVERY_SEC"); ok {
+		if n < 0 {
+			n = 0
+		}
+		if n > 0 && n < 5 {
+			n = 5
+		}
+		c.Interval = time.Duration(n) * time.Second
+	}
+	if n, ok := envInt("STANDING_ORDERS_BATCH"); ok {
+		if n < 1 {
+			n = 1
+		}
+		if n > 1000 {
+			n = 1000
+		}
+		c.Batch = n
+	}
+	if n, ok := envInt("STANDING_ORDERS_MAX_FAILURES"); ok {
+		if n < 1 {
+			n = 1
+		}
+		if n > 50 {
+			n = 50
+		}
+		c.MaxFailures = n
+	}
+	if n, ok := envInt("STANDING_ORDERS_RETRY_MIN"); ok {
+		if n < 1 {
+			n = 1
+		}
+		if n > 24*60 {
+			n = 24 * 60
+		}
+		c.RetryAfter = time.Duration(n) * time.Minute
+	}
+	return c
+}
+
+func envInt(key string) (int64, bool) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+type Executor struct {
+	db     store.StandingOrders
+	tokens *tokenomics.TokenomicsManager
+	notify Notifier
+	events Publisher
+	halt   HaltChecker
+	cfg    Config
+}
+
+// New builds an executor over *db.DB or any other store.StandingOrders.
+// tokens, notify, pub and halt may be nil: no fees, no messages, no events,
+// no halt check.
+func New(database store.StandingOrders, tokens *tokenomics.TokenomicsManager, notify Notifier, pub Publisher, halt HaltChecker, cfg Config) *Executor {
+	return &Executor{db: database, tokens: tokens, notify: notify, events: pub, halt: halt, cfg: cfg}
+}
+
+// Run executes due orders until ctx is done.
+func (e *Executor) Run(ctx context.Context) {
+	if e.cfg.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		runCtx := logx.WithRequestID(ctx, "")
+		if n, err := e.RunOnce(runCtx, time.Now().UTC()); err != nil {
+			if ctx.Err() == nil {
+				logger.ErrorContext(runCtx, "run failed", "err", err)
+			}
+		} else if n > 0 {
+			logger.InfoContext(runCtx, "orders paid", "paid", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce runs every order due at now, oldest first, and returns how many
+// payments went through. An order that is behind pays its due slot once and
+// moves on to the first slot after now; the slots in between are skipped.
+func (e *Executor) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	if e.halt != nil {
+		if halted, _ := e.halt.Halted(ctx); halted {
+			return 0, nil
+		}
+	}
+	due, err := e.db.DueStandingOrders(ctx, now, e.cfg.Batch)
+	if err != nil {
+		return 0, err
+	}
+	paid := 0
+	for _, o := range due {
+		if ctx.Err() != nil {
+			return paid, ctx.Err()
+		}
+		// Each payment is its own unit of work in the logs.
+		octx := logx.WithRequestID(ctx, "")
+		logx.SetUser(octx, o.FromID)
+		ok, err := e.runOrder(octx, o, now)
+		if err != nil {
+			logger.ErrorContext(octx, "order failed", "order_id", o.OrderID, "err", err)
+			continue
+		}
+		if ok {
+			paid++
+		}
+	}
+	return paid, nil
+}
+
+func (e *Executor) runOrder(ctx context.Context, o db.StandingOrder, now time.Time) (bool, error) {
+	q := tokenomics.TransferQuote{Gross: o.Amount, Net: o.Amount}
+	if e.cfg.Fees && e.tokens != nil {
+		tq, err := e.tokens.QuoteTransfer(ctx, o.FromID, o.Amount)
+		if err != nil {
+			return false, err
+		}
+		q = *tq
+	}
+	spec := db.TransferSpec{
+		FromID:          o.FromID,
+		ToID:            o.ToID,
+		Amount:          q.Gross,
+		FeeBurn:         q.FeeBurned,
+		FeeReserve:      q.FeeReserve,
+		Memo:            o.Memo,
+		StandingOrderID: o.OrderID,
+	}
+	nextSlot, next := NextSlot(o.Schedule, o.StartAt, o.Slot+1, now)
+	ran, err := e.db.ExecuteStandingOrder(ctx, o, spec, nextSlot, next)
+	switch {
+	case err == nil:
+		if ran {
+			text := fmt.Sprintf("🔁 Автоплатёж #%d: переведено %d BKC на %s", o.OrderID, q.Net, address.Format(o.ToID))
+			if q.Fee > 0 {
+				text += fmt.Sprintf(" (комиссия %d BKC)", q.Fee)
+			}
+			e.send(o.FromID, text)
+			e.send(o.ToID, fmt.Sprintf("🔁 Автоплатёж #%d: получено %d BKC от %s", o.OrderID, q.Net, address.Format(o.FromID)))
+			if e.events != nil {
+				e.events.Publish(o.FromID, events.TransferOut, map[string]any{"to": address.Format(o.ToID), "amount": q.Gross, "fee": q.Fee, "memo": o.Memo, "standing_order_id": o.OrderID})
+				e.events.Publish(o.ToID, events.TransferIn, map[string]any{"from": map[string]any{"user_id": o.FromID, "address": address.Format(o.FromID)}, "amount": q.Net, "memo": o.Memo, "standing_order_id": o.OrderID})
+			}
+		}
+		return ran, nil
+	case errors.Is(err, db.ErrNotEnough), errors.Is(err, pgx.ErrNoRows):
+		reason, why := "not enough balance", "не хватает баланса"
+		if !errors.Is(err, db.ErrNotEnough) {
+			reason, why = "account not found", "аккаунт не найден"
+		}
+		paused, ferr := e.db.FailStandingOrder(ctx, o, reason, now.Add(e.cfg.RetryAfter), e.cfg.MaxFailures)
+		if ferr != nil {
+			return false, ferr
+		}
+		if paused {
+			e.send(o.FromID, fmt.Sprintf("⏸ Автоплатёж #%d на %s приостановлен: %d попыток подряд не прошли (%s). Пополните баланс и возобновите его в приложении.", o.OrderID, address.Format(o.ToID), e.cfg.MaxFailures, why))
+			e.send(o.ToID, fmt.Sprintf("⏸ Автоплатёж #%d от %s приостановлен: платёж не прошёл.", o.OrderID, address.Format(o.FromID)))
+		}
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (e *Executor) send(userID int64, text string) {
+	if e.notify == nil {
+		return
+	}
+	if err := e.notify.Notify(userID, text); err != nil {
+		logger.Warn("notify failed", "to_user", userID, "err", err)
+	}
+}
@@ -0,0 +1,95 @@
+package memstore
+
+import (
+	"context"
+	"time"
+
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/db"
+)
+
+var _ audit.Store = (*Store)(nil)
+
+// auditTx appends to the chain of the state an update is working on, so an
+// entry commits or rolls back with the action, as admin_audit does.
+type auditTx struct {
+	s *state
+}
+
+// Head needs no lock: update already holds the store's mutex.
+func (t auditTx) Head(ctx context.Context) (int64, string, error) {
+	if n := len(t.s.audit); n > 0 {
+		last := t.s.audit[n-1]
+		return last.Seq, last.Hash, nil
+	}
+	return 0, "", nil
+}
+
+func (t auditTx) Insert(ctx context.Context, e audit.Entry) error {
+	t.s.audit = append(t.s.audit, e)
+	return nil
+}
+
+// runHook calls a db.TxHook inside update. There is no pgx.Tx here, so the
+// hook gets nil and finds the state's audit.Tx in ctx instead.
+func (s *state) runHook(ctx context.Context, hook db.TxHook, before, after any) error {
+	if hook == nil {
+		return nil
+	}
+	return hook(audit.WithTx(ctx, auditTx{s}), nil, before, after)
+}
+
+func (m *Store) InAuditTx(ctx context.Context, fn func(audit.Tx) error) error {
+	return m.update(ctx, func(s *state) error {
+		return fn(auditTx{s})
+	})
+}
+
+func (m *Store) AuditEntries(ctx context.Context, after int64, limit int) ([]audit.Entry, error) {
+	out := []audit.Entry{}
+	err := m.view(ctx, func(s *state) error {
+		for _, e := range s.audit {
+			if len(out) >= limit {
+				break
+			}
+			if e.Seq > after {
+				out = append(out, e)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) ListAudit(ctx context.Context, f audit.Filter) ([]audit.Entry, error) {
+	out := []audit.Entry{}
+	err := m.view(ctx, func(s *state) error {
+		skip := f.Offset
+		for i := len(s.audit) - 1; i >= 0 && len(out) < f.Limit; i-- {
+			e := s.audit[i]
+			if !f.Match(e) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			out = append(out, e)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) CountAuditSince(ctx context.Context, actorKind string, t time.Time) (int64, error) {
+	var n int64
+	err := m.view(ctx, func(s *state) error {
+		for _, e := range s.audit {
+			if !e.At.Before(t) && (actorKind == "" || e.Actor.Kind == actorKind) {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
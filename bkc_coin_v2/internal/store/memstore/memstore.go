@@ -0,0 +1,1769 @@
+// Package memstore is an in-process store.Store. Every method runs as one
+// transaction over a copy of the state: on error nothing is applied, exactly
+// like the Postgres implementation. Checks and ledger rows mirror internal/db
+// one to one, so the same sequence of calls yields the same balances.
+package memstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/store"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.Store = (*Store)(nil)
+
+type user struct {
+	db.UserState
+	photoURL  string
+	createdAt time.Time
+	seq       int64 // insertion order, ties on createdAt
+}
+
+type referral struct {
+	referrerID int64
+	referredID int64
+	bonus      int64
+}
+
+type ledgerRow struct {
+	id     int64
+	ts     time.Time
+	kind   string
+	fromID int64 // 0 = NULL
+	toID   int64
+	amount int64
+	meta   map[string]any
+	memo   string // transfer_memos: not part of the ledger row
+}
+
+type runKey struct {
+	orderID int64
+	slot    int64
+}
+
+type dailyKey struct {
+	userID int64
+	day    time.Time
+}
+
+type state struct {
+	hasSys bool
+	sys    db.SystemState
+
+	users     map[int64]user
+	referrals []referral
+	ledger    []ledgerRow
+	daily     map[dailyKey]db.UserDaily
+	bankLoans map[int64]db.BankLoan
+	p2pLoans  map[int64]db.P2PLoan
+	listings  map[int64]db.MarketListing
+	images    map[int64]db.MarketListingImage
+	deposits  map[int64]db.Deposit
+	wallets   map[string]string
+	standing  map[int64]db.StandingOrder
+	runs      map[runKey]string // run status: ok | failed
+
+	nfts       map[int64]nft
+	nftOwns    map[ownKey]int64 // qty
+	invoices   map[int64]db.CryptoPayInvoice
+	idem       map[idemKey]idemRow
+	broadcasts map[int64]db.Broadcast
+	audit      []audit.Entry
+
+	nextUser, nextLedger, nextBankLoan, nextP2PLoan, nextListing, nextImage, nextDeposit, nextStanding, nextNFT, nextBroadcast int64
+}
+
+func (s *state) clone() *state {
+	c := *s
+	c.users = maps.Clone(s.users)
+	c.referrals = append([]referral(nil), s.referrals...)
+	// Ledger rows and audit entries are never modified, only appended, so
+	// the backing arrays are shared: a transaction appends past the committed
+	// length and a rollback simply keeps the old, shorter slice header.
+	c.ledger = s.ledger
+	c.audit = s.audit
+	c.daily = maps.Clone(s.daily)
+	c.bankLoans = maps.Clone(s.bankLoans)
+	c.p2pLoans = maps.Clone(s.p2pLoans)
+	c.listings = maps.Clone(s.listings)
+	c.images = maps.Clone(s.images)
+	c.deposits = maps.Clone(s.deposits)
+	c.wallets = maps.Clone(s.wallets)
+	c.standing = maps.Clone(s.standing)
+	c.runs = maps.Clone(s.runs)
+	c.nfts = maps.Clone(s.nfts)
+	c.nftOwns = maps.Clone(s.nftOwns)
+	c.invoices = maps.Clone(s.invoices)
+	c.idem = maps.Clone(s.idem)
+	c.broadcasts = maps.Clone(s.broadcasts)
+	return &c
+}
+
+// Store keeps everything in memory. Now is the clock used for timestamps;
+// tests may replace it before the first call.
+type Store struct {
+	Now func() time.Time
+
+	mu sync.Mutex
+	st *state
+}
+
+func New() *Store {
+	return &Store{
+		Now: time.Now,
+		st: &state{
+			users:     map[int64]user{},
+			daily:     map[dailyKey]db.UserDaily{},
+			bankLoans: map[int64]db.BankLoan{},
+			p2pLoans:  map[int64]db.P2PLoan{},
+			listings:  map[int64]db.MarketListing{},
+			images:    map[int64]db.MarketListingImage{},
+			deposits:  map[int64]db.Deposit{},
+			wallets:   map[string]string{},
+			standing:  map[int64]db.StandingOrder{},
+			runs:      map[runKey]string{},
+
+			nfts:       map[int64]nft{},
+			nftOwns:    map[ownKey]int64{},
+			invoices:   map[int64]db.CryptoPayInvoice{},
+			idem:       map[idemKey]idemRow{},
+			broadcasts: map[int64]db.Broadcast{},
+		},
+	}
+}
+
+func (m *Store) now() time.Time { return m.Now().UTC() }
+
+// update runs fn on a copy of the state and commits it only if fn succeeds.
+func (m *Store) update(ctx context.Context, fn func(s *state) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := m.st.clone()
+	if err := fn(next); err != nil {
+		return err
+	}
+	m.st = next
+	return nil
+}
+
+// view runs fn on the committed state; fn must not modify it.
+func (m *Store) view(ctx context.Context, fn func(s *state) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fn(m.st)
+}
+
+// metaJSON mirrors the jsonb round trip: numbers come back as float64.
+func metaJSON(v any) map[string]any {
+	out := map[string]any{}
+	if v == nil {
+		return out
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return out
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return map[string]any{}
+	}
+	return out
+}
+
+func (s *state) appendLedger(now time.Time, kind string, fromID, toID, amount int64, meta any) {
+	s.nextLedger++
+	s.ledger = append(s.ledger, ledgerRow{
+		id: s.nextLedger, ts: now, kind: kind, fromID: fromID, toID: toID, amount: amount, meta: metaJSON(meta),
+	})
+}
+
+func (s *state) system() (*db.SystemState, error) {
+	if !s.hasSys {
+		return nil, pgx.ErrNoRows
+	}
+	return &s.sys, nil
+}
+
+func (s *state) touch(now time.Time) { s.sys.UpdatedAt = now }
+
+// addBalance is "UPDATE users SET balance=balance+$1": a missing user is a no-op.
+func (s *state) addBalance(userID, delta int64) {
+	if u, ok := s.users[userID]; ok {
+		u.Balance += delta
+		s.users[userID] = u
+	}
+}
+
+func (s *state) lockUser(userID int64) (user, error) {
+	u, ok := s.users[userID]
+	if !ok {
+		return user{}, pgx.ErrNoRows
+	}
+	return u, nil
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func dayUTC(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func clampLimit(limit int64) int {
+	if limit <= 0 || limit > 200 {
+		return 50
+	}
+	return int(limit)
+}
+
+func interestFromBP(amount int64, bp int64) int64 {
+	if amount <= 0 || bp <= 0 {
+		return 0
+	}
+	return (amount * bp) / 10_000
+}
+
+func (m *Store) Ping(ctx context.Context) error { return ctx.Err() }
+
+// ---- system ----
+
+func (m *Store) EnsureSystemState(ctx context.Context, totalSupply, adminUserID, adminAllocated, reserveSupply, startRate, minRate, refStep, refBonus int64) (db.SystemState, error) {
+	now := m.now()
+	err := m.update(ctx, func(s *state) error {
+		if s.hasSys {
+			return nil
+		}
+		s.hasSys = true
+		s.sys = db.SystemState{
+			TotalSupply:       totalSupply,
+			ReserveSupply:     reserveSupply,
+			InitialReserve:    reserveSupply,
+			AdminUserID:       adminUserID,
+			AdminAllocated:    adminAllocated,
+			StartRateCoinsUSD: startRate,
+			MinRateCoinsUSD:   minRate,
+			ReferralStep:      refStep,
+			ReferralBonus:     refBonus,
+			TapRewardBP:       10_000,
+			HalvingThreshold:  100000000,
+			CreatedAt:         now,
+			UpdatedAt:         now,
+		}
+		return nil
+	})
+	if err != nil {
+		return db.SystemState{}, err
+	}
+	return m.GetSystem(ctx)
+}
+
+func (m *Store) GetSystem(ctx context.Context) (db.SystemState, error) {
+	var out db.SystemState
+	err := m.view(ctx, func(s *state) error {
+		sys, err := s.system()
+		if err != nil {
+			return err
+		}
+		out = *sys
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) GetCounters(ctx context.Context) (db.Counters, error) {
+	var c db.Counters
+	err := m.view(ctx, func(s *state) error {
+		c.Users = int64(len(s.users))
+		c.LedgerRows = int64(len(s.ledger))
+		for _, r := range s.ledger {
+			if r.kind == "tap" {
+				c.TapsMinted += r.amount
+			}
+		}
+		return nil
+	})
+	return c, err
+}
+
+func (m *Store) CreditFromReserve(ctx context.Context, userID int64, amount int64, kind string, meta any, hook db.TxHook) error {
+	if amount <= 0 {
+		return nil
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		sys, err := s.system()
+		if err != nil {
+			return err
+		}
+		if sys.ReserveSupply-sys.ReservedSupply < amount {
+			return db.ErrNotEnough
+		}
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		reserve := sys.ReserveSupply
+		sys.ReserveSupply -= amount
+		s.touch(now)
+		s.addBalance(userID, amount)
+		s.appendLedger(now, kind, 0, userID, amount, meta)
+		return s.runHook(ctx, hook,
+			map[string]any{"balance": u.Balance, "reserve": reserve},
+			map[string]any{"balance": u.Balance + amount, "reserve": reserve - amount, "amount": amount},
+		)
+	})
+}
+
+func (m *Store) DebitToReserve(ctx context.Context, userID int64, amount int64, kind string, meta any) error {
+	if amount <= 0 {
+		return nil
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		if u.Balance < amount {
+			return db.ErrNotEnough
+		}
+		s.addBalance(userID, -amount)
+		if s.hasSys {
+			s.sys.ReserveSupply += amount
+			s.touch(now)
+		}
+		s.appendLedger(now, kind, userID, 0, amount, meta)
+		return nil
+	})
+}
+
+func (m *Store) Burn(ctx context.Context, userID int64, amount int64, kind string, meta any) error {
+	if amount <= 0 {
+		return nil
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		if u.Balance < amount {
+			return db.ErrNotEnough
+		}
+		s.addBalance(userID, -amount)
+		s.burnSupply(amount, now)
+		s.appendLedger(now, kind, userID, 0, amount, meta)
+		return nil
+	})
+}
+
+func (s *state) burnSupply(amount int64, now time.Time) {
+	if !s.hasSys {
+		return
+	}
+	s.sys.TotalSupply -= amount
+	if s.sys.TotalSupply < 0 {
+		s.sys.TotalSupply = 0
+	}
+	s.touch(now)
+}
+
+// ---- users ----
+
+func (m *Store) EnsureUser(ctx context.Context, userID int64, username, firstName string, energyMax float64) (db.UserState, error) {
+	now := m.now()
+	err := m.update(ctx, func(s *state) error {
+		if u, ok := s.users[userID]; ok {
+			u.Username = username
+			u.FirstName = firstName
+			s.users[userID] = u
+			return nil
+		}
+		s.nextUser++
+		s.users[userID] = user{
+			UserState: db.UserState{
+				UserID:                     userID,
+				Username:                   username,
+				FirstName:                  firstName,
+				Energy:                     energyMax,
+				EnergyMax:                  energyMax,
+				EnergyUpdatedAt:            now,
+				EnergyBoostUntil:           time.Unix(0, 0).UTC(),
+				EnergyBoostRegenMultiplier: 1,
+				EnergyBoostMaxMultiplier:   1,
+				Level:                      1,
+				TapsPower:                  1,
+			},
+			createdAt: now,
+			seq:       s.nextUser,
+		}
+		return nil
+	})
+	if err != nil {
+		return db.UserState{}, err
+	}
+	return m.GetUser(ctx, userID)
+}
+
+func (m *Store) GetUser(ctx context.Context, userID int64) (db.UserState, error) {
+	var out db.UserState
+	err := m.view(ctx, func(s *state) error {
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		out = u.UserState
+		out.ReferralBonusTotal = 0
+		for _, r := range s.referrals {
+			if r.referrerID == userID {
+				out.ReferralBonusTotal += r.bonus
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) UserExists(ctx context.Context, userID int64) (bool, error) {
+	var ok bool
+	err := m.view(ctx, func(s *state) error {
+		_, ok = s.users[userID]
+		return nil
+	})
+	return ok, err
+}
+
+func (u user) profile() db.UserProfile {
+	return db.UserProfile{UserID: u.UserID, Username: u.Username, FirstName: u.FirstName, PhotoURL: u.photoURL}
+}
+
+func (m *Store) GetUserProfile(ctx context.Context, userID int64) (db.UserProfile, error) {
+	var out db.UserProfile
+	err := m.view(ctx, func(s *state) error {
+		u, err := s.lockUser(userID)
+		out = u.profile()
+		return err
+	})
+	return out, err
+}
+
+func (m *Store) FindUserByUsername(ctx context.Context, username string) (db.UserProfile, error) {
+	var out db.UserProfile
+	err := m.view(ctx, func(s *state) error {
+		found := 0
+		for _, u := range s.users {
+			if u.Username != "" && strings.EqualFold(u.Username, username) {
+				out = u.profile()
+				found++
+			}
+		}
+		switch found {
+		case 0:
+			return pgx.ErrNoRows
+		case 1:
+			return nil
+		default:
+			out = db.UserProfile{}
+			return db.ErrAmbiguous
+		}
+	})
+	return out, err
+}
+
+func (m *Store) SetUserPhoto(ctx context.Context, userID int64, photoURL string) error {
+	return m.update(ctx, func(s *state) error {
+		if u, ok := s.users[userID]; ok {
+			u.photoURL = photoURL
+			s.users[userID] = u
+		}
+		return nil
+	})
+}
+
+func (m *Store) SetUserEnergy(ctx context.Context, userID int64, energy float64, at time.Time) error {
+	return m.update(ctx, func(s *state) error {
+		if u, ok := s.users[userID]; ok {
+			u.Energy = energy
+			u.EnergyUpdatedAt = at
+			s.users[userID] = u
+		}
+		return nil
+	})
+}
+
+func (m *Store) ListUserIDs(ctx context.Context) ([]int64, error) {
+	var out []int64
+	err := m.view(ctx, func(s *state) error {
+		us := make([]user, 0, len(s.users))
+		for _, u := range s.users {
+			us = append(us, u)
+		}
+		sort.Slice(us, func(i, j int) bool {
+			if !us[i].createdAt.Equal(us[j].createdAt) {
+				return us[i].createdAt.Before(us[j].createdAt)
+			}
+			return us[i].seq < us[j].seq
+		})
+		for _, u := range us {
+			out = append(out, u.UserID)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) GetUserDaily(ctx context.Context, userID int64, day time.Time) (db.UserDaily, error) {
+	if day.IsZero() {
+		day = m.now()
+	}
+	day = dayUTC(day)
+	out := db.UserDaily{UserID: userID, Day: day}
+	err := m.view(ctx, func(s *state) error {
+		if d, ok := s.daily[dailyKey{userID, day}]; ok {
+			out.Tapped = d.Tapped
+			out.ExtraQuota = d.ExtraQuota
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) Transfer(ctx context.Context, fromID, toID, amount int64) error {
+	return m.TransferWithFee(ctx, db.TransferSpec{FromID: fromID, ToID: toID, Amount: amount})
+}
+
+func (m *Store) TransferWithFee(ctx context.Context, t db.TransferSpec) error {
+	if t.Amount <= 0 || t.FromID == t.ToID {
+		return nil
+	}
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		return s.transfer(now, t)
+	})
+}
+
+// transfer is shared with standing orders, like db.transferTx.
+func (s *state) transfer(now time.Time, t db.TransferSpec) error {
+	from, err := s.lockUser(t.FromID)
+	if err != nil {
+		return err
+	}
+	if from.Balance < t.Amount {
+		return db.ErrNotEnough
+	}
+	if _, err := s.lockUser(t.ToID); err != nil {
+		return err
+	}
+	s.addBalance(t.FromID, -t.Amount)
+	s.addBalance(t.ToID, t.Net())
+	s.appendLedger(now, "transfer", t.FromID, t.ToID, t.Net(), t.LegMeta())
+	s.ledger[len(s.ledger)-1].memo = t.Memo
+	if t.FeeBurn > 0 {
+		s.burnSupply(t.FeeBurn, now)
+		s.appendLedger(now, "transfer_fee_burn", t.FromID, 0, t.FeeBurn, t.FeeMeta())
+	}
+	if t.FeeReserve > 0 {
+		if s.hasSys {
+			s.sys.ReserveSupply += t.FeeReserve
+			s.touch(now)
+		}
+		s.appendLedger(now, "transfer_fee", t.FromID, 0, t.FeeReserve, t.FeeMeta())
+	}
+	return nil
+}
+
+func (m *Store) UpgradeLevel(ctx context.Context, userID, fromLevel, toLevel, power, cost int64) error {
+	if cost < 0 || toLevel <= fromLevel || power < 1 {
+		return errors.New("bad upgrade")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		if _, err := s.system(); err != nil {
+			return err
+		}
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		if u.Level != fromLevel {
+			return db.ErrAlreadyExists
+		}
+		if u.Balance < cost {
+			return db.ErrNotEnough
+		}
+		u.Balance -= cost
+		u.Level = toLevel
+		u.TapsPower = power
+		s.users[userID] = u
+		s.sys.ReserveSupply += cost
+		s.touch(now)
+		s.appendLedger(now, "upgrade_level", userID, 0, cost, map[string]any{"from_level": fromLevel, "level": toLevel, "taps_power": power})
+		return nil
+	})
+}
+
+func (m *Store) FreezeBalance(ctx context.Context, userID int64, amount int64) error {
+	if userID <= 0 || amount <= 0 {
+		return errors.New("bad params")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		if u.Balance < amount {
+			return db.ErrNotEnough
+		}
+		u.Balance -= amount
+		u.FrozenBalance += amount
+		s.users[userID] = u
+		s.appendLedger(now, "balance_freeze", userID, 0, amount, map[string]any{"amount": amount})
+		return nil
+	})
+}
+
+func (m *Store) UnfreezeBalance(ctx context.Context, userID int64, amount int64) error {
+	if userID <= 0 || amount <= 0 {
+		return errors.New("bad params")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		if u.FrozenBalance < amount {
+			return db.ErrNotEnough
+		}
+		u.Balance += amount
+		u.FrozenBalance -= amount
+		s.users[userID] = u
+		s.appendLedger(now, "balance_unfreeze", userID, 0, amount, map[string]any{"amount": amount})
+		return nil
+	})
+}
+
+func (s *state) wasReferred(referredID int64) bool {
+	for _, r := range s.referrals {
+		if r.referredID == referredID {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Store) WasReferred(ctx context.Context, referredID int64) (bool, error) {
+	var ok bool
+	err := m.view(ctx, func(s *state) error {
+		ok = s.wasReferred(referredID)
+		return nil
+	})
+	return ok, err
+}
+
+func (m *Store) RegisterReferral(ctx context.Context, referrerID, referredID, step, referralBonus int64) (int64, error) {
+	if referrerID == 0 || referredID == 0 || referrerID == referredID {
+		return 0, nil
+	}
+	if step <= 0 || referralBonus < 0 {
+		return 0, nil
+	}
+	now := m.now()
+	var bonus int64
+	err := m.update(ctx, func(s *state) error {
+		bonus = 0
+		if s.wasReferred(referredID) {
+			return nil
+		}
+		sys, err := s.system()
+		if err != nil {
+			return err
+		}
+		available := sys.ReserveSupply - sys.ReservedSupply
+		ref, err := s.lockUser(referrerID)
+		if err != nil {
+			return err
+		}
+		nextCount := ref.ReferralsCount + 1
+		if nextCount%step == 0 && available >= referralBonus {
+			bonus = referralBonus
+		}
+		s.referrals = append(s.referrals, referral{referrerID: referrerID, referredID: referredID, bonus: bonus})
+		ref.ReferralsCount = nextCount
+		if bonus > 0 {
+			sys.ReserveSupply -= bonus
+			s.touch(now)
+			ref.Balance += bonus
+		}
+		s.users[referrerID] = ref
+		if bonus > 0 {
+			s.appendLedger(now, "ref_bonus", 0, referrerID, bonus, map[string]any{"step": step, "count": nextCount})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return bonus, nil
+}
+
+// ---- ledger ----
+
+func (m *Store) RecordLedger(ctx context.Context, kind string, fromID, toID, amount int64, meta any) error {
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		s.appendLedger(now, kind, fromID, toID, amount, meta)
+		return nil
+	})
+}
+
+func (r ledgerRow) entry() db.LedgerEntry {
+	e := db.LedgerEntry{ID: r.id, TS: r.ts, Kind: r.kind, FromID: r.fromID, ToID: r.toID, Amount: r.amount, Meta: maps.Clone(r.meta)}
+	if r.memo != "" {
+		e.Meta["memo"] = r.memo
+	}
+	return e
+}
+
+// ForEachUserLedger matches db.ForEachUserLedger. Rows are collected under
+// the lock and fn runs after it is released, so fn may call the store.
+func (m *Store) ForEachUserLedger(ctx context.Context, f db.HistoryFilter, fn func(db.LedgerEntry) error) error {
+	kinds := map[string]bool{}
+	for _, k := range f.Kinds {
+		kinds[k] = true
+	}
+	var rows []ledgerRow
+	err := m.view(ctx, func(s *state) error {
+		for _, r := range s.ledger {
+			if r.fromID != f.UserID && r.toID != f.UserID {
+				continue
+			}
+			if len(kinds) > 0 && !kinds[r.kind] {
+				continue
+			}
+			if !f.From.IsZero() && r.ts.Before(f.From) {
+				continue
+			}
+			if !f.To.IsZero() && !r.ts.Before(f.To) {
+				continue
+			}
+			if !f.Asc && !f.BeforeTS.IsZero() {
+				if r.ts.After(f.BeforeTS) || (r.ts.Equal(f.BeforeTS) && r.id >= f.BeforeID) {
+					continue
+				}
+			}
+			rows = append(rows, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if !a.ts.Equal(b.ts) {
+			return a.ts.Before(b.ts) == f.Asc
+		}
+		return (a.id < b.id) == f.Asc
+	})
+	if f.Limit > 0 && len(rows) > f.Limit {
+		rows = rows[:f.Limit]
+	}
+	for _, r := range rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(r.entry()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Store) ListUserHistory(ctx context.Context, f db.HistoryFilter) ([]db.LedgerEntry, error) {
+	f.Asc = false
+	out := make([]db.LedgerEntry, 0, f.Limit)
+	err := m.ForEachUserLedger(ctx, f, func(e db.LedgerEntry) error {
+		out = append(out, e)
+		return nil
+	})
+	return out, err
+}
+
+// ---- bank loans ----
+
+func (m *Store) CreateBankLoan(ctx context.Context, userID int64, principal int64, interestBP int64, termDays int64) (db.BankLoan, error) {
+	if userID <= 0 || principal <= 0 || termDays <= 0 {
+		return db.BankLoan{}, errors.New("bad params")
+	}
+	interest := interestFromBP(principal, interestBP)
+	totalDue := principal + interest
+	now := m.now()
+	dueAt := now.Add(time.Duration(termDays) * 24 * time.Hour)
+
+	var out db.BankLoan
+	err := m.update(ctx, func(s *state) error {
+		for _, l := range s.bankLoans {
+			if l.UserID == userID && l.Status == "active" {
+				return db.ErrAlreadyExists
+			}
+		}
+		sys, err := s.system()
+		if err != nil {
+			return err
+		}
+		if sys.ReserveSupply-sys.ReservedSupply < principal {
+			return db.ErrNotEnough
+		}
+		if _, err := s.lockUser(userID); err != nil {
+			return err
+		}
+		sys.ReserveSupply -= principal
+		s.touch(now)
+		s.addBalance(userID, principal)
+
+		s.nextBankLoan++
+		out = db.BankLoan{
+			LoanID: s.nextBankLoan, UserID: userID, Principal: principal, Interest: interest, TotalDue: totalDue,
+			TermDays: termDays, Status: "active", CreatedAt: now, DueAt: dueAt,
+		}
+		s.bankLoans[out.LoanID] = out
+		s.appendLedger(now, "bank_loan_issue", 0, userID, principal, map[string]any{
+			"loan_id": out.LoanID, "principal": principal, "interest": interest, "total_due": totalDue, "term_days": termDays, "due_at": dueAt.Unix(),
+		})
+		return nil
+	})
+	if err != nil {
+		return db.BankLoan{}, err
+	}
+	return out, nil
+}
+
+func (m *Store) ListBankLoansByUser(ctx context.Context, userID int64, limit int64) ([]db.BankLoan, error) {
+	var out []db.BankLoan
+	err := m.view(ctx, func(s *state) error {
+		for _, l := range s.bankLoans {
+			if l.UserID == userID {
+				out = append(out, l)
+			}
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool {
+		return newerFirst(out[i].CreatedAt, out[i].LoanID, out[j].CreatedAt, out[j].LoanID)
+	})
+	if n := clampLimit(limit); len(out) > n {
+		out = out[:n]
+	}
+	return out, err
+}
+
+func newerFirst(at time.Time, id int64, bt time.Time, bid int64) bool {
+	if !at.Equal(bt) {
+		return at.After(bt)
+	}
+	return id > bid
+}
+
+func (m *Store) RepayBankLoan(ctx context.Context, userID int64, loanID int64) error {
+	if userID <= 0 || loanID <= 0 {
+		return errors.New("bad params")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		l, ok := s.bankLoans[loanID]
+		if !ok || l.UserID != userID {
+			return pgx.ErrNoRows
+		}
+		if strings.ToLower(strings.TrimSpace(l.Status)) != "active" {
+			return nil
+		}
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		if u.Balance < l.TotalDue {
+			return db.ErrNotEnough
+		}
+		s.addBalance(userID, -l.TotalDue)
+		if s.hasSys {
+			s.sys.ReserveSupply += l.TotalDue
+			s.touch(now)
+		}
+		l.Status = "repaid"
+		l.ClosedAt = ptr(now)
+		s.bankLoans[loanID] = l
+		s.appendLedger(now, "bank_loan_repay", userID, 0, l.TotalDue, map[string]any{"loan_id": loanID, "principal": l.Principal, "interest": l.Interest})
+		return nil
+	})
+}
+
+// MarkOverdueBankLoans matches db.MarkOverdueBankLoans: each loan is its own
+// transaction and the balance may go negative.
+func (m *Store) MarkOverdueBankLoans(ctx context.Context, now time.Time) (int64, error) {
+	if now.IsZero() {
+		now = m.now()
+	}
+	var due []db.BankLoan
+	err := m.view(ctx, func(s *state) error {
+		for _, l := range s.bankLoans {
+			if l.Status == "active" && !l.DueAt.After(now) {
+				due = append(due, l)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].DueAt.Before(due[j].DueAt) })
+	if len(due) > 500 {
+		due = due[:500]
+	}
+
+	var processed int64
+	for _, d := range due {
+		loanID := d.LoanID
+		err := m.update(ctx, func(s *state) error {
+			l, ok := s.bankLoans[loanID]
+			if !ok {
+				return pgx.ErrNoRows
+			}
+			if strings.ToLower(strings.TrimSpace(l.Status)) != "active" {
+				return nil
+			}
+			s.addBalance(l.UserID, -l.TotalDue)
+			if s.hasSys {
+				s.sys.ReserveSupply += l.TotalDue
+				s.touch(m.now())
+			}
+			l.Status = "overdue"
+			l.ClosedAt = ptr(now)
+			s.bankLoans[loanID] = l
+			s.appendLedger(m.now(), "bank_loan_overdue", l.UserID, 0, l.TotalDue, map[string]any{"loan_id": loanID, "ts": now.Unix()})
+			return nil
+		})
+		if err == nil {
+			processed++
+		}
+	}
+	return processed, nil
+}
+
+// ---- p2p loans ----
+
+func (m *Store) CreateP2PLoanRequest(ctx context.Context, borrowerID, lenderID int64, principal int64, interestBP int64, termDays int64) (db.P2PLoan, error) {
+	if borrowerID <= 0 || lenderID <= 0 || borrowerID == lenderID || principal <= 0 || termDays <= 0 {
+		return db.P2PLoan{}, errors.New("bad params")
+	}
+	interest := interestFromBP(principal, interestBP)
+	now := m.now()
+	var out db.P2PLoan
+	err := m.update(ctx, func(s *state) error {
+		s.nextP2PLoan++
+		out = db.P2PLoan{
+			LoanID: s.nextP2PLoan, LenderID: lenderID, BorrowerID: borrowerID, Principal: principal, Interest: interest,
+			TotalDue: principal + interest, InterestBP: interestBP, TermDays: termDays, Status: "requested", CreatedAt: now,
+		}
+		s.p2pLoans[out.LoanID] = out
+		return nil
+	})
+	if err != nil {
+		return db.P2PLoan{}, err
+	}
+	return out, nil
+}
+
+func (m *Store) listP2P(ctx context.Context, match func(db.P2PLoan) bool, oldestFirst bool, limit int64) ([]db.P2PLoan, error) {
+	var out []db.P2PLoan
+	err := m.view(ctx, func(s *state) error {
+		for _, l := range s.p2pLoans {
+			if match(l) {
+				out = append(out, l)
+			}
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool {
+		newer := newerFirst(out[i].CreatedAt, out[i].LoanID, out[j].CreatedAt, out[j].LoanID)
+		if oldestFirst {
+			return !newer
+		}
+		return newer
+	})
+	if n := clampLimit(limit); len(out) > n {
+		out = out[:n]
+	}
+	return out, err
+}
+
+func (m *Store) ListIncomingP2PRequests(ctx context.Context, lenderID int64, limit int64) ([]db.P2PLoan, error) {
+	return m.listP2P(ctx, func(l db.P2PLoan) bool { return l.LenderID == lenderID && l.Status == "requested" }, true, limit)
+}
+
+func (m *Store) ListP2PLoansByUser(ctx context.Context, userID int64, limit int64) ([]db.P2PLoan, error) {
+	return m.listP2P(ctx, func(l db.P2PLoan) bool { return l.LenderID == userID || l.BorrowerID == userID }, false, limit)
+}
+
+func (m *Store) GetP2PLoan(ctx context.Context, loanID int64) (db.P2PLoan, error) {
+	var out db.P2PLoan
+	err := m.view(ctx, func(s *state) error {
+		l, ok := s.p2pLoans[loanID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		out = l
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) AcceptP2PLoan(ctx context.Context, lenderID int64, loanID int64) error {
+	if lenderID <= 0 || loanID <= 0 {
+		return errors.New("bad params")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		l, ok := s.p2pLoans[loanID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		if l.LenderID != lenderID {
+			return db.ErrForbidden
+		}
+		if strings.ToLower(strings.TrimSpace(l.Status)) != "requested" {
+			return nil
+		}
+		lender, err := s.lockUser(lenderID)
+		if err != nil {
+			return err
+		}
+		if lender.Balance < l.Principal {
+			return db.ErrNotEnough
+		}
+		if _, err := s.lockUser(l.BorrowerID); err != nil {
+			return err
+		}
+		s.addBalance(lenderID, -l.Principal)
+		s.addBalance(l.BorrowerID, l.Principal)
+		dueAt := now.Add(time.Duration(l.TermDays) * 24 * time.Hour)
+		l.Status = "active"
+		l.AcceptedAt = ptr(now)
+		l.DueAt = ptr(dueAt)
+		s.p2pLoans[loanID] = l
+		s.appendLedger(now, "p2p_loan_issue", lenderID, l.BorrowerID, l.Principal, map[string]any{
+			"loan_id": loanID, "total_due": l.TotalDue, "interest": l.Interest, "due_at": dueAt.Unix(),
+		})
+		return nil
+	})
+}
+
+func (m *Store) RejectP2PLoan(ctx context.Context, lenderID int64, loanID int64) error {
+	if lenderID <= 0 || loanID <= 0 {
+		return errors.New("bad params")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		l, ok := s.p2pLoans[loanID]
+		if !ok || l.LenderID != lenderID || l.Status != "requested" {
+			return nil
+		}
+		l.Status = "rejected"
+		l.ClosedAt = ptr(now)
+		s.p2pLoans[loanID] = l
+		return nil
+	})
+}
+
+func (m *Store) RepayP2PLoan(ctx context.Context, borrowerID int64, loanID int64) error {
+	if borrowerID <= 0 || loanID <= 0 {
+		return errors.New("bad params")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		l, ok := s.p2pLoans[loanID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		if l.BorrowerID != borrowerID {
+			return db.ErrForbidden
+		}
+		if strings.ToLower(strings.TrimSpace(l.Status)) != "active" {
+			return nil
+		}
+		return s.settleP2P(l, now, "p2p_loan_repay")
+	})
+}
+
+func (m *Store) RecallP2PLoan(ctx context.Context, lenderID int64, loanID int64, minDays int64) error {
+	if lenderID <= 0 || loanID <= 0 {
+		return errors.New("bad params")
+	}
+	if minDays <= 0 {
+		minDays = 5
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		l, ok := s.p2pLoans[loanID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		if l.LenderID != lenderID {
+			return db.ErrForbidden
+		}
+		if strings.ToLower(strings.TrimSpace(l.Status)) != "active" {
+			return nil
+		}
+		if l.DueAt == nil || l.AcceptedAt == nil {
+			return errors.New("bad loan state")
+		}
+		if now.Before(*l.DueAt) {
+			if l.TermDays <= minDays {
+				return errors.New("too early")
+			}
+			if now.Before(l.AcceptedAt.Add(time.Duration(minDays) * 24 * time.Hour)) {
+				return errors.New("too early")
+			}
+		}
+		return s.settleP2P(l, now, "p2p_loan_recall")
+	})
+}
+
+// settleP2P moves total_due from borrower to lender and closes the loan.
+func (s *state) settleP2P(l db.P2PLoan, now time.Time, kind string) error {
+	borrower, err := s.lockUser(l.BorrowerID)
+	if err != nil {
+		return err
+	}
+	if borrower.Balance < l.TotalDue {
+		return db.ErrNotEnough
+	}
+	if _, err := s.lockUser(l.LenderID); err != nil {
+		return err
+	}
+	s.addBalance(l.BorrowerID, -l.TotalDue)
+	s.addBalance(l.LenderID, l.TotalDue)
+	l.Status = "repaid"
+	l.ClosedAt = ptr(now)
+	s.p2pLoans[l.LoanID] = l
+	s.appendLedger(now, kind, l.BorrowerID, l.LenderID, l.TotalDue, map[string]any{"loan_id": l.LoanID})
+	return nil
+}
+
+// ---- market ----
+
+func (m *Store) CreateMarketListing(ctx context.Context, sellerID int64, title, description, category string, priceCoins int64, contact string, listingFee int64) (db.MarketListing, error) {
+	title = strings.TrimSpace(title)
+	description = strings.TrimSpace(description)
+	category = strings.ToLower(strings.TrimSpace(category))
+	contact = strings.TrimSpace(contact)
+	if sellerID <= 0 || title == "" || description == "" || contact == "" || priceCoins <= 0 {
+		return db.MarketListing{}, errors.New("bad params")
+	}
+	if category == "" {
+		category = "other"
+	}
+	if listingFee < 0 {
+		listingFee = 0
+	}
+	now := m.now()
+	var out db.MarketListing
+	err := m.update(ctx, func(s *state) error {
+		if listingFee > 0 {
+			u, err := s.lockUser(sellerID)
+			if err != nil {
+				return err
+			}
+			if u.Balance < listingFee {
+				return db.ErrNotEnough
+			}
+			s.addBalance(sellerID, -listingFee)
+			s.burnSupply(listingFee, now)
+			s.appendLedger(now, "market_listing_fee_burn", sellerID, 0, listingFee, map[string]any{"fee": listingFee})
+		}
+		s.nextListing++
+		out = db.MarketListing{
+			ListingID: s.nextListing, SellerID: sellerID, Title: title, Description: description, Category: category,
+			PriceCoins: priceCoins, Contact: contact, Status: "active", CreatedAt: now,
+		}
+		s.listings[out.ListingID] = out
+		return nil
+	})
+	if err != nil {
+		return db.MarketListing{}, err
+	}
+	return out, nil
+}
+
+func (m *Store) AddMarketListingImage(ctx context.Context, listingID int64, mime string, data []byte) (int64, error) {
+	mime = strings.TrimSpace(mime)
+	if listingID <= 0 || mime == "" || len(data) == 0 {
+		return 0, errors.New("bad params")
+	}
+	now := m.now()
+	var id int64
+	err := m.update(ctx, func(s *state) error {
+		if _, ok := s.listings[listingID]; !ok {
+			return errors.New("listing not found") // foreign key violation in Postgres
+		}
+		s.nextImage++
+		id = s.nextImage
+		s.images[id] = db.MarketListingImage{ImageID: id, ListingID: listingID, Mime: mime, Data: append([]byte(nil), data...), CreatedAt: now}
+		return nil
+	})
+	return id, err
+}
+
+func (m *Store) GetMarketListingImage(ctx context.Context, imageID int64) (db.MarketListingImage, error) {
+	var out db.MarketListingImage
+	err := m.view(ctx, func(s *state) error {
+		img, ok := s.images[imageID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		out = img
+		out.Data = append([]byte(nil), img.Data...)
+		return nil
+	})
+	return out, err
+}
+
+// firstImages maps each listing to its oldest image, the one listings show.
+func (s *state) firstImages() map[int64]db.MarketListingImage {
+	first := map[int64]db.MarketListingImage{}
+	for _, img := range s.images {
+		cur, ok := first[img.ListingID]
+		if !ok || img.CreatedAt.Before(cur.CreatedAt) || (img.CreatedAt.Equal(cur.CreatedAt) && img.ImageID < cur.ImageID) {
+			first[img.ListingID] = img
+		}
+	}
+	return first
+}
+
+func (m *Store) GetMarketListing(ctx context.Context, listingID int64) (db.MarketListing, error) {
+	var out db.MarketListing
+	err := m.view(ctx, func(s *state) error {
+		l, ok := s.listings[listingID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		if img, ok := s.firstImages()[listingID]; ok {
+			l.ImageID = ptr(img.ImageID)
+		}
+		out = l
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) listListings(ctx context.Context, match func(db.MarketListing) bool, limit int64) ([]db.MarketListing, error) {
+	var out []db.MarketListing
+	err := m.view(ctx, func(s *state) error {
+		first := s.firstImages()
+		for _, l := range s.listings {
+			if !match(l) {
+				continue
+			}
+			if img, ok := first[l.ListingID]; ok {
+				l.ImageID = ptr(img.ImageID)
+			}
+			out = append(out, l)
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool {
+		return newerFirst(out[i].CreatedAt, out[i].ListingID, out[j].CreatedAt, out[j].ListingID)
+	})
+	if n := clampLimit(limit); len(out) > n {
+		out = out[:n]
+	}
+	return out, err
+}
+
+func (m *Store) ListMarketListings(ctx context.Context, status string, limit int64) ([]db.MarketListing, error) {
+	status = strings.ToLower(strings.TrimSpace(status))
+	if status == "" {
+		status = "active"
+	}
+	return m.listListings(ctx, func(l db.MarketListing) bool { return l.Status == status }, limit)
+}
+
+func (m *Store) ListMyMarketListings(ctx context.Context, sellerID int64, limit int64) ([]db.MarketListing, error) {
+	return m.listListings(ctx, func(l db.MarketListing) bool { return l.SellerID == sellerID }, limit)
+}
+
+func (m *Store) BuyMarketListing(ctx context.Context, buyerID int64, listingID int64) error {
+	if buyerID <= 0 || listingID <= 0 {
+		return errors.New("bad params")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		l, ok := s.listings[listingID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		if strings.ToLower(strings.TrimSpace(l.Status)) != "active" {
+			return nil
+		}
+		if l.SellerID == buyerID {
+			return errors.New("cant buy own listing")
+		}
+		cat := strings.ToLower(strings.TrimSpace(l.Category))
+		if cat == "exchange" || cat == "fiat" {
+			// Fiat/exchange listing: mark as sold, no in-app coin transfer.
+			l.Status = "sold"
+			l.SoldAt = ptr(now)
+			l.BuyerID = ptr(buyerID)
+			s.listings[listingID] = l
+			s.appendLedger(now, "market_buy_fiat", buyerID, l.SellerID, 0, map[string]any{"listing_id": listingID, "category": cat, "price_coins": l.PriceCoins})
+			return nil
+		}
+		buyer, err := s.lockUser(buyerID)
+		if err != nil {
+			return err
+		}
+		if buyer.Balance < l.PriceCoins {
+			return db.ErrNotEnough
+		}
+		if _, err := s.lockUser(l.SellerID); err != nil {
+			return err
+		}
+		s.addBalance(buyerID, -l.PriceCoins)
+		s.addBalance(l.SellerID, l.PriceCoins)
+		l.Status = "sold"
+		l.SoldAt = ptr(now)
+		l.BuyerID = ptr(buyerID)
+		s.listings[listingID] = l
+		s.appendLedger(now, "market_buy", buyerID, l.SellerID, l.PriceCoins, map[string]any{"listing_id": listingID})
+		return nil
+	})
+}
+
+func (m *Store) CancelMarketListing(ctx context.Context, listingID, sellerID int64, hook db.TxHook) (bool, error) {
+	if listingID <= 0 || sellerID < 0 {
+		return false, errors.New("bad params")
+	}
+	var found bool
+	err := m.update(ctx, func(s *state) error {
+		l, ok := s.listings[listingID]
+		if !ok || l.Status != "active" || (sellerID != 0 && l.SellerID != sellerID) {
+			return nil
+		}
+		l.Status = "cancelled"
+		s.listings[listingID] = l
+		if err := s.runHook(ctx, hook,
+			map[string]any{"status": "active", "seller_id": l.SellerID, "title": l.Title, "price_coins": l.PriceCoins},
+			map[string]any{"status": "cancelled"},
+		); err != nil {
+			return err
+		}
+		found = true
+		return nil
+	})
+	return found, err
+}
+
+// ---- deposits ----
+
+func (m *Store) CreateDeposit(ctx context.Context, userID int64, txHash string, amountUSD int64, currency string, coins int64) (int64, error) {
+	txHash = strings.TrimSpace(txHash)
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if userID <= 0 || txHash == "" || amountUSD <= 0 || coins <= 0 || currency == "" {
+		return 0, errors.New("bad params")
+	}
+	now := m.now()
+	var id int64
+	err := m.update(ctx, func(s *state) error {
+		sys, err := s.system()
+		if err != nil {
+			return err
+		}
+		if sys.ReserveSupply-sys.ReservedSupply < coins {
+			return db.ErrNotEnough
+		}
+		s.nextDeposit++
+		id = s.nextDeposit
+		s.deposits[id] = db.Deposit{
+			DepositID: id, UserID: userID, TxHash: txHash, AmountUSD: amountUSD, Currency: currency, Coins: coins,
+			Status: "pending", CreatedAt: now,
+		}
+		sys.ReservedSupply += coins
+		s.touch(now)
+		s.appendLedger(now, "deposit_create", userID, 0, 0, map[string]any{"deposit_id": id, "tx_hash": txHash, "usd": amountUSD, "currency": currency, "coins": coins})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (m *Store) ListDeposits(ctx context.Context, status string, limit int64) ([]db.Deposit, error) {
+	status = strings.ToLower(strings.TrimSpace(status))
+	if status == "" {
+		status = "pending"
+	}
+	var out []db.Deposit
+	err := m.view(ctx, func(s *state) error {
+		for _, d := range s.deposits {
+			if d.Status == status {
+				out = append(out, d)
+			}
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool {
+		return newerFirst(out[i].CreatedAt, out[i].DepositID, out[j].CreatedAt, out[j].DepositID)
+	})
+	if n := clampLimit(limit); len(out) > n {
+		out = out[:n]
+	}
+	return out, err
+}
+
+func (m *Store) GetDeposit(ctx context.Context, depositID int64) (db.Deposit, error) {
+	if depositID <= 0 {
+		return db.Deposit{}, errors.New("bad deposit_id")
+	}
+	var out db.Deposit
+	err := m.view(ctx, func(s *state) error {
+		d, ok := s.deposits[depositID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		out = d
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) ProcessDeposit(ctx context.Context, depositID int64, adminID int64, approve bool, hook db.TxHook) error {
+	if depositID <= 0 || adminID <= 0 {
+		return errors.New("bad params")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		d, ok := s.deposits[depositID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		if strings.ToLower(strings.TrimSpace(d.Status)) != "pending" {
+			return nil
+		}
+		sys, err := s.system()
+		if err != nil {
+			return err
+		}
+		before := d
+		d.ApprovedAt = ptr(now)
+		d.ApprovedBy = ptr(adminID)
+		meta := map[string]any{"deposit_id": depositID, "by": adminID}
+
+		if approve {
+			if sys.ReservedSupply < d.Coins {
+				return errors.New("reserved underflow")
+			}
+			if sys.ReserveSupply < d.Coins {
+				return db.ErrNotEnough
+			}
+			sys.ReserveSupply -= d.Coins
+			sys.ReservedSupply -= d.Coins
+			s.touch(now)
+			s.addBalance(d.UserID, d.Coins)
+			d.Status = "approved"
+			s.deposits[depositID] = d
+			s.appendLedger(now, "deposit_approve", 0, d.UserID, d.Coins, meta)
+			return s.runHook(ctx, hook, before, d)
+		}
+
+		// reject -> release reserved
+		release := d.Coins
+		if sys.ReservedSupply < release {
+			release = sys.ReservedSupply
+		}
+		if release > 0 {
+			sys.ReservedSupply -= release
+			s.touch(now)
+		}
+		d.Status = "rejected"
+		s.deposits[depositID] = d
+		s.appendLedger(now, "deposit_reject", d.UserID, 0, 0, meta)
+		return s.runHook(ctx, hook, before, d)
+	})
+}
+
+func (m *Store) GetDepositWallets(ctx context.Context) (map[string]string, error) {
+	var out map[string]string
+	err := m.view(ctx, func(s *state) error {
+		out = maps.Clone(s.wallets)
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) SetDepositWallets(ctx context.Context, wallets map[string]string, hook db.TxHook) error {
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		before := s.wallets
+		s.wallets = map[string]string{}
+		for k, v := range wallets {
+			kk := strings.ToUpper(strings.TrimSpace(k))
+			vv := strings.TrimSpace(v)
+			if kk == "" || vv == "" {
+				continue
+			}
+			s.wallets[kk] = vv
+		}
+		s.appendLedger(now, "admin_set_deposit_wallets", 0, 0, 0, nil)
+		return s.runHook(ctx, hook, before, maps.Clone(s.wallets))
+	})
+}
+
+func (m *Store) EnsureDepositWalletsIfEmpty(ctx context.Context, wallets map[string]string) error {
+	if len(wallets) == 0 {
+		return nil
+	}
+	var n int
+	_ = m.view(ctx, func(s *state) error {
+		n = len(s.wallets)
+		return nil
+	})
+	if n > 0 {
+		return nil
+	}
+	return m.SetDepositWallets(ctx, wallets, nil)
+}
+
+// ---- standing orders ----
+
+func (m *Store) CreateStandingOrder(ctx context.Context, o db.StandingOrder, maxOpen int64) (db.StandingOrder, error) {
+	if o.FromID <= 0 || o.ToID <= 0 || o.FromID == o.ToID || o.Amount <= 0 {
+		return db.StandingOrder{}, errors.New("bad params")
+	}
+	now := m.now()
+	var out db.StandingOrder
+	err := m.update(ctx, func(s *state) error {
+		if _, err := s.lockUser(o.FromID); err != nil {
+			return err
+		}
+		if _, err := s.lockUser(o.ToID); err != nil {
+			return err
+		}
+		var open int64
+		for _, x := range s.standing {
+			if x.FromID == o.FromID && (x.Status == db.StandingActive || x.Status == db.StandingPaused) {
+				open++
+			}
+		}
+		if open >= maxOpen {
+			return db.ErrLimit
+		}
+		s.nextStanding++
+		out = db.StandingOrder{
+			OrderID:   s.nextStanding,
+			FromID:    o.FromID,
+			ToID:      o.ToID,
+			Amount:    o.Amount,
+			Memo:      o.Memo,
+			Schedule:  o.Schedule,
+			StartAt:   o.StartAt,
+			NextRunAt: o.StartAt,
+			Status:    db.StandingActive,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		s.standing[out.OrderID] = out
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) GetStandingOrder(ctx context.Context, orderID int64) (db.StandingOrder, error) {
+	var out db.StandingOrder
+	err := m.view(ctx, func(s *state) error {
+		o, ok := s.standing[orderID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		out = o
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) ListStandingOrders(ctx context.Context, userID int64, limit int64) ([]db.StandingOrder, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	var out []db.StandingOrder
+	err := m.view(ctx, func(s *state) error {
+		for _, o := range s.standing {
+			if o.FromID == userID || o.ToID == userID {
+				out = append(out, o)
+			}
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].OrderID > out[j].OrderID })
+	if int64(len(out)) > limit {
+		out = out[:limit]
+	}
+	return out, err
+}
+
+func standingDueAt(o db.StandingOrder) time.Time {
+	if o.RetryAt != nil {
+		return *o.RetryAt
+	}
+	return o.NextRunAt
+}
+
+func (m *Store) DueStandingOrders(ctx context.Context, now time.Time, limit int64) ([]db.StandingOrder, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	var out []db.StandingOrder
+	err := m.view(ctx, func(s *state) error {
+		for _, o := range s.standing {
+			if o.Status == db.StandingActive && !standingDueAt(o).After(now) {
+				out = append(out, o)
+			}
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool {
+		a, b := standingDueAt(out[i]), standingDueAt(out[j])
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return out[i].OrderID < out[j].OrderID
+	})
+	if int64(len(out)) > limit {
+		out = out[:limit]
+	}
+	return out, err
+}
+
+func (m *Store) SetStandingOrderStatus(ctx context.Context, orderID, fromID int64, status string, reschedule func(db.StandingOrder) (int64, time.Time)) (bool, error) {
+	var from []string
+	switch status {
+	case db.StandingPaused:
+		from = []string{db.StandingActive}
+	case db.StandingActive:
+		from = []string{db.StandingPaused}
+	case db.StandingCancelled:
+		from = []string{db.StandingActive, db.StandingPaused}
+	default:
+		return false, errors.New("bad status")
+	}
+	now := m.now()
+	var changed bool
+	err := m.update(ctx, func(s *state) error {
+		o, ok := s.standing[orderID]
+		if !ok || o.FromID != fromID || !slices.Contains(from, o.Status) {
+			return nil
+		}
+		if status == db.StandingActive {
+			if reschedule != nil {
+				o.Slot, o.NextRunAt = reschedule(o)
+			}
+			o.FailCount = 0
+			o.RetryAt = nil
+		}
+		o.Status = status
+		o.UpdatedAt = now
+		s.standing[orderID] = o
+		changed = true
+		return nil
+	})
+	return changed, err
+}
+
+// standingSlot returns the order if o.Slot is still its active, unpaid slot.
+func (s *state) standingSlot(o db.StandingOrder) (db.StandingOrder, bool, error) {
+	cur, ok := s.standing[o.OrderID]
+	if !ok {
+		return db.StandingOrder{}, false, pgx.ErrNoRows
+	}
+	return cur, cur.Status == db.StandingActive && cur.Slot == o.Slot, nil
+}
+
+func (m *Store) ExecuteStandingOrder(ctx context.Context, o db.StandingOrder, spec db.TransferSpec, nextSlot int64, next time.Time) (bool, error) {
+	if err := spec.Validate(); err != nil {
+		return false, err
+	}
+	now := m.now()
+	var ran bool
+	err := m.update(ctx, func(s *state) error {
+		cur, ok, err := s.standingSlot(o)
+		if err != nil || !ok {
+			return err
+		}
+		key := runKey{o.OrderID, o.Slot}
+		if s.runs[key] != "ok" {
+			if err := s.transfer(now, spec); err != nil {
+				return err
+			}
+			s.runs[key] = "ok"
+			cur.RunsCount++
+			ran = true
+		}
+		cur.Slot = nextSlot
+		if next.IsZero() {
+			cur.Status = db.StandingDone
+		} else {
+			cur.NextRunAt = next
+		}
+		cur.RetryAt = nil
+		cur.FailCount = 0
+		cur.LastError = ""
+		cur.UpdatedAt = now
+		s.standing[o.OrderID] = cur
+		return nil
+	})
+	return ran, err
+}
+
+func (m *Store) FailStandingOrder(ctx context.Context, o db.StandingOrder, reason string, retryAt time.Time, maxFailures int64) (bool, error) {
+	now := m.now()
+	var paused bool
+	err := m.update(ctx, func(s *state) error {
+		cur, ok, err := s.standingSlot(o)
+		if err != nil || !ok {
+			return err
+		}
+		s.runs[runKey{o.OrderID, o.Slot}] = "failed"
+		cur.FailCount++
+		cur.RetryAt = ptr(retryAt)
+		cur.LastError = reason
+		if cur.FailCount >= maxFailures {
+			cur.Status = db.StandingPaused
+			paused = true
+		}
+		cur.UpdatedAt = now
+		s.standing[o.OrderID] = cur
+		return nil
+	})
+	return paused, err
+}
@@ -0,0 +1,434 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"bkc_coin_v2/internal/db"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type nft struct {
+	db.NFT
+	supplyTotal int64
+}
+
+type ownKey struct {
+	userID int64
+	nftID  int64
+}
+
+type idemKey struct {
+	userID int64
+	key    string
+}
+
+type idemRow struct {
+	db.IdempotencyRecord
+	expiresAt time.Time
+}
+
+// idempotencyStaleAfter is db's lease on a pending key.
+const idempotencyStaleAfter = 15 * time.Minute
+
+// toReserve is "UPDATE system_state SET reserve_supply = reserve_supply + $1":
+// without the row it is a no-op.
+func (s *state) toReserve(amount int64, now time.Time) {
+	if s.hasSys {
+		s.sys.ReserveSupply += amount
+		s.touch(now)
+	}
+}
+
+// ---- shop ----
+
+func (m *Store) ListNFTs(ctx context.Context) ([]db.NFT, error) {
+	var out []db.NFT
+	err := m.view(ctx, func(s *state) error {
+		for _, n := range s.nfts {
+			out = append(out, n.NFT)
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].NFTID > out[j].NFTID })
+	if len(out) > 200 {
+		out = out[:200]
+	}
+	return out, err
+}
+
+func (m *Store) ListUserNFTs(ctx context.Context, userID int64) ([]db.UserNFT, error) {
+	var out []db.UserNFT
+	err := m.view(ctx, func(s *state) error {
+		for k, qty := range s.nftOwns {
+			if k.userID != userID || qty <= 0 {
+				continue
+			}
+			n := s.nfts[k.nftID]
+			out = append(out, db.UserNFT{NFTID: k.nftID, Title: n.Title, ImageURL: n.ImageURL, Qty: qty})
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Qty != out[j].Qty {
+			return out[i].Qty > out[j].Qty
+		}
+		return out[i].NFTID > out[j].NFTID
+	})
+	return out, err
+}
+
+func (m *Store) CreateNFT(ctx context.Context, title, imageURL string, priceCoins, supply int64, hook db.TxHook) (int64, error) {
+	title = strings.TrimSpace(title)
+	imageURL = strings.TrimSpace(imageURL)
+	if title == "" || imageURL == "" || priceCoins <= 0 || supply <= 0 {
+		return 0, errors.New("bad params")
+	}
+	now := m.now()
+	var id int64
+	err := m.update(ctx, func(s *state) error {
+		s.nextNFT++
+		id = s.nextNFT
+		s.nfts[id] = nft{
+			NFT:         db.NFT{NFTID: id, Title: title, ImageURL: imageURL, PriceCoins: priceCoins, SupplyLeft: supply, CreatedAt: now},
+			supplyTotal: supply,
+		}
+		s.appendLedger(now, "nft_create", 0, 0, 0, map[string]any{"nft_id": id, "title": title, "price": priceCoins, "supply": supply})
+		return s.runHook(ctx, hook, nil, map[string]any{"nft_id": id, "title": title, "image_url": imageURL, "price_coins": priceCoins, "supply_total": supply})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (m *Store) BuyNFT(ctx context.Context, buyerID, nftID int64) error {
+	if buyerID <= 0 || nftID <= 0 {
+		return errors.New("bad params")
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		n, ok := s.nfts[nftID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		if n.SupplyLeft <= 0 {
+			return db.ErrNotEnough
+		}
+		u, err := s.lockUser(buyerID)
+		if err != nil {
+			return err
+		}
+		if u.Balance < n.PriceCoins {
+			return db.ErrNotEnough
+		}
+		s.addBalance(buyerID, -n.PriceCoins)
+		s.toReserve(n.PriceCoins, now)
+		n.SupplyLeft--
+		s.nfts[nftID] = n
+		s.nftOwns[ownKey{buyerID, nftID}]++
+		s.appendLedger(now, "nft_buy", buyerID, 0, n.PriceCoins, map[string]any{"nft_id": nftID})
+		return nil
+	})
+}
+
+func (m *Store) BuyEnergyBoost(ctx context.Context, userID, price int64, until time.Time, regenMult, maxMult float64, now time.Time) (float64, error) {
+	if userID <= 0 || price < 0 {
+		return 0, errors.New("bad params")
+	}
+	ts := m.now()
+	var baseMax float64
+	err := m.update(ctx, func(s *state) error {
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		if u.Balance < price {
+			return db.ErrNotEnough
+		}
+		baseMax = u.EnergyMax
+		u.Balance -= price
+		u.EnergyBoostUntil = until
+		u.EnergyBoostRegenMultiplier = regenMult
+		u.EnergyBoostMaxMultiplier = maxMult
+		u.Energy = u.EnergyMax * maxMult
+		u.EnergyUpdatedAt = now
+		s.users[userID] = u
+		s.toReserve(price, ts)
+		s.appendLedger(ts, "buy_energy_1h", userID, 0, price, map[string]any{"until": until.Unix()})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return baseMax, nil
+}
+
+func (m *Store) BuyTapPack(ctx context.Context, userID, price, packSize int64, day time.Time) error {
+	if userID <= 0 || price < 0 || packSize <= 0 {
+		return errors.New("bad params")
+	}
+	day = dayUTC(day)
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		u, err := s.lockUser(userID)
+		if err != nil {
+			return err
+		}
+		if u.Balance < price {
+			return db.ErrNotEnough
+		}
+		s.addBalance(userID, -price)
+		s.toReserve(price, now)
+		k := dailyKey{userID, day}
+		d, ok := s.daily[k]
+		if !ok {
+			d = db.UserDaily{UserID: userID, Day: day}
+		}
+		d.ExtraQuota += packSize
+		s.daily[k] = d
+		s.appendLedger(now, "buy_tap_pack", userID, 0, price, map[string]any{"day": day.Format("2006-01-02"), "pack_size": packSize})
+		return nil
+	})
+}
+
+// ---- crypto pay ----
+
+func (m *Store) CreateCryptoPayInvoice(ctx context.Context, invoiceID, userID, amountUSD, coins int64, status string) error {
+	if invoiceID <= 0 || userID <= 0 || amountUSD <= 0 || coins <= 0 {
+		return errors.New("bad params")
+	}
+	status = strings.TrimSpace(status)
+	if status == "" {
+		status = "active"
+	}
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		sys, err := s.system()
+		if err != nil {
+			return err
+		}
+		if sys.ReserveSupply-sys.ReservedSupply < coins {
+			return db.ErrNotEnough
+		}
+		if _, ok := s.invoices[invoiceID]; ok {
+			return nil
+		}
+		s.invoices[invoiceID] = db.CryptoPayInvoice{InvoiceID: invoiceID, UserID: userID, AmountUSD: amountUSD, Coins: coins, Status: status, CreatedAt: now}
+		sys.ReservedSupply += coins
+		s.touch(now)
+		s.appendLedger(now, "cryptopay_invoice", userID, 0, 0, map[string]any{"invoice_id": invoiceID, "usd": amountUSD, "coins": coins, "status": status})
+		return nil
+	})
+}
+
+func (m *Store) GetCryptoPayInvoice(ctx context.Context, invoiceID int64) (db.CryptoPayInvoice, error) {
+	var out db.CryptoPayInvoice
+	err := m.view(ctx, func(s *state) error {
+		inv, ok := s.invoices[invoiceID]
+		if !ok {
+			return pgx.ErrNoRows
+		}
+		out = inv
+		return nil
+	})
+	return out, err
+}
+
+func (m *Store) ProcessCryptoPayStatus(ctx context.Context, invoiceID int64, newStatus string, paidAt time.Time) (int64, string, error) {
+	if invoiceID <= 0 {
+		return 0, "", errors.New("bad invoice_id")
+	}
+	newStatus = strings.ToLower(strings.TrimSpace(newStatus))
+	if newStatus == "" {
+		return 0, "", errors.New("missing status")
+	}
+	now := m.now()
+	var credited int64
+	var finalStatus string
+	err := m.update(ctx, func(s *state) error {
+		inv, ok := s.invoices[invoiceID]
+		if !ok {
+			finalStatus = "unknown"
+			return nil
+		}
+		finalStatus = newStatus
+		inv.Status = newStatus
+
+		isPaid := newStatus == "paid"
+		isExpired := newStatus == "expired" || newStatus == "canceled" || newStatus == "cancelled"
+		if isPaid && inv.PaidAt == nil {
+			inv.PaidAt = ptr(paidAt)
+		}
+		defer func() { s.invoices[invoiceID] = inv }()
+
+		if isPaid && inv.CreditedAt == nil {
+			sys, err := s.system()
+			if err != nil {
+				return err
+			}
+			if sys.ReservedSupply < inv.Coins {
+				return errors.New("reserved underflow")
+			}
+			if sys.ReserveSupply < inv.Coins {
+				return db.ErrNotEnough
+			}
+			sys.ReserveSupply -= inv.Coins
+			sys.ReservedSupply -= inv.Coins
+			s.touch(now)
+			s.addBalance(inv.UserID, inv.Coins)
+			inv.CreditedAt = ptr(now)
+			credited = inv.Coins
+			s.appendLedger(now, "cryptopay_deposit", 0, inv.UserID, inv.Coins, map[string]any{"invoice_id": invoiceID})
+			return nil
+		}
+
+		if isExpired && inv.CreditedAt == nil && inv.ReleasedAt == nil {
+			sys, err := s.system()
+			if err != nil {
+				return err
+			}
+			release := inv.Coins
+			if sys.ReservedSupply < release {
+				release = sys.ReservedSupply
+			}
+			if release > 0 {
+				sys.ReservedSupply -= release
+				s.touch(now)
+			}
+			inv.ReleasedAt = ptr(now)
+			s.appendLedger(now, "cryptopay_release", inv.UserID, 0, 0, map[string]any{"invoice_id": invoiceID, "status": newStatus})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	return credited, finalStatus, nil
+}
+
+// ---- idempotency keys ----
+
+func (m *Store) ClaimIdempotencyKey(ctx context.Context, userID int64, key, endpoint, requestHash string, ttl time.Duration) (bool, db.IdempotencyRecord, error) {
+	now := m.now()
+	var claimed bool
+	var rec db.IdempotencyRecord
+	err := m.update(ctx, func(s *state) error {
+		k := idemKey{userID, key}
+		cur, ok := s.idem[k]
+		stale := cur.State == "pending" && cur.CreatedAt.Before(now.Add(-idempotencyStaleAfter)) && cur.RequestHash == requestHash
+		if ok && !cur.expiresAt.Before(now) && !stale {
+			rec = cur.IdempotencyRecord
+			return nil
+		}
+		s.idem[k] = idemRow{
+			IdempotencyRecord: db.IdempotencyRecord{Endpoint: endpoint, RequestHash: requestHash, State: "pending", CreatedAt: now},
+			expiresAt:         now.Add(ttl),
+		}
+		claimed = true
+		return nil
+	})
+	if err != nil {
+		return false, db.IdempotencyRecord{}, err
+	}
+	return claimed, rec, nil
+}
+
+func (m *Store) CompleteIdempotencyKey(ctx context.Context, userID int64, key string, status int, response string) error {
+	return m.update(ctx, func(s *state) error {
+		k := idemKey{userID, key}
+		if cur, ok := s.idem[k]; ok {
+			cur.State, cur.Status, cur.Response = "done", status, response
+			s.idem[k] = cur
+		}
+		return nil
+	})
+}
+
+func (m *Store) ReleaseIdempotencyKey(ctx context.Context, userID int64, key string) error {
+	return m.update(ctx, func(s *state) error {
+		k := idemKey{userID, key}
+		if cur, ok := s.idem[k]; ok && cur.State == "pending" {
+			delete(s.idem, k)
+		}
+		return nil
+	})
+}
+
+// ---- broadcasts ----
+
+func (m *Store) CreateBroadcast(ctx context.Context, adminChatID int64, text string) (db.Broadcast, error) {
+	now := m.now()
+	var out db.Broadcast
+	err := m.update(ctx, func(s *state) error {
+		s.nextBroadcast++
+		out = db.Broadcast{
+			BroadcastID: s.nextBroadcast, AdminChatID: adminChatID, Text: text, Status: "running",
+			Total: int64(len(s.users)), CreatedAt: now, UpdatedAt: now,
+		}
+		s.broadcasts[out.BroadcastID] = out
+		return nil
+	})
+	if err != nil {
+		return db.Broadcast{}, err
+	}
+	return out, nil
+}
+
+func (m *Store) ClaimBroadcasts(ctx context.Context, staleAfter time.Duration) ([]db.Broadcast, error) {
+	now := m.now()
+	var out []db.Broadcast
+	err := m.update(ctx, func(s *state) error {
+		for id, b := range s.broadcasts {
+			if b.Status != "paused" && (b.Status != "running" || !b.UpdatedAt.Before(now.Add(-staleAfter))) {
+				continue
+			}
+			b.Status, b.UpdatedAt = "running", now
+			s.broadcasts[id] = b
+			out = append(out, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].BroadcastID < out[j].BroadcastID })
+	return out, nil
+}
+
+func (m *Store) SaveBroadcast(ctx context.Context, b db.Broadcast) error {
+	now := m.now()
+	return m.update(ctx, func(s *state) error {
+		cur, ok := s.broadcasts[b.BroadcastID]
+		if !ok {
+			return nil
+		}
+		cur.Status, cur.Cursor, cur.OK, cur.Fail, cur.UpdatedAt = b.Status, b.Cursor, b.OK, b.Fail, now
+		s.broadcasts[b.BroadcastID] = cur
+		return nil
+	})
+}
+
+func (m *Store) ListUserIDsAfter(ctx context.Context, after int64, limit int64) ([]int64, error) {
+	var ids []int64
+	err := m.view(ctx, func(s *state) error {
+		for id := range s.users {
+			if id > after {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if limit < 0 {
+		limit = 0
+	}
+	if int64(len(ids)) > limit {
+		ids = ids[:limit]
+	}
+	return ids, err
+}
@@ -0,0 +1,153 @@
+// Package store describes the economy's persistence as narrow repositories.
+// *db.DB is the Postgres implementation; memstore is an in-process one for
+// local development and deterministic tests. Both return the db sentinels
+// (db.ErrNotEnough, db.ErrAlreadyExists, db.ErrForbidden, db.ErrAmbiguous) and
+// pgx.ErrNoRows for missing rows, so callers handle errors the same way for
+// either.
+package store
+
+import (
+	"context"
+	"time"
+
+	"bkc_coin_v2/internal/db"
+)
+
+// System is the single system_state row: supply, reserve and its movements.
+type System interface {
+	EnsureSystemState(ctx context.Context, totalSupply, adminUserID, adminAllocated, reserveSupply, startRate, minRate, refStep, refBonus int64) (db.SystemState, error)
+	GetSystem(ctx context.Context) (db.SystemState, error)
+	GetCounters(ctx context.Context) (db.Counters, error)
+	CreditFromReserve(ctx context.Context, userID int64, amount int64, kind string, meta any, hook db.TxHook) error
+	DebitToReserve(ctx context.Context, userID int64, amount int64, kind string, meta any) error
+	Burn(ctx context.Context, userID int64, amount int64, kind string, meta any) error
+}
+
+// Users covers accounts, balances between users and referrals.
+type Users interface {
+	EnsureUser(ctx context.Context, userID int64, username, firstName string, energyMax float64) (db.UserState, error)
+	GetUser(ctx context.Context, userID int64) (db.UserState, error)
+	UserExists(ctx context.Context, userID int64) (bool, error)
+	GetUserProfile(ctx context.Context, userID int64) (db.UserProfile, error)
+	FindUserByUsername(ctx context.Context, username string) (db.UserProfile, error)
+	SetUserPhoto(ctx context.Context, userID int64, photoURL string) error
+	SetUserEnergy(ctx context.Context, userID int64, energy float64, at time.Time) error
+	ListUserIDs(ctx context.Context) ([]int64, error)
+	GetUserDaily(ctx context.Context, userID int64, day time.Time) (db.UserDaily, error)
+	Transfer(ctx context.Context, fromID, toID, amount int64) error
+	TransferWithFee(ctx context.Context, t db.TransferSpec) error
+	UpgradeLevel(ctx context.Context, userID, fromLevel, toLevel, power, cost int64) error
+	FreezeBalance(ctx context.Context, userID int64, amount int64) error
+	UnfreezeBalance(ctx context.Context, userID int64, amount int64) error
+	WasReferred(ctx context.Context, referredID int64) (bool, error)
+	RegisterReferral(ctx context.Context, referrerID, referredID, step, referralBonus int64) (int64, error)
+}
+
+// Ledger is the append-only movement log.
+type Ledger interface {
+	RecordLedger(ctx context.Context, kind string, fromID, toID, amount int64, meta any) error
+	ForEachUserLedger(ctx context.Context, f db.HistoryFilter, fn func(db.LedgerEntry) error) error
+	ListUserHistory(ctx context.Context, f db.HistoryFilter) ([]db.LedgerEntry, error)
+}
+
+// Loans covers bank (reserve -> user) and P2P (user -> user) loans.
+type Loans interface {
+	CreateBankLoan(ctx context.Context, userID int64, principal int64, interestBP int64, termDays int64) (db.BankLoan, error)
+	ListBankLoansByUser(ctx context.Context, userID int64, limit int64) ([]db.BankLoan, error)
+	RepayBankLoan(ctx context.Context, userID int64, loanID int64) error
+	MarkOverdueBankLoans(ctx context.Context, now time.Time) (int64, error)
+
+	CreateP2PLoanRequest(ctx context.Context, borrowerID, lenderID int64, principal int64, interestBP int64, termDays int64) (db.P2PLoan, error)
+	ListIncomingP2PRequests(ctx context.Context, lenderID int64, limit int64) ([]db.P2PLoan, error)
+	ListP2PLoansByUser(ctx context.Context, userID int64, limit int64) ([]db.P2PLoan, error)
+	AcceptP2PLoan(ctx context.Context, lenderID int64, loanID int64) error
+	RejectP2PLoan(ctx context.Context, lenderID int64, loanID int64) error
+	RepayP2PLoan(ctx context.Context, borrowerID int64, loanID int64) error
+	RecallP2PLoan(ctx context.Context, lenderID int64, loanID int64, minDays int64) error
+	GetP2PLoan(ctx context.Context, loanID int64) (db.P2PLoan, error)
+}
+
+// Listings is the bazaar.
+type Listings interface {
+	CreateMarketListing(ctx context.Context, sellerID int64, title, description, category string, priceCoins int64, contact string, listingFee int64) (db.MarketListing, error)
+	AddMarketListingImage(ctx context.Context, listingID int64, mime string, data []byte) (int64, error)
+	GetMarketListingImage(ctx context.Context, imageID int64) (db.MarketListingImage, error)
+	ListMarketListings(ctx context.Context, status string, limit int64) ([]db.MarketListing, error)
+	ListMyMarketListings(ctx context.Context, sellerID int64, limit int64) ([]db.MarketListing, error)
+	BuyMarketListing(ctx context.Context, buyerID int64, listingID int64) error
+	CancelMarketListing(ctx context.Context, listingID, sellerID int64, hook db.TxHook) (bool, error)
+	GetMarketListing(ctx context.Context, listingID int64) (db.MarketListing, error)
+}
+
+// Shop is what users buy from the reserve: NFTs, energy boosts, tap packs.
+type Shop interface {
+	ListNFTs(ctx context.Context) ([]db.NFT, error)
+	ListUserNFTs(ctx context.Context, userID int64) ([]db.UserNFT, error)
+	CreateNFT(ctx context.Context, title, imageURL string, priceCoins, supply int64, hook db.TxHook) (int64, error)
+	BuyNFT(ctx context.Context, buyerID, nftID int64) error
+	BuyEnergyBoost(ctx context.Context, userID, price int64, until time.Time, regenMult, maxMult float64, now time.Time) (float64, error)
+	BuyTapPack(ctx context.Context, userID, price, packSize int64, day time.Time) error
+}
+
+// Deposits covers manual top-ups and the wallets shown to users.
+type Deposits interface {
+	CreateDeposit(ctx context.Context, userID int64, txHash string, amountUSD int64, currency string, coins int64) (int64, error)
+	ListDeposits(ctx context.Context, status string, limit int64) ([]db.Deposit, error)
+	GetDeposit(ctx context.Context, depositID int64) (db.Deposit, error)
+	ProcessDeposit(ctx context.Context, depositID int64, adminID int64, approve bool, hook db.TxHook) error
+	GetDepositWallets(ctx context.Context) (map[string]string, error)
+	SetDepositWallets(ctx context.Context, wallets map[string]string, hook db.TxHook) error
+	EnsureDepositWalletsIfEmpty(ctx context.Context, wallets map[string]string) error
+}
+
+// CryptoPay covers invoices paid through Crypto Pay; their coins are reserved
+// until paid or expired.
+type CryptoPay interface {
+	CreateCryptoPayInvoice(ctx context.Context, invoiceID, userID, amountUSD, coins int64, status string) error
+	GetCryptoPayInvoice(ctx context.Context, invoiceID int64) (db.CryptoPayInvoice, error)
+	ProcessCryptoPayStatus(ctx context.Context, invoiceID int64, newStatus string, paidAt time.Time) (int64, string, error)
+}
+
+// Idempotency stores Idempotency-Key claims and their responses.
+type Idempotency interface {
+	ClaimIdempotencyKey(ctx context.Context, userID int64, key, endpoint, requestHash string, ttl time.Duration) (bool, db.IdempotencyRecord, error)
+	CompleteIdempotencyKey(ctx context.Context, userID int64, key string, status int, response string) error
+	ReleaseIdempotencyKey(ctx context.Context, userID int64, key string) error
+}
+
+// Broadcasts are the bot's resumable mass messages.
+type Broadcasts interface {
+	CreateBroadcast(ctx context.Context, adminChatID int64, text string) (db.Broadcast, error)
+	ClaimBroadcasts(ctx context.Context, staleAfter time.Duration) ([]db.Broadcast, error)
+	SaveBroadcast(ctx context.Context, b db.Broadcast) error
+	ListUserIDsAfter(ctx context.Context, after int64, limit int64) ([]int64, error)
+}
+
+// StandingOrders are scheduled transfers and their per-slot run records.
+type StandingOrders interface {
+	CreateStandingOrder(ctx context.Context, o db.StandingOrder, maxOpen int64) (db.StandingOrder, error)
+	GetStandingOrder(ctx context.Context, orderID int64) (db.StandingOrder, error)
+	ListStandingOrders(ctx context.Context, userID int64, limit int64) ([]db.StandingOrder, error)
+	DueStandingOrders(ctx context.Context, now time.Time, limit int64) ([]db.StandingOrder, error)
+	SetStandingOrderStatus(ctx context.Context, orderID, fromID int64, status string, reschedule func(db.StandingOrder) (int64, time.Time)) (bool, error)
+	ExecuteStandingOrder(ctx context.Context, o db.StandingOrder, spec db.TransferSpec, nextSlot int64, next time.Time) (bool, error)
+	FailStandingOrder(ctx context.Context, o db.StandingOrder, reason string, retryAt time.Time, maxFailures int64) (bool, error)
+}
+
+// Store is every repository together.
+type Store interface {
+	System
+	Users
+	Ledger
+	Loans
+	Listings
+	Shop
+	Deposits
+	CryptoPay
+	Idempotency
+	Broadcasts
+	StandingOrders
+	Ping(ctx context.Context) error
+}
+
+var _ Store = (*db.DB)(nil)
@@ -724,5 +724,17 @@ func (sm *SubscriptionManager) GetMetrics() SubscriptionMetrics {
 	sm.metrics.mu.RLock()
 	defer sm.metrics.mu.RUnlock()
 
-	return *sm.metrics
+	// Копируем поля по одному: мьютекс копировать нельзя
+	m := sm.metrics
+	return SubscriptionMetrics{
+		TotalSubscriptions:  m.TotalSubscriptions,
+		ActiveSubscriptions: m.ActiveSubscriptions,
+		BasicSubscriptions:  m.BasicSubscriptions,
+		SilverSubscriptions: m.SilverSubscriptions,
+		GoldSubscriptions:   m.GoldSubscriptions,
+		TotalRevenue:        m.TotalRevenue,
+		MonthlyRevenue:      m.MonthlyRevenue,
+		ChurnRate:           m.ChurnRate,
+		LastUpdated:         m.LastUpdated,
+	}
 }
@@ -0,0 +1,431 @@
+package supply
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/metrics"
+)
+
+var logger = logx.Component("supply")
+
+var audits = metrics.Default.Counter("bkc_supply_audits_total",
+	"Balance sheet audits run on this node, by result.", "result")
+
+// The auditor checks the balance sheet
+//
+//	sum(users.balance) + sum(users.frozen_balance) + reserve_supply == total_supply
+//
+// where reserved_supply is the part of the reserve promised to open invoices
+// and burns shrink total_supply. Periodically it also replays the ledger by
+// category: the reserve must equal initial_reserve - minted + spent, and
+// total_supply + burned must equal the genesis supply.
+//
+// A violation raises the shared halt flag (supply_halt) and money movement
+// endpoints are rejected until an admin acknowledges it. An acknowledged
+// violation with the same figures does not halt again; any new discrepancy does.
+
+var ErrNotHalted = errors.New("not halted")
+
+type Config struct {
+	Every       time.Duration // balance sheet check interval, 0 = off
+	LedgerEvery time.Duration // ledger replay interval, 0 = off
+	Strict      bool          // ledger drift is a violation, not a warning
+}
+
+func ConfigFromEnv() Config {
+	c := Config{Every: 60 * time.Second, LedgerEvery: 10 * time.Minute}
+	if n, ok := envInt("SUPPLY_AUDIT_EVERY_SEC"); ok {
+		if n < 0 {
+			n = 0
+		}
+		if n > 0 && n < 10 {
+			n = 10
+		}
+		c.Every = time.Duration(n) * time.Second
+	}
+	if n, ok := envInt("SUPPLY_AUDIT_LEDGER_EVERY_SEC"); ok {
+		if n < 0 {
+			n = 0
+		}
+		if n > 0 && n < 60 {
+			n = 60
+		}
+		c.LedgerEvery = time.Duration(n) * time.Second
+	}
+	c.Strict = strings.TrimSpace(os.Getenv("SUPPLY_AUDIT_STRICT_LEDGER")) == "1"
+	return c
+}
+
+func envInt(key string) (int64, bool) {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+type LedgerReport struct {
+	Categories      map[Category]int64 `json:"categories"`
+	Kinds           map[string]int64   `json:"kinds"`
+	Unclassified    []string           `json:"unclassified,omitempty"`
+	Burned          int64              `json:"burned"`
+	ExpectedReserve int64              `json:"expected_reserve"`
+	ReserveDrift    int64              `json:"reserve_drift"` // reserve_supply - expected
+	GenesisDrift    int64              `json:"genesis_drift"` // total_supply + burned - genesis
+}
+
+type Report struct {
+	At               time.Time     `json:"at"`
+	TotalSupply      int64         `json:"total_supply"`
+	UsersBalance     int64         `json:"users_balance"`
+	UsersFrozen      int64         `json:"users_frozen"`
+	ReserveSupply    int64         `json:"reserve_supply"`
+	ReservedSupply   int64         `json:"reserved_supply"`
+	InitialReserve   int64         `json:"initial_reserve"`
+	AdminAllocated   int64         `json:"admin_allocated"`
+	NegativeBalances int64         `json:"negative_balances"` // overdue bank loans
+	Diff             int64         `json:"diff"`              // users + frozen + reserve - total
+	Ledger           *LedgerReport `json:"ledger,omitempty"`
+	Violations       []string      `json:"violations,omitempty"`
+	Keys             []string      `json:"violation_keys,omitempty"` // stable part of each violation
+	Warnings         []string      `json:"warnings,omitempty"`
+	Acknowledged     bool          `json:"acknowledged,omitempty"`
+}
+
+func (r *Report) OK() bool { return len(r.Violations) == 0 }
+
+// Signature identifies a set of violations; acks are matched against it.
+// It is built from the violation kinds and drifts only, so the running totals
+// moving with every tap do not make an acknowledged drift halt again.
+func (r *Report) Signature() string {
+	return strings.Join(r.Keys, "; ")
+}
+
+// Reason is the human-readable text of the violations, with the totals.
+func (r *Report) Reason() string {
+	return strings.Join(r.Violations, "; ")
+}
+
+// violate adds a violation: key goes into the signature, text is for people.
+func (r *Report) violate(key, text string) {
+	r.Keys = append(r.Keys, key)
+	r.Violations = append(r.Violations, text)
+}
+
+type Halt struct {
+	Halted         bool       `json:"halted"`
+	Reason         string     `json:"reason,omitempty"`
+	HaltedAt       *time.Time `json:"halted_at,omitempty"`
+	AckedSignature string     `json:"acked_signature,omitempty"`
+	AckedBy        *int64     `json:"acked_by,omitempty"`
+	AckedAt        *time.Time `json:"acked_at,omitempty"`
+	AckNote        string     `json:"ack_note,omitempty"`
+}
+
+type Auditor struct {
+	db  *db.DB
+	cfg Config
+
+	lastLedger time.Time
+
+	mu        sync.Mutex
+	halted    bool
+	reason    string
+	checkedAt time.Time
+}
+
+func New(database *db.DB, cfg Config) *Auditor {
+	return &Auditor{db: database, cfg: cfg}
+}
+
+// Run audits until ctx is done. With Every == 0 the node only honours the
+// halt flag raised by other replicas.
+func (a *Auditor) Run(ctx context.Context) {
+	if a.cfg.Every <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.cfg.Every)
+	defer ticker.Stop()
+	for {
+		withLedger := a.cfg.LedgerEvery > 0 && time.Since(a.lastLedger) >= a.cfg.LedgerEvery
+		runCtx := logx.WithRequestID(ctx, "")
+		rep, err := a.Audit(runCtx, withLedger)
+		if err != nil {
+			if ctx.Err() == nil {
+				audits.With("error").Inc()
+				logger.ErrorContext(runCtx, "audit failed", "err", err)
+			}
+		} else {
+			if withLedger {
+				a.lastLedger = time.Now()
+			}
+			switch {
+			case rep.OK():
+				audits.With("ok").Inc()
+			case rep.Acknowledged:
+				audits.With("acknowledged").Inc()
+			default:
+				audits.With("violation").Inc()
+				logger.ErrorContext(runCtx, "VIOLATION", "signature", rep.Signature(), "reason", rep.Reason())
+			}
+			for _, w := range rep.Warnings {
+				logger.WarnContext(runCtx, "audit warning", "warning", w)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Audit runs the checks and raises the halt flag on an unacknowledged violation.
+func (a *Auditor) Audit(ctx context.Context, withLedger bool) (*Report, error) {
+	rep, err := a.Check(ctx, withLedger)
+	if err != nil {
+		return nil, err
+	}
+	if rep.OK() {
+		return rep, nil
+	}
+	sig, reason := rep.Signature(), rep.Reason()
+	raw, _ := json.Marshal(rep)
+	err = a.db.WithTx(ctx, func(tx pgx.Tx) error {
+		var halted bool
+		var acked string
+		if err := tx.QueryRow(ctx, `SELECT halted, acked_signature FROM supply_halt WHERE id=1 FOR UPDATE`).Scan(&halted, &acked); err != nil {
+			return err
+		}
+		if sig == acked {
+			rep.Acknowledged = true
+			return nil
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO supply_audits(signature, report) VALUES($1, $2::jsonb)`, sig, string(raw)); err != nil {
+			return err
+		}
+		if halted {
+			return nil // keep the first reason and timestamp
+		}
+		_, err := tx.Exec(ctx, `
+UPDATE supply_halt
+SET halted=true, reason=$1, signature=$2, report=$3::jsonb, halted_at=now()
+WHERE id=1`, reason, sig, string(raw))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !rep.Acknowledged {
+		a.mu.Lock()
+		a.halted, a.reason, a.checkedAt = true, reason, time.Now()
+		a.mu.Unlock()
+	}
+	return rep, nil
+}
+
+// Check computes a report from one consistent snapshot without side effects.
+func (a *Auditor) Check(ctx context.Context, withLedger bool) (*Report, error) {
+	tx, err := a.db.Pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	rep := &Report{At: time.Now().UTC()}
+	if err := tx.QueryRow(ctx, `
+SELECT total_supply, reserve_supply, reserved_supply, initial_reserve, admin_allocated
+FROM system_state WHERE id=1`).Scan(&rep.TotalSupply, &rep.ReserveSupply, &rep.ReservedSupply, &rep.InitialReserve, &rep.AdminAllocated); err != nil {
+		return nil, fmt.Errorf("system_state: %w", err)
+	}
+	if err := tx.QueryRow(ctx, `
+SELECT COALESCE(SUM(balance),0), COALESCE(SUM(frozen_balance),0), COUNT(*) FILTER (WHERE balance < 0)
+FROM users`).Scan(&rep.UsersBalance, &rep.UsersFrozen, &rep.NegativeBalances); err != nil {
+		return nil, fmt.Errorf("users: %w", err)
+	}
+
+	rep.Diff = rep.UsersBalance + rep.UsersFrozen + rep.ReserveSupply - rep.TotalSupply
+	if rep.Diff != 0 {
+		rep.violate(fmt.Sprintf("balance_sheet diff=%d", rep.Diff), fmt.Sprintf("balance sheet off by %d (users %d + frozen %d + reserve %d != total %d)",
+			rep.Diff, rep.UsersBalance, rep.UsersFrozen, rep.ReserveSupply, rep.TotalSupply))
+	}
+	if rep.ReserveSupply < 0 {
+		rep.violate("reserve_negative", fmt.Sprintf("reserve_supply negative: %d", rep.ReserveSupply))
+	}
+	switch {
+	case rep.ReservedSupply < 0:
+		rep.violate("reserved_negative", fmt.Sprintf("reserved_supply %d outside [0, reserve %d]", rep.ReservedSupply, rep.ReserveSupply))
+	case rep.ReservedSupply > rep.ReserveSupply:
+		rep.violate("reserved_above_reserve", fmt.Sprintf("reserved_supply %d outside [0, reserve %d]", rep.ReservedSupply, rep.ReserveSupply))
+	}
+
+	if withLedger {
+		lr, err := ledgerReport(ctx, tx, rep)
+		if err != nil {
+			return nil, fmt.Errorf("ledger: %w", err)
+		}
+		rep.Ledger = lr
+		var drift, driftKeys []string
+		if lr.ReserveDrift != 0 {
+			drift = append(drift, fmt.Sprintf("reserve differs from ledger replay by %d (expected %d)", lr.ReserveDrift, lr.ExpectedReserve))
+			driftKeys = append(driftKeys, fmt.Sprintf("ledger_reserve drift=%d", lr.ReserveDrift))
+		}
+		if lr.GenesisDrift != 0 {
+			drift = append(drift, fmt.Sprintf("total+burned differs from genesis by %d", lr.GenesisDrift))
+			driftKeys = append(driftKeys, fmt.Sprintf("ledger_genesis drift=%d", lr.GenesisDrift))
+		}
+		if a.cfg.Strict {
+			for i := range drift {
+				rep.violate(driftKeys[i], drift[i])
+			}
+		} else {
+			rep.Warnings = append(rep.Warnings, drift...)
+		}
+		if len(lr.Unclassified) > 0 {
+			rep.Warnings = append(rep.Warnings, "unclassified ledger kinds: "+strings.Join(lr.Unclassified, ","))
+		}
+	}
+	return rep, nil
+}
+
+func ledgerReport(ctx context.Context, tx pgx.Tx, rep *Report) (*LedgerReport, error) {
+	rows, err := tx.Query(ctx, `SELECT kind, COALESCE(SUM(amount),0) FROM ledger GROUP BY kind`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lr := &LedgerReport{Categories: map[Category]int64{}, Kinds: map[string]int64{}}
+	for rows.Next() {
+		var kind string
+		var sum int64
+		if err := rows.Scan(&kind, &sum); err != nil {
+			return nil, err
+		}
+		cat := Classify(kind)
+		lr.Kinds[kind] = sum
+		lr.Categories[cat] += sum
+		if cat == CatUnknown {
+			lr.Unclassified = append(lr.Unclassified, kind)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(lr.Unclassified)
+	lr.Burned = lr.Categories[CatBurn]
+	lr.ExpectedReserve = rep.InitialReserve - lr.Categories[CatMint] + lr.Categories[CatToReserve]
+	lr.ReserveDrift = rep.ReserveSupply - lr.ExpectedReserve
+	lr.GenesisDrift = rep.TotalSupply + lr.Burned - (rep.InitialReserve + rep.AdminAllocated)
+	return lr, nil
+}
+
+// Halted reports the shared halt flag, cached for a few seconds so the
+// middleware does not hit Postgres on every request. Errors keep the last value.
+func (a *Auditor) Halted(ctx context.Context) (bool, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.checkedAt) < 5*time.Second {
+		return a.halted, a.reason
+	}
+	var halted bool
+	var reason string
+	if err := a.db.Pool.QueryRow(ctx, `SELECT halted, reason FROM supply_halt WHERE id=1`).Scan(&halted, &reason); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			logger.WarnContext(ctx, "halt flag read failed", "err", err)
+		}
+		a.checkedAt = time.Now()
+		return a.halted, a.reason
+	}
+	a.halted, a.reason, a.checkedAt = halted, reason, time.Now()
+	return halted, reason
+}
+
+// WriteMetrics exports the money supply and open loans (metrics.Collector).
+// Burned is the genesis supply minus total_supply, which is what the
+// ledger replay checks, so it needs no ledger scan.
+func (a *Auditor) WriteMetrics(ctx context.Context, w *metrics.Writer) {
+	if sys, err := a.db.GetSystem(ctx); err == nil {
+		w.Gauge("bkc_supply_total_coins", "Coins in existence (total_supply).", float64(sys.TotalSupply))
+		w.Gauge("bkc_supply_reserve_coins", "Coins left in the reserve.", float64(sys.ReserveSupply))
+		w.Gauge("bkc_supply_reserved_coins", "Reserve promised to open invoices.", float64(sys.ReservedSupply))
+		w.Counter("bkc_coins_minted_total", "Coins mined by taps.", float64(sys.TotalMined))
+		w.Counter("bkc_coins_burned_total", "Coins destroyed by burns and fees.", float64(sys.InitialReserve+sys.AdminAllocated-sys.TotalSupply))
+		w.Gauge("bkc_halving_epoch", "Current halving epoch.", float64(sys.CurrentHalving))
+	}
+	if loans, err := a.db.GetLoanExposure(ctx); err == nil {
+		for _, l := range loans {
+			w.Gauge("bkc_loans_outstanding", "Open loans by kind and status.", float64(l.Count), "kind", l.Kind, "status", l.Status)
+			w.Gauge("bkc_loans_outstanding_coins", "Coins due on open loans by kind and status.", float64(l.Due), "kind", l.Kind, "status", l.Status)
+		}
+	}
+	halted, _ := a.Halted(ctx)
+	v := 0.0
+	if halted {
+		v = 1
+	}
+	w.Gauge("bkc_supply_halted", "1 while money movement is halted by the audit.", v)
+}
+
+func (a *Auditor) HaltState(ctx context.Context) (Halt, error) {
+	return scanHalt(a.db.Pool.QueryRow(ctx, `SELECT `+haltCols+` FROM supply_halt WHERE id=1`))
+}
+
+const haltCols = `halted, reason, halted_at, acked_signature, acked_by, acked_at, ack_note`
+
+func scanHalt(row pgx.Row) (Halt, error) {
+	var h Halt
+	err := row.Scan(&h.Halted, &h.Reason, &h.HaltedAt, &h.AckedSignature, &h.AckedBy, &h.AckedAt, &h.AckNote)
+	return h, err
+}
+
+// Acknowledge clears the halt. The violation it was raised for is remembered,
+// so the same figures do not halt again until something else changes. hook
+// sees the halt row before and after.
+func (a *Auditor) Acknowledge(ctx context.Context, adminID int64, note string, hook db.TxHook) (Halt, error) {
+	var after Halt
+	err := a.db.WithTx(ctx, func(tx pgx.Tx) error {
+		before, err := scanHalt(tx.QueryRow(ctx, `SELECT `+haltCols+` FROM supply_halt WHERE id=1 FOR UPDATE`))
+		if err != nil {
+			return err
+		}
+		if !before.Halted {
+			return ErrNotHalted
+		}
+		after, err = scanHalt(tx.QueryRow(ctx, `
+UPDATE supply_halt
+SET halted=false, acked_signature=signature, acked_by=$1, acked_at=now(), ack_note=$2
+WHERE id=1
+RETURNING `+haltCols, adminID, note))
+		if err != nil {
+			return err
+		}
+		if hook == nil {
+			return nil
+		}
+		return hook(ctx, tx, before, after)
+	})
+	if err != nil {
+		return Halt{}, err
+	}
+	a.mu.Lock()
+	a.halted, a.reason, a.checkedAt = false, "", time.Now()
+	a.mu.Unlock()
+	return after, nil
+}
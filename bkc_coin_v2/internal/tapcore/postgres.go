@@ -0,0 +1,198 @@
+package tapcore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+
+	"bkc_coin_v2/internal/config"
+	"bkc_coin_v2/internal/db"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PostgresBackend applies every tap immediately in one Postgres transaction.
+// It is the fallback when neither Redis fasttap nor memtap is enabled.
+type PostgresBackend struct {
+	cfg config.Config
+	db  *db.DB
+}
+
+func NewPostgres(cfg config.Config, database *db.DB) *PostgresBackend {
+	if database == nil {
+		return nil
+	}
+	return &PostgresBackend{cfg: cfg, db: database}
+}
+
+func (p *PostgresBackend) Name() string { return "postgres" }
+
+func (p *PostgresBackend) Tap(ctx context.Context, userID int64, username, firstName string, requested int64, now time.Time) (TapResult, error) {
+	econ := config.Econ()
+	if userID <= 0 {
+		return TapResult{}, errors.New("bad user_id")
+	}
+	requested = ClampRequested(econ, requested)
+	if now.IsZero() {
+		now = time.Now().UTC()
+	}
+	now = now.UTC()
+
+	if _, err := p.db.EnsureUser(ctx, userID, username, firstName, float64(econ.EnergyMax)); err != nil {
+		return TapResult{}, err
+	}
+
+	res := TapResult{Reason: "ok"}
+	err := p.db.WithTx(ctx, func(tx pgx.Tx) error {
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+		// Lock system reserve first (avoid deadlocks with other reserve ops).
+		var reserve int64
+		var reserved int64
+		var rewardBP int64
+		if err := tx.QueryRow(ctx, `SELECT reserve_supply, reserved_supply, tap_reward_bp FROM system_state WHERE id=1 FOR UPDATE`).Scan(&reserve, &reserved, &rewardBP); err != nil {
+			return err
+		}
+		availableReserve := reserve - reserved
+		if availableReserve < 0 {
+			availableReserve = 0
+		}
+
+		// Lock user
+		var energy float64
+		var energyMax float64
+		var updatedAt time.Time
+		var boostUntil time.Time
+		var regenMult float64
+		var maxMult float64
+		var power int64
+		var carry int64
+		if err := tx.QueryRow(ctx, `
+SELECT energy, energy_max, energy_updated_at,
+       COALESCE(energy_boost_until, to_timestamp(0)), energy_boost_regen_multiplier, energy_boost_max_multiplier,
+       taps_power, tap_reward_carry
+FROM users
+WHERE user_id=$1
+FOR UPDATE
+`, userID).Scan(&energy, &energyMax, &updatedAt, &boostUntil, &regenMult, &maxMult, &power, &carry); err != nil {
+			return err
+		}
+		power = NormalizePower(power)
+		rewardBP = NormalizeRewardBP(rewardBP)
+
+		eMax, eRegen := EnergyParams(energyMax, econ.EnergyRegenPerSec, boostUntil, regenMult, maxMult, now)
+		energy = RegenEnergy(energy, eMax, eRegen, updatedAt, now)
+
+		mintable := int64(math.Floor(energy))
+		if mintable < 0 {
+			mintable = 0
+		}
+
+		var tapped int64
+		var extraQuota int64
+		remainingDaily := int64(1 << 62)
+		if econ.TapDailyLimit > 0 {
+			if _, err := tx.Exec(ctx, `INSERT INTO user_daily(user_id, day) VALUES($1,$2) ON CONFLICT DO NOTHING`, userID, day); err != nil {
+				return err
+			}
+			if err := tx.QueryRow(ctx, `SELECT tapped, extra_quota FROM user_daily WHERE user_id=$1 AND day=$2 FOR UPDATE`, userID, day).Scan(&tapped, &extraQuota); err != nil {
+				return err
+			}
+			remainingDaily = (econ.TapDailyLimit + extraQuota) - tapped
+			if remainingDaily < 0 {
+				remainingDaily = 0
+			}
+		}
+
+		// Taps are limited by energy and the daily quota; the reserve limits coins.
+		reserveTaps := ReserveTaps(availableReserve, power, rewardBP, carry)
+		gained := requested
+		for _, limit := range []int64{mintable, remainingDaily, reserveTaps} {
+			if limit < gained {
+				gained = limit
+			}
+		}
+		if gained < 0 {
+			gained = 0
+		}
+
+		if gained == 0 {
+			switch {
+			case econ.TapDailyLimit > 0 && remainingDaily == 0 && mintable > 0:
+				res.Reason = "daily_limit"
+			case reserveTaps == 0 && mintable > 0 && remainingDaily > 0:
+				res.Reason = "reserve_empty"
+			case mintable <= 0:
+				res.Reason = "no_energy"
+			default:
+				res.Reason = "zero"
+			}
+		}
+		energy = energy - float64(gained)
+		if energy < 0 {
+			energy = 0
+		}
+
+		coins, carry := MintCoins(gained, power, rewardBP, carry)
+		if gained > 0 {
+			// Move coins out of reserve.
+			if _, err := tx.Exec(ctx, `UPDATE system_state SET reserve_supply = reserve_supply - $1, total_mined = total_mined + $1, updated_at=now() WHERE id=1`, coins); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, `UPDATE users SET balance = balance + $1, taps_total = taps_total + $2, tap_reward_carry = $3 WHERE user_id=$4`, coins, gained, carry, userID); err != nil {
+				return err
+			}
+			if econ.TapDailyLimit > 0 {
+				if _, err := tx.Exec(ctx, `UPDATE user_daily SET tapped=tapped+$1, updated_at=now() WHERE user_id=$2 AND day=$3`, gained, userID, day); err != nil {
+					return err
+				}
+				tapped += gained
+			}
+			// Taps that only grew the carry mint nothing and leave no ledger row.
+			if coins > 0 {
+				meta, _ := json.Marshal(map[string]any{"req": requested, "taps": gained, "power": power, "reward_bp": rewardBP})
+				if _, err := tx.Exec(ctx, `INSERT INTO ledger(kind, from_id, to_id, amount, meta) VALUES('tap', NULL, $1, $2, $3::jsonb)`, userID, coins, string(meta)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE users SET energy=$1, energy_updated_at=$2 WHERE user_id=$3`, energy, now, userID); err != nil {
+			return err
+		}
+
+		dailyRemaining := econ.TapDailyLimit + extraQuota - tapped
+		if dailyRemaining < 0 {
+			dailyRemaining = 0
+		}
+		res.Gained = coins
+		res.Taps = gained
+		res.TapPower = power
+		res.RewardBP = rewardBP
+		res.Energy = int64(math.Floor(energy))
+		res.EnergyMax = int64(math.Floor(eMax))
+		res.DailyTapped = tapped
+		res.DailyExtra = extraQuota
+		res.DailyRemaining = dailyRemaining
+		return nil
+	})
+	if err != nil {
+		return TapResult{}, err
+	}
+	return res, nil
+}
+
+func (p *PostgresBackend) Snapshot(ctx context.Context, u db.UserState, now time.Time) (Snapshot, error) {
+	return LoadSnapshot(ctx, config.Econ(), p.db, u, now)
+}
+
+// InvalidateUser is a no-op: Postgres is the source of truth.
+func (p *PostgresBackend) InvalidateUser(ctx context.Context, userID int64) {}
+
+func (p *PostgresBackend) Stats(ctx context.Context) map[string]any {
+	return map[string]any{"enabled": true}
+}
+
+func (p *PostgresBackend) Flush(ctx context.Context) error { return nil }
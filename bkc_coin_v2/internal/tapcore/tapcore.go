@@ -0,0 +1,231 @@
+package tapcore
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"bkc_coin_v2/internal/config"
+	"bkc_coin_v2/internal/db"
+)
+
+// TapBackend is one implementation of the tap hot path (Redis fasttap,
+// in-memory memtap or direct Postgres). The API layer talks only to this
+// interface; the backend is picked once at startup.
+type TapBackend interface {
+	// Name is a short stable identifier used in health output ("fasttap", "memtap", "postgres").
+	Name() string
+	// Tap mints up to requested coins for the user and reports the resulting tap state.
+	Tap(ctx context.Context, userID int64, username, firstName string, requested int64, now time.Time) (TapResult, error)
+	// Snapshot returns the user's tap-related state as the backend currently sees it.
+	// u is the freshly loaded Postgres row for the user.
+	Snapshot(ctx context.Context, u db.UserState, now time.Time) (Snapshot, error)
+	// InvalidateUser drops any cached per-user state so it is reloaded from Postgres.
+	InvalidateUser(ctx context.Context, userID int64)
+	Stats(ctx context.Context) map[string]any
+	// Flush persists buffered work to Postgres. Backends without a buffer return nil.
+	Flush(ctx context.Context) error
+}
+
+// ReserveSnapshotter is implemented by backends that keep unflushed reserve
+// deltas in memory, so the displayed reserve/rate does not lag behind taps.
+type ReserveSnapshotter interface {
+	ReserveSnapshot() (ReserveSnapshot, bool)
+}
+
+// NotOwnerError is returned by Tap when another replica owns the user.
+// Addr is the owner's advertised base URL; empty means the tap cannot be
+// forwarded and the client should retry.
+type NotOwnerError struct {
+	Owner string
+	Addr  string
+}
+
+func (e *NotOwnerError) Error() string {
+	if e.Owner == "" {
+		return "tap: user has no owner replica"
+	}
+	return "tap: user owned by " + e.Owner
+}
+
+type TapResult struct {
+	Gained         int64 // coins minted, see MintCoins
+	Taps           int64 // taps consumed from energy and the daily quota
+	TapPower       int64 // user tap power (coins per tap at the full reward)
+	RewardBP       int64 // halving reward in basis points of RewardBPOne
+	Reason         string
+	Energy         int64
+	EnergyMax      int64
+	DailyTapped    int64
+	DailyExtra     int64
+	DailyRemaining int64
+}
+
+type Snapshot struct {
+	Balance        int64
+	TapsTotal      int64
+	Level          int64
+	TapPower       int64
+	Energy         int64
+	EnergyMax      int64
+	DailyTapped    int64
+	DailyExtra     int64
+	DailyRemaining int64
+}
+
+type ReserveSnapshot struct {
+	Reserve        int64
+	InitialReserve int64
+	StartRate      int64
+	MinRate        int64
+}
+
+// EnergyParams returns effective energy max and regen/sec, taking an active boost into account.
+func EnergyParams(baseMax, baseRegen float64, boostUntil time.Time, regenMul, maxMul float64, now time.Time) (eMax float64, regen float64) {
+	eMax = baseMax
+	regen = baseRegen
+	if now.Before(boostUntil) {
+		eMax = eMax * maxMul
+		regen = regen * regenMul
+	}
+	if eMax < 0 {
+		eMax = 0
+	}
+	if regen < 0 {
+		regen = 0
+	}
+	return eMax, regen
+}
+
+func RegenEnergy(current float64, eMax float64, regenPerSec float64, updatedAt, now time.Time) float64 {
+	if eMax <= 0 {
+		return 0
+	}
+	if current < 0 {
+		current = 0
+	}
+	dt := now.Sub(updatedAt).Seconds()
+	if dt > 0 {
+		current = current + dt*regenPerSec
+	}
+	if current > eMax {
+		current = eMax
+	}
+	return current
+}
+
+// SnapshotStore is what LoadSnapshot reads and writes: *db.DB, or any
+// store.Users such as memstore.
+type SnapshotStore interface {
+	GetUserDaily(ctx context.Context, userID int64, day time.Time) (db.UserDaily, error)
+	SetUserEnergy(ctx context.Context, userID int64, energy float64, at time.Time) error
+}
+
+// LoadSnapshot builds a snapshot from the store: energy is regenerated (and
+// persisted when it moved) and today's daily counters are read.
+func LoadSnapshot(ctx context.Context, econ *config.Economy, database SnapshotStore, u db.UserState, now time.Time) (Snapshot, error) {
+	if now.IsZero() {
+		now = time.Now().UTC()
+	}
+	now = now.UTC()
+
+	eMax, regen := EnergyParams(u.EnergyMax, econ.EnergyRegenPerSec, u.EnergyBoostUntil, u.EnergyBoostRegenMultiplier, u.EnergyBoostMaxMultiplier, now)
+	energy := RegenEnergy(u.Energy, eMax, regen, u.EnergyUpdatedAt, now)
+	if math.Abs(energy-u.Energy) > 0.0001 || now.Sub(u.EnergyUpdatedAt) > 2*time.Second {
+		_ = database.SetUserEnergy(ctx, u.UserID, energy, now)
+	}
+
+	ud, err := database.GetUserDaily(ctx, u.UserID, now)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	dailyLimit := econ.TapDailyLimit
+	if dailyLimit < 0 {
+		dailyLimit = 0
+	}
+	dailyRemaining := dailyLimit + ud.ExtraQuota - ud.Tapped
+	if dailyRemaining < 0 {
+		dailyRemaining = 0
+	}
+
+	return Snapshot{
+		Balance:        u.Balance,
+		TapsTotal:      u.TapsTotal,
+		Level:          NormalizeLevel(u.Level),
+		TapPower:       NormalizePower(u.TapsPower),
+		Energy:         int64(math.Floor(energy)),
+		EnergyMax:      int64(math.Floor(eMax)),
+		DailyTapped:    ud.Tapped,
+		DailyExtra:     ud.ExtraQuota,
+		DailyRemaining: dailyRemaining,
+	}, nil
+}
+
+// NormalizeLevel treats unset levels as level 1.
+func NormalizeLevel(level int64) int64 {
+	if level < 1 {
+		return 1
+	}
+	return level
+}
+
+// NormalizePower treats unset tap power as 1 coin per tap.
+func NormalizePower(power int64) int64 {
+	if power < 1 {
+		return 1
+	}
+	return power
+}
+
+// RewardBPOne is the full halving reward in basis points: 1 coin per unit of
+// tap power. Each halving halves the reward, so it soon drops below a coin.
+const RewardBPOne = 10_000
+
+// NormalizeRewardBP treats an unset halving reward as the full one.
+func NormalizeRewardBP(bp int64) int64 {
+	if bp < 1 {
+		return RewardBPOne
+	}
+	return bp
+}
+
+// MintCoins converts taps into whole coins at the halving reward. carry is
+// the user's unpaid fraction of a coin in basis points; the new fraction is
+// returned so that small taps add up instead of rounding to nothing.
+func MintCoins(taps, power, rewardBP, carry int64) (coins, newCarry int64) {
+	if taps <= 0 {
+		return 0, carry
+	}
+	units := taps*NormalizePower(power)*NormalizeRewardBP(rewardBP) + carry
+	return units / RewardBPOne, units % RewardBPOne
+}
+
+// ReserveTaps is the most taps whose coins the available reserve still covers.
+func ReserveTaps(available, power, rewardBP, carry int64) int64 {
+	if available <= 0 {
+		available = 0
+	}
+	per := NormalizePower(power) * NormalizeRewardBP(rewardBP)
+	n := (available*RewardBPOne + RewardBPOne - 1 - carry) / per
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// RewardSetter is implemented by backends that cache the halving reward and
+// must switch to a new one as soon as a halving is recorded in Postgres.
+type RewardSetter interface {
+	SetTapReward(ctx context.Context, rewardBP, epoch int64) error
+}
+
+// ClampRequested normalizes the requested tap count to [1, TapMaxPerRequest].
+func ClampRequested(econ *config.Economy, requested int64) int64 {
+	if requested <= 0 {
+		requested = 1
+	}
+	if econ.TapMaxPerRequest > 0 && requested > econ.TapMaxPerRequest {
+		requested = econ.TapMaxPerRequest
+	}
+	return requested
+}
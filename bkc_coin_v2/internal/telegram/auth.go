@@ -7,13 +7,23 @@ import (
 	"encoding/json"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type AuthUser struct {
 	ID        int64  `json:"id"`
 	Username  string `json:"username"`
 	FirstName string `json:"first_name"`
+	PhotoURL  string `json:"photo_url"`
+
+	// LanguageCode is the user's Telegram client language ("ru", "en", ...).
+	LanguageCode string `json:"language_code"`
+
+	// AuthDate is initData's auth_date (zero if absent). It is signed with the
+	// rest of initData, so callers can bound how old an accepted string is.
+	AuthDate time.Time `json:"-"`
 }
 
 // VerifyWebAppInitData verifies Telegram WebApp initData using bot token.
@@ -75,5 +85,8 @@ func VerifyWebAppInitData(initData string, botToken string) (AuthUser, bool) {
 	if strings.TrimSpace(user.FirstName) == "" {
 		user.FirstName = "User"
 	}
+	if sec, err := strconv.ParseInt(vals.Get("auth_date"), 10, 64); err == nil && sec > 0 {
+		user.AuthDate = time.Unix(sec, 0).UTC()
+	}
 	return user, true
-}
+}
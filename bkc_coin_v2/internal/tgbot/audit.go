@@ -0,0 +1,103 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"bkc_coin_v2/internal/audit"
+	"bkc_coin_v2/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Админские команды аудируются без разрыва между действием и записью:
+// действия в Postgres получают auditHook и пишут запись в своей транзакции,
+// остальные сначала вызывают recordAudit и выполняются, только если запись
+// удалась. Нет записи — нет действия.
+
+func botActor(from *tgbotapi.User) audit.Actor {
+	return audit.Actor{Kind: audit.ActorTelegram, ID: from.ID, Name: from.UserName, Via: "bot"}
+}
+
+// auditHook возвращает db.TxHook, который пишет e в транзакции действия;
+// nil, если журнал не подключен.
+func (b *Bot) auditHook(from *tgbotapi.User, e audit.Entry) db.TxHook {
+	if b.Audit == nil || from == nil {
+		return nil
+	}
+	return audit.Hook(botActor(from), e)
+}
+
+// recordAudit пишет e перед действием вне Postgres. При ошибке действие
+// выполнять нельзя.
+func (b *Bot) recordAudit(ctx context.Context, from *tgbotapi.User, e audit.Entry) error {
+	if b.Audit == nil || from == nil {
+		return nil
+	}
+	ctx = audit.WithActor(ctx, botActor(from))
+	if _, err := b.Audit.Record(ctx, e); err != nil {
+		logger.ErrorContext(ctx, "audit record failed", "action", e.Action, "target", e.Target, "err", err)
+		return err
+	}
+	return nil
+}
+
+// sendAudit показывает последние n записей журнала.
+func (b *Bot) sendAudit(ctx context.Context, chatID int64, n int) error {
+	if b.Audit == nil {
+		return b.sendMessage(chatID, "Журнал аудита не подключен", "")
+	}
+	if n <= 0 {
+		n = 10
+	}
+	if n > 30 {
+		n = 30
+	}
+	entries, err := b.Audit.List(ctx, audit.Filter{Limit: n})
+	if err != nil {
+		return b.sendMessage(chatID, "Не удалось загрузить журнал аудита", "")
+	}
+	if len(entries) == 0 {
+		return b.sendMessage(chatID, "🧾 Журнал аудита пуст", "")
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "🧾 Журнал аудита (%d), время UTC\n", len(entries))
+	for _, e := range entries {
+		who := e.Actor.Name
+		if who == "" {
+			who = fmt.Sprint(e.Actor.ID)
+		}
+		fmt.Fprintf(&sb, "\n#%d %s  %s/%s via %s\n%s", e.Seq, e.At.Format("02.01 15:04"), e.Actor.Kind, who, e.Actor.Via, e.Action)
+		if e.Target != "" {
+			sb.WriteString(" → " + e.Target)
+		}
+		if e.Reason != "" {
+			sb.WriteString("\nПричина: " + e.Reason)
+		}
+	}
+	return b.sendMessage(chatID, sb.String(), "")
+}
+
+// sendAuditVerify проверяет всю цепочку хэшей. Голову стоит сохранить:
+// если позже seq головы окажется меньше, последние записи были удалены.
+func (b *Bot) sendAuditVerify(ctx context.Context, chatID int64) error {
+	if b.Audit == nil {
+		return b.sendMessage(chatID, "Журнал аудита не подключен", "")
+	}
+	rep, err := b.Audit.Verify(ctx)
+	if err != nil {
+		return b.sendMessage(chatID, "Не удалось проверить журнал аудита", "")
+	}
+	var sb strings.Builder
+	if rep.OK {
+		sb.WriteString("✅ Цепочка журнала цела\n")
+	} else {
+		sb.WriteString("❌ Цепочка журнала нарушена\n")
+	}
+	fmt.Fprintf(&sb, "\nПроверено записей: %d\nГолова: #%d %s", rep.Checked, rep.HeadSeq, rep.HeadHash)
+	for _, p := range rep.Problems {
+		fmt.Fprintf(&sb, "\n#%d: %s", p.Seq, p.Issue)
+	}
+	return b.sendMessage(chatID, sb.String(), "")
+}
@@ -5,51 +5,103 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"bkc_coin_v2/internal/address"
+	"bkc_coin_v2/internal/audit"
 	"bkc_coin_v2/internal/config"
 	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/history"
+	"bkc_coin_v2/internal/lifecycle"
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/store"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jackc/pgx/v5"
 )
 
+var logger = logx.Component("bot")
+
+// Store is what the bot reads and writes: *db.DB, or memstore locally.
+type Store interface {
+	store.System
+	store.Users
+	store.Ledger
+	store.Broadcasts
+}
+
 type Bot struct {
 	Cfg config.Config
-	DB  *db.DB
+	DB  Store
 	Bot *tgbotapi.BotAPI
+	// Audit records admin commands; nil skips recording.
+	Audit *audit.Log
+
+	stop     chan struct{} // closed by Stop
+	stopOnce sync.Once
+	polling  bool
+	jobs     sync.WaitGroup // polling loop and broadcasts
 }
 
-func New(cfg config.Config, d *db.DB) (*Bot, error) {
+func New(cfg config.Config, d Store) (*Bot, error) {
 	bot, err := tgbotapi.NewBotAPI(cfg.BotToken)
 	if err != nil {
 		return nil, err
 	}
 	bot.Debug = false
-	return &Bot{Cfg: cfg, DB: d, Bot: bot}, nil
+	return &Bot{Cfg: cfg, DB: d, Bot: bot, stop: make(chan struct{})}, nil
 }
 
 func (b *Bot) StartPolling(ctx context.Context) {
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 30
 	updates := b.Bot.GetUpdatesChan(u)
+	b.polling = true
 
+	b.jobs.Add(1)
 	go func() {
+		defer b.jobs.Done()
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case upd := <-updates:
+			case <-b.stop:
+				return
+			case upd, ok := <-updates:
+				if !ok {
+					return
+				}
 				b.handleUpdate(ctx, upd)
 			}
 		}
 	}()
 }
 
+// Stop stops polling after the update in hand and pauses running broadcasts
+// (they save their position and continue after the next start), then waits
+// for both within ctx. Updates fetched but not handled are not confirmed to
+// Telegram, so they come again.
+func (b *Bot) Stop(ctx context.Context) error {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+		if b.polling {
+			b.Bot.StopReceivingUpdates()
+		}
+	})
+	return lifecycle.WaitGroup(ctx, &b.jobs)
+}
+
+// handleUpdate runs one update as its own unit of work in the logs, with
+// request ID "tg-<update_id>".
 func (b *Bot) handleUpdate(ctx context.Context, upd tgbotapi.Update) {
+	ctx = logx.WithRequestID(ctx, "tg-"+strconv.Itoa(upd.UpdateID))
+	if from := upd.SentFrom(); from != nil {
+		logx.SetUser(ctx, from.ID)
+	}
 	if upd.Message != nil {
 		b.handleMessage(ctx, upd.Message)
 		return
@@ -74,7 +126,105 @@ func (b *Bot) SetWebhook(url string) error {
 // StartBroadcast triggers a background broadcast job from the bot.
 // adminChatID is used for progress messages.
 func (b *Bot) StartBroadcast(ctx context.Context, adminChatID int64, text string) {
-	go b.broadcast(ctx, adminChatID, text)
+	bc, err := b.DB.CreateBroadcast(ctx, adminChatID, text)
+	if err != nil {
+		logger.ErrorContext(ctx, "create broadcast failed", "err", err)
+		_ = b.sendMessage(adminChatID, "Ошибка БД (broadcasts)", "")
+		return
+	}
+	if bc.Total == 0 {
+		bc.Status = "done"
+		_ = b.DB.SaveBroadcast(ctx, bc)
+		_ = b.sendMessage(adminChatID, "Нет пользователей для рассылки.", "")
+		return
+	}
+	_ = b.sendMessage(adminChatID, fmt.Sprintf("Рассылка #%d запущена. Пользователей: %d", bc.BroadcastID, bc.Total), "")
+	b.goBroadcast(ctx, bc)
+}
+
+// ResumeBroadcasts continues broadcasts paused by a restart and the ones
+// left running by a process that died.
+func (b *Bot) ResumeBroadcasts(ctx context.Context) error {
+	list, err := b.DB.ClaimBroadcasts(ctx, broadcastStaleAfter)
+	if err != nil {
+		return err
+	}
+	for _, bc := range list {
+		_ = b.sendMessage(bc.AdminChatID, fmt.Sprintf("Рассылка #%d продолжена. OK=%d FAIL=%d", bc.BroadcastID, bc.OK, bc.Fail), "")
+		b.goBroadcast(ctx, bc)
+	}
+	return nil
+}
+
+func (b *Bot) goBroadcast(ctx context.Context, bc db.Broadcast) {
+	ctx = logx.WithRequestID(context.WithoutCancel(ctx), fmt.Sprintf("broadcast-%d", bc.BroadcastID))
+	b.jobs.Add(1)
+	go func() {
+		defer b.jobs.Done()
+		b.broadcast(ctx, bc)
+	}()
+}
+
+const (
+	broadcastPage       = 500
+	broadcastSaveEvery  = 50
+	broadcastStaleAfter = 2 * time.Minute // several saves missed: the sender is gone
+)
+
+// broadcast sends bc.Text to the users after bc.Cursor. Progress is saved
+// every broadcastSaveEvery messages; on Stop the broadcast is saved as
+// paused and resumed by the next ResumeBroadcasts.
+func (b *Bot) broadcast(ctx context.Context, bc db.Broadcast) {
+	ticker := time.NewTicker(60 * time.Millisecond) // ~16 msg/sec
+	defer ticker.Stop()
+
+	save := func() {
+		if err := b.DB.SaveBroadcast(ctx, bc); err != nil {
+			logger.WarnContext(ctx, "save broadcast failed", "status", bc.Status, "cursor", bc.Cursor, "err", err)
+		}
+	}
+	for {
+		ids, err := b.DB.ListUserIDsAfter(ctx, bc.Cursor, broadcastPage)
+		if err != nil {
+			logger.WarnContext(ctx, "broadcast users failed", "cursor", bc.Cursor, "err", err)
+			select {
+			case <-b.stop:
+				bc.Status = "paused"
+				save()
+				return
+			case <-time.After(5 * time.Second):
+				continue
+			}
+		}
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			select {
+			case <-b.stop:
+				bc.Status = "paused"
+				save()
+				_ = b.sendMessage(bc.AdminChatID, fmt.Sprintf("Рассылка #%d приостановлена (перезапуск), продолжится после старта. OK=%d FAIL=%d", bc.BroadcastID, bc.OK, bc.Fail), "")
+				return
+			case <-ticker.C:
+			}
+
+			if err := b.sendMessage(id, bc.Text, ""); err != nil {
+				bc.Fail++
+				logger.WarnContext(ctx, "broadcast message failed", "to_user", id, "err", err)
+			} else {
+				bc.OK++
+			}
+			bc.Cursor = id
+			if (bc.OK+bc.Fail)%broadcastSaveEvery == 0 {
+				save()
+			}
+		}
+	}
+
+	bc.Status = "done"
+	save()
+	_ = b.sendMessage(bc.AdminChatID, fmt.Sprintf("Рассылка #%d готова. OK=%d FAIL=%d", bc.BroadcastID, bc.OK, bc.Fail), "")
 }
 
 func (b *Bot) handleMessage(ctx context.Context, msg *tgbotapi.Message) {
@@ -85,17 +235,21 @@ func (b *Bot) handleMessage(ctx context.Context, msg *tgbotapi.Message) {
 		return
 	}
 
+	var err error
 	switch msg.Command() {
 	case "start":
 		payload := strings.TrimSpace(msg.CommandArguments())
-		_ = b.onStart(ctx, msg, payload)
+		err = b.onStart(ctx, msg, payload)
+	case "history":
+		n, _ := strconv.Atoi(strings.TrimSpace(msg.CommandArguments()))
+		err = b.sendHistory(ctx, msg.Chat.ID, int64(msg.From.ID), n)
 	case "reserve_send":
 		if int64(msg.From.ID) != b.Cfg.AdminID {
 			return
 		}
 		parts := strings.Fields(msg.CommandArguments())
-		if len(parts) != 2 {
-			_ = b.sendMessage(msg.Chat.ID, "Формат: /reserve_send <user_id> <amount>", "")
+		if len(parts) < 2 {
+			_ = b.sendMessage(msg.Chat.ID, "Формат: /reserve_send <user_id> <amount> [причина]", "")
 			return
 		}
 		toID, _ := strconv.ParseInt(parts[0], 10, 64)
@@ -104,7 +258,7 @@ func (b *Bot) handleMessage(ctx context.Context, msg *tgbotapi.Message) {
 			_ = b.sendMessage(msg.Chat.ID, "Неверные параметры", "")
 			return
 		}
-		_ = b.reserveSend(ctx, msg.Chat.ID, toID, amount)
+		err = b.reserveSend(ctx, msg.From, msg.Chat.ID, toID, amount, strings.Join(parts[2:], " "))
 	case "broadcast":
 		if int64(msg.From.ID) != b.Cfg.AdminID {
 			return
@@ -114,10 +268,28 @@ func (b *Bot) handleMessage(ctx context.Context, msg *tgbotapi.Message) {
 			_ = b.sendMessage(msg.Chat.ID, "Формат: /broadcast <текст>", "")
 			return
 		}
-		go b.broadcast(ctx, msg.Chat.ID, text)
+		if err := b.recordAudit(ctx, msg.From, audit.Entry{Action: "broadcast", After: audit.JSON(map[string]any{"text": text})}); err != nil {
+			_ = b.sendMessage(msg.Chat.ID, "Журнал аудита недоступен, рассылка не запущена", "")
+			return
+		}
+		b.StartBroadcast(ctx, msg.Chat.ID, text)
+	case "audit":
+		if int64(msg.From.ID) != b.Cfg.AdminID {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(msg.CommandArguments()))
+		err = b.sendAudit(ctx, msg.Chat.ID, n)
+	case "audit_verify":
+		if int64(msg.From.ID) != b.Cfg.AdminID {
+			return
+		}
+		err = b.sendAuditVerify(ctx, msg.Chat.ID)
 	default:
 		return
 	}
+	if err != nil {
+		logger.WarnContext(ctx, "command failed", "command", msg.Command(), "err", err)
+	}
 }
 
 func (b *Bot) onStart(ctx context.Context, msg *tgbotapi.Message, payload string) error {
@@ -127,15 +299,14 @@ func (b *Bot) onStart(ctx context.Context, msg *tgbotapi.Message, payload string
 	}
 
 	// Check if new user
-	var existed bool
-	_ = b.DB.Pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE user_id=$1)`, int64(user.ID)).Scan(&existed)
+	existed, _ := b.DB.UserExists(ctx, int64(user.ID))
 
 	sys, err := b.DB.GetSystem(ctx)
 	if err != nil {
 		return err
 	}
 
-	_, err = b.DB.EnsureUser(ctx, int64(user.ID), user.UserName, user.FirstName, float64(b.Cfg.EnergyMax))
+	_, err = b.DB.EnsureUser(ctx, int64(user.ID), user.UserName, user.FirstName, float64(config.Econ().EnergyMax))
 	if err != nil {
 		return err
 	}
@@ -174,7 +345,7 @@ func (b *Bot) onStart(ctx context.Context, msg *tgbotapi.Message, payload string
 		nameLine,
 		int64(user.ID),
 		u.Balance,
-		fmtAddress(int64(user.ID)),
+		address.Format(int64(user.ID)),
 		rate,
 		refLink,
 	)
@@ -200,63 +371,26 @@ func (b *Bot) handleCallback(ctx context.Context, q *tgbotapi.CallbackQuery) {
 		}
 		sys, _ := b.DB.GetSystem(ctx)
 		rate := coinsPerUSD(sys.ReserveSupply, sys.InitialReserve, sys.StartRateCoinsUSD, sys.MinRateCoinsUSD)
-		text := fmt.Sprintf("💰 Кошелек\n\nБаланс: %d BKC\nАдрес: %s\nКурс: %d BKC = $1", u.Balance, fmtAddress(int64(user.ID)), rate)
+		text := fmt.Sprintf("💰 Кошелек\n\nБаланс: %d BKC\nАдрес: %s\nКурс: %d BKC = $1", u.Balance, address.Format(int64(user.ID)), rate)
 		_ = b.editMessageText(q.Message.Chat.ID, q.Message.MessageID, text, kb)
 	case "invite":
 		refLink := fmt.Sprintf("https://t.me/%s?start=%d", b.Bot.Self.UserName, user.ID)
 		text := "👥 Рефералы\n\nТвоя ссылка:\n" + refLink + "\n\nБонус: 30 000 BKC за каждые 3 приглашенных."
 		_ = b.editMessageText(q.Message.Chat.ID, q.Message.MessageID, text, kb)
 	case "store":
-		text := fmt.Sprintf("🛒 Магазин\n\n• Energy 1h: %d BKC\n• CryptoBot пополнение (USD)\n• Пополнение по TX hash (админ подтверждает)\n• NFT магазин\n• Банк: кредиты 7/30 дней\n• Барахолка: объявления + фото\n\nВсе покупки и функции внутри ⚡ MINI APP.", b.Cfg.EnergyBoost1HPriceCoins)
+		text := fmt.Sprintf("🛒 Магазин\n\n• Energy 1h: %d BKC\n• CryptoBot пополнение (USD)\n• Пополнение по TX hash (админ подтверждает)\n• NFT магазин\n• Банк: кредиты 7/30 дней\n• Барахолка: объявления + фото\n\nВсе покупки и функции внутри ⚡ MINI APP.", config.Econ().EnergyBoost1HPriceCoins)
 		_ = b.editMessageText(q.Message.Chat.ID, q.Message.MessageID, text, kb)
 	case "admin":
 		if !isAdmin {
 			return
 		}
-		text := "👑 Админ\n\n/reserve_send <user_id> <amount>\n/broadcast <text>"
+		text := "👑 Админ\n\n/reserve_send <user_id> <amount> [причина]\n/broadcast <text>\n/audit [N] — журнал аудита\n/audit_verify — проверка цепочки журнала"
 		_ = b.editMessageText(q.Message.Chat.ID, q.Message.MessageID, text, kb)
 	default:
 		return
 	}
 }
 
-func (b *Bot) broadcast(ctx context.Context, adminChatID int64, text string) {
-	ids, err := b.DB.ListUserIDs(ctx)
-	if err != nil {
-		_ = b.sendMessage(adminChatID, "Ошибка БД (users)", "")
-		return
-	}
-	if len(ids) == 0 {
-		_ = b.sendMessage(adminChatID, "Нет пользователей для рассылки.", "")
-		return
-	}
-
-	_ = b.sendMessage(adminChatID, fmt.Sprintf("Рассылка запущена. Пользователей: %d", len(ids)), "")
-
-	ticker := time.NewTicker(60 * time.Millisecond) // ~16 msg/sec
-	defer ticker.Stop()
-
-	var okCount int
-	var failCount int
-	for _, id := range ids {
-		select {
-		case <-ctx.Done():
-			_ = b.sendMessage(adminChatID, fmt.Sprintf("Рассылка остановлена. OK=%d FAIL=%d", okCount, failCount), "")
-			return
-		case <-ticker.C:
-		}
-
-		if err := b.sendMessage(id, text, ""); err != nil {
-			failCount++
-			log.Printf("broadcast to %d failed: %v", id, err)
-			continue
-		}
-		okCount++
-	}
-
-	_ = b.sendMessage(adminChatID, fmt.Sprintf("Рассылка готова. OK=%d FAIL=%d", okCount, failCount), "")
-}
-
 type webAppInfo struct {
 	URL string `json:"url"`
 }
@@ -305,10 +439,6 @@ func (b *Bot) mainKeyboardJSON(isAdmin bool) string {
 	return string(bts)
 }
 
-func fmtAddress(userID int64) string {
-	return "BKC" + strconv.FormatInt(userID, 10)
-}
-
 func parseRef(payload string) int64 {
 	payload = strings.TrimSpace(payload)
 	if payload == "" {
@@ -336,13 +466,42 @@ func coinsPerUSD(reserve, initialReserve, startRate, minRate int64) int64 {
 	return minRate + (span*reserve)/initialReserve
 }
 
-func (b *Bot) reserveSend(ctx context.Context, adminChatID int64, toID int64, amount int64) error {
-	if _, err := b.DB.GetUser(ctx, toID); err != nil {
-		_ = b.sendMessage(adminChatID, "Получатель не найден в БД", "")
-		return err
+// sendHistory shows the user's last n ledger operations (default 10, max 30).
+func (b *Bot) sendHistory(ctx context.Context, chatID int64, userID int64, n int) error {
+	if n <= 0 {
+		n = 10
 	}
-	err := b.DB.CreditFromReserve(ctx, toID, amount, "admin_reserve_send", map[string]any{"by": b.Cfg.AdminID})
+	if n > 30 {
+		n = 30
+	}
+	entries, err := b.DB.ListUserHistory(ctx, db.HistoryFilter{UserID: userID, Limit: n})
 	if err != nil {
+		return b.sendMessage(chatID, "Не удалось загрузить историю", "")
+	}
+	if len(entries) == 0 {
+		return b.sendMessage(chatID, "📜 История пуста", "")
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "📜 Последние операции (%d), время UTC\n", len(entries))
+	for _, e := range entries {
+		it := history.FromEntry(e, userID)
+		fmt.Fprintf(&sb, "\n%s  %+d BKC\n%s", e.TS.Format("02.01 15:04"), it.Amount, it.Description)
+	}
+	sb.WriteString("\n\nПолная история и CSV — в ⚡ MINI APP.")
+	return b.sendMessage(chatID, sb.String(), "")
+}
+
+func (b *Bot) reserveSend(ctx context.Context, from *tgbotapi.User, adminChatID int64, toID int64, amount int64, reason string) error {
+	err := b.DB.CreditFromReserve(ctx, toID, amount, "admin_reserve_send", map[string]any{"by": b.Cfg.AdminID}, b.auditHook(from, audit.Entry{
+		Action: "reserve_send",
+		Target: audit.Target("user", toID),
+		Reason: reason,
+	}))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			_ = b.sendMessage(adminChatID, "Получатель не найден в БД", "")
+			return err
+		}
 		if errors.Is(err, db.ErrNotEnough) {
 			_ = b.sendMessage(adminChatID, "В резерве недостаточно", "")
 			return err
@@ -355,6 +514,11 @@ func (b *Bot) reserveSend(ctx context.Context, adminChatID int64, toID int64, am
 	return nil
 }
 
+// Notify sends a plain message to the user's private chat.
+func (b *Bot) Notify(userID int64, text string) error {
+	return b.sendMessage(userID, text, "")
+}
+
 func (b *Bot) sendMessage(chatID int64, text string, replyMarkup string) error {
 	params := tgbotapi.Params{
 		"chat_id": strconv.FormatInt(chatID, 10),
@@ -4,21 +4,29 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"math"
 	"time"
 
 	"bkc_coin_v2/internal/db"
+	"bkc_coin_v2/internal/logx"
+	"bkc_coin_v2/internal/subscription"
+	"bkc_coin_v2/internal/tapcore"
 )
 
+var logger = logx.Component("tokenomics")
+
 // TokenomicsManager управляет всей экономикой BKC Coin
 type TokenomicsManager struct {
-	db *db.DB
+	db   *db.DB
+	subs *subscription.SubscriptionManager
 }
 
 // NewTokenomicsManager создает новый менеджер токеномики
 func NewTokenomicsManager(database *db.DB) *TokenomicsManager {
-	return &TokenomicsManager{db: database}
+	return &TokenomicsManager{
+		db:   database,
+		subs: subscription.NewSubscriptionManager(subscription.DefaultSubscriptionConfig()),
+	}
 }
 
 // SystemState представляет состояние системы токеномики
@@ -29,7 +37,7 @@ type SystemState struct {
 	AdminAllocated   int64         `json:"admin_allocated"`
 	TotalMined       int64         `json:"total_mined"`
 	TotalBurned      int64         `json:"total_burned"`
-	CurrentTapReward int64         `json:"current_tap_reward"`
+	TapRewardBP      int64         `json:"tap_reward_bp"` // базисные пункты монеты за единицу силы тапа
 	CurrentHalving   int           `json:"current_halving"`
 	HalvingThreshold int64         `json:"halving_threshold"`
 	TaxRateBurn      float64       `json:"tax_rate_burn"`
@@ -66,14 +74,14 @@ func (tm *TokenomicsManager) GetSystemState(ctx context.Context) (*SystemState,
 	err := tm.db.Pool.QueryRow(ctx, `
 		SELECT 
 			total_supply, reserve_supply, frozen_supply, admin_allocated,
-			total_mined, total_burned, current_tap_reward, current_halving,
+			total_mined, total_burned, tap_reward_bp, current_halving,
 			halving_threshold, tax_rate_burn, tax_rate_system,
 			unfrozen_schedule, created_at, updated_at
 		FROM system_state WHERE id = 1
 	`).Scan(
 		&state.TotalSupply, &state.ReserveSupply, &state.FrozenSupply,
 		&state.AdminAllocated, &state.TotalMined, &state.TotalBurned,
-		&state.CurrentTapReward, &state.CurrentHalving,
+		&state.TapRewardBP, &state.CurrentHalving,
 		&state.HalvingThreshold, &state.TaxRateBurn, &state.TaxRateSystem,
 		&scheduleJSON, &state.CreatedAt, &state.UpdatedAt,
 	)
@@ -85,7 +93,7 @@ func (tm *TokenomicsManager) GetSystemState(ctx context.Context) (*SystemState,
 	// Десериализуем график разблокировки
 	if len(scheduleJSON) > 0 {
 		if err := json.Unmarshal(scheduleJSON, &state.UnfrozenSchedule); err != nil {
-			log.Printf("Warning: failed to parse unfrozen schedule: %v", err)
+			logger.WarnContext(ctx, "failed to parse unfrozen schedule", "err", err)
 			state.UnfrozenSchedule = make(map[int]int64)
 		}
 	} else {
@@ -102,16 +110,16 @@ func (tm *TokenomicsManager) ProcessTapReward(ctx context.Context, userID int64,
 	}
 
 	// Получаем текущую награду за тап
-	var currentReward int64
+	var rewardBP int64
 	err := tm.db.Pool.QueryRow(ctx,
-		"SELECT current_tap_reward FROM system_state WHERE id = 1",
-	).Scan(&currentReward)
+		"SELECT tap_reward_bp FROM system_state WHERE id = 1",
+	).Scan(&rewardBP)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tap reward: %w", err)
 	}
 
-	// Рассчитываем общую награду
-	grossReward := taps * currentReward
+	// Рассчитываем общую награду (дробный остаток здесь отбрасывается)
+	grossReward, _ := tapcore.MintCoins(taps, 1, rewardBP, 0)
 
 	// Рассчитываем налоги (только для награды за тапы)
 	taxBurned := int64(math.Floor(float64(grossReward) * 0.05)) // 5% сжигается
@@ -157,17 +165,27 @@ func (tm *TokenomicsManager) CalculateTransactionTax(ctx context.Context, amount
 	}, nil
 }
 
-// CheckAndProcessHalving проверяет и обрабатывает халвинг
+// CheckAndProcessHalving проверяет и обрабатывает халвинг.
+// Строка system_state блокируется, поэтому несколько нод могут вызывать проверку одновременно.
 func (tm *TokenomicsManager) CheckAndProcessHalving(ctx context.Context) (bool, error) {
-	var totalMined, halvingThreshold, currentHalving, currentReward int64
+	tx, err := tm.db.Pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
 
-	err := tm.db.Pool.QueryRow(ctx, `
-		SELECT total_mined, halving_threshold, current_halving, current_tap_reward 
+	var totalMined, halvingThreshold, currentHalving, currentReward int64
+	err = tx.QueryRow(ctx, `
+		SELECT total_mined, halving_threshold, current_halving, tap_reward_bp
 		FROM system_state WHERE id = 1
+		FOR UPDATE
 	`).Scan(&totalMined, &halvingThreshold, &currentHalving, &currentReward)
 	if err != nil {
 		return false, fmt.Errorf("failed to get halving data: %w", err)
 	}
+	if halvingThreshold <= 0 {
+		return false, nil // Халвинг отключен
+	}
 
 	// Проверяем нужен ли халвинг
 	expectedHalving := totalMined / halvingThreshold
@@ -175,35 +193,31 @@ func (tm *TokenomicsManager) CheckAndProcessHalving(ctx context.Context) (bool,
 		return false, nil // Халвинг еще не нужен
 	}
 
-	// Выполняем халвинг
+	// Выполняем халвинг. Награда в базисных пунктах монеты, поэтому она
+	// продолжает падать и ниже 1 BKC за тап; минимум — 1 б.п.
+	currentReward = tapcore.NormalizeRewardBP(currentReward)
 	newReward := currentReward / 2
 	if newReward < 1 {
-		newReward = 1 // Минимальная награда 1 BKC
+		newReward = 1
 	}
 
-	tx, err := tm.db.Pool.Begin(ctx)
-	if err != nil {
-		return false, fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback(ctx)
-
 	// Обновляем состояние системы
 	_, err = tx.Exec(ctx, `
 		UPDATE system_state 
-		SET current_tap_reward = $1, current_halving = $2, updated_at = now()
+		SET tap_reward_bp = $1, current_halving = $2, updated_at = now()
 		WHERE id = 1
 	`, newReward, currentHalving+1)
 	if err != nil {
 		return false, fmt.Errorf("failed to update halving: %w", err)
 	}
 
-	// Записываем в ledger
+	// Записываем в ledger: строка информационная, монеты не двигаются
 	_, err = tx.Exec(ctx, `
 		INSERT INTO ledger(kind, amount, meta)
-		VALUES('halving', $1, $2::jsonb)
-	`, newReward, fmt.Sprintf(`{
-		"old_reward": %d,
-		"new_reward": %d,
+		VALUES('halving', 0, $1::jsonb)
+	`, fmt.Sprintf(`{
+		"old_reward_bp": %d,
+		"new_reward_bp": %d,
 		"halving_number": %d,
 		"total_mined": %d
 	}`, currentReward, newReward, currentHalving+1, totalMined))
@@ -215,8 +229,8 @@ func (tm *TokenomicsManager) CheckAndProcessHalving(ctx context.Context) (bool,
 		return false, fmt.Errorf("failed to commit halving: %w", err)
 	}
 
-	log.Printf("HALVING COMPLETED: reward %d -> %d, halving #%d",
-		currentReward, newReward, currentHalving+1)
+	logger.InfoContext(ctx, "halving completed",
+		"reward_bp_from", currentReward, "reward_bp_to", newReward, "halving", currentHalving+1)
 
 	return true, nil
 }
@@ -299,7 +313,7 @@ func (tm *TokenomicsManager) ProcessUnfrozenVesting(ctx context.Context) (int64,
 		return 0, fmt.Errorf("failed to commit unfreeze: %w", err)
 	}
 
-	log.Printf("UNFROZEN: %d BKC unlocked for month %d", unfreezeAmount, monthsPassed)
+	logger.InfoContext(ctx, "frozen supply unlocked", "amount", unfreezeAmount, "month", monthsPassed)
 
 	return unfreezeAmount, nil
 }
@@ -358,7 +372,7 @@ func (tm *TokenomicsManager) GetEconomyStats(ctx context.Context) (map[string]in
 
 	err := tm.db.Pool.QueryRow(ctx, `
 		SELECT 
-			total_supply, reserve_supply, frozen_supply, total_mined, total_burned, current_tap_reward
+			total_supply, reserve_supply, frozen_supply, total_mined, total_burned, tap_reward_bp
 		FROM system_state WHERE id = 1
 	`).Scan(&totalSupply, &reserveSupply, &frozenSupply, &totalMined, &totalBurned, &currentReward)
 	if err != nil {
@@ -413,7 +427,7 @@ func (tm *TokenomicsManager) GetEconomyStats(ctx context.Context) (map[string]in
 	stats["frozen_supply"] = frozenSupply
 	stats["total_mined"] = totalMined
 	stats["total_burned"] = totalBurned
-	stats["current_tap_reward"] = currentReward
+	stats["tap_reward_bp"] = currentReward
 	stats["burn_percentage"] = burnPercentage
 	stats["reserve_percentage"] = reservePercentage
 	stats["frozen_percentage"] = frozenPercentage
@@ -451,35 +465,31 @@ func (tm *TokenomicsManager) InitializeVestingSchedule(ctx context.Context, tota
 	return err
 }
 
-// ValidateSupply проверяет целостность эмиссии
+// ValidateSupply проверяет целостность эмиссии: балансы + замороженные + резерв = total_supply.
+// Полная проверка с разбором ledger и флагом остановки — в internal/supply.
 func (tm *TokenomicsManager) ValidateSupply(ctx context.Context) error {
-	var totalSupply, reserveSupply, frozenSupply, adminAllocated, totalBurned int64
-
+	var totalSupply, reserveSupply, reservedSupply int64
 	err := tm.db.Pool.QueryRow(ctx, `
-		SELECT total_supply, reserve_supply, frozen_supply, admin_allocated, total_burned
+		SELECT total_supply, reserve_supply, reserved_supply
 		FROM system_state WHERE id = 1
-	`).Scan(&totalSupply, &reserveSupply, &frozenSupply, &adminAllocated, &totalBurned)
+	`).Scan(&totalSupply, &reserveSupply, &reservedSupply)
 	if err != nil {
 		return fmt.Errorf("failed to get supply data: %w", err)
 	}
 
-	// Проверяем что сумма всех частей равна total supply
-	calculatedTotal := reserveSupply + frozenSupply + adminAllocated + totalBurned
-	if calculatedTotal != totalSupply {
-		return fmt.Errorf("supply validation failed: calculated %d != stored %d",
-			calculatedTotal, totalSupply)
-	}
-
-	// Проверяем что баланс всех пользователей + reserve = оставшаяся часть
-	var userBalanceSum int64
-	err = tm.db.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(balance), 0) FROM users").Scan(&userBalanceSum)
+	var userBalanceSum, userFrozenSum int64
+	err = tm.db.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(balance), 0), COALESCE(SUM(frozen_balance), 0) FROM users").Scan(&userBalanceSum, &userFrozenSum)
 	if err != nil {
 		return fmt.Errorf("failed to get user balance sum: %w", err)
 	}
 
-	if userBalanceSum != reserveSupply {
-		return fmt.Errorf("user balance mismatch: users have %d, reserve has %d",
-			userBalanceSum, reserveSupply)
+	// reserved_supply — часть резерва под открытые счета, отдельно не суммируется
+	if calculated := userBalanceSum + userFrozenSum + reserveSupply; calculated != totalSupply {
+		return fmt.Errorf("supply validation failed: users %d + frozen %d + reserve %d = %d != total %d",
+			userBalanceSum, userFrozenSum, reserveSupply, calculated, totalSupply)
+	}
+	if reservedSupply < 0 || reservedSupply > reserveSupply {
+		return fmt.Errorf("reserved supply %d outside reserve %d", reservedSupply, reserveSupply)
 	}
 
 	return nil
@@ -0,0 +1,67 @@
+package tokenomics
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"bkc_coin_v2/internal/subscription"
+)
+
+// TransferQuote расчет перевода: сколько спишется у отправителя,
+// сколько уйдет в комиссию и сколько получит адресат
+type TransferQuote struct {
+	Tier       string  `json:"tier"`
+	FeeRate    float64 `json:"fee_rate"`
+	Gross      int64   `json:"gross"`
+	Fee        int64   `json:"fee"`
+	FeeBurned  int64   `json:"fee_burned"`
+	FeeReserve int64   `json:"fee_reserve"`
+	Net        int64   `json:"net"`
+}
+
+// QuoteTransfer считает комиссию перевода для отправителя. Тариф, ставка
+// и NoTransferFee берутся из менеджера подписок (GetUserTaxRate,
+// CheckPrivilege), доля сжигания — из CalculateTransactionTax над
+// комиссией; остаток комиссии уходит в резерв.
+func (tm *TokenomicsManager) QuoteTransfer(ctx context.Context, userID int64, amount int64) (*TransferQuote, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+
+	plan, err := tm.subs.GetUserPrivileges(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user plan: %w", err)
+	}
+
+	q := &TransferQuote{Tier: string(plan.Type), Gross: amount, Net: amount}
+	if tm.subs.CheckPrivilege(ctx, userID, "no_transfer_fee") {
+		return q, nil
+	}
+
+	rate := tm.subs.GetUserTaxRate(ctx, userID)
+	fee := int64(math.Floor(float64(amount) * rate))
+	if fee >= amount {
+		fee = amount - 1
+	}
+	if fee <= 0 {
+		return q, nil
+	}
+
+	tax, err := tm.CalculateTransactionTax(ctx, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	q.FeeRate = rate
+	q.Fee = fee
+	q.FeeBurned = tax.TaxBurned
+	q.FeeReserve = fee - tax.TaxBurned
+	q.Net = amount - fee
+	return q, nil
+}
+
+// Subscriptions возвращает менеджер подписок, по которому считаются комиссии
+func (tm *TokenomicsManager) Subscriptions() *subscription.SubscriptionManager {
+	return tm.subs
+}
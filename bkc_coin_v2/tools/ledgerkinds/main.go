@@ -0,0 +1,177 @@
+// Command ledgerkinds checks that every ledger kind written by the code is
+// classified by the supply auditor. Run it from the module root:
+//
+//	go run ./tools/ledgerkinds
+//
+// It finds kinds in two places: string literals in the kind column of
+// "INSERT INTO ledger" statements, and literal kind arguments of the db
+// helpers that insert a row of the given kind. Exit status 1 lists the
+// kinds supply.Classify does not know.
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bkc_coin_v2/internal/supply"
+)
+
+// kindArgs maps helpers that insert a ledger row to the index of their kind
+// argument.
+var kindArgs = map[string]int{
+	"RecordLedger":      1,
+	"CreditFromReserve": 3,
+	"DebitToReserve":    3,
+	"Burn":              3,
+	"appendLedger":      1, // memstore
+}
+
+var (
+	insertRe  = regexp.MustCompile(`(?is)INSERT\s+INTO\s+ledger\s*\(([^)]*)\)\s*(?:VALUES\s*\(|SELECT\s+)(.*)`)
+	literalRe = regexp.MustCompile(`^'([a-z0-9_]+)'$`)
+)
+
+type site struct {
+	kind string
+	pos  string
+}
+
+func main() {
+	var sites []site
+	fset := token.NewFileSet()
+	for _, root := range []string{"cmd", "internal"} {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, ".go") {
+				return err
+			}
+			f, err := parser.ParseFile(fset, path, nil, 0)
+			if err != nil {
+				return err
+			}
+			sites = append(sites, fileSites(fset, f)...)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ledgerkinds: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	unknown := map[string][]string{}
+	for _, s := range sites {
+		if supply.Classify(s.kind) == supply.CatUnknown {
+			unknown[s.kind] = append(unknown[s.kind], s.pos)
+		}
+	}
+	if len(unknown) == 0 {
+		fmt.Printf("ledgerkinds: %d insert sites, all kinds classified\n", len(sites))
+		return
+	}
+	kinds := make([]string, 0, len(unknown))
+	for k := range unknown {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	for _, k := range kinds {
+		fmt.Printf("unclassified ledger kind %q: %s\n", k, strings.Join(unknown[k], ", "))
+	}
+	os.Exit(1)
+}
+
+func fileSites(fset *token.FileSet, f *ast.File) []site {
+	var out []site
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.BasicLit:
+			if x.Kind != token.STRING {
+				return true
+			}
+			s, err := strconv.Unquote(x.Value)
+			if err != nil {
+				return true
+			}
+			if kind, ok := insertKind(s); ok {
+				out = append(out, site{kind: kind, pos: fset.Position(x.Pos()).String()})
+			}
+		case *ast.CallExpr:
+			sel, ok := x.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			i, ok := kindArgs[sel.Sel.Name]
+			if !ok || i >= len(x.Args) {
+				return true
+			}
+			lit, ok := x.Args[i].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			if kind, err := strconv.Unquote(lit.Value); err == nil {
+				out = append(out, site{kind: kind, pos: fset.Position(lit.Pos()).String()})
+			}
+		}
+		return true
+	})
+	return out
+}
+
+// insertKind returns the literal kind of an "INSERT INTO ledger" statement.
+// A parameter ($1) is not a literal: those kinds are checked at the callers.
+func insertKind(sql string) (string, bool) {
+	m := insertRe.FindStringSubmatch(sql)
+	if m == nil {
+		return "", false
+	}
+	col := -1
+	for i, c := range strings.Split(m[1], ",") {
+		if strings.TrimSpace(c) == "kind" {
+			col = i
+		}
+	}
+	if col < 0 {
+		return "", false
+	}
+	vals := splitTopLevel(m[2])
+	if col >= len(vals) {
+		return "", false
+	}
+	lm := literalRe.FindStringSubmatch(strings.TrimSpace(vals[col]))
+	if lm == nil {
+		return "", false
+	}
+	return lm[1], true
+}
+
+// splitTopLevel splits a value list on commas outside parentheses and quotes.
+func splitTopLevel(s string) []string {
+	var out []string
+	depth, start := 0, 0
+	inQuote := false
+	for i, r := range s {
+		switch {
+		case r == '\'':
+			inQuote = !inQuote
+		case inQuote:
+		case r == '(':
+			depth++
+		case r == ')':
+			if depth == 0 {
+				return append(out, s[start:i])
+			}
+			depth--
+		case r == ',' && depth == 0:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}